@@ -0,0 +1,18 @@
+import sqlite3
+
+from flask import Flask, request
+
+app = Flask(__name__)
+
+
+@app.route("/", methods=["GET", "POST"])
+def login():
+    if request.method == "GET":
+        return '<form method="post"><input name="user"><input name="password" type="password"><button>login</button></form>'
+    db = sqlite3.connect("/opt/web-login/users.db")
+    row = db.execute(
+        f"SELECT name FROM users WHERE name = '{request.form['user']}' AND password = '{request.form['password']}'"
+    ).fetchone()
+    if row is None:
+        return "invalid user or password", 401
+    return f"welcome {row[0]}"
@@ -61,18 +61,97 @@ CREATE TABLE category (
     update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- 'templates' (template サービスが管理する Proxmox のテンプレート)
+CREATE TABLE templates (
+    id             INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    name           VARCHAR(64) NOT NULL, -- 例: ubuntu-24.04
+    version        INT UNSIGNED NOT NULL, -- 同じ名前で登録するたびに 1 つずつ増える
+    vmid           INT NOT NULL,
+    cluster_id     VARCHAR(64) NOT NULL DEFAULT '', -- テンプレートがある Proxmox のクラスタ (空の場合はデフォルト)
+    backend        ENUM('qemu','lxc') NOT NULL DEFAULT 'qemu',
+    os             VARCHAR(64) NOT NULL DEFAULT '',
+    cpu            INT UNSIGNED NOT NULL DEFAULT 0, -- 問題の作成で指定がなければ使う (0 の場合はテンプレートのまま)
+    memory         INT UNSIGNED NOT NULL DEFAULT 0, -- MB
+    disk           INT UNSIGNED NOT NULL DEFAULT 0, -- GB
+    cloudinit      VARCHAR(64) NOT NULL DEFAULT '', -- 対応する cloud-init の設定 (例: user,network,vendor)
+    retired_at     DATETIME, -- 退役した日時 (新しい問題には使えない)
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE (name, version),
+    UNIQUE (cluster_id, vmid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'template_jobs' (クラウドイメージからテンプレートを作るジョブ)
+CREATE TABLE template_jobs (
+    id             INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    name           VARCHAR(64) NOT NULL, -- 登録するテンプレートの名前
+    cluster_id     VARCHAR(64) NOT NULL DEFAULT '',
+    status         ENUM('pending','running','succeeded','failed') NOT NULL DEFAULT 'pending',
+    step           VARCHAR(16) NOT NULL DEFAULT '', -- import / create / provision / convert / register
+    progress       TINYINT UNSIGNED NOT NULL DEFAULT 0, -- 0-100
+    vmid           INT NOT NULL DEFAULT 0, -- ビルド中の VM (作成前は 0)
+    template_id    INT UNSIGNED, -- 登録したテンプレート (成功した場合のみ)
+    error          TEXT,
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (template_id) REFERENCES templates(id) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
 -- 'questions'
 CREATE TABLE questions (
     id             INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
     name           VARCHAR(255) NOT NULL,
     category_id    INT UNSIGNED  NOT NULL,
     env            VARCHAR(255),
-    description    VARCHAR(255),
+    description    TEXT,
     vmid           INT NOT NULL,
+    cluster_id     VARCHAR(64) NOT NULL DEFAULT '', -- VM がある Proxmox のクラスタ (空の場合はデフォルト)
+    backend        ENUM('qemu','lxc') NOT NULL DEFAULT 'qemu', -- VM (qemu) または LXC のコンテナ (lxc)
+    template_id    INT UNSIGNED, -- クローン元のテンプレート (使われている間は削除できない)
     answer         VARCHAR(255),
+    ports          VARCHAR(255), -- 公開するポート (例: 22/tcp,80/tcp)
+    flags          TEXT, -- 正解のフラグ (JSON の配列、answer は最初のフラグ)
+    point          INT UNSIGNED NOT NULL DEFAULT 0, -- コンテストに追加するときのデフォルトの点数
+    hints          TEXT, -- ヒント (JSON)
+    files          TEXT, -- 配布するファイル (JSON の配列)
+    healthcheck    TEXT, -- VM が動いているかの確認方法 (JSON)
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (category_id) REFERENCES category(id) ON DELETE CASCADE,
+    FOREIGN KEY (template_id) REFERENCES templates(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'question_vms' (行がない問題は questions.vmid の VM 1 台で作る)
+CREATE TABLE question_vms (
+    question_id    INT UNSIGNED NOT NULL,
+    role           VARCHAR(16) NOT NULL, -- attacker や target1 など (VM の名前とスニペットに使う)
+    vmid           INT NOT NULL, -- クローン元のテンプレートの VM (template_id から決める)
+    template_id    INT UNSIGNED, -- クローン元のテンプレート (使われている間は削除できない)
+    cpu            INT UNSIGNED NOT NULL DEFAULT 0, -- 0 の場合はテンプレートのまま
+    memory         INT UNSIGNED NOT NULL DEFAULT 0, -- MB
+    disk           INT UNSIGNED NOT NULL DEFAULT 0, -- GB
+    cloudinit      TEXT, -- VM ごとの cloud-init の設定 (JSON、pveapi の base に渡す)
+    position       INT UNSIGNED NOT NULL DEFAULT 0, -- 並び順 (最初の VM の接続情報をチームに返す)
+    PRIMARY KEY (question_id, role),
+    FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE,
+    FOREIGN KEY (template_id) REFERENCES templates(id),
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'question_attachments' (中身は ATTACHMENT_STORE のストレージに置く)
+CREATE TABLE question_attachments (
+    id             INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    question_id    INT UNSIGNED NOT NULL,
+    name           VARCHAR(255) NOT NULL, -- ダウンロードするときのファイル名
+    size           BIGINT UNSIGNED NOT NULL, -- byte
+    sha256         CHAR(64) NOT NULL,
+    content_type   VARCHAR(255) NOT NULL,
+    storage_key    VARCHAR(255) NOT NULL, -- questions/<question_id>/<sha256>
     create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
     update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-    FOREIGN KEY (category_id) REFERENCES category(id) ON DELETE CASCADE
+    UNIQUE (question_id, name),
+    FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 -- 'points'
@@ -106,8 +185,13 @@ CREATE TABLE cloudinit (
     question_id INT UNSIGNED NOT NULL,
     team_id                 INT UNSIGNED NOT NULL,
     filename                VARCHAR(255) NOT NULL,
-    access                  VARCHAR(255),
+    access                  VARCHAR(255), -- AES-256-GCM で暗号化したパスワード
     vmid                    INT,
+    cluster_id              VARCHAR(64) NOT NULL DEFAULT '', -- VM がある Proxmox のクラスタ (空の場合はデフォルト)
+    ready_at                DATETIME, -- VM の準備がすべて終わった時刻 (終わるまで NULL)
+    suspended_at            DATETIME, -- アイドルのため止めた時刻 (再開すると NULL)
+    expires_at              DATETIME, -- オンデマンドのインスタンスを削除する時刻 (NULL の場合は削除しない)
+    extend_count            INT UNSIGNED NOT NULL DEFAULT 0, -- expires_at を延長した回数
     FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
     FOREIGN KEY (contest_id) REFERENCES contests(id) ON DELETE CASCADE,
     FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE,
@@ -115,6 +199,88 @@ CREATE TABLE cloudinit (
     create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
     update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'cloudinit_vms' (複数の VM の問題のチームごとの VM、cloudinit の vmid は最初の VM)
+CREATE TABLE cloudinit_vms (
+    contest_id     INT UNSIGNED NOT NULL,
+    question_id    INT UNSIGNED NOT NULL,
+    team_id        INT UNSIGNED NOT NULL,
+    role           VARCHAR(16) NOT NULL,
+    vmid           INT NOT NULL,
+    cluster_id     VARCHAR(64) NOT NULL DEFAULT '',
+    access         VARCHAR(255), -- AES-256-GCM で暗号化したパスワード
+    position       INT UNSIGNED NOT NULL DEFAULT 0,
+    PRIMARY KEY (contest_id, question_id, team_id, role),
+    FOREIGN KEY (contest_id, question_id, team_id) REFERENCES cloudinit(contest_id, question_id, team_id) ON DELETE CASCADE,
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'contest_vnets'
+CREATE TABLE contest_vnets (
+    contest_id     INT UNSIGNED NOT NULL,
+    team_id        INT UNSIGNED NOT NULL,
+    vnet           VARCHAR(8) NOT NULL UNIQUE,
+    tag            INT NOT NULL UNIQUE,
+    subnet         VARCHAR(32) NOT NULL,
+    gateway        VARCHAR(32) NOT NULL,
+    FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+    FOREIGN KEY (contest_id) REFERENCES contests(id) ON DELETE CASCADE,
+    PRIMARY KEY (contest_id,team_id),
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'contest_vpn_peers'
+CREATE TABLE contest_vpn_peers (
+    contest_id     INT UNSIGNED NOT NULL,
+    team_id        INT UNSIGNED NOT NULL,
+    public_key     VARCHAR(64) NOT NULL,
+    private_key    VARCHAR(255) NOT NULL, -- AES-256-GCM で暗号化した秘密鍵
+    address        VARCHAR(32) NOT NULL UNIQUE,
+    allowed_ips    VARCHAR(255) NOT NULL,
+    FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+    FOREIGN KEY (contest_id) REFERENCES contests(id) ON DELETE CASCADE,
+    PRIMARY KEY (contest_id,team_id),
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'contest_ondemand_policies' (行があるコンテストは開始時に VM を作らず、チームの要求で作る)
+CREATE TABLE contest_ondemand_policies (
+    contest_id     INT UNSIGNED NOT NULL PRIMARY KEY,
+    ttl_minutes    INT UNSIGNED NOT NULL, -- 作成・延長してから削除するまでの時間
+    max_extends    INT UNSIGNED NOT NULL DEFAULT 0, -- 延長できる回数
+    team_quota     INT UNSIGNED NOT NULL DEFAULT 0, -- チームが同時に持てるインスタンスの数 (0 は無制限)
+    FOREIGN KEY (contest_id) REFERENCES contests(id) ON DELETE CASCADE,
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'contest_idle_policies' (行がないコンテストの VM は止めない)
+CREATE TABLE contest_idle_policies (
+    contest_id     INT UNSIGNED NOT NULL PRIMARY KEY,
+    mode           VARCHAR(16) NOT NULL, -- suspend / hibernate
+    idle_minutes   INT UNSIGNED NOT NULL,
+    threshold      DOUBLE NOT NULL DEFAULT 0, -- netin + netout (bytes/s)
+    FOREIGN KEY (contest_id) REFERENCES contests(id) ON DELETE CASCADE,
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    update_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- 'agent_audits' (VM を削除しても残すので外部キーを付けない)
+CREATE TABLE agent_audits (
+    id             INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    user_id        INT UNSIGNED NOT NULL, -- 0 は contest サービス自身
+    contest_id     INT UNSIGNED NOT NULL,
+    team_id        INT UNSIGNED NOT NULL,
+    question_id    INT UNSIGNED NOT NULL,
+    vmid           INT NOT NULL,
+    action         VARCHAR(32) NOT NULL,
+    detail         TEXT NOT NULL,
+    result         VARCHAR(255) NOT NULL,
+    create_date    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 -- 'roles'
 CREATE TABLE roles (
     id              INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
@@ -69,6 +69,10 @@ INSERT INTO contest_teams (contest_id, team_id) VALUES
 (2, 1),
 (2, 3);
 
+-- templates テーブルへの挿入 (以前の CreateQuestion がクローンしていた 9000 を登録しておく)
+INSERT INTO templates (name, version, vmid, backend, os, cloudinit) VALUES
+('ubuntu-22.04', 1, 9000, 'qemu', 'ubuntu', 'user,network,meta,vendor');
+
 -- 9. questions テーブルへの挿入
 INSERT INTO questions (name, category_id, env, description, vmid,answer) VALUES
 ('Crypto Challenge 1', 1, 'env1', 'Solve the crypto puzzle.', 101,"cc1"),
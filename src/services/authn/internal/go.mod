@@ -13,7 +13,7 @@ require (
 	github.com/labstack/echo-contrib v0.17.1
 	github.com/labstack/echo/v4 v4.12.0
 	github.com/labstack/gommon v0.4.2
-	github.com/redis/go-redis/v9 v9.6.1
+	github.com/redis/go-redis/v9 v9.7.0
 	golang.org/x/crypto v0.22.0
 	golang.org/x/xerrors v0.0.0-20240903120638-7835f813f4da
 )
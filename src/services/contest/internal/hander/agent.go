@@ -0,0 +1,164 @@
+package hander
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/contest/service"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type AgentHander interface {
+	Exec(c echo.Context) error
+	ExecStatus(c echo.Context) error
+	ReadFile(c echo.Context) error
+	WriteFile(c echo.Context) error
+}
+
+type agentHander struct {
+	serv service.AgentService
+}
+
+type agentExecRequest struct {
+	Command   []string `json:"command" validate:"required,min=1"`
+	InputData string   `json:"input_data,omitempty"`
+	Wait      bool     `json:"wait,omitempty"`
+	Timeout   int      `json:"timeout,omitempty" validate:"omitempty,min=1,max=300"`
+}
+
+type agentFileWriteRequest struct {
+	Path     string `json:"path" validate:"required"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding,omitempty" validate:"omitempty,oneof=base64"`
+}
+
+func NewAgentHander(s service.AgentService) AgentHander {
+	return &agentHander{
+		serv: s,
+	}
+}
+
+// adminInstance は管理者のユーザー ID と対象の VM のコンテスト・チーム・問題を返します
+// 複数の VM の問題は machine クエリ (ロール) で操作する VM を選ぶ (省略した場合は最初の VM)
+// 管理者でない場合はレスポンスを書き込んで ok=false を返す
+func (h *agentHander) adminInstance(c echo.Context) (uid, cid, tid, qid int, ok bool, err error) {
+	uid, cerr := strconv.Atoi(c.Request().Header.Get("X-User-ID"))
+	if cerr != nil {
+		return 0, 0, 0, 0, false, c.JSON(http.StatusUnauthorized, map[string]string{"error": "User ID not found"})
+	}
+	admin, aerr := h.serv.IsAdmin(uid)
+	if aerr != nil {
+		wrappedErr := xerrors.Errorf(": %w", aerr)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return 0, 0, 0, 0, false, c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if !admin {
+		return 0, 0, 0, 0, false, c.JSON(http.StatusForbidden, map[string]string{"error": "admin only"})
+	}
+	ids := []int{}
+	for _, p := range []string{"contestID", "teamID", "questionID"} {
+		id, perr := strconv.Atoi(c.Param(p))
+		if perr != nil {
+			return 0, 0, 0, 0, false, c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+		}
+		ids = append(ids, id)
+	}
+	return uid, ids[0], ids[1], ids[2], true, nil
+}
+
+func (h *agentHander) Exec(c echo.Context) error {
+	uid, cid, tid, qid, ok, err := h.adminInstance(c)
+	if !ok {
+		return err
+	}
+	var req agentExecRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	status, err := h.serv.Exec(uid, cid, tid, qid, c.QueryParam("machine"), model.AgentExec{
+		Command:   req.Command,
+		InputData: req.InputData,
+		Wait:      req.Wait,
+		Timeout:   req.Timeout,
+	})
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// ExecStatus は wait を付けずに実行したコマンドの状態を返します
+func (h *agentHander) ExecStatus(c echo.Context) error {
+	uid, cid, tid, qid, ok, err := h.adminInstance(c)
+	if !ok {
+		return err
+	}
+	pid, err := strconv.Atoi(c.Param("pid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+	}
+	status, err := h.serv.ExecStatus(uid, cid, tid, qid, c.QueryParam("machine"), pid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+func (h *agentHander) ReadFile(c echo.Context) error {
+	uid, cid, tid, qid, ok, err := h.adminInstance(c)
+	if !ok {
+		return err
+	}
+	file, err := h.serv.ReadFile(uid, cid, tid, qid, c.QueryParam("machine"), c.QueryParam("path"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+func (h *agentHander) WriteFile(c echo.Context) error {
+	uid, cid, tid, qid, ok, err := h.adminInstance(c)
+	if !ok {
+		return err
+	}
+	var req agentFileWriteRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	err = h.serv.WriteFile(uid, cid, tid, qid, c.QueryParam("machine"), model.AgentFileWrite{
+		Path:     req.Path,
+		Content:  req.Content,
+		Encoding: req.Encoding,
+	})
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "success to write file"})
+}
@@ -30,6 +30,12 @@ type ContestHander interface {
 	GetCloudinit(c echo.Context) error
 	GetClusterResource(c echo.Context) error
 	AllVMDelete(c echo.Context) error
+	GetVPNConfig(c echo.Context) error
+	LaunchInstance(c echo.Context) error
+	ExtendInstance(c echo.Context) error
+	DestroyInstance(c echo.Context) error
+	GetOnDemandPolicy(c echo.Context) error
+	SetOnDemandPolicy(c echo.Context) error
 }
 
 type contestHander struct {
@@ -529,6 +535,10 @@ func (h *contestHander) GetCloudinit(c echo.Context) error {
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
+	// コンテストに参加しているチームのメンバーのみ取得できる
+	if len(teams) == 0 {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "team not found"})
+	}
 
 	cloudinit, err := h.serv.GetCloudinit(cid, teams[0].ID, qid)
 	if err != nil {
@@ -540,7 +550,12 @@ func (h *contestHander) GetCloudinit(c echo.Context) error {
 }
 
 func (h *contestHander) GetClusterResource(c echo.Context) error {
-	cluster, err := h.serv.GetClusterResource()
+	// ?contest_id= でそのコンテストの VM だけに絞り込む
+	cid, err := optionalContestID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: contest_id")})
+	}
+	cluster, err := h.serv.GetClusterResource(cid)
 	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
@@ -550,11 +565,60 @@ func (h *contestHander) GetClusterResource(c echo.Context) error {
 }
 
 func (h *contestHander) AllVMDelete(c echo.Context) error {
-	err := h.serv.AllDeleteVM()
+	// ?confirm=true がない場合は削除対象を返すだけ
+	confirm := c.QueryParam("confirm") == "true"
+	cid, err := optionalContestID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: contest_id")})
+	}
+	vms, err := h.serv.AllDeleteVM(cid, confirm)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"confirm": confirm, "vms": vms})
+}
+
+// optionalContestID はクエリの contest_id を返します (ない場合は 0)
+func optionalContestID(c echo.Context) (int, error) {
+	scid := c.QueryParam("contest_id")
+	if scid == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(scid)
+}
+
+func (h *contestHander) GetVPNConfig(c echo.Context) error {
+	scid := c.Param("contestID")
+	cid, err := strconv.Atoi(scid)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+	}
+	suid := c.Request().Header.Get("X-User-ID")
+	uid, err := strconv.Atoi(suid)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "User ID not found",
+		})
+	}
+	teams, err := h.serv.GetTeamByUserID(cid, uid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// コンテストに参加しているチームのメンバーのみ取得できる
+	if len(teams) == 0 {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "team not found"})
+	}
+
+	conf, err := h.serv.GetVPNConfig(cid, teams[0].ID)
 	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
-	return c.JSON(http.StatusOK, nil)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"contest-%d.conf\"", cid))
+	return c.Blob(http.StatusOK, "text/plain; charset=utf-8", conf)
 }
@@ -0,0 +1,43 @@
+package hander
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf_backend/contest/service"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type HealthHander interface {
+	Check(c echo.Context) error
+}
+
+type healthHander struct {
+	serv service.HealthService
+}
+
+func NewHealthHander(s service.HealthService) HealthHander {
+	return &healthHander{
+		serv: s,
+	}
+}
+
+// Check はコンテストの問題の VM のヘルスチェックを実行して結果を返します
+func (h *healthHander) Check(c echo.Context) error {
+	cid, err := strconv.Atoi(c.Param("contestID"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	report, err := h.serv.Check(cid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,92 @@
+package hander
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/contest/service"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type IdleHander interface {
+	GetPolicy(c echo.Context) error
+	SetPolicy(c echo.Context) error
+	Check(c echo.Context) error
+}
+
+type idleHander struct {
+	serv service.IdleService
+}
+
+type idlePolicyRequest struct {
+	// 空の場合は VM を止めない
+	Mode        string  `json:"mode" validate:"omitempty,oneof=suspend hibernate"`
+	IdleMinutes int     `json:"idle_minutes" validate:"omitempty,min=1,max=60"`
+	Threshold   float64 `json:"threshold" validate:"min=0"`
+}
+
+func NewIdleHander(s service.IdleService) IdleHander {
+	return &idleHander{
+		serv: s,
+	}
+}
+
+func (h *idleHander) GetPolicy(c echo.Context) error {
+	cid, err := strconv.Atoi(c.Param("contestID"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	p, err := h.serv.GetPolicy(cid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// SetPolicy はコンテストの VM を止める条件を設定します
+func (h *idleHander) SetPolicy(c echo.Context) error {
+	cid, err := strconv.Atoi(c.Param("contestID"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	var req idlePolicyRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	p := model.IdlePolicy{ContestID: cid, Mode: req.Mode, IdleMinutes: req.IdleMinutes, Threshold: req.Threshold}
+	if err := h.serv.SetPolicy(p); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// Check は定期実行を待たずにアイドル状態の VM を止めます
+func (h *idleHander) Check(c echo.Context) error {
+	report, err := h.serv.Check()
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, report)
+}
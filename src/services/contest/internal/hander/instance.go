@@ -0,0 +1,144 @@
+package hander
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type onDemandPolicyRequest struct {
+	// 0 の場合はオンデマンドをやめる
+	TTLMinutes int `json:"ttl_minutes" validate:"min=0"`
+	MaxExtends int `json:"max_extends" validate:"min=0"`
+	TeamQuota  int `json:"team_quota" validate:"min=0"`
+}
+
+// instanceParams はパスのコンテストと問題、X-User-ID のユーザーが所属するチームを返します
+// 取得できない場合はレスポンスを書き込んで ok を false で返す
+func (h *contestHander) instanceParams(c echo.Context) (cid, tid, qid int, ok bool, err error) {
+	cid, err = strconv.Atoi(c.Param("contestID"))
+	if err != nil {
+		return 0, 0, 0, false, c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+	}
+	qid, err = strconv.Atoi(c.Param("questionID"))
+	if err != nil {
+		return 0, 0, 0, false, c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+	}
+	uid, err := strconv.Atoi(c.Request().Header.Get("X-User-ID"))
+	if err != nil {
+		return 0, 0, 0, false, c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "User ID not found",
+		})
+	}
+	teams, err := h.serv.GetTeamByUserID(cid, uid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return 0, 0, 0, false, c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// コンテストに参加しているチームのメンバーのみ操作できる
+	if len(teams) == 0 {
+		return 0, 0, 0, false, c.JSON(http.StatusForbidden, map[string]string{"error": "team not found"})
+	}
+	return cid, teams[0].ID, qid, true, nil
+}
+
+// instanceErrorStatus は上限を超えた場合に 409 を返します
+func instanceErrorStatus(err error) int {
+	if xerrors.Is(err, model.ErrInstanceQuota) || xerrors.Is(err, model.ErrInstanceExtend) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// LaunchInstance はチームの問題の VM を作成します (オンデマンドのコンテストのみ)
+func (h *contestHander) LaunchInstance(c echo.Context) error {
+	cid, tid, qid, ok, err := h.instanceParams(c)
+	if !ok {
+		return err
+	}
+	cloudinit, err := h.serv.LaunchInstance(cid, tid, qid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(instanceErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, cloudinit)
+}
+
+func (h *contestHander) ExtendInstance(c echo.Context) error {
+	cid, tid, qid, ok, err := h.instanceParams(c)
+	if !ok {
+		return err
+	}
+	cloudinit, err := h.serv.ExtendInstance(cid, tid, qid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(instanceErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, cloudinit)
+}
+
+func (h *contestHander) DestroyInstance(c echo.Context) error {
+	cid, tid, qid, ok, err := h.instanceParams(c)
+	if !ok {
+		return err
+	}
+	if err := h.serv.DestroyInstance(cid, tid, qid); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *contestHander) GetOnDemandPolicy(c echo.Context) error {
+	cid, err := strconv.Atoi(c.Param("contestID"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	p, err := h.serv.GetOnDemandPolicy(cid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// SetOnDemandPolicy はコンテストをオンデマンドにして TTL・延長回数・チームの上限を設定します
+func (h *contestHander) SetOnDemandPolicy(c echo.Context) error {
+	cid, err := strconv.Atoi(c.Param("contestID"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	var req onDemandPolicyRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	p := model.OnDemandPolicy{ContestID: cid, TTLMinutes: req.TTLMinutes, MaxExtends: req.MaxExtends, TeamQuota: req.TeamQuota}
+	if err := h.serv.SetOnDemandPolicy(p); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, p)
+}
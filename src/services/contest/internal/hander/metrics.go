@@ -0,0 +1,44 @@
+package hander
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf_backend/contest/service"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type MetricsHander interface {
+	ContestMetrics(c echo.Context) error
+}
+
+type metricsHander struct {
+	serv service.MetricsService
+}
+
+func NewMetricsHander(s service.MetricsService) MetricsHander {
+	return &metricsHander{
+		serv: s,
+	}
+}
+
+// ContestMetrics はコンテストのインスタンスごとの使用状況と閾値を超えたものを返します
+// ?timeframe=hour|day|week|month|year (省略時は hour)
+func (h *metricsHander) ContestMetrics(c echo.Context) error {
+	cid, err := strconv.Atoi(c.Param("contestID"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	metrics, err := h.serv.ContestMetrics(cid, c.QueryParam("timeframe"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, metrics)
+}
@@ -0,0 +1,50 @@
+package hander
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/LainInTheWired/ctf_backend/contest/service"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type ReconcileHander interface {
+	Report(c echo.Context) error
+	Reconcile(c echo.Context) error
+}
+
+type reconcileHander struct {
+	rec service.Reconciler
+}
+
+func NewReconcileHander(rec service.Reconciler) ReconcileHander {
+	return &reconcileHander{
+		rec: rec,
+	}
+}
+
+// Report は Proxmox と cloudinit テーブルの不整合を返します (削除はしない)
+func (h *reconcileHander) Report(c echo.Context) error {
+	if c.QueryParam("dry_run") == "false" {
+		return c.JSON(http.StatusMethodNotAllowed, map[string]string{"error": "error: use POST /contest/reconcile to delete"})
+	}
+	return h.reconcile(c, true, false)
+}
+
+// Reconcile は猶予を過ぎた不整合を削除し、?confirm=true を付けると猶予を待たずに削除します
+// ?dry_run=true の場合は Report と同じく削除しない
+func (h *reconcileHander) Reconcile(c echo.Context) error {
+	return h.reconcile(c, c.QueryParam("dry_run") == "true", c.QueryParam("confirm") == "true")
+}
+
+func (h *reconcileHander) reconcile(c echo.Context, dryRun, confirm bool) error {
+	report, err := h.rec.Reconcile(dryRun, confirm)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, report)
+}
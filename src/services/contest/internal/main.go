@@ -9,11 +9,14 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/LainInTheWired/ctf_backend/contest/hander"
+	"github.com/LainInTheWired/ctf_backend/contest/model"
 	"github.com/LainInTheWired/ctf_backend/contest/repository"
 	"github.com/LainInTheWired/ctf_backend/contest/service"
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
 	myvalidator "github.com/LainInTheWired/ctf_backend/shared/pkg/validator"
 	"github.com/joho/godotenv"
 	"golang.org/x/xerrors"
@@ -181,8 +184,108 @@ func main() {
 	ter := repository.NewTeamRepository(client, os.Getenv("TEAM_URL"))
 	qr := repository.NewQuestionRepository(client, os.Getenv("QUESTION_URL"))
 
-	s := service.NewContestService(pr, mr, ter, qr)
+	// cloudinit.access の暗号鍵 (base64 でエンコードした 32 バイト)
+	access, err := service.NewAccessCipher(os.Getenv("CLOUDINIT_ACCESS_KEY"))
+	if err != nil {
+		log.Fatalf("access cipher error: %v", err)
+	}
+
+	// WireGuard サーバーの設定 (VPN_ENDPOINT が空なら VPN を使わない)
+	vpnPort, err := strconv.Atoi(os.Getenv("VPN_LISTEN_PORT"))
+	if err != nil {
+		vpnPort = 51820
+	}
+	vpnConf := &model.VPNConfig{
+		Endpoint:         os.Getenv("VPN_ENDPOINT"),
+		ServerPrivateKey: os.Getenv("VPN_SERVER_PRIVATE_KEY"),
+		ServerAddress:    os.Getenv("VPN_SERVER_ADDRESS"),
+		ListenPort:       vpnPort,
+		DNS:              os.Getenv("VPN_DNS"),
+		ForwardRules:     os.Getenv("VPN_FORWARD_RULES"),
+	}
+	if vpnConf.ServerAddress == "" {
+		vpnConf.ServerAddress = "10.255.255.254/16"
+	}
+	if vpnConf.ForwardRules == "" {
+		vpnConf.ForwardRules = "/etc/wireguard/wg0.rules"
+	}
+	if vpnConf.Endpoint != "" {
+		if _, err := service.WireGuardPublicKey(vpnConf.ServerPrivateKey); err != nil {
+			log.Fatalf("VPN_SERVER_PRIVATE_KEY error: %v", err)
+		}
+	}
+	vr := repository.NewVPNRepository(os.Getenv("VPN_SERVER_CONFIG"), vpnConf.ForwardRules)
+
+	// INSTANCE_POOL_PREFIX が空ならリソースプールに入れない
+	instConf := &model.InstanceConfig{
+		PoolPrefix:     os.Getenv("INSTANCE_POOL_PREFIX"),
+		ExpiryInterval: time.Minute,
+	}
+	// オンデマンドのインスタンスの期限を確認する間隔
+	if d, err := time.ParseDuration(os.Getenv("INSTANCE_EXPIRY_INTERVAL")); err == nil {
+		instConf.ExpiryInterval = d
+	}
+
+	s := service.NewContestService(pr, mr, ter, qr, access, vr, vpnConf, instConf)
 	h := hander.NewContestHander(s)
+	// 暗号化する前に保存した接続情報を暗号化する
+	if n, err := s.EncryptLegacyAccess(); err != nil {
+		log.Fatalf("can't encrypt legacy access: %+v", err)
+	} else if n > 0 {
+		log.Printf("encrypted %d legacy cloudinit access", n)
+	}
+	go s.RunExpiry(context.Background())
+
+	// リコンサイラーの設定 (RECONCILE_INTERVAL が空なら定期実行しない)
+	reconcileConf := &model.ReconcileConfig{Grace: 30 * time.Minute}
+	if d, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil {
+		reconcileConf.Interval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("RECONCILE_GRACE")); err == nil {
+		reconcileConf.Grace = d
+	}
+	rec := service.NewReconciler(pr, mr, qr, reconcileConf)
+	rh := hander.NewReconcileHander(rec)
+	go rec.Run(context.Background())
+
+	// インスタンスの使用状況のアラートの閾値 (0 の場合はその項目を確認しない)
+	thresholds := &model.MetricsThresholds{CPU: 0.9, Memory: 0.95}
+	for env, v := range map[string]*float64{
+		"METRICS_CPU_THRESHOLD":        &thresholds.CPU,
+		"METRICS_MEMORY_THRESHOLD":     &thresholds.Memory,
+		"METRICS_NETOUT_THRESHOLD":     &thresholds.NetOut,
+		"METRICS_DISK_WRITE_THRESHOLD": &thresholds.DiskWrite,
+	} {
+		if f, err := strconv.ParseFloat(os.Getenv(env), 64); err == nil {
+			*v = f
+		}
+	}
+	mh := hander.NewMetricsHander(service.NewMetricsService(pr, mr, thresholds))
+
+	// アイドル状態の VM を止める (条件はコンテストごとに contest_idle_policies に設定する)
+	idleConf := &model.IdleConfig{Interval: 5 * time.Minute}
+	if d, err := time.ParseDuration(os.Getenv("IDLE_CHECK_INTERVAL")); err == nil {
+		idleConf.Interval = d
+	}
+	idle := service.NewIdleService(pr, mr, idleConf)
+	ih := hander.NewIdleHander(idle)
+	go idle.Run(context.Background())
+
+	// guest agent の操作は管理者のみ (ロールは gateway と同じく Redis から読む)
+	as := service.NewAgentService(pr, mr, role.NewRoleRepository(reddb))
+	ah := hander.NewAgentHander(as)
+
+	// 問題の VM のヘルスチェック (HEALTHCHECK_INTERVAL が空なら定期実行しない)
+	healthConf := &model.HealthConfig{}
+	if d, err := time.ParseDuration(os.Getenv("HEALTHCHECK_INTERVAL")); err == nil {
+		healthConf.Interval = d
+	}
+	health := service.NewHealthService(as, mr, healthConf)
+	hh := hander.NewHealthHander(health)
+	go health.Run(context.Background())
+
+	// 管理者のみの操作 (X-User-ID のロールを確認する)
+	admin := hander.AdminOnly(as)
 
 	fmt.Println(h)
 	e.POST("/contest", h.CreateContest)
@@ -205,9 +308,26 @@ func main() {
 	e.POST("/contest/:contestID/question", h.JoinContestQuestions)
 	e.PUT("/contest/:contestID/question/:questionID", h.UpdateContestQuestions)
 	e.GET("/contest/:contestID/cloudinit/:questionID", h.GetCloudinit)
+	e.POST("/contest/:contestID/question/:questionID/instance", h.LaunchInstance)
+	e.POST("/contest/:contestID/question/:questionID/instance/extend", h.ExtendInstance)
+	e.DELETE("/contest/:contestID/question/:questionID/instance", h.DestroyInstance)
+	e.GET("/contest/:contestID/on-demand", h.GetOnDemandPolicy)
+	e.PUT("/contest/:contestID/on-demand", h.SetOnDemandPolicy, admin)
 	e.GET("/contest/cluster", h.GetClusterResource)
+	e.GET("/contest/reconcile", rh.Report)
+	e.POST("/contest/reconcile", rh.Reconcile, admin)
+	e.GET("/contest/:contestID/instances/metrics", mh.ContestMetrics, admin)
+	e.GET("/contest/:contestID/idle-policy", ih.GetPolicy)
+	e.PUT("/contest/:contestID/idle-policy", ih.SetPolicy, admin)
+	e.POST("/contest/idle/check", ih.Check, admin)
+	e.GET("/contest/:contestID/vpn-config", h.GetVPNConfig)
+	e.GET("/contest/:contestID/health", hh.Check)
+	e.POST("/contest/:contestID/team/:teamID/question/:questionID/agent/exec", ah.Exec)
+	e.GET("/contest/:contestID/team/:teamID/question/:questionID/agent/exec/:pid", ah.ExecStatus)
+	e.GET("/contest/:contestID/team/:teamID/question/:questionID/agent/file", ah.ReadFile)
+	e.PUT("/contest/:contestID/team/:teamID/question/:questionID/agent/file", ah.WriteFile)
 
-	e.DELETE("/contest/vm", h.AllVMDelete)
+	e.DELETE("/contest/vm", h.AllVMDelete, admin)
 	// e.PUT("/contest/:contestID/question/:questionID",h.)
 
 	e.Start(":8000")
@@ -0,0 +1,51 @@
+package model
+
+// AgentSystemUserID は contest サービス自身が guest agent を操作したときの監査ログのユーザーです
+const AgentSystemUserID = 0
+
+// AgentExec は VM の中で実行するコマンドです
+type AgentExec struct {
+	Command   []string `json:"command"`
+	InputData string   `json:"input_data,omitempty"`
+	// true の場合は終了を待って結果を返す
+	Wait    bool `json:"wait,omitempty"`
+	Timeout int  `json:"timeout,omitempty"` // 秒
+}
+
+// AgentExecStatus はコマンドの実行結果です (Wait が false の場合は Pid のみ)
+type AgentExecStatus struct {
+	Pid          int    `json:"pid,omitempty"`
+	Exited       int    `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal,omitempty"`
+	OutData      string `json:"out-data,omitempty"`
+	ErrData      string `json:"err-data,omitempty"`
+	OutTruncated int    `json:"out-truncated,omitempty"`
+	ErrTruncated int    `json:"err-truncated,omitempty"`
+}
+
+// AgentFile は VM から読み出したファイルです
+type AgentFile struct {
+	Content   string `json:"content"`
+	Truncated int    `json:"truncated,omitempty"`
+}
+
+// AgentFileWrite は VM に書き込むファイルです
+type AgentFileWrite struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	// base64 の場合は Content をデコードして書き込む
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// AgentAudit は guest agent の操作の監査ログです
+type AgentAudit struct {
+	UserID     int
+	ContestID  int
+	TeamID     int
+	QuestionID int
+	VMID       int
+	Action     string // exec / file-read / file-write
+	Detail     string
+	Result     string
+}
@@ -1,6 +1,9 @@
 package model
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type Contest struct {
 	ID        int        `json:"id,"`
@@ -24,6 +27,33 @@ type Point struct {
 	Point      int       `json:"point"`
 }
 
+// VNet はコンテスト中にチームへ割り当てる SDN の VNet です
+type VNet struct {
+	ContestID int    `json:"contest_id"`
+	TeamID    int    `json:"team_id"`
+	Name      string `json:"vnet"`
+	Tag       int    `json:"tag"`
+	Subnet    string `json:"subnet"`
+	Gateway   string `json:"gateway"`
+}
+
+// Firewall は pveapi の PUT /vm/:vmid/firewall に渡す設定です
+type Firewall struct {
+	Enable    bool           `json:"enable"`
+	PolicyIn  string         `json:"policy_in,omitempty"`
+	PolicyOut string         `json:"policy_out,omitempty"`
+	Rules     []FirewallRule `json:"rules,omitempty"`
+}
+
+type FirewallRule struct {
+	Type    string `json:"type"`
+	Action  string `json:"action"`
+	Proto   string `json:"proto,omitempty"`
+	Dport   string `json:"dport,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
 type ContestQuestions struct {
 	ContestID  int
 	QuestionID int
@@ -49,4 +79,38 @@ type ClusterResources struct {
 	Disk      int     `json:"disk"`
 	Netout    int     `json:"netout"`
 	Vmid      int     `json:"vmid"`
+	Tags      string  `json:"tags,omitempty"`
+	Pool      string  `json:"pool,omitempty"`
+	Cluster   string  `json:"cluster,omitempty"` // リソースがある Proxmox のクラスタ
+	// pveapi がタグから取り出したコンテストの情報 (コンテストの VM のみ)
+	Instance *InstanceTags `json:"instance,omitempty"`
+}
+
+// IsGuest は VM または LXC のコンテナであれば true を返します
+func (c ClusterResources) IsGuest() bool {
+	return c.Type == "qemu" || c.Type == "lxc"
 }
+
+// InstanceTags はコンテストの VM に付けるタグの内容です
+type InstanceTags struct {
+	ContestID  int    `json:"contest_id,omitempty"`
+	TeamID     int    `json:"team_id,omitempty"`
+	QuestionID int    `json:"question_id,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+}
+
+// Key は VM の名前と同じ contest-team-question の形式を返します
+func (t InstanceTags) Key() string {
+	return fmt.Sprintf("%d-%d-%d", t.ContestID, t.TeamID, t.QuestionID)
+}
+
+// InstanceConfig はコンテストの VM を作成するときの設定です
+type InstanceConfig struct {
+	// 空でなければコンテストごとに <PoolPrefix><contestID> のリソースプールに入れる
+	PoolPrefix string
+	// 期限切れのオンデマンドのインスタンスを削除する間隔 (0 の場合は削除しない)
+	ExpiryInterval time.Duration
+}
+
+// InstanceCreatedBy は VM の created-by タグに使う名前です
+const InstanceCreatedBy = "contest"
@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// HealthConfig は問題の VM のヘルスチェックの設定です
+type HealthConfig struct {
+	// 確認する間隔 (0 の場合は実行しない)
+	Interval time.Duration
+}
+
+// Healthcheck は questions.healthcheck の確認方法です (question サービスの challenge.yml と同じ形式)
+type Healthcheck struct {
+	Port    string `json:"port"`           // 例: 80/tcp
+	Type    string `json:"type,omitempty"` // tcp (省略時) または http
+	Path    string `json:"path,omitempty"`
+	Timeout int    `json:"timeout,omitempty"` // 秒
+}
+
+// HealthInstance は確認したインスタンスごとの結果です
+type HealthInstance struct {
+	ContestID  int    `json:"contest_id"`
+	TeamID     int    `json:"team_id"`
+	QuestionID int    `json:"question_id"`
+	VMID       int    `json:"vmid"`
+	Healthy    bool   `json:"healthy"`
+	Error      string `json:"error,omitempty"`
+}
+
+// HealthReport は 1 回の確認の結果です
+type HealthReport struct {
+	CheckedAt time.Time        `json:"checked_at"`
+	Instances []HealthInstance `json:"instances"`
+}
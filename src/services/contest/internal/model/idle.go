@@ -0,0 +1,51 @@
+package model
+
+import "time"
+
+// アイドル状態の VM の止め方 (pveapi の mode)
+const (
+	IdleModeSuspend   = "suspend"
+	IdleModeHibernate = "hibernate"
+)
+
+// IdleConfig はアイドル状態の VM を確認する設定です
+type IdleConfig struct {
+	// 確認する間隔 (0 の場合は実行しない)
+	Interval time.Duration
+}
+
+// IdlePolicy はコンテストの VM を止める条件です (Mode が空の場合は止めない)
+type IdlePolicy struct {
+	ContestID int    `json:"contest_id"`
+	Mode      string `json:"mode"`
+	// 直近 IdleMinutes 分の送受信がすべて Threshold 以下なら止める
+	IdleMinutes int     `json:"idle_minutes"`
+	Threshold   float64 `json:"threshold"` // netin + netout (bytes/s)
+}
+
+// PowerState は pveapi の POST /vm/:vmid/suspend-idle と /vm/:vmid/resume のレスポンスです
+type PowerState struct {
+	Vmid    int    `json:"vmid"`
+	State   string `json:"state"` // running / paused / hibernated / stopped
+	Idle    bool   `json:"idle,omitempty"`
+	Changed bool   `json:"changed"`
+}
+
+// IdleInstance は確認したインスタンスごとの結果です
+type IdleInstance struct {
+	ContestID  int    `json:"contest_id"`
+	TeamID     int    `json:"team_id"`
+	QuestionID int    `json:"question_id"`
+	VMID       int    `json:"vmid"`
+	Role       string `json:"role,omitempty"` // 複数の VM の問題の VM の役割
+	State      string `json:"state,omitempty"`
+	Suspended  bool   `json:"suspended"`
+	Error      string `json:"error,omitempty"`
+}
+
+// IdleReport は 1 回の確認の結果です (止めたものと失敗したものだけを含む)
+type IdleReport struct {
+	CheckedAt time.Time      `json:"checked_at"`
+	Checked   int            `json:"checked"`
+	Instances []IdleInstance `json:"instances"`
+}
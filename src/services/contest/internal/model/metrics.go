@@ -0,0 +1,77 @@
+package model
+
+// rrddata の期間 (pveapi の ?timeframe=)
+var Timeframes = []string{"hour", "day", "week", "month", "year"}
+
+// MetricsThresholds はインスタンスのアラートの閾値です (0 の場合はその項目を確認しない)
+type MetricsThresholds struct {
+	CPU       float64 `json:"cpu"`        // CPU 使用率 (0-1)
+	Memory    float64 `json:"memory"`     // メモリ使用率 (0-1)
+	NetOut    float64 `json:"netout"`     // 送信 (bytes/s)
+	DiskWrite float64 `json:"disk_write"` // ディスクへの書き込み (bytes/s)
+}
+
+// RRDData は pveapi が返す rrddata の 1 点です
+type RRDData struct {
+	Time      int64   `json:"time"`
+	CPU       float64 `json:"cpu"`
+	MaxCPU    float64 `json:"maxcpu"`
+	Mem       float64 `json:"mem"`
+	MaxMem    float64 `json:"maxmem"`
+	NetIn     float64 `json:"netin"`
+	NetOut    float64 `json:"netout"`
+	DiskRead  float64 `json:"diskread"`
+	DiskWrite float64 `json:"diskwrite"`
+}
+
+// VMMetrics は pveapi の GET /vm/:vmid/metrics のレスポンスです
+type VMMetrics struct {
+	Cluster   string    `json:"cluster"`
+	Node      string    `json:"node"`
+	Vmid      int       `json:"vmid"`
+	Timeframe string    `json:"timeframe"`
+	Data      []RRDData `json:"data"`
+}
+
+// MetricsSummary は rrddata の平均です
+type MetricsSummary struct {
+	CPU       float64 `json:"cpu"`
+	Memory    float64 `json:"memory"`
+	NetIn     float64 `json:"netin"`
+	NetOut    float64 `json:"netout"`
+	DiskRead  float64 `json:"disk_read"`
+	DiskWrite float64 `json:"disk_write"`
+}
+
+// MetricsAlert は閾値を超えた項目です
+type MetricsAlert struct {
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+}
+
+// InstanceMetrics はチームの問題の VM ごとの使用状況です
+type InstanceMetrics struct {
+	TeamID     int    `json:"team_id"`
+	QuestionID int    `json:"question_id"`
+	VMID       int    `json:"vmid"`
+	Role       string `json:"role,omitempty"` // 複数の VM の問題の VM の役割
+	ClusterID  string `json:"cluster_id,omitempty"`
+	Node       string `json:"node,omitempty"`
+	// 期間全体の平均
+	Average MetricsSummary `json:"average"`
+	// 直近の平均 (閾値の判定に使う)
+	Recent MetricsSummary `json:"recent"`
+	Alerts []MetricsAlert `json:"alerts"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// ContestMetrics はコンテストのすべてのインスタンスの使用状況です
+type ContestMetrics struct {
+	ContestID  int               `json:"contest_id"`
+	Timeframe  string            `json:"timeframe"`
+	Thresholds MetricsThresholds `json:"thresholds"`
+	Instances  []InstanceMetrics `json:"instances"`
+	// 閾値を超えたインスタンスの数
+	Alerts int `json:"alerts"`
+}
@@ -0,0 +1,21 @@
+package model
+
+import "github.com/cockroachdb/errors"
+
+// ErrInstanceQuota はチームが同時に持てるインスタンスの数を超えた場合のエラーです
+var ErrInstanceQuota = errors.New("instance quota exceeded")
+
+// ErrInstanceExtend はインスタンスをこれ以上延長できない場合のエラーです
+var ErrInstanceExtend = errors.New("instance can't be extended")
+
+// OnDemandPolicy はオンデマンドのコンテストの設定です
+// 設定のあるコンテストは StartContest で VM を作らず、チームが要求した問題の VM だけを作る
+type OnDemandPolicy struct {
+	ContestID int `json:"contest_id"`
+	// 作成・延長してから削除するまでの時間 (0 の場合はオンデマンドではない)
+	TTLMinutes int `json:"ttl_minutes"`
+	// 延長できる回数
+	MaxExtends int `json:"max_extends"`
+	// チームが同時に持てるインスタンスの数 (0 は無制限)
+	TeamQuota int `json:"team_quota"`
+}
@@ -0,0 +1,48 @@
+package model
+
+import "time"
+
+// ReconcileConfig はリコンサイラーの設定です
+type ReconcileConfig struct {
+	// バックグラウンドで実行する間隔 (0 の場合は実行しない)
+	Interval time.Duration
+	// 不整合を最初に見つけてから削除するまでの猶予
+	Grace time.Duration
+}
+
+// OrphanVM は cloudinit の行がないコンテストの VM です
+type OrphanVM struct {
+	Vmid      int       `json:"vmid"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Name      string    `json:"name"`
+	Node      string    `json:"node"`
+	FirstSeen time.Time `json:"first_seen"`
+	Deleted   bool      `json:"deleted"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// MissingVM は VM が存在しない cloudinit の行です
+type MissingVM struct {
+	Cloudinit Cloudinit `json:"cloudinit"`
+	FirstSeen time.Time `json:"first_seen"`
+	Deleted   bool      `json:"deleted"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// StaleSnippet は対応する VM も cloudinit の行もないスニペットです
+type StaleSnippet struct {
+	Filename  string    `json:"filename"`
+	FirstSeen time.Time `json:"first_seen"`
+	Deleted   bool      `json:"deleted"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ReconcileReport はリコンサイルの結果です
+type ReconcileReport struct {
+	DryRun        bool           `json:"dry_run"`
+	Confirm       bool           `json:"confirm"`
+	CheckedAt     time.Time      `json:"checked_at"`
+	OrphanVMs     []OrphanVM     `json:"orphan_vms"`
+	MissingVMs    []MissingVM    `json:"missing_vms"`
+	StaleSnippets []StaleSnippet `json:"stale_snippets"`
+}
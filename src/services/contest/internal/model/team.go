@@ -1,5 +1,10 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type Team struct {
 	ID    int    `json:"id"`
 	Name  string `json:"name"`
@@ -25,10 +30,14 @@ type Question struct {
 	VMID         int                 `json:"vmid"`
 	Env          string              `json:"env"`
 	Answer       string              `json:"answer"`
+	Flags        []string            `json:"-"` // Answer 以外にも正解にするフラグ
 	Point        int                 `json:"point"`
 	CategoryName string              `json:"category_name"`
 	CurrentPoint int                 `json:"current_point,omitempty"`
 	IPs          map[string][]string `json:"ips"`
+	Ports        []string            `json:"ports,omitempty"`
+	Backend      string              `json:"backend,omitempty"` // qemu または lxc
+	Healthcheck  *Healthcheck        `json:"-"`
 }
 
 type QuesionRequest struct {
@@ -44,6 +53,41 @@ type QuesionRequest struct {
 	IP          string   `json:"ip,omitempty" validate:"cidr"`
 	Gateway     string   `json:"gateway,omitempty" validate:"ip"`
 	Password    string   `json:"password,omitempty"`
+	Bridge      string   `json:"bridge,omitempty"`
+	// VM のタグとリソースプール
+	ContestID  int    `json:"contest_id,omitempty"`
+	TeamID     int    `json:"team_id,omitempty"`
+	QuestionID int    `json:"question_id,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Pool       string `json:"pool,omitempty"`
+	// qemu または lxc (省略時はテンプレートに合わせる)
+	Backend string `json:"backend,omitempty"`
+	// 複数の VM の問題で VM ごとに渡す cloud-init の設定
+	Cloudinit json.RawMessage `json:"cloudinit,omitempty"`
+}
+
+// QuestionVM は複数の VM で構成する問題の VM 1 台分の設定です (question_vms)
+type QuestionVM struct {
+	Role      string          `json:"role"`
+	VMID      int             `json:"vmid"`
+	CPUs      int             `json:"cpu,omitempty"`
+	Memory    int             `json:"memory,omitempty"`
+	Disk      int             `json:"disk,omitempty"`
+	Cloudinit json.RawMessage `json:"cloudinit,omitempty"`
+}
+
+// Machine は複数の VM の問題でチームごとに作成した VM です (cloudinit_vms)
+type Machine struct {
+	ContestID  int    `json:"-"`
+	TeamID     int    `json:"-"`
+	QuestionID int    `json:"-"`
+	Role       string `json:"role"`
+	VMID       int    `json:"vmid"`
+	ClusterID  string `json:"cluster_id"`
+	// 暗号化したパスワード (チームには最初の VM のものだけを Cloudinit.Access で返す)
+	Access    string              `json:"-"`
+	IPs       map[string][]string `json:"ips,omitempty"`
+	Readiness *VMReadiness        `json:"readiness,omitempty"`
 }
 
 type Cloudinit struct {
@@ -53,10 +97,44 @@ type Cloudinit struct {
 	Filename   string              `json:"filename"`
 	Access     string              `json:"access"`
 	VMID       int                 `json:"vmid"`
+	ClusterID  string              `json:"cluster_id"` // VM がある Proxmox のクラスタ (空の場合はデフォルトのクラスタ)
 	IPs        map[string][]string `json:"ips,omitempty"`
+	// VM の準備がすべて終わっている場合のみ true (それまでは Access と IPs を返さない)
+	Ready     bool         `json:"ready"`
+	Readiness *VMReadiness `json:"readiness,omitempty"`
+	// アイドルのため止めている (GetCloudinit で再開する)
+	Suspended bool `json:"suspended"`
+	// GetCloudinit で再開した場合の結果
+	Power *PowerState `json:"power,omitempty"`
+	// オンデマンドのインスタンスを削除する時刻と延長した回数
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Extends   int        `json:"extends,omitempty"`
+	// 複数の VM の問題の場合の VM の一覧 (VMID などは最初の VM のもの)
+	Machines []Machine `json:"machines,omitempty"`
+}
+
+// ReadinessStage は VM の準備の段階ごとの結果です (running, agent, cloud-init, ip)
+type ReadinessStage struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// VMReadiness は pveapi の GET /vm/:vmid/status のレスポンスです
+type VMReadiness struct {
+	Vmid   int                 `json:"vmid"`
+	Ready  bool                `json:"ready"`
+	Stages []ReadinessStage    `json:"stages"`
+	IPs    map[string][]string `json:"ips,omitempty"`
 }
 
 type QuesionResponse[T any] struct {
-	Data  T      `json:"data"`
-	Error string `json:"error"`
+	Data    T      `json:"data"`
+	Cluster string `json:"cluster,omitempty"` // VM を置いた Proxmox のクラスタ
+	Type    string `json:"type,omitempty"`    // クローンした VM の種類 (qemu / lxc)
+	Error   string `json:"error"`
 }
+
+// GuestLXC は LXC のコンテナの種類です
+// コンテナには cloud-init のパスワードが設定されないので接続情報を発行しない
+const GuestLXC = "lxc"
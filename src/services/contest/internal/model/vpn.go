@@ -0,0 +1,22 @@
+package model
+
+// VPNPeer はコンテスト中のチームの WireGuard のピアです
+type VPNPeer struct {
+	ContestID  int
+	TeamID     int
+	PublicKey  string
+	PrivateKey string // AccessCipher で暗号化した秘密鍵
+	Address    string // 例: 10.255.0.100/32
+	AllowedIPs string // チームが到達できるサブネット (チームの VNet)
+}
+
+// VPNConfig は WireGuard サーバーの設定です
+type VPNConfig struct {
+	Endpoint         string // 参加者が接続する host:port
+	ServerPrivateKey string
+	ServerAddress    string // 例: 10.255.255.254/16
+	ListenPort       int
+	DNS              string
+	// ForwardRules はピアごとの FORWARD のルールを書く iptables-restore のファイルです
+	ForwardRules string
+}
@@ -2,7 +2,10 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/LainInTheWired/ctf_backend/contest/model"
 	"github.com/cockroachdb/errors"
@@ -27,8 +30,52 @@ type MysqlRepository interface {
 	UpdateContestsQuestions(cq *model.ContestQuestions) error
 	DeleteCloudinit(contest model.Cloudinit) error
 	SelectCloudinitByContestID(cid int) ([]model.Cloudinit, error)
+	SelectCloudinits() ([]model.Cloudinit, error)
 	SelectCloudinitByContestIDAndTeamID(cid, tid int) ([]model.Cloudinit, error)
 	SelectCloudinitByContestIDAndTeamIDAndQuestionID(cid, tid, qid int) (*model.Cloudinit, error)
+	UpdateCloudinitReady(cid, tid, qid int) error
+	// suspended の場合は止めた時刻を記録し、再開後に準備を確認し直すため ready_at を消す
+	UpdateCloudinitSuspended(cid, tid, qid int, suspended bool) error
+	// ExtendCloudinit は延長した回数が maxExtends 未満であれば expires_at を延長します (延長した場合は true)
+	ExtendCloudinit(cid, tid, qid int, expiresAt time.Time, maxExtends int) (bool, error)
+	// SelectExpiredCloudinits は expires_at を過ぎた cloudinit を返します
+	SelectExpiredCloudinits() ([]model.Cloudinit, error)
+	// SelectLegacyCloudinitAccess は access が prefix で始まらない (暗号化する前の) cloudinit を返します
+	SelectLegacyCloudinitAccess(prefix string) ([]model.Cloudinit, error)
+	// UpdateCloudinitAccess は access が old のままの場合に access を書き換えます
+	UpdateCloudinitAccess(cid, tid, qid int, old, access string) error
+	SelectOnDemandPolicy(cid int) (*model.OnDemandPolicy, error)
+	UpsertOnDemandPolicy(p model.OnDemandPolicy) error
+	DeleteOnDemandPolicy(cid int) error
+	SelectIdlePolicy(cid int) (*model.IdlePolicy, error)
+	SelectIdlePolicies() ([]model.IdlePolicy, error)
+	UpsertIdlePolicy(p model.IdlePolicy) error
+	DeleteIdlePolicy(cid int) error
+	InsertVNet(v model.VNet) error
+	DeleteVNet(v model.VNet) error
+	SelectVNetsByContestID(cid int) ([]model.VNet, error)
+	SelectVNetTags() ([]int, error)
+	InsertVPNPeer(p model.VPNPeer) error
+	DeleteVPNPeersByContestID(cid int) error
+	SelectVPNPeers() ([]model.VPNPeer, error)
+	SelectVPNPeer(cid, tid int) (*model.VPNPeer, error)
+	InsertAgentAudit(a model.AgentAudit) error
+	// SelectQuestionVMsByContestID はコンテストの複数の VM の問題の VM を問題ごとに返します
+	SelectQuestionVMsByContestID(cid int) (map[int][]model.QuestionVM, error)
+	InsertCloudinitVM(m model.Machine, position int) error
+	SelectCloudinitVMs(cid, tid, qid int) ([]model.Machine, error)
+	// SelectCloudinitVMsByContestID はコンテストの複数の VM の問題の VM を返します (アクセス情報は含まない)
+	SelectCloudinitVMsByContestID(cid int) ([]model.Machine, error)
+	// SelectAllCloudinitVMs はすべてのコンテストの複数の VM の問題の VM を返します (リコンサイル用)
+	SelectAllCloudinitVMs() ([]model.Machine, error)
+}
+
+// nullTime は NULL の場合に nil を返します
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
 }
 
 func NewDBClient() (*sql.DB, error) {
@@ -70,13 +117,13 @@ func (r *mysqlRepository) InsertContest(contest model.Contest) error {
 
 func (r *mysqlRepository) InsertCloudinit(contest model.Cloudinit) error {
 	// emailが登録されているかチェック
-	ins, err := r.db.Prepare("INSERT INTO cloudinit (contest_id,question_id,team_id,filename,access,vmid) VALUES(? ,?, ?, ?, ?, ?)")
+	ins, err := r.db.Prepare("INSERT INTO cloudinit (contest_id,question_id,team_id,filename,access,vmid,cluster_id,expires_at) VALUES(? ,?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return errors.Wrap(err, "contest insert error")
 	}
 	defer ins.Close()
 
-	_, err = ins.Exec(contest.ContestID, contest.QuestionID, contest.TeamID, contest.Filename, contest.Access, contest.VMID)
+	_, err = ins.Exec(contest.ContestID, contest.QuestionID, contest.TeamID, contest.Filename, contest.Access, contest.VMID, contest.ClusterID, contest.ExpiresAt)
 	if err != nil {
 		return errors.Wrap(err, "can't insert cloudinit")
 	}
@@ -361,7 +408,7 @@ func (m *mysqlRepository) SelectContestQuestionsByContestID(cid int) (model.Cont
 	var contest model.Contest
 	//  emailよりユーザ情報を取得
 	// rows, err := m.DB.Query("SELECT id,name,category_id,description,vmid FROM questions WEHERE id = ?", contestID)
-	rows, err := m.db.Query("SELECT c.id,c.name,q.id,q.name,cg.name,cq.point,q.description,q.vmid,q.answer FROM contest_questions as cq JOIN questions as q ON q.id = cq.question_id JOIN contests  AS c ON  c.id = cq.contest_id JOIN category AS cg ON cg.id = q.category_id WHERE c.id = ?;", cid)
+	rows, err := m.db.Query("SELECT c.id,c.name,q.id,q.name,cg.name,cq.point,q.description,q.vmid,q.backend,q.answer,q.ports,q.flags,q.healthcheck FROM contest_questions as cq JOIN questions as q ON q.id = cq.question_id JOIN contests  AS c ON  c.id = cq.contest_id JOIN category AS cg ON cg.id = q.category_id WHERE c.id = ?;", cid)
 	if err != nil {
 		return model.Contest{}, errors.Wrap(err, "error select contest")
 	}
@@ -377,10 +424,14 @@ func (m *mysqlRepository) SelectContestQuestionsByContestID(cid int) (model.Cont
 			Point        int
 			Description  string
 			VMID         int
+			Backend      string
 			Answer       sql.NullString
+			Ports        sql.NullString
+			Flags        sql.NullString
+			Healthcheck  sql.NullString
 		)
 		// すべてのカラムをスキャン
-		if err := rows.Scan(&contestID, &contestName, &questionID, &questionName, &CategoryName, &Point, &Description, &VMID, &Answer); err != nil {
+		if err := rows.Scan(&contestID, &contestName, &questionID, &questionName, &CategoryName, &Point, &Description, &VMID, &Backend, &Answer, &Ports, &Flags, &Healthcheck); err != nil {
 			return model.Contest{}, errors.Wrap(err, "SelectTeamUsersInContest: failed to scan row")
 		}
 		contest.ID = contestID
@@ -393,6 +444,7 @@ func (m *mysqlRepository) SelectContestQuestionsByContestID(cid int) (model.Cont
 			Point:        Point,
 			Description:  Description,
 			VMID:         VMID,
+			Backend:      Backend,
 			CategoryId:   CategoryID,
 			CategoryName: contestName,
 			// 必要に応じてPasswordフィールドも追加
@@ -400,6 +452,20 @@ func (m *mysqlRepository) SelectContestQuestionsByContestID(cid int) (model.Cont
 		if Answer.Valid {
 			question.Answer = Answer.String
 		}
+		if Ports.Valid && Ports.String != "" {
+			question.Ports = strings.Split(Ports.String, ",")
+		}
+		// challenge.yml でインポートした問題は複数のフラグを持てる
+		if Flags.Valid && Flags.String != "" {
+			if err := json.Unmarshal([]byte(Flags.String), &question.Flags); err != nil {
+				return model.Contest{}, errors.Wrap(err, "can't unmarshal question flags")
+			}
+		}
+		if Healthcheck.Valid && Healthcheck.String != "" {
+			if err := json.Unmarshal([]byte(Healthcheck.String), &question.Healthcheck); err != nil {
+				return model.Contest{}, errors.Wrap(err, "can't unmarshal question healthcheck")
+			}
+		}
 		contest.Questions = append(contest.Questions, question)
 	}
 	if err = rows.Err(); err != nil {
@@ -411,20 +477,23 @@ func (m *mysqlRepository) SelectContestQuestionsByContestID(cid int) (model.Cont
 
 func (m *mysqlRepository) SelectCloudinitByContestID(cid int) ([]model.Cloudinit, error) {
 	cs := []model.Cloudinit{}
-	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,filename,access,vmid FROM cloudinit WHERE contest_id = ?", cid)
+	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,filename,access,vmid,cluster_id,suspended_at,expires_at FROM cloudinit WHERE contest_id = ?", cid)
 	if err != nil {
 		return nil, errors.Wrap(err, "Can't Select Cloudinit")
 	}
 	for rows.Next() {
 		var (
-			QuestionID int
-			ContestID  int
-			TeamID     int
-			Filename   string
-			Access     string
-			VMID       int
+			QuestionID  int
+			ContestID   int
+			TeamID      int
+			Filename    string
+			Access      string
+			VMID        int
+			ClusterID   string
+			SuspendedAt sql.NullTime
+			ExpiresAt   sql.NullTime
 		)
-		if err := rows.Scan(&QuestionID, &ContestID, &TeamID, &Filename, &Access, &VMID); err != nil {
+		if err := rows.Scan(&QuestionID, &ContestID, &TeamID, &Filename, &Access, &VMID, &ClusterID, &SuspendedAt, &ExpiresAt); err != nil {
 			return nil, errors.Wrap(err, "SelectTeamUsersInContest: failed to scan row")
 		}
 		c := model.Cloudinit{
@@ -434,6 +503,9 @@ func (m *mysqlRepository) SelectCloudinitByContestID(cid int) ([]model.Cloudinit
 			Filename:   Filename,
 			Access:     Access,
 			VMID:       VMID,
+			ClusterID:  ClusterID,
+			Suspended:  SuspendedAt.Valid,
+			ExpiresAt:  nullTime(ExpiresAt),
 		}
 		cs = append(cs, c)
 
@@ -444,9 +516,34 @@ func (m *mysqlRepository) SelectCloudinitByContestID(cid int) ([]model.Cloudinit
 	return cs, nil
 }
 
+// SelectCloudinits はすべてのコンテストの cloudinit を返します (リコンサイル用)
+func (m *mysqlRepository) SelectCloudinits() ([]model.Cloudinit, error) {
+	cs := []model.Cloudinit{}
+	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,filename,vmid,cluster_id FROM cloudinit")
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select Cloudinit")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			c    model.Cloudinit
+			VMID sql.NullInt64
+		)
+		if err := rows.Scan(&c.QuestionID, &c.ContestID, &c.TeamID, &c.Filename, &VMID, &c.ClusterID); err != nil {
+			return nil, errors.Wrap(err, "SelectCloudinits: failed to scan row")
+		}
+		c.VMID = int(VMID.Int64)
+		cs = append(cs, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return cs, nil
+}
+
 func (m *mysqlRepository) SelectCloudinitByContestIDAndTeamID(cid, tid int) ([]model.Cloudinit, error) {
 	cs := []model.Cloudinit{}
-	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,filename,access,vmid FROM cloudinit WHERE contest_id = ? AND team_id = ?", cid, tid)
+	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,filename,access,vmid,cluster_id,expires_at FROM cloudinit WHERE contest_id = ? AND team_id = ?", cid, tid)
 	if err != nil {
 		return nil, errors.Wrap(err, "Can't Select Cloudinit")
 	}
@@ -458,8 +555,10 @@ func (m *mysqlRepository) SelectCloudinitByContestIDAndTeamID(cid, tid int) ([]m
 			Filename   string
 			Access     string
 			VMID       int
+			ClusterID  string
+			ExpiresAt  sql.NullTime
 		)
-		if err := rows.Scan(&QuestionID, &ContestID, &TeamID, &Filename, &Access, &VMID); err != nil {
+		if err := rows.Scan(&QuestionID, &ContestID, &TeamID, &Filename, &Access, &VMID, &ClusterID, &ExpiresAt); err != nil {
 			return nil, errors.Wrap(err, "SelectTeamUsersInContest: failed to scan row")
 		}
 		c := model.Cloudinit{
@@ -469,6 +568,8 @@ func (m *mysqlRepository) SelectCloudinitByContestIDAndTeamID(cid, tid int) ([]m
 			Filename:   Filename,
 			Access:     Access,
 			VMID:       VMID,
+			ClusterID:  ClusterID,
+			ExpiresAt:  nullTime(ExpiresAt),
 		}
 		cs = append(cs, c)
 
@@ -481,20 +582,25 @@ func (m *mysqlRepository) SelectCloudinitByContestIDAndTeamID(cid, tid int) ([]m
 
 func (m *mysqlRepository) SelectCloudinitByContestIDAndTeamIDAndQuestionID(cid, tid, qid int) (*model.Cloudinit, error) {
 	c := model.Cloudinit{}
-	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,filename,access,vmid FROM cloudinit WHERE contest_id = ? AND team_id = ? AND question_id = ?", cid, tid, qid)
+	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,filename,access,vmid,cluster_id,ready_at,suspended_at,expires_at,extend_count FROM cloudinit WHERE contest_id = ? AND team_id = ? AND question_id = ?", cid, tid, qid)
 	if err != nil {
 		return nil, errors.Wrap(err, "Can't Select Cloudinit")
 	}
 	for rows.Next() {
 		var (
-			QuestionID int
-			ContestID  int
-			TeamID     int
-			Filename   string
-			Access     string
-			VMID       int
+			QuestionID  int
+			ContestID   int
+			TeamID      int
+			Filename    string
+			Access      string
+			VMID        int
+			ClusterID   string
+			ReadyAt     sql.NullTime
+			SuspendedAt sql.NullTime
+			ExpiresAt   sql.NullTime
+			Extends     int
 		)
-		if err := rows.Scan(&QuestionID, &ContestID, &TeamID, &Filename, &Access, &VMID); err != nil {
+		if err := rows.Scan(&QuestionID, &ContestID, &TeamID, &Filename, &Access, &VMID, &ClusterID, &ReadyAt, &SuspendedAt, &ExpiresAt, &Extends); err != nil {
 			return nil, errors.Wrap(err, "SelectTeamUsersInContest: failed to scan row")
 		}
 		c = model.Cloudinit{
@@ -504,6 +610,11 @@ func (m *mysqlRepository) SelectCloudinitByContestIDAndTeamIDAndQuestionID(cid,
 			Filename:   Filename,
 			Access:     Access,
 			VMID:       VMID,
+			ClusterID:  ClusterID,
+			Ready:      ReadyAt.Valid,
+			Suspended:  SuspendedAt.Valid,
+			ExpiresAt:  nullTime(ExpiresAt),
+			Extends:    Extends,
 		}
 
 	}
@@ -512,3 +623,428 @@ func (m *mysqlRepository) SelectCloudinitByContestIDAndTeamIDAndQuestionID(cid,
 	}
 	return &c, nil
 }
+
+func (r *mysqlRepository) UpdateCloudinitReady(cid, tid, qid int) error {
+	upd, err := r.db.Prepare("UPDATE cloudinit SET ready_at = NOW() WHERE contest_id = ? AND team_id = ? AND question_id = ? AND ready_at IS NULL")
+	if err != nil {
+		return errors.Wrap(err, "cloudinit update error")
+	}
+	defer upd.Close()
+
+	if _, err := upd.Exec(cid, tid, qid); err != nil {
+		return errors.Wrap(err, "can't update cloudinit ready")
+	}
+	return nil
+}
+
+func (r *mysqlRepository) UpdateCloudinitSuspended(cid, tid, qid int, suspended bool) error {
+	query := "UPDATE cloudinit SET suspended_at = NULL WHERE contest_id = ? AND team_id = ? AND question_id = ?"
+	if suspended {
+		query = "UPDATE cloudinit SET suspended_at = NOW(), ready_at = NULL WHERE contest_id = ? AND team_id = ? AND question_id = ?"
+	}
+	upd, err := r.db.Prepare(query)
+	if err != nil {
+		return errors.Wrap(err, "cloudinit update error")
+	}
+	defer upd.Close()
+
+	if _, err := upd.Exec(cid, tid, qid); err != nil {
+		return errors.Wrap(err, "can't update cloudinit suspended")
+	}
+	return nil
+}
+
+func (r *mysqlRepository) ExtendCloudinit(cid, tid, qid int, expiresAt time.Time, maxExtends int) (bool, error) {
+	upd, err := r.db.Prepare("UPDATE cloudinit SET expires_at = ?, extend_count = extend_count + 1 WHERE contest_id = ? AND team_id = ? AND question_id = ? AND expires_at IS NOT NULL AND extend_count < ?")
+	if err != nil {
+		return false, errors.Wrap(err, "cloudinit update error")
+	}
+	defer upd.Close()
+
+	res, err := upd.Exec(expiresAt, cid, tid, qid, maxExtends)
+	if err != nil {
+		return false, errors.Wrap(err, "can't extend cloudinit")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "can't extend cloudinit")
+	}
+	return n > 0, nil
+}
+
+func (m *mysqlRepository) SelectExpiredCloudinits() ([]model.Cloudinit, error) {
+	cs := []model.Cloudinit{}
+	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,vmid,cluster_id,expires_at FROM cloudinit WHERE expires_at <= NOW()")
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select Cloudinit")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			c         model.Cloudinit
+			VMID      sql.NullInt64
+			ExpiresAt sql.NullTime
+		)
+		if err := rows.Scan(&c.QuestionID, &c.ContestID, &c.TeamID, &VMID, &c.ClusterID, &ExpiresAt); err != nil {
+			return nil, errors.Wrap(err, "SelectExpiredCloudinits: failed to scan row")
+		}
+		c.VMID = int(VMID.Int64)
+		c.ExpiresAt = nullTime(ExpiresAt)
+		cs = append(cs, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return cs, nil
+}
+
+func (m *mysqlRepository) SelectLegacyCloudinitAccess(prefix string) ([]model.Cloudinit, error) {
+	cs := []model.Cloudinit{}
+	rows, err := m.db.Query("SELECT question_id,contest_id,team_id,access FROM cloudinit WHERE access IS NOT NULL AND access <> '' AND LEFT(access, CHAR_LENGTH(?)) <> ?", prefix, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select Cloudinit")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c model.Cloudinit
+		if err := rows.Scan(&c.QuestionID, &c.ContestID, &c.TeamID, &c.Access); err != nil {
+			return nil, errors.Wrap(err, "SelectLegacyCloudinitAccess: failed to scan row")
+		}
+		cs = append(cs, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return cs, nil
+}
+
+func (r *mysqlRepository) UpdateCloudinitAccess(cid, tid, qid int, old, access string) error {
+	upd, err := r.db.Prepare("UPDATE cloudinit SET access = ? WHERE contest_id = ? AND team_id = ? AND question_id = ? AND access = ?")
+	if err != nil {
+		return errors.Wrap(err, "cloudinit update error")
+	}
+	defer upd.Close()
+
+	if _, err := upd.Exec(access, cid, tid, qid, old); err != nil {
+		return errors.Wrap(err, "can't update cloudinit access")
+	}
+	return nil
+}
+
+// SelectOnDemandPolicy はコンテストのオンデマンドの設定を返します (設定がない場合は TTLMinutes が 0)
+func (m *mysqlRepository) SelectOnDemandPolicy(cid int) (*model.OnDemandPolicy, error) {
+	p := model.OnDemandPolicy{ContestID: cid}
+	err := m.db.QueryRow("SELECT ttl_minutes,max_extends,team_quota FROM contest_ondemand_policies WHERE contest_id = ?", cid).
+		Scan(&p.TTLMinutes, &p.MaxExtends, &p.TeamQuota)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &p, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select ondemand policy")
+	}
+	return &p, nil
+}
+
+func (r *mysqlRepository) UpsertOnDemandPolicy(p model.OnDemandPolicy) error {
+	ins, err := r.db.Prepare("INSERT INTO contest_ondemand_policies (contest_id,ttl_minutes,max_extends,team_quota) VALUES(?, ?, ?, ?) ON DUPLICATE KEY UPDATE ttl_minutes = VALUES(ttl_minutes), max_extends = VALUES(max_extends), team_quota = VALUES(team_quota)")
+	if err != nil {
+		return errors.Wrap(err, "ondemand policy insert error")
+	}
+	defer ins.Close()
+
+	if _, err := ins.Exec(p.ContestID, p.TTLMinutes, p.MaxExtends, p.TeamQuota); err != nil {
+		return errors.Wrap(err, "can't upsert ondemand policy")
+	}
+	return nil
+}
+
+func (r *mysqlRepository) DeleteOnDemandPolicy(cid int) error {
+	del, err := r.db.Prepare("DELETE FROM contest_ondemand_policies WHERE contest_id = ?")
+	if err != nil {
+		return errors.Wrap(err, "ondemand policy delete error")
+	}
+	defer del.Close()
+
+	if _, err := del.Exec(cid); err != nil {
+		return errors.Wrap(err, "can't delete ondemand policy")
+	}
+	return nil
+}
+
+// SelectIdlePolicy はコンテストのアイドルの条件を返します (設定がない場合は Mode が空)
+func (m *mysqlRepository) SelectIdlePolicy(cid int) (*model.IdlePolicy, error) {
+	p := model.IdlePolicy{ContestID: cid}
+	err := m.db.QueryRow("SELECT mode,idle_minutes,threshold FROM contest_idle_policies WHERE contest_id = ?", cid).
+		Scan(&p.Mode, &p.IdleMinutes, &p.Threshold)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &p, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select idle policy")
+	}
+	return &p, nil
+}
+
+func (m *mysqlRepository) SelectIdlePolicies() ([]model.IdlePolicy, error) {
+	ps := []model.IdlePolicy{}
+	rows, err := m.db.Query("SELECT contest_id,mode,idle_minutes,threshold FROM contest_idle_policies ORDER BY contest_id")
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select idle policies")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p model.IdlePolicy
+		if err := rows.Scan(&p.ContestID, &p.Mode, &p.IdleMinutes, &p.Threshold); err != nil {
+			return nil, errors.Wrap(err, "SelectIdlePolicies: failed to scan row")
+		}
+		ps = append(ps, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return ps, nil
+}
+
+func (r *mysqlRepository) UpsertIdlePolicy(p model.IdlePolicy) error {
+	ins, err := r.db.Prepare("INSERT INTO contest_idle_policies (contest_id,mode,idle_minutes,threshold) VALUES(?, ?, ?, ?) ON DUPLICATE KEY UPDATE mode = VALUES(mode), idle_minutes = VALUES(idle_minutes), threshold = VALUES(threshold)")
+	if err != nil {
+		return errors.Wrap(err, "idle policy insert error")
+	}
+	defer ins.Close()
+
+	if _, err := ins.Exec(p.ContestID, p.Mode, p.IdleMinutes, p.Threshold); err != nil {
+		return errors.Wrap(err, "can't upsert idle policy")
+	}
+	return nil
+}
+
+func (r *mysqlRepository) DeleteIdlePolicy(cid int) error {
+	del, err := r.db.Prepare("DELETE FROM contest_idle_policies WHERE contest_id = ?")
+	if err != nil {
+		return errors.Wrap(err, "idle policy delete error")
+	}
+	defer del.Close()
+
+	if _, err := del.Exec(cid); err != nil {
+		return errors.Wrap(err, "can't delete idle policy")
+	}
+	return nil
+}
+
+func (r *mysqlRepository) InsertVNet(v model.VNet) error {
+	ins, err := r.db.Prepare("INSERT INTO contest_vnets (contest_id,team_id,vnet,tag,subnet,gateway) VALUES(?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return errors.Wrap(err, "vnet insert error")
+	}
+	defer ins.Close()
+
+	_, err = ins.Exec(v.ContestID, v.TeamID, v.Name, v.Tag, v.Subnet, v.Gateway)
+	if err != nil {
+		return errors.Wrap(err, "can't insert vnet")
+	}
+	return nil
+}
+
+func (r *mysqlRepository) DeleteVNet(v model.VNet) error {
+	ins, err := r.db.Prepare("DELETE FROM contest_vnets WHERE contest_id = ? AND team_id = ?")
+	if err != nil {
+		return errors.Wrap(err, "vnet delete error")
+	}
+	defer ins.Close()
+
+	_, err = ins.Exec(v.ContestID, v.TeamID)
+	if err != nil {
+		return errors.Wrap(err, "can't delete vnet")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) SelectVNetsByContestID(cid int) ([]model.VNet, error) {
+	vs := []model.VNet{}
+	rows, err := m.db.Query("SELECT contest_id,team_id,vnet,tag,subnet,gateway FROM contest_vnets WHERE contest_id = ?", cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select vnets")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v model.VNet
+		if err := rows.Scan(&v.ContestID, &v.TeamID, &v.Name, &v.Tag, &v.Subnet, &v.Gateway); err != nil {
+			return nil, errors.Wrap(err, "SelectVNetsByContestID: failed to scan row")
+		}
+		vs = append(vs, v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return vs, nil
+}
+
+// SelectVNetTags は全コンテストで使用中の VLAN タグを返します
+func (m *mysqlRepository) SelectVNetTags() ([]int, error) {
+	tags := []int{}
+	rows, err := m.db.Query("SELECT tag FROM contest_vnets")
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select vnet tags")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag int
+		if err := rows.Scan(&tag); err != nil {
+			return nil, errors.Wrap(err, "SelectVNetTags: failed to scan row")
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return tags, nil
+}
+
+func (r *mysqlRepository) InsertVPNPeer(p model.VPNPeer) error {
+	ins, err := r.db.Prepare("INSERT INTO contest_vpn_peers (contest_id,team_id,public_key,private_key,address,allowed_ips) VALUES(?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return errors.Wrap(err, "vpn peer insert error")
+	}
+	defer ins.Close()
+
+	_, err = ins.Exec(p.ContestID, p.TeamID, p.PublicKey, p.PrivateKey, p.Address, p.AllowedIPs)
+	if err != nil {
+		return errors.Wrap(err, "can't insert vpn peer")
+	}
+	return nil
+}
+
+func (r *mysqlRepository) DeleteVPNPeersByContestID(cid int) error {
+	ins, err := r.db.Prepare("DELETE FROM contest_vpn_peers WHERE contest_id = ?")
+	if err != nil {
+		return errors.Wrap(err, "vpn peer delete error")
+	}
+	defer ins.Close()
+
+	_, err = ins.Exec(cid)
+	if err != nil {
+		return errors.Wrap(err, "can't delete vpn peers")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) SelectVPNPeers() ([]model.VPNPeer, error) {
+	ps := []model.VPNPeer{}
+	rows, err := m.db.Query("SELECT contest_id,team_id,public_key,private_key,address,allowed_ips FROM contest_vpn_peers ORDER BY contest_id,team_id")
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select vpn peers")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p model.VPNPeer
+		if err := rows.Scan(&p.ContestID, &p.TeamID, &p.PublicKey, &p.PrivateKey, &p.Address, &p.AllowedIPs); err != nil {
+			return nil, errors.Wrap(err, "SelectVPNPeers: failed to scan row")
+		}
+		ps = append(ps, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return ps, nil
+}
+
+func (m *mysqlRepository) SelectVPNPeer(cid, tid int) (*model.VPNPeer, error) {
+	var p model.VPNPeer
+	err := m.db.QueryRow("SELECT contest_id,team_id,public_key,private_key,address,allowed_ips FROM contest_vpn_peers WHERE contest_id = ? AND team_id = ?", cid, tid).
+		Scan(&p.ContestID, &p.TeamID, &p.PublicKey, &p.PrivateKey, &p.Address, &p.AllowedIPs)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select vpn peer")
+	}
+	return &p, nil
+}
+
+func (r *mysqlRepository) InsertAgentAudit(a model.AgentAudit) error {
+	ins, err := r.db.Prepare("INSERT INTO agent_audits (user_id,contest_id,team_id,question_id,vmid,action,detail,result) VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return errors.Wrap(err, "agent audit insert error")
+	}
+	defer ins.Close()
+
+	_, err = ins.Exec(a.UserID, a.ContestID, a.TeamID, a.QuestionID, a.VMID, a.Action, a.Detail, a.Result)
+	if err != nil {
+		return errors.Wrap(err, "can't insert agent audit")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) SelectQuestionVMsByContestID(cid int) (map[int][]model.QuestionVM, error) {
+	envs := map[int][]model.QuestionVM{}
+	rows, err := m.db.Query("SELECT qv.question_id,qv.role,qv.vmid,qv.cpu,qv.memory,qv.disk,qv.cloudinit FROM question_vms AS qv JOIN contest_questions AS cq ON cq.question_id = qv.question_id WHERE cq.contest_id = ? ORDER BY qv.question_id,qv.position,qv.role", cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select question_vms")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			qid       int
+			vm        model.QuestionVM
+			Cloudinit sql.NullString
+		)
+		if err := rows.Scan(&qid, &vm.Role, &vm.VMID, &vm.CPUs, &vm.Memory, &vm.Disk, &Cloudinit); err != nil {
+			return nil, errors.Wrap(err, "SelectQuestionVMsByContestID: failed to scan row")
+		}
+		if Cloudinit.Valid && Cloudinit.String != "" {
+			vm.Cloudinit = json.RawMessage(Cloudinit.String)
+		}
+		envs[qid] = append(envs[qid], vm)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return envs, nil
+}
+
+func (r *mysqlRepository) InsertCloudinitVM(m model.Machine, position int) error {
+	ins, err := r.db.Prepare("INSERT INTO cloudinit_vms (contest_id,question_id,team_id,role,vmid,cluster_id,access,position) VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return errors.Wrap(err, "cloudinit_vms insert error")
+	}
+	defer ins.Close()
+
+	_, err = ins.Exec(m.ContestID, m.QuestionID, m.TeamID, m.Role, m.VMID, m.ClusterID, m.Access, position)
+	if err != nil {
+		return errors.Wrap(err, "can't insert cloudinit_vms")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) SelectCloudinitVMs(cid, tid, qid int) ([]model.Machine, error) {
+	return m.selectCloudinitVMs("SELECT contest_id,team_id,question_id,role,vmid,cluster_id,access FROM cloudinit_vms WHERE contest_id = ? AND team_id = ? AND question_id = ? ORDER BY position,role", cid, tid, qid)
+}
+
+func (m *mysqlRepository) SelectCloudinitVMsByContestID(cid int) ([]model.Machine, error) {
+	return m.selectCloudinitVMs("SELECT contest_id,team_id,question_id,role,vmid,cluster_id,'' FROM cloudinit_vms WHERE contest_id = ? ORDER BY team_id,question_id,position,role", cid)
+}
+
+func (m *mysqlRepository) SelectAllCloudinitVMs() ([]model.Machine, error) {
+	return m.selectCloudinitVMs("SELECT contest_id,team_id,question_id,role,vmid,cluster_id,'' FROM cloudinit_vms")
+}
+
+func (m *mysqlRepository) selectCloudinitVMs(query string, args ...any) ([]model.Machine, error) {
+	ms := []model.Machine{}
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't Select cloudinit_vms")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			c      model.Machine
+			Access sql.NullString
+		)
+		if err := rows.Scan(&c.ContestID, &c.TeamID, &c.QuestionID, &c.Role, &c.VMID, &c.ClusterID, &Access); err != nil {
+			return nil, errors.Wrap(err, "selectCloudinitVMs: failed to scan row")
+		}
+		c.Access = Access.String
+		ms = append(ms, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return ms, nil
+}
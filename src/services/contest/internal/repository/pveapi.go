@@ -1,18 +1,38 @@
 package repository
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/LainInTheWired/ctf_backend/contest/model"
 	"github.com/cockroachdb/errors"
 )
 
 type PVEAPIRepository interface {
-	GetIPByVMID(vmid int) (*model.ResponseIPs, error)
-	GetClusterResource() ([]model.ClusterResources, error)
+	// cluster は VM があるクラスタの ID (cloudinit.cluster_id、空の場合は pveapi のデフォルト)
+	GetIPByVMID(cluster string, vmid int) (*model.ResponseIPs, error)
+	GetVMStatus(cluster string, vmid int) (*model.VMReadiness, error)
+	GetVMMetrics(cluster string, vmid int, timeframe string) (*model.VMMetrics, error)
+	// cid が 0 でなければそのコンテストのタグが付いた VM だけを返す
+	GetClusterResource(cid int) ([]model.ClusterResources, error)
+	CreateVNet(v model.VNet) error
+	DeleteVNet(name string) error
+	SetFirewall(cluster string, vmid int, fw model.Firewall) error
+	// SuspendIdle は VM が policy の条件でアイドルであれば pveapi に止めさせます
+	SuspendIdle(cluster string, vmid int, policy model.IdlePolicy) (*model.PowerState, error)
+	ResumeVM(cluster string, vmid int) (*model.PowerState, error)
+	ListSnippets() ([]string, error)
+	DeleteSnippet(filename string) error
+	// actor は監査ログに残す操作したユーザー (pveapi に X-User-ID で渡す)
+	AgentExec(cluster string, vmid int, actor string, exec model.AgentExec) (*model.AgentExecStatus, error)
+	// AgentExecStatus は Wait を付けずに実行したコマンドの状態を返します
+	AgentExecStatus(cluster string, vmid int, actor string, pid int) (*model.AgentExecStatus, error)
+	AgentFileRead(cluster string, vmid int, actor string, path string) (*model.AgentFile, error)
+	AgentFileWrite(cluster string, vmid int, actor string, file model.AgentFileWrite) error
 }
 
 type pveapiRepository struct {
@@ -27,8 +47,23 @@ func NewPVEAPIRepository(hc *http.Client, url string) PVEAPIRepository {
 	}
 }
 
-func (r *pveapiRepository) GetIPByVMID(vmid int) (*model.ResponseIPs, error) {
-	endpoint := fmt.Sprintf("%s/vm/%d/ips", r.URL, vmid)
+// vmEndpoint は cluster の VM の pveapi のエンドポイントを返します
+func (r *pveapiRepository) vmEndpoint(cluster string, vmid int, path string, query url.Values) string {
+	endpoint := fmt.Sprintf("%s/vm/%d/%s", r.URL, vmid, path)
+	if query == nil {
+		query = url.Values{}
+	}
+	if cluster != "" {
+		query.Set("cluster", cluster)
+	}
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	return endpoint
+}
+
+func (r *pveapiRepository) GetIPByVMID(cluster string, vmid int) (*model.ResponseIPs, error) {
+	endpoint := r.vmEndpoint(cluster, vmid, "ips", nil)
 
 	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
@@ -58,8 +93,67 @@ func (r *pveapiRepository) GetIPByVMID(vmid int) (*model.ResponseIPs, error) {
 	return &ifs, nil
 }
 
-func (r *pveapiRepository) GetClusterResource() ([]model.ClusterResources, error) {
+func (r *pveapiRepository) GetVMStatus(cluster string, vmid int) (*model.VMReadiness, error) {
+	endpoint := r.vmEndpoint(cluster, vmid, "status", nil)
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create http request")
+	}
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read response body")
+	}
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return nil, errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, string(body))
+	}
+	status := &model.VMReadiness{}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal response body")
+	}
+	return status, nil
+}
+
+func (r *pveapiRepository) GetVMMetrics(cluster string, vmid int, timeframe string) (*model.VMMetrics, error) {
+	endpoint := r.vmEndpoint(cluster, vmid, "metrics", url.Values{"timeframe": {timeframe}})
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create http request")
+	}
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read response body")
+	}
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return nil, errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, string(body))
+	}
+	metrics := &model.VMMetrics{}
+	if err := json.Unmarshal(body, metrics); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal response body")
+	}
+	return metrics, nil
+}
+
+func (r *pveapiRepository) GetClusterResource(cid int) ([]model.ClusterResources, error) {
 	endpoint := fmt.Sprintf("%s/cluster", r.URL)
+	if cid != 0 {
+		endpoint = fmt.Sprintf("%s?contest_id=%d", endpoint, cid)
+	}
 
 	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
@@ -88,3 +182,247 @@ func (r *pveapiRepository) GetClusterResource() ([]model.ClusterResources, error
 	}
 	return cluster, nil
 }
+
+func (r *pveapiRepository) CreateVNet(v model.VNet) error {
+	endpoint := fmt.Sprintf("%s/sdn/vnet", r.URL)
+
+	jsend, err := json.Marshal(map[string]any{
+		"vnet":    v.Name,
+		"tag":     v.Tag,
+		"alias":   fmt.Sprintf("contest %d team %d", v.ContestID, v.TeamID),
+		"subnet":  v.Subnet,
+		"gateway": v.Gateway,
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't change json")
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsend))
+	if err != nil {
+		return errors.Wrap(err, "can't create http request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+func (r *pveapiRepository) DeleteVNet(name string) error {
+	endpoint := fmt.Sprintf("%s/sdn/vnet/%s", r.URL, name)
+
+	req, err := http.NewRequest("DELETE", endpoint, nil)
+	if err != nil {
+		return errors.Wrap(err, "can't create http request")
+	}
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+func (r *pveapiRepository) SetFirewall(cluster string, vmid int, fw model.Firewall) error {
+	endpoint := r.vmEndpoint(cluster, vmid, "firewall", nil)
+
+	jsend, err := json.Marshal(fw)
+	if err != nil {
+		return errors.Wrap(err, "can't change json")
+	}
+	req, err := http.NewRequest("PUT", endpoint, bytes.NewBuffer(jsend))
+	if err != nil {
+		return errors.Wrap(err, "can't create http request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// powerRequest は body を JSON で POST して VM の電源の状態を受け取ります
+func (r *pveapiRepository) powerRequest(endpoint string, body any) (*model.PowerState, error) {
+	jsend, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't change json")
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsend))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create http request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	rbody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read response body")
+	}
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return nil, errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, string(rbody))
+	}
+	state := &model.PowerState{}
+	if err := json.Unmarshal(rbody, state); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal response body")
+	}
+	return state, nil
+}
+
+func (r *pveapiRepository) SuspendIdle(cluster string, vmid int, policy model.IdlePolicy) (*model.PowerState, error) {
+	return r.powerRequest(r.vmEndpoint(cluster, vmid, "suspend-idle", nil), map[string]any{
+		"mode":         policy.Mode,
+		"idle_minutes": policy.IdleMinutes,
+		"threshold":    policy.Threshold,
+	})
+}
+
+func (r *pveapiRepository) ResumeVM(cluster string, vmid int) (*model.PowerState, error) {
+	return r.powerRequest(r.vmEndpoint(cluster, vmid, "resume", nil), struct{}{})
+}
+
+// ListSnippets はすべてのクラスタのスニペットの保存先にある cloud-init のファイル名を返します
+func (r *pveapiRepository) ListSnippets() ([]string, error) {
+	endpoint := fmt.Sprintf("%s/cloudinit", r.URL)
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create http request")
+	}
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return nil, errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	}
+	names := []string{}
+	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal response body")
+	}
+	return names, nil
+}
+
+// DeleteSnippet は user-data のスニペットと同じ名前の network などのスニペットを削除します
+func (r *pveapiRepository) DeleteSnippet(filename string) error {
+	endpoint := fmt.Sprintf("%s/cloudinit", r.URL)
+
+	jsend, err := json.Marshal(map[string]string{"filename": filename})
+	if err != nil {
+		return errors.Wrap(err, "can't change json")
+	}
+	req, err := http.NewRequest("DELETE", endpoint, bytes.NewBuffer(jsend))
+	if err != nil {
+		return errors.Wrap(err, "can't create http request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// agentRequest は pveapi の guest agent のエンドポイントを呼び出します
+func (r *pveapiRepository) agentRequest(method string, endpoint string, actor string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		jsend, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "can't change json")
+		}
+		reader = bytes.NewBuffer(jsend)
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return errors.Wrap(err, "can't create http request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", actor)
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	resbody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "can't read response body")
+	}
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, string(resbody))
+	}
+	if out != nil {
+		if err := json.Unmarshal(resbody, out); err != nil {
+			return errors.Wrap(err, "can't unmarshal response body")
+		}
+	}
+	return nil
+}
+
+func (r *pveapiRepository) AgentExec(cluster string, vmid int, actor string, exec model.AgentExec) (*model.AgentExecStatus, error) {
+	endpoint := r.vmEndpoint(cluster, vmid, "agent/exec", nil)
+	status := &model.AgentExecStatus{}
+	if err := r.agentRequest("POST", endpoint, actor, exec, status); err != nil {
+		return nil, errors.Wrap(err, "can't exec command")
+	}
+	return status, nil
+}
+
+func (r *pveapiRepository) AgentExecStatus(cluster string, vmid int, actor string, pid int) (*model.AgentExecStatus, error) {
+	endpoint := r.vmEndpoint(cluster, vmid, fmt.Sprintf("agent/exec/%d", pid), nil)
+	status := &model.AgentExecStatus{}
+	if err := r.agentRequest("GET", endpoint, actor, nil, status); err != nil {
+		return nil, errors.Wrap(err, "can't get exec status")
+	}
+	return status, nil
+}
+
+func (r *pveapiRepository) AgentFileRead(cluster string, vmid int, actor string, path string) (*model.AgentFile, error) {
+	endpoint := r.vmEndpoint(cluster, vmid, "agent/file", url.Values{"path": {path}})
+	file := &model.AgentFile{}
+	if err := r.agentRequest("GET", endpoint, actor, nil, file); err != nil {
+		return nil, errors.Wrap(err, "can't read file")
+	}
+	return file, nil
+}
+
+func (r *pveapiRepository) AgentFileWrite(cluster string, vmid int, actor string, file model.AgentFileWrite) error {
+	endpoint := r.vmEndpoint(cluster, vmid, "agent/file", nil)
+	if err := r.agentRequest("PUT", endpoint, actor, file, nil); err != nil {
+		return errors.Wrap(err, "can't write file")
+	}
+	return nil
+}
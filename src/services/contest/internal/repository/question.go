@@ -7,6 +7,8 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/LainInTheWired/ctf_backend/contest/model"
 	"github.com/cockroachdb/errors"
@@ -15,9 +17,10 @@ import (
 
 type QuestionRepository interface {
 	GetListQuestionsByContest(cid int) ([]model.Question, error)
-	CloneQuestion(conf model.QuesionRequest) (int, error)
+	// CloneQuestion は問題の VM をクローンして VMID とクローン先のクラスタ、VM の種類を返します
+	CloneQuestion(conf model.QuesionRequest) (*model.QuesionResponse[int], error)
 	GetListQuestionsByQuestionID(qid int) (model.Question, error)
-	DeleteVM(vmid int) error
+	DeleteVM(cluster string, vmid int) error
 }
 
 type questionRepository struct {
@@ -107,20 +110,20 @@ func (r *questionRepository) GetListQuestionsByQuestionID(qid int) (model.Questi
 	return question, nil
 }
 
-func (r *questionRepository) CloneQuestion(conf model.QuesionRequest) (int, error) {
+func (r *questionRepository) CloneQuestion(conf model.QuesionRequest) (*model.QuesionResponse[int], error) {
 	// フォームデータの作成
 	endpoint := fmt.Sprintf("%s/question/clone", r.URL)
 	// フォームデータの作成
 
 	jsend, err := json.Marshal(conf)
 	if err != nil {
-		return 0, errors.Wrap(err, "can't change json")
+		return nil, errors.Wrap(err, "can't change json")
 	}
 
 	// 新しいPOSTリクエストの作成
 	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsend))
 	if err != nil {
-		return 0, xerrors.Errorf("can't create http request: %w", err)
+		return nil, xerrors.Errorf("can't create http request: %w", err)
 	}
 
 	// ヘッダーの設定
@@ -129,7 +132,7 @@ func (r *questionRepository) CloneQuestion(conf model.QuesionRequest) (int, erro
 	// リクエストの送信
 	resp, err := r.HTTPClient.Do(req)
 	if err != nil {
-		return 0, xerrors.Errorf("fail http request: %w", err)
+		return nil, xerrors.Errorf("fail http request: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -142,41 +145,31 @@ func (r *questionRepository) CloneQuestion(conf model.QuesionRequest) (int, erro
 	// // json.Unmarshalでデコード
 	var pveresp model.QuesionResponse[int]
 	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return 0, xerrors.Errorf("can't unmarshal response body: %w", err)
+		return nil, xerrors.Errorf("can't unmarshal response body: %w", err)
 	}
 
 	// エラーチェック
 	if resp.StatusCode >= 400 {
-		return 0, xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+		return nil, xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
 	}
-	return pveresp.Data, nil
+	return &pveresp, nil
 }
 
-func (r *questionRepository) DeleteVM(vmid int) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/question/clone", r.URL)
-	// フォームデータの作成
-
-	conf := struct {
-		ID int
-	}{
-		ID: vmid,
-	}
-
-	jsend, err := json.Marshal(conf)
-	if err != nil {
-		return errors.Wrap(err, "can't change json")
+func (r *questionRepository) DeleteVM(cluster string, vmid int) error {
+	// question サービスはクエリパラメータで VMID とクラスタを受け取る
+	q := url.Values{}
+	q.Set("questionID", strconv.Itoa(vmid))
+	if cluster != "" {
+		q.Set("cluster", cluster)
 	}
+	endpoint := fmt.Sprintf("%s/question/clone?%s", r.URL, q.Encode())
 
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("DELETE", endpoint, bytes.NewBuffer(jsend))
+	// 新しいDELETEリクエストの作成
+	req, err := http.NewRequest("DELETE", endpoint, nil)
 	if err != nil {
 		return xerrors.Errorf("can't create http request: %w", err)
 	}
 
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/json")
-
 	// リクエストの送信
 	resp, err := r.HTTPClient.Do(req)
 	if err != nil {
@@ -184,18 +177,6 @@ func (r *questionRepository) DeleteVM(vmid int) error {
 	}
 	defer resp.Body.Close()
 
-	// レスポンスの読み取り
-	// body, err := io.ReadAll(resp.Body)
-	// if err != nil {
-	// 	log.Fatalf("Error reading clone response body: %v", err)
-	// }
-
-	// // // json.Unmarshalでデコード
-	// var pveresp model.QuesionResponse[int]
-	// if err := json.Unmarshal(body, &pveresp); err != nil {
-	// 	return xerrors.Errorf("can't unmarshal response body: %w", err)
-	// }
-
 	// エラーチェック
 	if resp.StatusCode >= 400 {
 		return xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
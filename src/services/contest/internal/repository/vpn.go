@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/cockroachdb/errors"
+)
+
+// VPNRepository は WireGuard サーバーの設定を書き出します
+// サーバー側は設定ファイルの更新を検知して wg syncconf と iptables-restore --noflush <ルール> で反映する
+// (wg syncconf は PostUp/PostDown を実行しないため、ピアごとのルールは別のファイルにする)
+type VPNRepository interface {
+	WriteServerConfig(data []byte) error
+	WriteForwardRules(data []byte) error
+}
+
+type fileVPNRepository struct {
+	path      string
+	rulesPath string
+}
+
+func NewVPNRepository(path, rulesPath string) VPNRepository {
+	return &fileVPNRepository{
+		path:      path,
+		rulesPath: rulesPath,
+	}
+}
+
+func (r *fileVPNRepository) WriteServerConfig(data []byte) error {
+	return writeFileAtomic(r.path, data)
+}
+
+func (r *fileVPNRepository) WriteForwardRules(data []byte) error {
+	return writeFileAtomic(r.rulesPath, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	// 書き込み途中の設定を読まれないように一時ファイルからリネームする
+	f, err := os.CreateTemp(filepath.Dir(path), ".wg-*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "can't create file")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "can't write file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "can't close file")
+	}
+	// 秘密鍵を含むので所有者のみ読める権限にする
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		return errors.Wrap(err, "can't chmod file")
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errors.Wrap(err, "can't rename file")
+	}
+	return nil
+}
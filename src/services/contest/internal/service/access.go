@@ -0,0 +1,92 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// 暗号化済みの値に付けるプレフィックス (鍵や方式を変えたときに区別する)
+const accessCipherPrefix = "v1:"
+
+// AccessCipher は cloudinit.access に保存するチームの認証情報を暗号化します
+type AccessCipher interface {
+	Encrypt(plain string) (string, error)
+	Decrypt(enc string) (string, error)
+}
+
+type aesGCMAccessCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAccessCipher は base64 でエンコードされた 32 バイトの鍵から AES-256-GCM の AccessCipher を作ります
+func NewAccessCipher(encodedKey string) (AccessCipher, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode access key")
+	}
+	if len(key) != 32 {
+		return nil, errors.Newf("access key must be 32 bytes: %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create gcm")
+	}
+	return &aesGCMAccessCipher{aead: aead}, nil
+}
+
+func (a *aesGCMAccessCipher) Encrypt(plain string) (string, error) {
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Wrap(err, "can't generate nonce")
+	}
+	sealed := a.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return accessCipherPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (a *aesGCMAccessCipher) Decrypt(enc string) (string, error) {
+	if !strings.HasPrefix(enc, accessCipherPrefix) {
+		return "", errors.New("access is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(enc, accessCipherPrefix))
+	if err != nil {
+		return "", errors.Wrap(err, "can't decode access")
+	}
+	if len(sealed) < a.aead.NonceSize() {
+		return "", errors.New("access is too short")
+	}
+	nonce, ciphertext := sealed[:a.aead.NonceSize()], sealed[a.aead.NonceSize():]
+	plain, err := a.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "can't decrypt access")
+	}
+	return string(plain), nil
+}
+
+// EncryptLegacyAccess は AccessCipher を入れる前に平文で保存した cloudinit.access を暗号化します
+// 起動時に一度実行する。同時に別の処理が書き換えた行は上書きしない
+func (s *contestService) EncryptLegacyAccess() (int, error) {
+	cs, err := s.mysqlRepo.SelectLegacyCloudinitAccess(accessCipherPrefix)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't select legacy access")
+	}
+	for i, c := range cs {
+		enc, err := s.access.Encrypt(c.Access)
+		if err != nil {
+			return i, errors.Wrap(err, "can't encrypt access")
+		}
+		if err := s.mysqlRepo.UpdateCloudinitAccess(c.ContestID, c.TeamID, c.QuestionID, c.Access, enc); err != nil {
+			return i, errors.Wrapf(err, "can't update access of %d-%d-%d", c.ContestID, c.TeamID, c.QuestionID)
+		}
+	}
+	return len(cs), nil
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+func TestAccessCipher(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAccessCipher(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := a.Encrypt("Passw0rdPassw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc == "Passw0rdPassw0rd" || len(enc) > 255 {
+		t.Fatalf("unexpected ciphertext: %q", enc)
+	}
+	plain, err := a.Decrypt(enc)
+	if err != nil || plain != "Passw0rdPassw0rd" {
+		t.Fatalf("Decrypt() = %q, %v", plain, err)
+	}
+	// 平文のまま保存された値や改ざんされた値は復号しない
+	if _, err := a.Decrypt("Passw0rdPassw0rd"); err == nil {
+		t.Fatal("plain text should be rejected")
+	}
+	if _, err := a.Decrypt(enc[:len(enc)-2] + "AA"); err == nil {
+		t.Fatal("tampered value should be rejected")
+	}
+	if _, err := NewAccessCipher(""); err == nil {
+		t.Fatal("empty key should be rejected")
+	}
+}
+
+func TestEncryptLegacyAccess(t *testing.T) {
+	access := testAccess(t)
+	enc := encrypt(t, access, "ctf:encrypted")
+	mysql := &fakeMysql{rows: []*model.Cloudinit{
+		{ContestID: 1, TeamID: 1, QuestionID: 1, VMID: 101, Access: "ctf:legacy", Ready: true},
+		{ContestID: 1, TeamID: 2, QuestionID: 1, VMID: 102, Access: enc, Ready: true},
+		{ContestID: 1, TeamID: 3, QuestionID: 1, VMID: 103},
+	}}
+	s := NewContestService(&fakePVE{}, mysql, nil, nil, access, nil, &model.VPNConfig{}, &model.InstanceConfig{})
+
+	n, err := s.EncryptLegacyAccess()
+	if err != nil || n != 1 {
+		t.Fatalf("EncryptLegacyAccess() = %d, %v", n, err)
+	}
+	if mysql.rows[1].Access != enc || mysql.rows[2].Access != "" {
+		t.Fatalf("encrypted rows should not change: %+v", mysql.rows)
+	}
+	c, err := s.GetCloudinit(1, 1, 1)
+	if err != nil || c.Access != "ctf:legacy" {
+		t.Fatalf("GetCloudinit() = %+v, %v", c, err)
+	}
+	// 2 回目は何もしない
+	if n, err := s.EncryptLegacyAccess(); err != nil || n != 0 {
+		t.Fatalf("second EncryptLegacyAccess() = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/contest/repository"
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
+	"github.com/cockroachdb/errors"
+)
+
+// AgentService はチームの VM を QEMU guest agent で操作します
+// 操作はすべて agent_audits に記録する。uid が model.AgentSystemUserID の場合は contest サービス自身の操作
+// (ヘルスチェックやフラグの配置) として扱う
+// machine は複数の VM の問題で操作する VM のロールです (空の場合は最初の VM)
+type AgentService interface {
+	IsAdmin(uid int) (bool, error)
+	Exec(uid, cid, tid, qid int, machine string, exec model.AgentExec) (*model.AgentExecStatus, error)
+	// ExecStatus は Wait を付けずに実行したコマンド pid の状態を返します
+	ExecStatus(uid, cid, tid, qid int, machine string, pid int) (*model.AgentExecStatus, error)
+	ReadFile(uid, cid, tid, qid int, machine string, path string) (*model.AgentFile, error)
+	WriteFile(uid, cid, tid, qid int, machine string, file model.AgentFileWrite) error
+}
+
+type agentService struct {
+	pveRepo   repository.PVEAPIRepository
+	mysqlRepo repository.MysqlRepository
+	roleRepo  role.RoleRepository
+}
+
+func NewAgentService(pveRepo repository.PVEAPIRepository, mysqlRepo repository.MysqlRepository, roleRepo role.RoleRepository) AgentService {
+	return &agentService{
+		pveRepo:   pveRepo,
+		mysqlRepo: mysqlRepo,
+		roleRepo:  roleRepo,
+	}
+}
+
+func (s *agentService) IsAdmin(uid int) (bool, error) {
+	return role.IsAdmin(s.roleRepo, uid)
+}
+
+// agentActor は pveapi の監査ログに残すユーザーです
+func agentActor(uid int) string {
+	if uid == model.AgentSystemUserID {
+		return "contest"
+	}
+	return strconv.Itoa(uid)
+}
+
+// audit は操作の結果を記録します。記録できなかった場合は操作が成功していてもエラーを返す
+func (s *agentService) audit(a model.AgentAudit, opErr error) error {
+	a.Result = "ok"
+	if opErr != nil {
+		a.Result = opErr.Error()
+		if len(a.Result) > 255 {
+			a.Result = a.Result[:255]
+		}
+	}
+	if err := s.mysqlRepo.InsertAgentAudit(a); err != nil {
+		return errors.Wrap(err, "can't insert agent audit")
+	}
+	return opErr
+}
+
+// target は操作する VM のクラスタと VMID を返します
+// machine を指定した場合は、インスタンスの cloudinit_vms にあるそのロールの VM のみ操作できる
+func (s *agentService) target(cid, tid, qid int, machine string) (string, int, error) {
+	c, err := s.mysqlRepo.SelectCloudinitByContestIDAndTeamIDAndQuestionID(cid, tid, qid)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "can't get cloudinit")
+	}
+	if c.VMID == 0 {
+		return "", 0, errors.Newf("vm not found: contest %d team %d question %d", cid, tid, qid)
+	}
+	if machine == "" {
+		return c.ClusterID, c.VMID, nil
+	}
+	machines, err := s.mysqlRepo.SelectCloudinitVMs(cid, tid, qid)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "can't get cloudinit vms")
+	}
+	for _, m := range machines {
+		if m.Role == machine {
+			return m.ClusterID, m.VMID, nil
+		}
+	}
+	return "", 0, errors.Newf("machine %q not found: contest %d team %d question %d", machine, cid, tid, qid)
+}
+
+func (s *agentService) Exec(uid, cid, tid, qid int, machine string, exec model.AgentExec) (*model.AgentExecStatus, error) {
+	if len(exec.Command) == 0 {
+		return nil, errors.New("command is empty")
+	}
+	cluster, vmid, err := s.target(cid, tid, qid, machine)
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.pveRepo.AgentExec(cluster, vmid, agentActor(uid), exec)
+	a := model.AgentAudit{UserID: uid, ContestID: cid, TeamID: tid, QuestionID: qid, VMID: vmid, Action: "exec", Detail: strings.Join(exec.Command, " ")}
+	if err := s.audit(a, err); err != nil {
+		return nil, errors.Wrap(err, "can't exec command")
+	}
+	return status, nil
+}
+
+func (s *agentService) ExecStatus(uid, cid, tid, qid int, machine string, pid int) (*model.AgentExecStatus, error) {
+	cluster, vmid, err := s.target(cid, tid, qid, machine)
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.pveRepo.AgentExecStatus(cluster, vmid, agentActor(uid), pid)
+	a := model.AgentAudit{UserID: uid, ContestID: cid, TeamID: tid, QuestionID: qid, VMID: vmid, Action: "exec-status", Detail: strconv.Itoa(pid)}
+	if err := s.audit(a, err); err != nil {
+		return nil, errors.Wrap(err, "can't get exec status")
+	}
+	return status, nil
+}
+
+func (s *agentService) ReadFile(uid, cid, tid, qid int, machine string, path string) (*model.AgentFile, error) {
+	cluster, vmid, err := s.target(cid, tid, qid, machine)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.pveRepo.AgentFileRead(cluster, vmid, agentActor(uid), path)
+	a := model.AgentAudit{UserID: uid, ContestID: cid, TeamID: tid, QuestionID: qid, VMID: vmid, Action: "file-read", Detail: path}
+	if err := s.audit(a, err); err != nil {
+		return nil, errors.Wrap(err, "can't read file")
+	}
+	return file, nil
+}
+
+func (s *agentService) WriteFile(uid, cid, tid, qid int, machine string, file model.AgentFileWrite) error {
+	cluster, vmid, err := s.target(cid, tid, qid, machine)
+	if err != nil {
+		return err
+	}
+	err = s.pveRepo.AgentFileWrite(cluster, vmid, agentActor(uid), file)
+	// 書き込んだ内容 (フラグなど) は記録しない
+	a := model.AgentAudit{UserID: uid, ContestID: cid, TeamID: tid, QuestionID: qid, VMID: vmid, Action: "file-write", Detail: file.Path}
+	if err := s.audit(a, err); err != nil {
+		return errors.Wrap(err, "can't write file")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
+	"github.com/cockroachdb/errors"
+)
+
+func TestAgentService(t *testing.T) {
+	pve := &fakePVE{}
+	mysql := &fakeMysql{rows: []*model.Cloudinit{{ContestID: 1, TeamID: 2, QuestionID: 3, VMID: 120}}}
+	s := NewAgentService(pve, mysql, fakeRoles{5: {{ID: role.AdminRoleID}}, 6: {{ID: 2}}})
+
+	if ok, _ := s.IsAdmin(5); !ok {
+		t.Error("IsAdmin(5) = false")
+	}
+	if ok, _ := s.IsAdmin(6); ok {
+		t.Error("IsAdmin(6) = true")
+	}
+
+	exec := model.AgentExec{Command: []string{"systemctl", "is-active", "nginx"}, Wait: true}
+	if _, err := s.Exec(5, 1, 2, 3, "", exec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Exec(model.AgentSystemUserID, 1, 2, 3, "", exec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Exec(5, 1, 9, 3, "", exec); err == nil {
+		t.Error("Exec() without vm should fail")
+	}
+	// 失敗した操作も記録する
+	pve.agentErr = errors.New("QEMU guest agent is not running")
+	if _, err := s.Exec(5, 1, 2, 3, "", exec); err == nil {
+		t.Error("Exec() should fail")
+	}
+
+	if st, err := s.ExecStatus(5, 1, 2, 3, "", 42); err != nil || st.Pid != 42 {
+		t.Errorf("ExecStatus() = %+v, %v", st, err)
+	}
+
+	if len(pve.actors) != 4 || pve.actors[0] != "5" || pve.actors[1] != "contest" {
+		t.Errorf("actors = %v", pve.actors)
+	}
+	if len(mysql.audits) != 4 {
+		t.Fatalf("audits = %+v", mysql.audits)
+	}
+	if a := mysql.audits[0]; a.VMID != 120 || a.Action != "exec" || a.Detail != "systemctl is-active nginx" || a.Result != "ok" {
+		t.Errorf("audit = %+v", a)
+	}
+	if a := mysql.audits[2]; a.Result != "QEMU guest agent is not running" {
+		t.Errorf("failed audit = %+v", a)
+	}
+	if a := mysql.audits[3]; a.Action != "exec-status" || a.Detail != "42" {
+		t.Errorf("status audit = %+v", a)
+	}
+}
+
+func TestAgentServiceMachine(t *testing.T) {
+	pve := &fakePVE{}
+	mysql := &fakeMysql{
+		rows: []*model.Cloudinit{{ContestID: 1, TeamID: 2, QuestionID: 3, VMID: 120}},
+		machines: []model.Machine{
+			{ContestID: 1, TeamID: 2, QuestionID: 3, Role: "attacker", VMID: 120},
+			{ContestID: 1, TeamID: 2, QuestionID: 3, Role: "target", VMID: 121},
+			{ContestID: 1, TeamID: 5, QuestionID: 3, Role: "db", VMID: 130},
+		},
+	}
+	s := NewAgentService(pve, mysql, fakeRoles{})
+
+	exec := model.AgentExec{Command: []string{"id"}, Wait: true}
+	if _, err := s.Exec(5, 1, 2, 3, "target", exec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ExecStatus(5, 1, 2, 3, "target", 42); err != nil {
+		t.Fatal(err)
+	}
+	// ほかのチームのインスタンスの VM は操作できない
+	if _, err := s.Exec(5, 1, 2, 3, "db", exec); err == nil {
+		t.Error("Exec() on a machine of another instance should fail")
+	}
+	if len(pve.vmids) != 2 || pve.vmids[0] != 121 || pve.vmids[1] != 121 {
+		t.Errorf("vmids = %v", pve.vmids)
+	}
+	if len(mysql.audits) != 2 || mysql.audits[0].VMID != 121 {
+		t.Errorf("audits = %+v", mysql.audits)
+	}
+}
@@ -1,10 +1,14 @@
 package service
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"log"
 	"math/big"
-	"regexp"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/LainInTheWired/ctf_backend/contest/model"
 	"github.com/LainInTheWired/ctf_backend/contest/repository"
@@ -27,8 +31,22 @@ type ContestService interface {
 	UpdateContestQuesionts(cq *model.ContestQuestions) error
 	StopContest(cid int) error
 	GetCloudinit(cid, tid, qid int) (*model.Cloudinit, error)
-	GetClusterResource() ([]model.ClusterResources, error)
-	AllDeleteVM() error
+	// cid が 0 の場合はすべてのコンテストの VM を対象にする
+	GetClusterResource(cid int) ([]model.ClusterResources, error)
+	// confirm が false の場合は削除対象を返すだけで削除しない
+	AllDeleteVM(cid int, confirm bool) ([]model.ClusterResources, error)
+	GetVPNConfig(cid, tid int) ([]byte, error)
+	GetOnDemandPolicy(cid int) (*model.OnDemandPolicy, error)
+	// TTLMinutes が 0 の場合は設定を削除してオンデマンドをやめる
+	SetOnDemandPolicy(p model.OnDemandPolicy) error
+	LaunchInstance(cid, tid, qid int) (*model.Cloudinit, error)
+	ExtendInstance(cid, tid, qid int) (*model.Cloudinit, error)
+	DestroyInstance(cid, tid, qid int) error
+	ExpireInstances() (int, error)
+	// RunExpiry は ctx が終わるまで期限の切れたインスタンスを削除し続けます
+	RunExpiry(ctx context.Context)
+	// EncryptLegacyAccess は暗号化する前に保存した cloudinit.access を暗号化し直し、暗号化した数を返します
+	EncryptLegacyAccess() (int, error)
 }
 
 type contestService struct {
@@ -36,14 +54,29 @@ type contestService struct {
 	mysqlRepo repository.MysqlRepository
 	teamRepo  repository.TeamRepository
 	quesRepo  repository.QuestionRepository
+	access    AccessCipher
+	vpnRepo   repository.VPNRepository
+	vpnConf   *model.VPNConfig
+	instConf  *model.InstanceConfig
+
+	// launchMu は teamLocks を守る
+	launchMu  sync.Mutex
+	teamLocks map[string]*sync.Mutex
+	// vpnMu は WireGuard の設定の書き出しを 1 つずつにする
+	vpnMu sync.Mutex
 }
 
-func NewContestService(pveRepo repository.PVEAPIRepository, mysqlRepo repository.MysqlRepository, teamRepo repository.TeamRepository, quesRepo repository.QuestionRepository) ContestService {
+func NewContestService(pveRepo repository.PVEAPIRepository, mysqlRepo repository.MysqlRepository, teamRepo repository.TeamRepository, quesRepo repository.QuestionRepository, access AccessCipher, vpnRepo repository.VPNRepository, vpnConf *model.VPNConfig, instConf *model.InstanceConfig) ContestService {
 	return &contestService{
 		pveRepo:   pveRepo,
 		mysqlRepo: mysqlRepo,
 		teamRepo:  teamRepo,
 		quesRepo:  quesRepo,
+		access:    access,
+		vpnRepo:   vpnRepo,
+		vpnConf:   vpnConf,
+		instConf:  instConf,
+		teamLocks: map[string]*sync.Mutex{},
 	}
 }
 
@@ -145,18 +178,47 @@ func (r *contestService) StartContest(cid int) error {
 	if err != nil {
 		return errors.Wrap(err, "can't get ListQuestions")
 	}
-	cluster, err := r.pveRepo.GetClusterResource()
+	// 作成済みの VM は名前ではなくタグで見分ける
+	cluster, err := r.pveRepo.GetClusterResource(cid)
 	if err != nil {
 		return errors.Wrap(err, "can't get cluster resouece")
 	}
 	mapcluster := map[string]model.ClusterResources{}
 	for _, c := range cluster {
-		if c.Type == "qemu" {
-			mapcluster[c.Name] = c
+		if c.IsGuest() && c.Instance != nil {
+			mapcluster[c.Instance.Key()] = c
 		}
 	}
+	// オンデマンドのコンテストはチームが要求したときに VM を作る
+	ondemand, err := r.mysqlRepo.SelectOnDemandPolicy(cid)
+	if err != nil {
+		return errors.Wrap(err, "can't get ondemand policy")
+	}
+	// 複数の VM の問題は問題ごとの VM の一覧をまとめて作る
+	envs, err := r.mysqlRepo.SelectQuestionVMsByContestID(cid)
+	if err != nil {
+		return errors.Wrap(err, "can't get question vms")
+	}
+	hosts := hostIndexes(questions.Questions, envs)
+	vnets, err := r.mysqlRepo.SelectVNetsByContestID(cid)
+	if err != nil {
+		return errors.Wrap(err, "can't get vnets")
+	}
 	for _, team := range teams {
-		for _, ques := range questions.Questions {
+		// チームごとに分離した VNet に VM を接続する
+		vnet, err := r.ensureTeamVNet(cid, team.ID, vnets)
+		if err != nil {
+			return errors.Wrap(err, "can't create team vnet")
+		}
+		if r.vpnEnabled() {
+			if err := r.ensureTeamVPNPeer(cid, team.ID, vnet); err != nil {
+				return errors.Wrap(err, "can't create vpn peer")
+			}
+		}
+		if ondemand.TTLMinutes > 0 {
+			continue
+		}
+		for i, ques := range questions.Questions {
 			name := fmt.Sprintf("%d-%d-%d", cid, team.ID, ques.ID)
 			fmt.Println("name: ", name)
 
@@ -165,32 +227,210 @@ func (r *contestService) StartContest(cid int) error {
 				fmt.Println(mapcluster[name])
 				continue
 			}
-			password, err := generatePassword(16)
-			if err != nil {
-				return errors.Wrap(err, "can't generate password")
-			}
-			m := model.QuesionRequest{
-				ID:       ques.VMID,
-				Name:     name,
-				Password: password,
+			if _, err := r.launchInstance(cid, team.ID, vnet, hosts[i], ques, envs[ques.ID], nil); err != nil {
+				return err
 			}
-			vmid, err := r.quesRepo.CloneQuestion(m)
-			if err != nil {
-				return errors.Wrap(err, "can't get ListQuestions")
-			}
-			cloudinit := model.Cloudinit{
-				QuestionID: ques.ID,
-				ContestID:  cid,
-				Filename:   "",
-				TeamID:     team.ID,
-				VMID:       vmid,
-				Access:     password,
+		}
+	}
+	if r.vpnEnabled() {
+		if err := r.syncVPNPeers(); err != nil {
+			return errors.Wrap(err, "can't sync vpn peers")
+		}
+	}
+	return nil
+}
+
+// instancePool はコンテストの VM を入れるリソースプールを返します (空の場合は入れない)
+func (r *contestService) instancePool(cid int) string {
+	if r.instConf.PoolPrefix == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%d", r.instConf.PoolPrefix, cid)
+}
+
+// launchInstance はチームの VNet に問題の VM をクローンして cloudinit に記録します
+// host は VNet 内の IP アドレスの番号 (複数の VM の問題は host から VM の数だけ使う)
+// vms は問題の VM の一覧 (空の場合は questions.vmid の VM 1 台)、expiresAt はオンデマンドの場合の削除する時刻
+func (r *contestService) launchInstance(cid, tid int, vnet model.VNet, host int, ques model.Question, vms []model.QuestionVM, expiresAt *time.Time) (*model.Cloudinit, error) {
+	multi := len(vms) > 0
+	if !multi {
+		vms = []model.QuestionVM{{VMID: ques.VMID}}
+	}
+	machines := []model.Machine{}
+	// 途中まで作った VM は残さない (残ったものはリコンサイルで削除される)
+	cleanup := func() {
+		for _, created := range machines {
+			if err := r.quesRepo.DeleteVM(created.ClusterID, created.VMID); err != nil {
+				log.Printf("can't delete vm %d: %+v", created.VMID, err)
 			}
-			err = r.mysqlRepo.InsertCloudinit(cloudinit)
-			if err != nil {
-				errors.Wrap(err, "can't InsertCloudinit")
+		}
+	}
+	for j, vm := range vms {
+		m, err := r.cloneMachine(cid, tid, vnet, host+j, ques, vm)
+		if err != nil {
+			cleanup()
+			return nil, errors.Wrapf(err, "can't clone vm %q", vm.Role)
+		}
+		machines = append(machines, *m)
+	}
+	// cloudinit には最初の VM を記録し、チームにはその接続情報を返す
+	primary := machines[0]
+	cloudinit := model.Cloudinit{
+		QuestionID: ques.ID,
+		ContestID:  cid,
+		Filename:   "",
+		TeamID:     tid,
+		VMID:       primary.VMID,
+		ClusterID:  primary.ClusterID,
+		Access:     primary.Access,
+		ExpiresAt:  expiresAt,
+	}
+	if err := r.mysqlRepo.InsertCloudinit(cloudinit); err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "can't InsertCloudinit")
+	}
+	if multi {
+		for j, m := range machines {
+			if err := r.mysqlRepo.InsertCloudinitVM(m, j); err != nil {
+				// 一部の VM だけが記録されたインスタンスを残さない (cloudinit_vms は外部キーで一緒に削除される)
+				if err := r.mysqlRepo.DeleteCloudinit(cloudinit); err != nil {
+					log.Printf("can't delete cloudinit %d-%d-%d: %+v", cid, tid, ques.ID, err)
+				}
+				cleanup()
+				return nil, errors.Wrap(err, "can't insert cloudinit vm")
 			}
 		}
+		cloudinit.Machines = machines
+	}
+	return &cloudinit, nil
+}
+
+// cloneMachine は問題の VM を 1 台クローンしてファイアウォールを設定します
+// role がある場合は VM の名前 (スニペットのファイル名) を contest-team-question-role にする
+func (r *contestService) cloneMachine(cid, tid int, vnet model.VNet, host int, ques model.Question, vm model.QuestionVM) (*model.Machine, error) {
+	password, err := generatePassword(16)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't generate password")
+	}
+	ip, err := VNetHostIP(vnet, host)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't allocate ip")
+	}
+	name := fmt.Sprintf("%d-%d-%d", cid, tid, ques.ID)
+	// 複数の VM の問題はテンプレートごとに種類が違ってよいので pveapi に判断させる
+	backend := ques.Backend
+	if vm.Role != "" {
+		name += "-" + vm.Role
+		backend = ""
+	}
+	m := model.QuesionRequest{
+		ID:        vm.VMID,
+		Name:      name,
+		Password:  password,
+		Bridge:    vnet.Name,
+		IP:        ip,
+		Gateway:   vnet.Gateway,
+		CPUs:      vm.CPUs,
+		Memory:    vm.Memory,
+		Disk:      vm.Disk,
+		Backend:   backend,
+		Cloudinit: vm.Cloudinit,
+
+		ContestID:  cid,
+		TeamID:     tid,
+		QuestionID: ques.ID,
+		CreatedBy:  model.InstanceCreatedBy,
+		Pool:       r.instancePool(cid),
+	}
+	cloned, err := r.quesRepo.CloneQuestion(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get ListQuestions")
+	}
+	vmid, cluster := cloned.Data, cloned.Cluster
+	// 同じチームの VNet と VPN からのみ問題のポートに到達できるようにする
+	sources := []string{vnet.Subnet}
+	if r.vpnEnabled() {
+		sources = append(sources, VPNClientAddress(vnet.Tag))
+	}
+	if err := r.pveRepo.SetFirewall(cluster, vmid, QuestionFirewall(ques.Ports, sources)); err != nil {
+		return nil, errors.Wrap(err, "can't set firewall")
+	}
+	// パスワードは暗号化して保存する
+	// コンテナは cicustom を使わずパスワードが設定されないので、使えない接続情報は発行しない
+	access := ""
+	if cloned.Type != model.GuestLXC {
+		if access, err = r.access.Encrypt(password); err != nil {
+			return nil, errors.Wrap(err, "can't encrypt access")
+		}
+	}
+	return &model.Machine{
+		ContestID:  cid,
+		TeamID:     tid,
+		QuestionID: ques.ID,
+		Role:       vm.Role,
+		VMID:       vmid,
+		ClusterID:  cluster,
+		Access:     access,
+	}, nil
+}
+
+// hostIndexes は問題ごとの VNet 内の IP アドレスの番号の先頭を返します
+// 複数の VM の問題は VM の数だけ番号を使う
+func hostIndexes(questions []model.Question, envs map[int][]model.QuestionVM) []int {
+	hosts := make([]int, len(questions))
+	next := 0
+	for i, q := range questions {
+		hosts[i] = next
+		if n := len(envs[q.ID]); n > 1 {
+			next += n
+		} else {
+			next++
+		}
+	}
+	return hosts
+}
+
+// contestMachines はコンテストの複数の VM の問題の VM をチームと問題ごとにまとめて返します
+func contestMachines(mysqlRepo repository.MysqlRepository, cid int) (map[[2]int][]model.Machine, error) {
+	ms, err := mysqlRepo.SelectCloudinitVMsByContestID(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cloudinit vms")
+	}
+	machines := map[[2]int][]model.Machine{}
+	for _, m := range ms {
+		key := [2]int{m.TeamID, m.QuestionID}
+		machines[key] = append(machines[key], m)
+	}
+	return machines, nil
+}
+
+// instanceMachines は cloudinit のすべての VM を返します
+// 複数の VM の問題でない場合は cloudinit に記録した VM 1 台だけを返す
+func instanceMachines(c model.Cloudinit, machines map[[2]int][]model.Machine) []model.Machine {
+	if ms := machines[[2]int{c.TeamID, c.QuestionID}]; len(ms) > 0 {
+		return ms
+	}
+	return []model.Machine{{ContestID: c.ContestID, TeamID: c.TeamID, QuestionID: c.QuestionID, VMID: c.VMID, ClusterID: c.ClusterID}}
+}
+
+// deleteInstanceVMs は cloudinit の VM を削除します (複数の VM の問題はすべての VM)
+func (r *contestService) deleteInstanceVMs(c model.Cloudinit) error {
+	machines, err := r.mysqlRepo.SelectCloudinitVMs(c.ContestID, c.TeamID, c.QuestionID)
+	if err != nil {
+		return errors.Wrap(err, "can't get cloudinit vms")
+	}
+	for _, m := range machines {
+		if m.VMID == c.VMID && m.ClusterID == c.ClusterID {
+			continue
+		}
+		if err := r.quesRepo.DeleteVM(m.ClusterID, m.VMID); err != nil {
+			return errors.Wrapf(err, "can't delete vm %q", m.Role)
+		}
+	}
+	if c.VMID != 0 {
+		if err := r.quesRepo.DeleteVM(c.ClusterID, c.VMID); err != nil {
+			return errors.Wrap(err, "can't delete vm")
+		}
 	}
 	return nil
 }
@@ -202,7 +442,7 @@ func (r *contestService) StopContest(cid int) error {
 	}
 
 	for _, c := range cloudinit {
-		if err = r.quesRepo.DeleteVM(c.VMID); err != nil {
+		if err = r.deleteInstanceVMs(c); err != nil {
 			// return errors.Wrap(err, "can't get ListQuestions")
 		}
 		cloudinit := model.Cloudinit{
@@ -216,50 +456,42 @@ func (r *contestService) StopContest(cid int) error {
 		}
 	}
 
+	if r.vpnEnabled() {
+		if err := r.mysqlRepo.DeleteVPNPeersByContestID(cid); err != nil {
+			return errors.Wrap(err, "can't delete vpn peers")
+		}
+		if err := r.syncVPNPeers(); err != nil {
+			return errors.Wrap(err, "can't sync vpn peers")
+		}
+	}
+	// VM を消した後にチームの VNet を削除する
+	if err := r.deleteContestVNets(cid); err != nil {
+		return errors.Wrap(err, "can't delete vnets")
+	}
 	return nil
 }
-func (r *contestService) AllDeleteVM() error {
-	// cloudinit, err := r.mysqlRepo.SelectCloudinitByContestID(cid)
-	// if err != nil {
-	// 	return errors.Wrap(err, "can't get Cloudinit")
-	// }
-
-	cluster, err := r.pveRepo.GetClusterResource()
+func (r *contestService) AllDeleteVM(cid int, confirm bool) ([]model.ClusterResources, error) {
+	cluster, err := r.pveRepo.GetClusterResource(cid)
 	if err != nil {
-		return errors.Wrap(err, "can't get cluster resouece")
+		return nil, errors.Wrap(err, "can't get cluster resouece")
 	}
 
-	var pattern = regexp.MustCompile(`^\d+-\d+-\d+$`)
+	// コンテストのタグが付いた VM だけを対象にする
 	filterdcluster := []model.ClusterResources{}
 	for _, c := range cluster {
-		if pattern.MatchString(c.Name) {
+		if c.IsGuest() && c.Template != 1 && c.Instance != nil && c.Instance.ContestID != 0 {
 			filterdcluster = append(filterdcluster, c)
 		}
 	}
-	fmt.Println("フィルタリングされたアイテム:")
+	if !confirm {
+		return filterdcluster, nil
+	}
 	for _, item := range filterdcluster {
-		fmt.Println(item.Name, ":", item.Vmid)
-		if err = r.quesRepo.DeleteVM(item.Vmid); err != nil {
-			return errors.Wrap(err, "can't get ListQuestions")
+		if err = r.quesRepo.DeleteVM(item.Cluster, item.Vmid); err != nil {
+			return nil, errors.Wrapf(err, "can't delete vm %d", item.Vmid)
 		}
 	}
-
-	// for _, c := range cloudinit {
-	// 	if err = r.quesRepo.DeleteVM(c.VMID); err != nil {
-	// 		// return errors.Wrap(err, "can't get ListQuestions")
-	// 	}
-	// 	cloudinit := model.Cloudinit{
-	// 		QuestionID: c.QuestionID,
-	// 		ContestID:  cid,
-	// 		TeamID:     c.TeamID,
-	// 	}
-	// 	err = r.mysqlRepo.DeleteCloudinit(cloudinit)
-	// 	if err != nil {
-	// 		errors.Wrap(err, "can't InsertCloudinit")
-	// 	}
-	// }
-
-	return nil
+	return filterdcluster, nil
 }
 
 func generatePassword(length int) (string, error) {
@@ -323,7 +555,7 @@ func (r *contestService) CheckQuestion(cid int, qid int, tid int, ans string) (b
 	if question == nil {
 		return false, errors.Wrap(err, "can't filter quesion")
 	}
-	if question.Answer == ans {
+	if question.Answer == ans || slices.Contains(question.Flags, ans) {
 		if err := r.mysqlRepo.InsertPoint(tid, qid, cid, question.Point); err != nil {
 			return false, errors.Wrap(err, "can't get Questions")
 		}
@@ -396,21 +628,127 @@ func (s *contestService) GetTeamByUserID(cid int, uid int) ([]model.Team, error)
 	return teams, nil
 }
 
+// GetCloudinit は tid のチームの認証情報を復号して返します
+// tid は呼び出し元のユーザーが所属するチームであること
 func (s *contestService) GetCloudinit(cid, tid, qid int) (*model.Cloudinit, error) {
 	cloudinit, err := s.mysqlRepo.SelectCloudinitByContestIDAndTeamIDAndQuestionID(cid, tid, qid)
 	if err != nil {
 		return nil, errors.Wrap(err, "errors")
 	}
-	ips, err := s.pveRepo.GetIPByVMID(cloudinit.VMID)
+	if cloudinit.TeamID != tid {
+		return nil, errors.Newf("cloudinit is not owned by team %d", tid)
+	}
+	// アイドルのため止めた VM は再開する (再開後は準備を確認し直す)
+	var power *model.PowerState
+	if cloudinit.Suspended {
+		if power, err = s.resumeInstance(cloudinit); err != nil {
+			return nil, errors.Wrap(err, "can't resume vm")
+		}
+		cloudinit.Suspended = false
+		cloudinit.Ready = false
+		cloudinit.Power = power
+	}
+	// 複数の VM の問題はすべての VM の準備が終わるまで接続情報を返さない
+	machines, err := s.mysqlRepo.SelectCloudinitVMs(cid, tid, qid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cloudinit vms")
+	}
+	// 起動・guest agent・cloud-init・IP のすべてを通過するまでは接続情報を返さない
+	if !cloudinit.Ready {
+		readiness, err := s.pveRepo.GetVMStatus(cloudinit.ClusterID, cloudinit.VMID)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't get vm status")
+		}
+		ready := readiness.Ready
+		for i := range machines {
+			m := &machines[i]
+			if m.VMID == cloudinit.VMID && m.ClusterID == cloudinit.ClusterID {
+				m.Readiness = readiness
+				continue
+			}
+			if m.Readiness, err = s.pveRepo.GetVMStatus(m.ClusterID, m.VMID); err != nil {
+				return nil, errors.Wrapf(err, "can't get vm status of %q", m.Role)
+			}
+			ready = ready && m.Readiness.Ready
+		}
+		if !ready {
+			return &model.Cloudinit{
+				QuestionID: cloudinit.QuestionID,
+				ContestID:  cloudinit.ContestID,
+				TeamID:     cloudinit.TeamID,
+				VMID:       cloudinit.VMID,
+				ClusterID:  cloudinit.ClusterID,
+				Readiness:  readiness,
+				Power:      power,
+				ExpiresAt:  cloudinit.ExpiresAt,
+				Extends:    cloudinit.Extends,
+				Machines:   machines,
+			}, nil
+		}
+		if err := s.mysqlRepo.UpdateCloudinitReady(cid, tid, qid); err != nil {
+			return nil, errors.Wrap(err, "can't mark cloudinit ready")
+		}
+		cloudinit.Ready = true
+		cloudinit.Readiness = readiness
+	}
+	// コンテナには接続情報を発行していない
+	if cloudinit.Access != "" {
+		access, err := s.access.Decrypt(cloudinit.Access)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't decrypt access")
+		}
+		cloudinit.Access = access
+	}
+	ips, err := s.pveRepo.GetIPByVMID(cloudinit.ClusterID, cloudinit.VMID)
 	if err != nil {
 		return nil, errors.Wrap(err, "errors")
 	}
 	cloudinit.IPs = *ips
+	for i := range machines {
+		m := &machines[i]
+		if m.VMID == cloudinit.VMID && m.ClusterID == cloudinit.ClusterID {
+			m.IPs = cloudinit.IPs
+			continue
+		}
+		ips, err := s.pveRepo.GetIPByVMID(m.ClusterID, m.VMID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't get ip of %q", m.Role)
+		}
+		m.IPs = *ips
+	}
+	if len(machines) > 0 {
+		cloudinit.Machines = machines
+	}
 	return cloudinit, nil
 }
 
-func (s *contestService) GetClusterResource() ([]model.ClusterResources, error) {
-	cluster, err := s.pveRepo.GetClusterResource()
+// resumeInstance はアイドルのため止めた VM を再開し、cloudinit の suspended_at を消します
+// 複数の VM の問題はすべての VM を再開して、最初の VM の状態を返す
+func (s *contestService) resumeInstance(c *model.Cloudinit) (*model.PowerState, error) {
+	power, err := s.pveRepo.ResumeVM(c.ClusterID, c.VMID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't resume vm")
+	}
+	machines, err := s.mysqlRepo.SelectCloudinitVMs(c.ContestID, c.TeamID, c.QuestionID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cloudinit vms")
+	}
+	for _, m := range machines {
+		if m.VMID == c.VMID && m.ClusterID == c.ClusterID {
+			continue
+		}
+		if _, err := s.pveRepo.ResumeVM(m.ClusterID, m.VMID); err != nil {
+			return nil, errors.Wrapf(err, "can't resume vm %q", m.Role)
+		}
+	}
+	if err := s.mysqlRepo.UpdateCloudinitSuspended(c.ContestID, c.TeamID, c.QuestionID, false); err != nil {
+		return nil, errors.Wrap(err, "can't update cloudinit suspended")
+	}
+	return power, nil
+}
+
+func (s *contestService) GetClusterResource(cid int) ([]model.ClusterResources, error) {
+	cluster, err := s.pveRepo.GetClusterResource(cid)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't get error")
 	}
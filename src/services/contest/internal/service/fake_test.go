@@ -0,0 +1,314 @@
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/contest/repository"
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
+	"github.com/cockroachdb/errors"
+)
+
+// サービスのテストで共通に使う pveapi・question サービス・MySQL の代わりです
+// 使わないメソッドは埋め込んだインターフェースのまま (呼ぶと nil で panic する)
+
+type fakePVE struct {
+	repository.PVEAPIRepository
+	// GetVMStatus が返す状態 (nil の場合は準備が終わっている)
+	readiness   *model.VMReadiness
+	statusCalls int
+	// SuspendIdle で止める VM
+	idle    map[int]bool
+	resumed []int
+	// GetVMMetrics が返すデータ (ない VM は 404)
+	metrics         map[int][]model.RRDData
+	cluster         []model.ClusterResources
+	snippets        []string
+	deletedSnippets []string
+	actors          []string
+	vmids           []int
+	execs           []model.AgentExec
+	agentErr        error
+}
+
+func (f *fakePVE) SetFirewall(cluster string, vmid int, fw model.Firewall) error { return nil }
+func (f *fakePVE) GetVMStatus(cluster string, vmid int) (*model.VMReadiness, error) {
+	f.statusCalls++
+	if f.readiness != nil {
+		return f.readiness, nil
+	}
+	return &model.VMReadiness{Vmid: vmid, Ready: true}, nil
+}
+func (f *fakePVE) GetIPByVMID(cluster string, vmid int) (*model.ResponseIPs, error) {
+	return &model.ResponseIPs{"eth0": {fmt.Sprintf("10.0.100.%d", vmid)}}, nil
+}
+func (f *fakePVE) SuspendIdle(cluster string, vmid int, policy model.IdlePolicy) (*model.PowerState, error) {
+	if !f.idle[vmid] {
+		return &model.PowerState{Vmid: vmid, State: "running"}, nil
+	}
+	return &model.PowerState{Vmid: vmid, State: "hibernated", Idle: true, Changed: true}, nil
+}
+func (f *fakePVE) ResumeVM(cluster string, vmid int) (*model.PowerState, error) {
+	f.resumed = append(f.resumed, vmid)
+	return &model.PowerState{Vmid: vmid, State: "running", Changed: true}, nil
+}
+func (f *fakePVE) GetVMMetrics(cluster string, vmid int, timeframe string) (*model.VMMetrics, error) {
+	data, ok := f.metrics[vmid]
+	if !ok {
+		return nil, errors.New("API Error: status code 404")
+	}
+	return &model.VMMetrics{Cluster: cluster, Node: "pve01", Vmid: vmid, Timeframe: timeframe, Data: data}, nil
+}
+func (f *fakePVE) GetClusterResource(cid int) ([]model.ClusterResources, error) {
+	return f.cluster, nil
+}
+func (f *fakePVE) ListSnippets() ([]string, error) { return f.snippets, nil }
+func (f *fakePVE) DeleteSnippet(filename string) error {
+	f.deletedSnippets = append(f.deletedSnippets, filename)
+	return nil
+}
+func (f *fakePVE) AgentExec(cluster string, vmid int, actor string, exec model.AgentExec) (*model.AgentExecStatus, error) {
+	f.actors = append(f.actors, actor)
+	f.vmids = append(f.vmids, vmid)
+	f.execs = append(f.execs, exec)
+	if f.agentErr != nil {
+		return nil, f.agentErr
+	}
+	return &model.AgentExecStatus{Exited: 1, OutData: "ok"}, nil
+}
+func (f *fakePVE) AgentExecStatus(cluster string, vmid int, actor string, pid int) (*model.AgentExecStatus, error) {
+	f.actors = append(f.actors, actor)
+	f.vmids = append(f.vmids, vmid)
+	return &model.AgentExecStatus{Pid: pid, Exited: 1}, nil
+}
+
+type fakeQuestion struct {
+	repository.QuestionRepository
+	next    int
+	cloned  []model.QuesionRequest
+	deleted []int
+	// cloning はクローンの前に呼ばれる
+	cloning func(conf model.QuesionRequest)
+	// クローンした VM の種類 (空の場合は qemu)
+	guest string
+}
+
+func (f *fakeQuestion) CloneQuestion(conf model.QuesionRequest) (*model.QuesionResponse[int], error) {
+	if f.cloning != nil {
+		f.cloning(conf)
+	}
+	f.next++
+	f.cloned = append(f.cloned, conf)
+	guest := f.guest
+	if guest == "" {
+		guest = "qemu"
+	}
+	return &model.QuesionResponse[int]{Data: f.next, Cluster: "pve-a", Type: guest}, nil
+}
+func (f *fakeQuestion) DeleteVM(cluster string, vmid int) error {
+	f.deleted = append(f.deleted, vmid)
+	return nil
+}
+
+type fakeMysql struct {
+	repository.MysqlRepository
+	rows     []*model.Cloudinit
+	machines []model.Machine
+	// DeleteCloudinit で削除した行
+	deleted      []model.Cloudinit
+	policy       model.OnDemandPolicy
+	idlePolicies []model.IdlePolicy
+	questions    []model.Question
+	envs         map[int][]model.QuestionVM
+	vnets        []model.VNet
+	audits       []model.AgentAudit
+	now          time.Time
+	// InsertCloudinitVM が返すエラー
+	machineErr error
+}
+
+// row は cid・tid・qid の cloudinit の行を返します (ない場合は nil)
+func (f *fakeMysql) row(cid, tid, qid int) *model.Cloudinit {
+	for _, c := range f.rows {
+		if c.ContestID == cid && c.TeamID == tid && c.QuestionID == qid {
+			return c
+		}
+	}
+	return nil
+}
+
+func (f *fakeMysql) SelectCloudinits() ([]model.Cloudinit, error) {
+	cs := []model.Cloudinit{}
+	for _, c := range f.rows {
+		cs = append(cs, *c)
+	}
+	return cs, nil
+}
+func (f *fakeMysql) SelectCloudinitByContestID(cid int) ([]model.Cloudinit, error) {
+	cs := []model.Cloudinit{}
+	for _, c := range f.rows {
+		if c.ContestID == cid {
+			cs = append(cs, *c)
+		}
+	}
+	return cs, nil
+}
+func (f *fakeMysql) SelectCloudinitByContestIDAndTeamID(cid, tid int) ([]model.Cloudinit, error) {
+	cs := []model.Cloudinit{}
+	for _, c := range f.rows {
+		if c.ContestID == cid && c.TeamID == tid {
+			cs = append(cs, *c)
+		}
+	}
+	return cs, nil
+}
+func (f *fakeMysql) SelectCloudinitByContestIDAndTeamIDAndQuestionID(cid, tid, qid int) (*model.Cloudinit, error) {
+	// リポジトリと同じく、ない場合は空の行を返す
+	if c := f.row(cid, tid, qid); c != nil {
+		r := *c
+		return &r, nil
+	}
+	return &model.Cloudinit{}, nil
+}
+func (f *fakeMysql) InsertCloudinit(c model.Cloudinit) error {
+	f.rows = append(f.rows, &c)
+	return nil
+}
+func (f *fakeMysql) DeleteCloudinit(c model.Cloudinit) error {
+	f.deleted = append(f.deleted, c)
+	// cloudinit_vms は外部キーで一緒に削除される
+	ms := []model.Machine{}
+	for _, m := range f.machines {
+		if m.ContestID != c.ContestID || m.TeamID != c.TeamID || m.QuestionID != c.QuestionID {
+			ms = append(ms, m)
+		}
+	}
+	f.machines = ms
+	for i, r := range f.rows {
+		if r.ContestID == c.ContestID && r.TeamID == c.TeamID && r.QuestionID == c.QuestionID {
+			f.rows = append(f.rows[:i], f.rows[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+func (f *fakeMysql) UpdateCloudinitReady(cid, tid, qid int) error {
+	if c := f.row(cid, tid, qid); c != nil {
+		c.Ready = true
+	}
+	return nil
+}
+func (f *fakeMysql) UpdateCloudinitSuspended(cid, tid, qid int, suspended bool) error {
+	if c := f.row(cid, tid, qid); c != nil {
+		c.Suspended = suspended
+		c.Ready = c.Ready && !suspended
+	}
+	return nil
+}
+func (f *fakeMysql) ExtendCloudinit(cid, tid, qid int, expiresAt time.Time, maxExtends int) (bool, error) {
+	c := f.row(cid, tid, qid)
+	if c == nil || c.ExpiresAt == nil || c.Extends >= maxExtends {
+		return false, nil
+	}
+	c.ExpiresAt = &expiresAt
+	c.Extends++
+	return true, nil
+}
+func (f *fakeMysql) SelectExpiredCloudinits() ([]model.Cloudinit, error) {
+	cs := []model.Cloudinit{}
+	for _, c := range f.rows {
+		if c.ExpiresAt != nil && !c.ExpiresAt.After(f.now) {
+			cs = append(cs, *c)
+		}
+	}
+	return cs, nil
+}
+func (f *fakeMysql) SelectLegacyCloudinitAccess(prefix string) ([]model.Cloudinit, error) {
+	cs := []model.Cloudinit{}
+	for _, c := range f.rows {
+		if c.Access != "" && !strings.HasPrefix(c.Access, prefix) {
+			cs = append(cs, *c)
+		}
+	}
+	return cs, nil
+}
+func (f *fakeMysql) UpdateCloudinitAccess(cid, tid, qid int, old, access string) error {
+	if c := f.row(cid, tid, qid); c != nil && c.Access == old {
+		c.Access = access
+	}
+	return nil
+}
+func (f *fakeMysql) InsertCloudinitVM(m model.Machine, position int) error {
+	if f.machineErr != nil {
+		return f.machineErr
+	}
+	f.machines = append(f.machines, m)
+	return nil
+}
+func (f *fakeMysql) SelectCloudinitVMs(cid, tid, qid int) ([]model.Machine, error) {
+	ms := []model.Machine{}
+	for _, m := range f.machines {
+		if m.ContestID == cid && m.TeamID == tid && m.QuestionID == qid {
+			ms = append(ms, m)
+		}
+	}
+	return ms, nil
+}
+func (f *fakeMysql) SelectCloudinitVMsByContestID(cid int) ([]model.Machine, error) {
+	ms := []model.Machine{}
+	for _, m := range f.machines {
+		if m.ContestID == cid {
+			ms = append(ms, m)
+		}
+	}
+	return ms, nil
+}
+func (f *fakeMysql) SelectAllCloudinitVMs() ([]model.Machine, error) {
+	return f.machines, nil
+}
+func (f *fakeMysql) SelectQuestionVMsByContestID(cid int) (map[int][]model.QuestionVM, error) {
+	return f.envs, nil
+}
+func (f *fakeMysql) SelectOnDemandPolicy(cid int) (*model.OnDemandPolicy, error) {
+	p := f.policy
+	return &p, nil
+}
+func (f *fakeMysql) SelectIdlePolicies() ([]model.IdlePolicy, error) { return f.idlePolicies, nil }
+func (f *fakeMysql) SelectContestQuestionsByContestID(cid int) (model.Contest, error) {
+	return model.Contest{ID: cid, Questions: f.questions}, nil
+}
+func (f *fakeMysql) SelectVNetsByContestID(cid int) ([]model.VNet, error) {
+	return f.vnets, nil
+}
+func (f *fakeMysql) InsertAgentAudit(a model.AgentAudit) error {
+	f.audits = append(f.audits, a)
+	return nil
+}
+
+type fakeRoles map[int][]role.Role
+
+func (f fakeRoles) GetRoles(uid int) ([]role.Role, error) { return f[uid], nil }
+
+// testAccess はテスト用の鍵の AccessCipher を返します
+func testAccess(t *testing.T) AccessCipher {
+	t.Helper()
+	access, err := NewAccessCipher(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return access
+}
+
+// encrypt は testAccess の鍵で plain を暗号化します
+func encrypt(t *testing.T, access AccessCipher, plain string) string {
+	t.Helper()
+	enc, err := access.Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+// QuestionFirewall は問題の公開ポートをチームの送信元からのみ許可する設定を作ります
+// ポートの宣言がない問題はチームの送信元からのすべての通信を許可します
+func QuestionFirewall(ports []string, sources []string) model.Firewall {
+	source := strings.Join(sources, ",")
+	fw := model.Firewall{
+		Enable:    true,
+		PolicyIn:  "DROP",
+		PolicyOut: "ACCEPT",
+	}
+	if len(ports) == 0 {
+		fw.Rules = append(fw.Rules, model.FirewallRule{
+			Type:    "in",
+			Action:  "ACCEPT",
+			Source:  source,
+			Comment: "team",
+		})
+		return fw
+	}
+	for _, p := range ports {
+		rule := model.FirewallRule{
+			Type:    "in",
+			Action:  "ACCEPT",
+			Source:  source,
+			Comment: fmt.Sprintf("team %s", p),
+		}
+		if p == "icmp" {
+			rule.Proto = "icmp"
+		} else {
+			// プロトコルの指定がなければ tcp とみなす
+			dport, proto, ok := strings.Cut(p, "/")
+			if !ok {
+				proto = "tcp"
+			}
+			rule.Proto = proto
+			rule.Dport = dport
+		}
+		fw.Rules = append(fw.Rules, rule)
+	}
+	return fw
+}
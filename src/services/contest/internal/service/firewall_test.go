@@ -0,0 +1,25 @@
+package service
+
+import "testing"
+
+func TestQuestionFirewall(t *testing.T) {
+	fw := QuestionFirewall([]string{"22/tcp", "8080", "53/udp", "icmp"}, []string{"10.0.100.0/24", "10.255.0.100/32"})
+	if !fw.Enable || fw.PolicyIn != "DROP" {
+		t.Fatalf("unexpected options: %+v", fw)
+	}
+	want := [][2]string{{"tcp", "22"}, {"tcp", "8080"}, {"udp", "53"}, {"icmp", ""}}
+	if len(fw.Rules) != len(want) {
+		t.Fatalf("unexpected rules: %+v", fw.Rules)
+	}
+	for i, w := range want {
+		r := fw.Rules[i]
+		if r.Proto != w[0] || r.Dport != w[1] || r.Source != "10.0.100.0/24,10.255.0.100/32" || r.Action != "ACCEPT" {
+			t.Errorf("rule %d = %+v, want %v", i, r, w)
+		}
+	}
+
+	all := QuestionFirewall(nil, []string{"10.0.100.0/24"})
+	if len(all.Rules) != 1 || all.Rules[0].Proto != "" || all.Rules[0].Source != "10.0.100.0/24" {
+		t.Errorf("unexpected rules without ports: %+v", all.Rules)
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/contest/repository"
+	"github.com/cockroachdb/errors"
+)
+
+// デフォルトのヘルスチェックのタイムアウト (秒)
+const defaultHealthTimeout = 5
+
+// HealthService は questions.healthcheck の方法でチームの VM の中から問題のサービスを確認します
+// 確認は guest agent で model.AgentSystemUserID として実行し、agent_audits に記録する
+type HealthService interface {
+	// Check はコンテストのヘルスチェックのある問題のインスタンスを確認します
+	Check(cid int) (*model.HealthReport, error)
+	// Run は ctx が終わるまで設定の間隔ですべてのコンテストを Check します
+	Run(ctx context.Context)
+}
+
+type healthService struct {
+	agent     AgentService
+	mysqlRepo repository.MysqlRepository
+	conf      *model.HealthConfig
+	now       func() time.Time
+}
+
+func NewHealthService(agent AgentService, mysqlRepo repository.MysqlRepository, conf *model.HealthConfig) HealthService {
+	return &healthService{
+		agent:     agent,
+		mysqlRepo: mysqlRepo,
+		conf:      conf,
+		now:       time.Now,
+	}
+}
+
+// healthCommand は VM の中で実行する確認のコマンドを返します
+// tcp は bash の /dev/tcp で接続できるか、http は curl で 2xx / 3xx が返るかを確かめる
+func healthCommand(hc model.Healthcheck) ([]string, int, error) {
+	port := strings.SplitN(strings.SplitN(hc.Port, "/", 2)[0], ":", 2)[0]
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, 0, errors.Newf("invalid healthcheck port %q", hc.Port)
+	}
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	t := strconv.Itoa(timeout)
+	switch hc.Type {
+	case "", "tcp":
+		return []string{"timeout", t, "bash", "-c", "exec 3<>/dev/tcp/127.0.0.1/" + port}, timeout, nil
+	case "http":
+		path := hc.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return []string{"curl", "-fsS", "-o", "/dev/null", "--max-time", t, "http://127.0.0.1:" + port + path}, timeout, nil
+	}
+	return nil, 0, errors.Newf("invalid healthcheck type %q", hc.Type)
+}
+
+func (s *healthService) Check(cid int) (*model.HealthReport, error) {
+	contest, err := s.mysqlRepo.SelectContestQuestionsByContestID(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get contest questions")
+	}
+	checks := map[int]model.Healthcheck{}
+	for _, q := range contest.Questions {
+		if q.Healthcheck != nil {
+			checks[q.ID] = *q.Healthcheck
+		}
+	}
+	report := &model.HealthReport{CheckedAt: s.now(), Instances: []model.HealthInstance{}}
+	if len(checks) == 0 {
+		return report, nil
+	}
+	rows, err := s.mysqlRepo.SelectCloudinitByContestID(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cloudinit")
+	}
+	for _, c := range rows {
+		hc, ok := checks[c.QuestionID]
+		// アイドルのため止めた VM は確認しない
+		if !ok || c.Suspended || c.VMID == 0 {
+			continue
+		}
+		inst := model.HealthInstance{ContestID: c.ContestID, TeamID: c.TeamID, QuestionID: c.QuestionID, VMID: c.VMID}
+		command, timeout, err := healthCommand(hc)
+		if err != nil {
+			inst.Error = err.Error()
+			report.Instances = append(report.Instances, inst)
+			continue
+		}
+		// 複数の VM の問題は最初の VM で確認する
+		status, err := s.agent.Exec(model.AgentSystemUserID, c.ContestID, c.TeamID, c.QuestionID, "", model.AgentExec{Command: command, Wait: true, Timeout: timeout + defaultHealthTimeout})
+		switch {
+		case err != nil:
+			inst.Error = err.Error()
+		case status.Exited == 0:
+			inst.Error = "healthcheck did not finish"
+		case status.ExitCode != 0:
+			inst.Error = strings.TrimSpace(fmt.Sprintf("exit code %d: %s", status.ExitCode, status.ErrData))
+		default:
+			inst.Healthy = true
+		}
+		report.Instances = append(report.Instances, inst)
+	}
+	return report, nil
+}
+
+func (s *healthService) Run(ctx context.Context) {
+	if s.conf.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rows, err := s.mysqlRepo.SelectCloudinits()
+			if err != nil {
+				log.Printf("healthcheck error: %+v", err)
+				continue
+			}
+			contests := map[int]bool{}
+			for _, c := range rows {
+				contests[c.ContestID] = true
+			}
+			cids := []int{}
+			for cid := range contests {
+				cids = append(cids, cid)
+			}
+			sort.Ints(cids)
+			for _, cid := range cids {
+				report, err := s.Check(cid)
+				if err != nil {
+					log.Printf("healthcheck error: contest %d: %+v", cid, err)
+					continue
+				}
+				for _, inst := range report.Instances {
+					if !inst.Healthy {
+						log.Printf("healthcheck: contest %d team %d question %d is unhealthy: %s", inst.ContestID, inst.TeamID, inst.QuestionID, inst.Error)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+func TestHealthCheck(t *testing.T) {
+	pve := &fakePVE{}
+	mysql := &fakeMysql{
+		questions: []model.Question{
+			{ID: 3, Healthcheck: &model.Healthcheck{Port: "80/tcp", Type: "http", Path: "health"}},
+			{ID: 4, Healthcheck: &model.Healthcheck{Port: "22/tcp", Timeout: 3}},
+			{ID: 5},
+		},
+		rows: []*model.Cloudinit{
+			{ContestID: 1, TeamID: 1, QuestionID: 3, VMID: 101},
+			{ContestID: 1, TeamID: 1, QuestionID: 4, VMID: 102},
+			{ContestID: 1, TeamID: 1, QuestionID: 5, VMID: 103},
+			// アイドルのため止めた VM は確認しない
+			{ContestID: 1, TeamID: 2, QuestionID: 3, VMID: 104, Suspended: true},
+		},
+	}
+	agent := NewAgentService(pve, mysql, fakeRoles{})
+	s := NewHealthService(agent, mysql, &model.HealthConfig{})
+
+	report, err := s.Check(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Instances) != 2 || !report.Instances[0].Healthy || !report.Instances[1].Healthy {
+		t.Fatalf("instances = %+v", report.Instances)
+	}
+	if got := strings.Join(pve.execs[0].Command, " "); got != "curl -fsS -o /dev/null --max-time 5 http://127.0.0.1:80/health" {
+		t.Errorf("http command = %q", got)
+	}
+	if got := strings.Join(pve.execs[1].Command, " "); got != "timeout 3 bash -c exec 3<>/dev/tcp/127.0.0.1/22" || !pve.execs[1].Wait {
+		t.Errorf("tcp command = %q", got)
+	}
+	// contest サービス自身の操作として記録する
+	if len(mysql.audits) != 2 || mysql.audits[0].UserID != model.AgentSystemUserID || pve.actors[0] != "contest" {
+		t.Errorf("audits = %+v, actors = %v", mysql.audits, pve.actors)
+	}
+}
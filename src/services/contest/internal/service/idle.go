@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/contest/repository"
+	"github.com/cockroachdb/errors"
+)
+
+// IdleService はコンテストごとの条件でアイドル状態の VM を止めます
+// 止めた VM は GetCloudinit で再開する
+type IdleService interface {
+	GetPolicy(cid int) (*model.IdlePolicy, error)
+	// Mode が空の場合は条件を削除する
+	SetPolicy(p model.IdlePolicy) error
+	// Check は条件のあるコンテストの実行中の VM を確認して、アイドルであれば止めます
+	Check() (*model.IdleReport, error)
+	// Run は ctx が終わるまで設定の間隔で Check を実行します
+	Run(ctx context.Context)
+}
+
+type idleService struct {
+	pveRepo   repository.PVEAPIRepository
+	mysqlRepo repository.MysqlRepository
+	conf      *model.IdleConfig
+
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+func NewIdleService(pveRepo repository.PVEAPIRepository, mysqlRepo repository.MysqlRepository, conf *model.IdleConfig) IdleService {
+	return &idleService{
+		pveRepo:   pveRepo,
+		mysqlRepo: mysqlRepo,
+		conf:      conf,
+		now:       time.Now,
+	}
+}
+
+func (s *idleService) GetPolicy(cid int) (*model.IdlePolicy, error) {
+	p, err := s.mysqlRepo.SelectIdlePolicy(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get idle policy")
+	}
+	return p, nil
+}
+
+func (s *idleService) SetPolicy(p model.IdlePolicy) error {
+	switch p.Mode {
+	case "":
+		if err := s.mysqlRepo.DeleteIdlePolicy(p.ContestID); err != nil {
+			return errors.Wrap(err, "can't delete idle policy")
+		}
+		return nil
+	case model.IdleModeSuspend, model.IdleModeHibernate:
+	default:
+		return errors.Newf("invalid idle mode %q", p.Mode)
+	}
+	// pveapi は直近 1 時間の rrddata で判定する
+	if p.IdleMinutes < 1 || p.IdleMinutes > 60 {
+		return errors.Newf("idle_minutes must be between 1 and 60: %d", p.IdleMinutes)
+	}
+	if p.Threshold < 0 {
+		return errors.Newf("threshold must not be negative: %v", p.Threshold)
+	}
+	if err := s.mysqlRepo.UpsertIdlePolicy(p); err != nil {
+		return errors.Wrap(err, "can't set idle policy")
+	}
+	return nil
+}
+
+func (s *idleService) Check() (*model.IdleReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policies, err := s.mysqlRepo.SelectIdlePolicies()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get idle policies")
+	}
+	report := &model.IdleReport{CheckedAt: s.now(), Instances: []model.IdleInstance{}}
+	for _, p := range policies {
+		rows, err := s.mysqlRepo.SelectCloudinitByContestID(p.ContestID)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't get cloudinit")
+		}
+		machines, err := contestMachines(s.mysqlRepo, p.ContestID)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range rows {
+			// 止めてあるものと VM のないものは確認しない
+			if c.Suspended || c.VMID == 0 {
+				continue
+			}
+			report.Instances = append(report.Instances, s.checkInstance(c, instanceMachines(c, machines), p, report)...)
+		}
+	}
+	return report, nil
+}
+
+// checkInstance はインスタンスのすべての VM を確認して、止めたものと失敗したものを返します
+// 1 台でも止めた場合はインスタンスを止めたことにして、GetCloudinit ですべての VM を再開する
+func (s *idleService) checkInstance(c model.Cloudinit, machines []model.Machine, p model.IdlePolicy, report *model.IdleReport) []model.IdleInstance {
+	insts := []model.IdleInstance{}
+	changed := false
+	for _, m := range machines {
+		report.Checked++
+		inst := model.IdleInstance{ContestID: c.ContestID, TeamID: c.TeamID, QuestionID: c.QuestionID, VMID: m.VMID, Role: m.Role}
+		state, err := s.pveRepo.SuspendIdle(m.ClusterID, m.VMID, p)
+		if err != nil {
+			inst.Error = err.Error()
+			insts = append(insts, inst)
+			continue
+		}
+		if !state.Changed {
+			continue
+		}
+		inst.State = state.State
+		insts = append(insts, inst)
+		changed = true
+	}
+	if !changed {
+		return insts
+	}
+	err := s.mysqlRepo.UpdateCloudinitSuspended(c.ContestID, c.TeamID, c.QuestionID, true)
+	for i := range insts {
+		if insts[i].State == "" {
+			continue
+		}
+		if err != nil {
+			insts[i].Error = err.Error()
+		} else {
+			insts[i].Suspended = true
+		}
+	}
+	return insts
+}
+
+func (s *idleService) Run(ctx context.Context) {
+	if s.conf.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.Check()
+			if err != nil {
+				log.Printf("idle check error: %+v", err)
+				continue
+			}
+			if n := len(report.Instances); n > 0 {
+				log.Printf("idle check: %d of %d instances suspended or failed", n, report.Checked)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+func TestIdleCheckAndResume(t *testing.T) {
+	access := testAccess(t)
+	enc := encrypt(t, access, "ctf:password")
+	pve := &fakePVE{idle: map[int]bool{101: true, 102: false, 201: true}}
+	mysql := &fakeMysql{
+		// コンテスト 2 は条件がないので止めない
+		idlePolicies: []model.IdlePolicy{{ContestID: 1, Mode: model.IdleModeHibernate, IdleMinutes: 30}},
+		rows: []*model.Cloudinit{
+			{ContestID: 1, TeamID: 1, QuestionID: 1, VMID: 101, Access: enc, Ready: true},
+			{ContestID: 1, TeamID: 2, QuestionID: 1, VMID: 102, Access: enc, Ready: true},
+			{ContestID: 2, TeamID: 1, QuestionID: 1, VMID: 201, Access: enc, Ready: true},
+		},
+	}
+	idle := NewIdleService(pve, mysql, &model.IdleConfig{})
+	report, err := idle.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 2 || len(report.Instances) != 1 || !report.Instances[0].Suspended || report.Instances[0].VMID != 101 {
+		t.Fatalf("report = %+v", report)
+	}
+	if r := mysql.rows[0]; !r.Suspended || r.Ready {
+		t.Fatalf("suspended row = %+v", r)
+	}
+	// 止めてある VM は確認しない
+	if report, _ := idle.Check(); report.Checked != 1 {
+		t.Errorf("second check = %+v", report)
+	}
+
+	// 接続情報を取得すると再開する
+	s := NewContestService(pve, mysql, nil, nil, access, nil, &model.VPNConfig{}, &model.InstanceConfig{})
+	c, err := s.GetCloudinit(1, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pve.resumed) != 1 || c.Power == nil || !c.Power.Changed || !c.Ready || c.Access != "ctf:password" {
+		t.Fatalf("resumed cloudinit = %+v", c)
+	}
+	if mysql.rows[0].Suspended {
+		t.Error("suspended_at was not cleared")
+	}
+	if _, err := s.GetCloudinit(1, 1, 1); err != nil || len(pve.resumed) != 1 {
+		t.Errorf("running vm was resumed again: %v", err)
+	}
+}
+
+func TestIdleCheckMultiVM(t *testing.T) {
+	access := testAccess(t)
+	pve := &fakePVE{idle: map[int]bool{102: true}}
+	mysql := &fakeMysql{
+		idlePolicies: []model.IdlePolicy{{ContestID: 1, Mode: model.IdleModeSuspend, IdleMinutes: 30}},
+		rows:         []*model.Cloudinit{{ContestID: 1, TeamID: 1, QuestionID: 1, VMID: 101, Access: encrypt(t, access, "ctf:password"), Ready: true}},
+		machines: []model.Machine{
+			{ContestID: 1, TeamID: 1, QuestionID: 1, Role: "attacker", VMID: 101},
+			{ContestID: 1, TeamID: 1, QuestionID: 1, Role: "target", VMID: 102},
+		},
+	}
+	report, err := NewIdleService(pve, mysql, &model.IdleConfig{}).Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 最初の VM 以外もアイドルであれば止める
+	if report.Checked != 2 || len(report.Instances) != 1 || report.Instances[0].VMID != 102 || report.Instances[0].Role != "target" || !report.Instances[0].Suspended {
+		t.Fatalf("report = %+v", report)
+	}
+	if !mysql.rows[0].Suspended {
+		t.Fatal("instance was not marked suspended")
+	}
+
+	// 再開するときはすべての VM を再開する
+	s := NewContestService(pve, mysql, nil, nil, access, nil, &model.VPNConfig{}, &model.InstanceConfig{})
+	if _, err := s.GetCloudinit(1, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(pve.resumed) != 2 || pve.resumed[0] != 101 || pve.resumed[1] != 102 {
+		t.Errorf("resumed = %v", pve.resumed)
+	}
+}
+
+func TestSetIdlePolicyValidation(t *testing.T) {
+	idle := NewIdleService(nil, &fakeMysql{}, &model.IdleConfig{})
+	for _, p := range []model.IdlePolicy{
+		{ContestID: 1, Mode: "shutdown", IdleMinutes: 10},
+		{ContestID: 1, Mode: model.IdleModeSuspend, IdleMinutes: 0},
+		{ContestID: 1, Mode: model.IdleModeSuspend, IdleMinutes: 61},
+		{ContestID: 1, Mode: model.IdleModeSuspend, IdleMinutes: 10, Threshold: -1},
+	} {
+		if err := idle.SetPolicy(p); err == nil {
+			t.Errorf("invalid policy was accepted: %+v", p)
+		}
+	}
+}
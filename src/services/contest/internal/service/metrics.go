@@ -0,0 +1,160 @@
+package service
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/contest/repository"
+	"github.com/cockroachdb/errors"
+)
+
+const (
+	// 閾値の判定に使う直近の点の数 (hour では 1 点が 1 分)
+	recentSamples = 5
+	// pveapi に同時に問い合わせる VM の数
+	metricsConcurrency = 8
+)
+
+// MetricsService はコンテストの VM の使用状況を集計します
+type MetricsService interface {
+	// timeframe は hour / day / week / month / year (空の場合は hour)
+	ContestMetrics(cid int, timeframe string) (*model.ContestMetrics, error)
+}
+
+type metricsService struct {
+	pveRepo    repository.PVEAPIRepository
+	mysqlRepo  repository.MysqlRepository
+	thresholds *model.MetricsThresholds
+}
+
+func NewMetricsService(pveRepo repository.PVEAPIRepository, mysqlRepo repository.MysqlRepository, thresholds *model.MetricsThresholds) MetricsService {
+	return &metricsService{
+		pveRepo:    pveRepo,
+		mysqlRepo:  mysqlRepo,
+		thresholds: thresholds,
+	}
+}
+
+func (s *metricsService) ContestMetrics(cid int, timeframe string) (*model.ContestMetrics, error) {
+	if timeframe == "" {
+		timeframe = model.Timeframes[0]
+	}
+	if !slices.Contains(model.Timeframes, timeframe) {
+		return nil, errors.Newf("invalid timeframe %q", timeframe)
+	}
+	rows, err := s.mysqlRepo.SelectCloudinitByContestID(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cloudinit")
+	}
+	machines, err := contestMachines(s.mysqlRepo, cid)
+	if err != nil {
+		return nil, err
+	}
+	// 複数の VM の問題は VM ごとに集計する
+	vms := []model.Machine{}
+	for _, c := range rows {
+		vms = append(vms, instanceMachines(c, machines)...)
+	}
+
+	res := &model.ContestMetrics{
+		ContestID:  cid,
+		Timeframe:  timeframe,
+		Thresholds: *s.thresholds,
+		Instances:  make([]model.InstanceMetrics, len(vms)),
+	}
+	sem := make(chan struct{}, metricsConcurrency)
+	var wg sync.WaitGroup
+	for i, c := range vms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res.Instances[i] = s.instanceMetrics(c, timeframe)
+		}()
+	}
+	wg.Wait()
+	for _, m := range res.Instances {
+		if len(m.Alerts) > 0 {
+			res.Alerts++
+		}
+	}
+	return res, nil
+}
+
+// instanceMetrics は 1 台の VM の使用状況を集計します
+// 取得できなかった場合もコンテスト全体は返せるように Error に入れる
+func (s *metricsService) instanceMetrics(c model.Machine, timeframe string) model.InstanceMetrics {
+	m := model.InstanceMetrics{
+		TeamID:     c.TeamID,
+		QuestionID: c.QuestionID,
+		VMID:       c.VMID,
+		Role:       c.Role,
+		ClusterID:  c.ClusterID,
+		Alerts:     []model.MetricsAlert{},
+	}
+	vm, err := s.pveRepo.GetVMMetrics(c.ClusterID, c.VMID, timeframe)
+	if err != nil {
+		m.Error = err.Error()
+		return m
+	}
+	m.Node = vm.Node
+	// 停止中などで値のない点は除く
+	data := []model.RRDData{}
+	for _, d := range vm.Data {
+		if d.MaxCPU > 0 {
+			data = append(data, d)
+		}
+	}
+	m.Average = summarize(data)
+	m.Recent = summarize(data[max(len(data)-recentSamples, 0):])
+	m.Alerts = checkThresholds(m.Recent, s.thresholds)
+	return m
+}
+
+// summarize は rrddata の平均を返します
+func summarize(data []model.RRDData) model.MetricsSummary {
+	sum := model.MetricsSummary{}
+	if len(data) == 0 {
+		return sum
+	}
+	for _, d := range data {
+		sum.CPU += d.CPU
+		if d.MaxMem > 0 {
+			sum.Memory += d.Mem / d.MaxMem
+		}
+		sum.NetIn += d.NetIn
+		sum.NetOut += d.NetOut
+		sum.DiskRead += d.DiskRead
+		sum.DiskWrite += d.DiskWrite
+	}
+	n := float64(len(data))
+	return model.MetricsSummary{
+		CPU:       sum.CPU / n,
+		Memory:    sum.Memory / n,
+		NetIn:     sum.NetIn / n,
+		NetOut:    sum.NetOut / n,
+		DiskRead:  sum.DiskRead / n,
+		DiskWrite: sum.DiskWrite / n,
+	}
+}
+
+// checkThresholds は閾値を超えた項目を返します
+func checkThresholds(sum model.MetricsSummary, t *model.MetricsThresholds) []model.MetricsAlert {
+	alerts := []model.MetricsAlert{}
+	for _, c := range []struct {
+		metric           string
+		value, threshold float64
+	}{
+		{"cpu", sum.CPU, t.CPU},
+		{"memory", sum.Memory, t.Memory},
+		{"netout", sum.NetOut, t.NetOut},
+		{"disk_write", sum.DiskWrite, t.DiskWrite},
+	} {
+		if c.threshold > 0 && c.value >= c.threshold {
+			alerts = append(alerts, model.MetricsAlert{Metric: c.metric, Value: c.value, Threshold: c.threshold})
+		}
+	}
+	return alerts
+}
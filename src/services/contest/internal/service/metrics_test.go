@@ -0,0 +1,68 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+func TestContestMetrics(t *testing.T) {
+	busy := []model.RRDData{}
+	// 最初は落ち着いていて、直近の 5 分だけ CPU を使い切っている
+	for i := 0; i < 60; i++ {
+		cpu := 0.05
+		if i >= 55 {
+			cpu = 1
+		}
+		busy = append(busy, model.RRDData{Time: int64(i * 60), CPU: cpu, MaxCPU: 2, Mem: 1, MaxMem: 4})
+	}
+	pve := &fakePVE{metrics: map[int][]model.RRDData{
+		101: busy,
+		102: {
+			{Time: 0, CPU: 0.1, MaxCPU: 2, Mem: 1, MaxMem: 2, NetOut: 100},
+			// 停止中の点は平均に含めない
+			{Time: 60},
+		},
+	}}
+	mysql := &fakeMysql{rows: []*model.Cloudinit{
+		{ContestID: 1, TeamID: 1, QuestionID: 1, VMID: 101},
+		{ContestID: 1, TeamID: 2, QuestionID: 1, VMID: 102, ClusterID: "pve-b"},
+		{ContestID: 1, TeamID: 3, QuestionID: 1, VMID: 103},
+	}}
+	s := NewMetricsService(pve, mysql, &model.MetricsThresholds{CPU: 0.9, Memory: 0.95})
+
+	res, err := s.ContestMetrics(1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Timeframe != "hour" || len(res.Instances) != 3 || res.Alerts != 1 {
+		t.Fatalf("metrics = %+v", res)
+	}
+	busyVM := res.Instances[0]
+	if len(busyVM.Alerts) != 1 || busyVM.Alerts[0].Metric != "cpu" || busyVM.Recent.CPU != 1 || busyVM.Average.CPU >= 0.9 {
+		t.Errorf("busy vm = %+v", busyVM)
+	}
+	idle := res.Instances[1]
+	if len(idle.Alerts) != 0 || idle.Average.CPU != 0.1 || idle.Average.Memory != 0.5 || idle.Average.NetOut != 100 {
+		t.Errorf("idle vm = %+v", idle)
+	}
+	if res.Instances[2].Error == "" {
+		t.Errorf("missing vm = %+v", res.Instances[2])
+	}
+	if _, err := s.ContestMetrics(1, "minute"); err == nil {
+		t.Errorf("invalid timeframe was accepted")
+	}
+
+	// 複数の VM の問題はすべての VM を集計する
+	mysql.machines = []model.Machine{
+		{ContestID: 1, TeamID: 1, QuestionID: 1, Role: "attacker", VMID: 101},
+		{ContestID: 1, TeamID: 1, QuestionID: 1, Role: "target", VMID: 102, ClusterID: "pve-b"},
+	}
+	res, err = s.ContestMetrics(1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Instances) != 4 || res.Instances[1].Role != "target" || res.Instances[1].VMID != 102 || res.Instances[1].Error != "" {
+		t.Errorf("multi vm metrics = %+v", res.Instances)
+	}
+}
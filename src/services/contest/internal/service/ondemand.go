@@ -0,0 +1,216 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/cockroachdb/errors"
+)
+
+func (r *contestService) GetOnDemandPolicy(cid int) (*model.OnDemandPolicy, error) {
+	p, err := r.mysqlRepo.SelectOnDemandPolicy(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get ondemand policy")
+	}
+	return p, nil
+}
+
+func (r *contestService) SetOnDemandPolicy(p model.OnDemandPolicy) error {
+	if p.TTLMinutes == 0 {
+		if err := r.mysqlRepo.DeleteOnDemandPolicy(p.ContestID); err != nil {
+			return errors.Wrap(err, "can't delete ondemand policy")
+		}
+		return nil
+	}
+	if p.TTLMinutes < 0 || p.MaxExtends < 0 || p.TeamQuota < 0 {
+		return errors.Newf("ondemand policy must not be negative: %+v", p)
+	}
+	if err := r.mysqlRepo.UpsertOnDemandPolicy(p); err != nil {
+		return errors.Wrap(err, "can't set ondemand policy")
+	}
+	return nil
+}
+
+// LaunchInstance はチームが要求した問題の VM を作成します
+// 作成済みの場合はそのインスタンスを返す
+func (r *contestService) LaunchInstance(cid, tid, qid int) (*model.Cloudinit, error) {
+	p, err := r.mysqlRepo.SelectOnDemandPolicy(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get ondemand policy")
+	}
+	if p.TTLMinutes == 0 {
+		return nil, errors.Newf("contest %d is not ondemand", cid)
+	}
+	questions, err := r.mysqlRepo.SelectContestQuestionsByContestID(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get questions")
+	}
+	index := -1
+	for i, q := range questions.Questions {
+		if q.ID == qid {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, errors.Newf("question %d is not in contest %d", qid, cid)
+	}
+
+	// 同じチームが同時に要求しても上限を超えないように、チームごとに作成は 1 つずつ行う
+	// (ほかのチームのクローンは待たない)
+	mu := r.teamLock(cid, tid)
+	mu.Lock()
+	defer mu.Unlock()
+
+	instances, err := r.mysqlRepo.SelectCloudinitByContestIDAndTeamID(cid, tid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cloudinit")
+	}
+	for _, c := range instances {
+		if c.QuestionID == qid {
+			return r.GetCloudinit(cid, tid, qid)
+		}
+	}
+	if p.TeamQuota > 0 && len(instances) >= p.TeamQuota {
+		return nil, errors.Wrapf(model.ErrInstanceQuota, "team %d has %d instances", tid, len(instances))
+	}
+
+	envs, err := r.mysqlRepo.SelectQuestionVMsByContestID(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get question vms")
+	}
+	vnets, err := r.mysqlRepo.SelectVNetsByContestID(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get vnets")
+	}
+	vnet, err := r.ensureTeamVNet(cid, tid, vnets)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create team vnet")
+	}
+	if r.vpnEnabled() {
+		if err := r.ensureTeamVPNPeer(cid, tid, vnet); err != nil {
+			return nil, errors.Wrap(err, "can't create vpn peer")
+		}
+		if err := r.syncVPNPeers(); err != nil {
+			return nil, errors.Wrap(err, "can't sync vpn peers")
+		}
+	}
+	expiresAt := time.Now().Add(time.Duration(p.TTLMinutes) * time.Minute)
+	hosts := hostIndexes(questions.Questions, envs)
+	if _, err := r.launchInstance(cid, tid, vnet, hosts[index], questions.Questions[index], envs[qid], &expiresAt); err != nil {
+		return nil, errors.Wrap(err, "can't launch instance")
+	}
+	return r.GetCloudinit(cid, tid, qid)
+}
+
+// teamLock はコンテストのチームのインスタンスを作成するときのロックを返します
+func (r *contestService) teamLock(cid, tid int) *sync.Mutex {
+	r.launchMu.Lock()
+	defer r.launchMu.Unlock()
+	key := fmt.Sprintf("%d-%d", cid, tid)
+	mu, ok := r.teamLocks[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		r.teamLocks[key] = mu
+	}
+	return mu
+}
+
+// ExtendInstance はインスタンスの期限を今から TTL だけ延長します
+func (r *contestService) ExtendInstance(cid, tid, qid int) (*model.Cloudinit, error) {
+	p, err := r.mysqlRepo.SelectOnDemandPolicy(cid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get ondemand policy")
+	}
+	if p.TTLMinutes == 0 {
+		return nil, errors.Newf("contest %d is not ondemand", cid)
+	}
+	expiresAt := time.Now().Add(time.Duration(p.TTLMinutes) * time.Minute)
+	ok, err := r.mysqlRepo.ExtendCloudinit(cid, tid, qid, expiresAt, p.MaxExtends)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't extend cloudinit")
+	}
+	if !ok {
+		return nil, errors.Wrapf(model.ErrInstanceExtend, "max extends is %d", p.MaxExtends)
+	}
+	return r.GetCloudinit(cid, tid, qid)
+}
+
+// DestroyInstance はチームのインスタンスを期限より前に削除します
+// 作り直せるのはオンデマンドのコンテストだけなので、事前に作成した VM は消させない
+func (r *contestService) DestroyInstance(cid, tid, qid int) error {
+	p, err := r.mysqlRepo.SelectOnDemandPolicy(cid)
+	if err != nil {
+		return errors.Wrap(err, "can't get ondemand policy")
+	}
+	if p.TTLMinutes == 0 {
+		return errors.Newf("contest %d is not ondemand", cid)
+	}
+	c, err := r.mysqlRepo.SelectCloudinitByContestIDAndTeamIDAndQuestionID(cid, tid, qid)
+	if err != nil {
+		return errors.Wrap(err, "can't get cloudinit")
+	}
+	if c.TeamID != tid {
+		return errors.Newf("cloudinit is not owned by team %d", tid)
+	}
+	if c.ExpiresAt == nil {
+		return errors.Newf("instance %d-%d-%d was not launched on demand", cid, tid, qid)
+	}
+	return r.destroyInstance(*c)
+}
+
+func (r *contestService) destroyInstance(c model.Cloudinit) error {
+	if err := r.deleteInstanceVMs(c); err != nil {
+		return errors.Wrap(err, "can't delete vms")
+	}
+	if err := r.mysqlRepo.DeleteCloudinit(c); err != nil {
+		return errors.Wrap(err, "can't delete cloudinit")
+	}
+	return nil
+}
+
+// ExpireInstances は期限の切れたインスタンスを削除して、削除した数を返します
+func (r *contestService) ExpireInstances() (int, error) {
+	expired, err := r.mysqlRepo.SelectExpiredCloudinits()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get expired cloudinit")
+	}
+	n := 0
+	var errs error
+	for _, c := range expired {
+		if err := r.destroyInstance(c); err != nil {
+			// 失敗したものは次の確認で削除し直す
+			errs = errors.CombineErrors(errs, errors.Wrapf(err, "instance %d-%d-%d", c.ContestID, c.TeamID, c.QuestionID))
+			continue
+		}
+		n++
+	}
+	return n, errs
+}
+
+// RunExpiry は ctx が終わるまで設定の間隔で ExpireInstances を実行します
+func (r *contestService) RunExpiry(ctx context.Context) {
+	if r.instConf.ExpiryInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.instConf.ExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := r.ExpireInstances()
+			if err != nil {
+				log.Printf("instance expiry error: %+v", err)
+			}
+			if n > 0 {
+				log.Printf("instance expiry: %d instances deleted", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+func TestOnDemandInstances(t *testing.T) {
+	access := testAccess(t)
+	mysql := &fakeMysql{
+		policy:    model.OnDemandPolicy{ContestID: 1, TTLMinutes: 30, MaxExtends: 1, TeamQuota: 1},
+		questions: []model.Question{{ID: 3, VMID: 9000}, {ID: 4, VMID: 9001}},
+		vnets:     []model.VNet{NewTeamVNet(1, 2, 100)},
+		now:       time.Now(),
+	}
+	ques := &fakeQuestion{next: 100}
+	s := NewContestService(&fakePVE{}, mysql, nil, ques, access, nil, &model.VPNConfig{}, &model.InstanceConfig{})
+
+	c, err := s.LaunchInstance(1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.VMID != 101 || c.ExpiresAt == nil || c.Access == "" {
+		t.Fatalf("unexpected instance: %+v", c)
+	}
+	// 作成済みの問題はもう一度クローンしない
+	if c, err = s.LaunchInstance(1, 2, 3); err != nil || c.VMID != 101 {
+		t.Fatalf("relaunch: %+v %v", c, err)
+	}
+	// チームの上限を超える場合は作らない
+	if _, err := s.LaunchInstance(1, 2, 4); !errors.Is(err, model.ErrInstanceQuota) {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+
+	if c, err = s.ExtendInstance(1, 2, 3); err != nil || c.Extends != 1 {
+		t.Fatalf("extend: %+v %v", c, err)
+	}
+	if _, err := s.ExtendInstance(1, 2, 3); !errors.Is(err, model.ErrInstanceExtend) {
+		t.Fatalf("expected extend error, got %v", err)
+	}
+
+	// 期限を過ぎたインスタンスは VM と cloudinit を削除する
+	mysql.now = time.Now().Add(time.Hour)
+	n, err := s.ExpireInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(mysql.rows) != 0 || len(ques.deleted) != 1 || ques.deleted[0] != 101 {
+		t.Fatalf("expire: n=%d rows=%d deleted=%v", n, len(mysql.rows), ques.deleted)
+	}
+	// 削除した後は上限の枠が空く
+	if c, err = s.LaunchInstance(1, 2, 4); err != nil || c.VMID != 102 {
+		t.Fatalf("launch after expiry: %+v %v", c, err)
+	}
+}
+
+func TestLaunchLXCInstanceWithoutAccess(t *testing.T) {
+	mysql := &fakeMysql{
+		policy:    model.OnDemandPolicy{ContestID: 1, TTLMinutes: 30},
+		questions: []model.Question{{ID: 3, VMID: 9000, Backend: model.GuestLXC}},
+		vnets:     []model.VNet{NewTeamVNet(1, 2, 100)},
+	}
+	ques := &fakeQuestion{next: 100, guest: model.GuestLXC}
+	s := NewContestService(&fakePVE{}, mysql, nil, ques, testAccess(t), nil, &model.VPNConfig{}, &model.InstanceConfig{})
+
+	// コンテナにはパスワードが設定されないので接続情報を発行しない
+	c, err := s.LaunchInstance(1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Access != "" || mysql.rows[0].Access != "" {
+		t.Fatalf("access issued for container: %+v", c)
+	}
+	if c, err = s.GetCloudinit(1, 2, 3); err != nil || c.Access != "" {
+		t.Fatalf("GetCloudinit() = %+v, %v", c, err)
+	}
+}
+
+func TestLaunchInstanceNotOnDemand(t *testing.T) {
+	mysql := &fakeMysql{questions: []model.Question{{ID: 3}}}
+	s := NewContestService(&fakePVE{}, mysql, nil, &fakeQuestion{}, nil, nil, &model.VPNConfig{}, &model.InstanceConfig{})
+	if _, err := s.LaunchInstance(1, 2, 3); err == nil {
+		t.Fatal("expected error for contest without ondemand policy")
+	}
+}
+
+func TestDestroyInstanceNotOnDemand(t *testing.T) {
+	row := &model.Cloudinit{ContestID: 1, TeamID: 2, QuestionID: 3, VMID: 101}
+	mysql := &fakeMysql{rows: []*model.Cloudinit{row}}
+	ques := &fakeQuestion{}
+	s := NewContestService(&fakePVE{}, mysql, nil, ques, nil, nil, &model.VPNConfig{}, &model.InstanceConfig{})
+
+	// 事前に作成した VM は作り直せないので削除しない
+	if err := s.DestroyInstance(1, 2, 3); err == nil {
+		t.Fatal("expected error for contest without ondemand policy")
+	}
+	mysql.policy = model.OnDemandPolicy{ContestID: 1, TTLMinutes: 30}
+	if err := s.DestroyInstance(1, 2, 3); err == nil {
+		t.Fatal("expected error for instance without expiry")
+	}
+	if len(mysql.rows) != 1 || len(ques.deleted) != 0 {
+		t.Fatalf("destroyed: rows=%d deleted=%v", len(mysql.rows), ques.deleted)
+	}
+}
+
+func TestLaunchMultiVMInstance(t *testing.T) {
+	access := testAccess(t)
+	mysql := &fakeMysql{
+		policy:    model.OnDemandPolicy{ContestID: 1, TTLMinutes: 30},
+		questions: []model.Question{{ID: 3, VMID: 9000}, {ID: 4, VMID: 9001}},
+		envs: map[int][]model.QuestionVM{3: {
+			{Role: "attacker", VMID: 9100, CPUs: 2},
+			{Role: "target", VMID: 9101, Cloudinit: []byte(`{"packages":["nginx"]}`)},
+		}},
+		vnets: []model.VNet{NewTeamVNet(1, 2, 100)},
+	}
+	ques := &fakeQuestion{next: 100}
+	s := NewContestService(&fakePVE{}, mysql, nil, ques, access, nil, &model.VPNConfig{}, &model.InstanceConfig{})
+
+	c, err := s.LaunchInstance(1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ques.cloned) != 2 || ques.cloned[0].Name != "1-2-3-attacker" || ques.cloned[1].Name != "1-2-3-target" ||
+		ques.cloned[0].CPUs != 2 || string(ques.cloned[1].Cloudinit) != `{"packages":["nginx"]}` {
+		t.Fatalf("cloned = %+v", ques.cloned)
+	}
+	if ques.cloned[0].IP != "10.0.100.10/24" || ques.cloned[1].IP != "10.0.100.11/24" {
+		t.Fatalf("ips = %s %s", ques.cloned[0].IP, ques.cloned[1].IP)
+	}
+	// 接続情報は最初の VM のもので、すべての VM の IP を返す
+	if c.VMID != 101 || c.Access == "" || len(c.Machines) != 2 || c.Machines[1].Role != "target" || c.Machines[1].IPs["eth0"][0] != "10.0.100.102" {
+		t.Fatalf("unexpected instance: %+v", c)
+	}
+	// 次の問題は前の問題の VM の数だけ後ろのアドレスを使う
+	if _, err := s.LaunchInstance(1, 2, 4); err != nil {
+		t.Fatal(err)
+	}
+	if ques.cloned[2].Name != "1-2-4" || ques.cloned[2].IP != "10.0.100.12/24" {
+		t.Fatalf("single vm = %+v", ques.cloned[2])
+	}
+
+	if err := s.DestroyInstance(1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(ques.deleted) != 2 || len(mysql.machines) != 0 {
+		t.Fatalf("destroy: deleted=%v machines=%+v", ques.deleted, mysql.machines)
+	}
+}
+
+func TestLaunchMultiVMInstanceRollback(t *testing.T) {
+	mysql := &fakeMysql{
+		policy:     model.OnDemandPolicy{ContestID: 1, TTLMinutes: 30},
+		questions:  []model.Question{{ID: 3, VMID: 9000}},
+		envs:       map[int][]model.QuestionVM{3: {{Role: "attacker", VMID: 9100}, {Role: "target", VMID: 9101}}},
+		vnets:      []model.VNet{NewTeamVNet(1, 2, 100)},
+		machineErr: errors.New("duplicate entry"),
+	}
+	ques := &fakeQuestion{next: 100}
+	s := NewContestService(&fakePVE{}, mysql, nil, ques, testAccess(t), nil, &model.VPNConfig{}, &model.InstanceConfig{})
+
+	if _, err := s.LaunchInstance(1, 2, 3); err == nil {
+		t.Fatal("expected error when cloudinit_vms can't be inserted")
+	}
+	// cloudinit の行と VM を残さない
+	if len(mysql.rows) != 0 || len(ques.deleted) != 2 {
+		t.Fatalf("rows=%+v deleted=%v", mysql.rows, ques.deleted)
+	}
+}
+
+func TestLaunchInstanceTeamsInParallel(t *testing.T) {
+	mysql := &fakeMysql{
+		policy:    model.OnDemandPolicy{ContestID: 1, TTLMinutes: 30},
+		questions: []model.Question{{ID: 3, VMID: 9000}},
+		vnets:     []model.VNet{NewTeamVNet(1, 2, 100), NewTeamVNet(1, 3, 101)},
+	}
+	ques := &fakeQuestion{next: 100}
+	s := NewContestService(&fakePVE{}, mysql, nil, ques, testAccess(t), nil, &model.VPNConfig{}, &model.InstanceConfig{})
+
+	// チーム 2 のクローン中でもチーム 3 のインスタンスは作成できる
+	var inner error
+	ques.cloning = func(conf model.QuesionRequest) {
+		if conf.Name != "1-2-3" {
+			return
+		}
+		done := make(chan error)
+		go func() {
+			_, err := s.LaunchInstance(1, 3, 3)
+			done <- err
+		}()
+		select {
+		case inner = <-done:
+		case <-time.After(5 * time.Second):
+			inner = errors.New("team 3 waited for team 2")
+		}
+	}
+	if _, err := s.LaunchInstance(1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if inner != nil {
+		t.Fatal(inner)
+	}
+	if len(mysql.rows) != 2 {
+		t.Fatalf("rows = %+v", mysql.rows)
+	}
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+func TestGetCloudinitReadiness(t *testing.T) {
+	access := testAccess(t)
+	enc := encrypt(t, access, "ctf:password")
+	pve := &fakePVE{readiness: &model.VMReadiness{
+		Vmid: 101,
+		Stages: []model.ReadinessStage{
+			{Name: "running", Passed: true},
+			{Name: "agent", Passed: false, Message: "QEMU guest agent is not running"},
+		},
+	}}
+	mysql := &fakeMysql{rows: []*model.Cloudinit{{ContestID: 1, TeamID: 2, QuestionID: 3, VMID: 101, Access: enc}}}
+	s := NewContestService(pve, mysql, nil, nil, access, nil, &model.VPNConfig{}, &model.InstanceConfig{})
+
+	// 準備が終わるまでは接続情報を返さない
+	c, err := s.GetCloudinit(1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Ready || c.Access != "" || c.IPs != nil || c.Readiness == nil {
+		t.Fatalf("unexpected cloudinit before ready: %+v", c)
+	}
+
+	pve.readiness = &model.VMReadiness{Vmid: 101, Ready: true}
+	c, err = s.GetCloudinit(1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Ready || c.Access != "ctf:password" || len(c.IPs["eth0"]) != 1 {
+		t.Fatalf("unexpected cloudinit after ready: %+v", c)
+	}
+	if !mysql.rows[0].Ready {
+		t.Error("ready_at was not recorded")
+	}
+
+	// 一度準備が終わったら pveapi に問い合わせない
+	calls := pve.statusCalls
+	if _, err := s.GetCloudinit(1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if pve.statusCalls != calls {
+		t.Errorf("GetVMStatus was called after ready")
+	}
+}
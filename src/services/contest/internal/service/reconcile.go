@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/LainInTheWired/ctf_backend/contest/repository"
+	"github.com/cockroachdb/errors"
+)
+
+// StartContest が VM と同じ名前 (contest-team-question、複数の VM の問題は -role が付く) で作る
+// user-data と network などのスニペット
+var contestSnippetPattern = regexp.MustCompile(`^(\d+-\d+-\d+)((?:-[a-z][a-z0-9]*)??)(?:-(?:network|meta|vendor))?\.yaml$`)
+
+// Reconciler は Proxmox の VM とスニペットを cloudinit テーブルと突き合わせます
+type Reconciler interface {
+	// dryRun の場合は不整合を報告するだけで削除しない
+	// confirm の場合は猶予を待たずに削除する
+	Reconcile(dryRun, confirm bool) (*model.ReconcileReport, error)
+	// Run は ctx が終わるまで設定の間隔で Reconcile を実行します
+	Run(ctx context.Context)
+}
+
+type reconciler struct {
+	pveRepo   repository.PVEAPIRepository
+	mysqlRepo repository.MysqlRepository
+	quesRepo  repository.QuestionRepository
+	conf      *model.ReconcileConfig
+
+	mu sync.Mutex
+	// 不整合を最初に見つけた時刻 (プロセス内のみ保持し、再起動すると猶予は最初から数え直す)
+	firstSeen map[string]time.Time
+	now       func() time.Time
+}
+
+func NewReconciler(pveRepo repository.PVEAPIRepository, mysqlRepo repository.MysqlRepository, quesRepo repository.QuestionRepository, conf *model.ReconcileConfig) Reconciler {
+	return &reconciler{
+		pveRepo:   pveRepo,
+		mysqlRepo: mysqlRepo,
+		quesRepo:  quesRepo,
+		conf:      conf,
+		firstSeen: map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+func cloudinitKey(c model.Cloudinit) string {
+	return fmt.Sprintf("%d-%d-%d", c.ContestID, c.TeamID, c.QuestionID)
+}
+
+// vmKey はクラスタと VMID の組です (VMID はクラスタごとに振られるため)
+// クラスタが空の行はクラスタを記録する前に作ったもので、どのクラスタの VM とも突き合わせる
+func vmKey(cluster string, vmid int) string {
+	return fmt.Sprintf("%s/%d", cluster, vmid)
+}
+
+func (r *reconciler) Reconcile(dryRun, confirm bool) (*model.ReconcileReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cluster, err := r.pveRepo.GetClusterResource(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cluster resource")
+	}
+	rows, err := r.mysqlRepo.SelectCloudinits()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cloudinit")
+	}
+	machines, err := r.mysqlRepo.SelectAllCloudinitVMs()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cloudinit vms")
+	}
+	snippets, err := r.pveRepo.ListSnippets()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list snippets")
+	}
+
+	now := r.now()
+	report := &model.ReconcileReport{
+		DryRun:        dryRun,
+		Confirm:       confirm,
+		CheckedAt:     now,
+		OrphanVMs:     []model.OrphanVM{},
+		MissingVMs:    []model.MissingVM{},
+		StaleSnippets: []model.StaleSnippet{},
+	}
+	// 今回見つかった不整合だけを残し、解消したものは猶予を数え直す
+	seen := map[string]time.Time{}
+	mark := func(key string) time.Time {
+		t, ok := r.firstSeen[key]
+		if !ok {
+			t = now
+		}
+		seen[key] = t
+		return t
+	}
+	// 猶予を過ぎたもの (confirm の場合はすべて) を削除する
+	shouldDelete := func(firstSeen time.Time) bool {
+		return !dryRun && (confirm || now.Sub(firstSeen) >= r.conf.Grace)
+	}
+
+	rowKeys := map[string]bool{}
+	rowsByVM := map[string]model.Cloudinit{}
+	for _, c := range rows {
+		rowKeys[cloudinitKey(c)] = true
+		rowsByVM[vmKey(c.ClusterID, c.VMID)] = c
+	}
+	// 複数の VM の問題の VM は同じ cloudinit の行のものとして扱う
+	for _, m := range machines {
+		rowsByVM[vmKey(m.ClusterID, m.VMID)] = model.Cloudinit{ContestID: m.ContestID, TeamID: m.TeamID, QuestionID: m.QuestionID, VMID: m.VMID, ClusterID: m.ClusterID}
+	}
+
+	vmKeys := map[string]bool{}
+	vms := map[string]bool{}
+	for _, c := range cluster {
+		if !c.IsGuest() {
+			continue
+		}
+		vms[vmKey(c.Cluster, c.Vmid)] = true
+		vms[vmKey("", c.Vmid)] = true
+		// このサービスがタグを付けて作成した VM だけを対象にする (名前だけでは判断しない)
+		if c.Template == 1 || c.Instance == nil || c.Instance.CreatedBy != model.InstanceCreatedBy {
+			continue
+		}
+		vmKeys[c.Instance.Key()] = true
+		row, ok := rowsByVM[vmKey(c.Cluster, c.Vmid)]
+		if !ok {
+			row, ok = rowsByVM[vmKey("", c.Vmid)]
+		}
+		if ok && cloudinitKey(row) == c.Instance.Key() {
+			continue
+		}
+		key := "vm/" + vmKey(c.Cluster, c.Vmid)
+		orphan := model.OrphanVM{Vmid: c.Vmid, Cluster: c.Cluster, Name: c.Name, Node: c.Node, FirstSeen: mark(key)}
+		if shouldDelete(orphan.FirstSeen) {
+			if err := r.quesRepo.DeleteVM(c.Cluster, c.Vmid); err != nil {
+				orphan.Error = err.Error()
+			} else {
+				orphan.Deleted = true
+				delete(seen, key)
+			}
+		}
+		report.OrphanVMs = append(report.OrphanVMs, orphan)
+	}
+
+	for _, c := range rows {
+		if vms[vmKey(c.ClusterID, c.VMID)] {
+			continue
+		}
+		key := "row/" + cloudinitKey(c)
+		missing := model.MissingVM{Cloudinit: c, FirstSeen: mark(key)}
+		if shouldDelete(missing.FirstSeen) {
+			if err := r.mysqlRepo.DeleteCloudinit(c); err != nil {
+				missing.Error = err.Error()
+			} else {
+				missing.Deleted = true
+				delete(seen, key)
+			}
+		}
+		report.MissingVMs = append(report.MissingVMs, missing)
+	}
+
+	stale := map[string]bool{}
+	for _, name := range snippets {
+		m := contestSnippetPattern.FindStringSubmatch(name)
+		if m == nil || rowKeys[m[1]] || vmKeys[m[1]] || stale[m[1]+m[2]] {
+			continue
+		}
+		stale[m[1]+m[2]] = true
+		key := "snippet/" + m[1] + m[2]
+		snippet := model.StaleSnippet{Filename: m[1] + m[2] + ".yaml", FirstSeen: mark(key)}
+		if shouldDelete(snippet.FirstSeen) {
+			// network などのスニペットも一緒に削除される
+			if err := r.pveRepo.DeleteSnippet(snippet.Filename); err != nil {
+				snippet.Error = err.Error()
+			} else {
+				snippet.Deleted = true
+				delete(seen, key)
+			}
+		}
+		report.StaleSnippets = append(report.StaleSnippets, snippet)
+	}
+
+	r.firstSeen = seen
+	return report, nil
+}
+
+func (r *reconciler) Run(ctx context.Context) {
+	if r.conf.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := r.Reconcile(false, false)
+			if err != nil {
+				log.Printf("reconcile error: %+v", err)
+				continue
+			}
+			if n := len(report.OrphanVMs) + len(report.MissingVMs) + len(report.StaleSnippets); n > 0 {
+				log.Printf("reconcile: %d orphan vms, %d missing vms, %d stale snippets", len(report.OrphanVMs), len(report.MissingVMs), len(report.StaleSnippets))
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+func instance(cid, tid, qid int) *model.InstanceTags {
+	return &model.InstanceTags{ContestID: cid, TeamID: tid, QuestionID: qid, CreatedBy: model.InstanceCreatedBy}
+}
+
+func TestReconcile(t *testing.T) {
+	pve := &fakePVE{
+		cluster: []model.ClusterResources{
+			{Type: "qemu", Vmid: 101, Name: "1-1-1", Instance: instance(1, 1, 1)},
+			{Type: "qemu", Vmid: 102, Name: "1-2-1", Instance: instance(1, 2, 1)},
+			{Type: "qemu", Vmid: 9000, Name: "1-9-9", Template: 1, Instance: instance(1, 9, 9)},
+			// タグのない VM は名前が一致しても対象にしない
+			{Type: "qemu", Vmid: 103, Name: "1-3-1"},
+			{Type: "qemu", Vmid: 200, Name: "web"},
+			{Type: "storage", Name: "local"},
+		},
+		snippets: []string{"1-1-1.yaml", "1-1-1-network.yaml", "2-1-1.yaml", "2-1-1-network.yaml", "1-2-1.yaml", "base.yaml"},
+	}
+	mysql := &fakeMysql{rows: []*model.Cloudinit{
+		{ContestID: 1, TeamID: 1, QuestionID: 1, VMID: 101},
+		{ContestID: 1, TeamID: 4, QuestionID: 1, VMID: 104},
+	}}
+	ques := &fakeQuestion{}
+	now := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	rec := NewReconciler(pve, mysql, ques, &model.ReconcileConfig{Grace: 30 * time.Minute}).(*reconciler)
+	rec.now = func() time.Time { return now }
+
+	report, err := rec.Reconcile(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanVMs) != 1 || report.OrphanVMs[0].Vmid != 102 {
+		t.Errorf("unexpected orphan vms: %+v", report.OrphanVMs)
+	}
+	if len(report.MissingVMs) != 1 || report.MissingVMs[0].Cloudinit.VMID != 104 {
+		t.Errorf("unexpected missing vms: %+v", report.MissingVMs)
+	}
+	if len(report.StaleSnippets) != 1 || report.StaleSnippets[0].Filename != "2-1-1.yaml" {
+		t.Errorf("unexpected stale snippets: %+v", report.StaleSnippets)
+	}
+
+	// 猶予の間は dry_run でなくても削除しない
+	now = now.Add(10 * time.Minute)
+	if _, err := rec.Reconcile(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(ques.deleted)+len(mysql.deleted)+len(pve.deletedSnippets) != 0 {
+		t.Fatalf("deleted before grace: %v %v %v", ques.deleted, mysql.deleted, pve.deletedSnippets)
+	}
+
+	now = now.Add(30 * time.Minute)
+	report, err = rec.Reconcile(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ques.deleted) != 1 || ques.deleted[0] != 102 || !report.OrphanVMs[0].Deleted {
+		t.Errorf("orphan vm not deleted: %v", ques.deleted)
+	}
+	if len(mysql.deleted) != 1 || mysql.deleted[0].VMID != 104 {
+		t.Errorf("cloudinit row not deleted: %v", mysql.deleted)
+	}
+	if len(pve.deletedSnippets) != 1 || pve.deletedSnippets[0] != "2-1-1.yaml" {
+		t.Errorf("snippet not deleted: %v", pve.deletedSnippets)
+	}
+}
+
+func TestReconcileConfirm(t *testing.T) {
+	pve := &fakePVE{cluster: []model.ClusterResources{{Type: "qemu", Vmid: 102, Name: "1-2-1", Instance: instance(1, 2, 1)}}}
+	ques := &fakeQuestion{}
+	rec := NewReconciler(pve, &fakeMysql{}, ques, &model.ReconcileConfig{Grace: time.Hour})
+
+	if _, err := rec.Reconcile(true, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ques.deleted) != 0 {
+		t.Fatalf("dry run deleted vms: %v", ques.deleted)
+	}
+	if _, err := rec.Reconcile(false, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ques.deleted) != 1 || ques.deleted[0] != 102 {
+		t.Errorf("confirm did not delete: %v", ques.deleted)
+	}
+}
+
+func TestReconcileClusters(t *testing.T) {
+	// VMID はクラスタごとに振られるので、同じ VMID でも別のクラスタの VM は突き合わせない
+	pve := &fakePVE{cluster: []model.ClusterResources{
+		{Type: "qemu", Vmid: 101, Cluster: "pve-a", Name: "1-1-1", Instance: instance(1, 1, 1)},
+		{Type: "qemu", Vmid: 101, Cluster: "pve-b", Name: "1-2-1", Instance: instance(1, 2, 1)},
+		{Type: "qemu", Vmid: 102, Cluster: "pve-b", Name: "1-3-1", Instance: instance(1, 3, 1)},
+	}}
+	mysql := &fakeMysql{rows: []*model.Cloudinit{
+		{ContestID: 1, TeamID: 1, QuestionID: 1, VMID: 101, ClusterID: "pve-a"},
+		// クラスタを記録する前の行はどのクラスタの VM とも突き合わせる
+		{ContestID: 1, TeamID: 3, QuestionID: 1, VMID: 102},
+		{ContestID: 1, TeamID: 4, QuestionID: 1, VMID: 102, ClusterID: "pve-a"},
+	}}
+	r := NewReconciler(pve, mysql, &fakeQuestion{}, &model.ReconcileConfig{Grace: time.Hour})
+	report, err := r.Reconcile(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanVMs) != 1 || report.OrphanVMs[0].Cluster != "pve-b" || report.OrphanVMs[0].Vmid != 101 {
+		t.Errorf("orphan vms = %+v", report.OrphanVMs)
+	}
+	if len(report.MissingVMs) != 1 || report.MissingVMs[0].Cloudinit.TeamID != 4 {
+		t.Errorf("missing vms = %+v", report.MissingVMs)
+	}
+}
+
+func TestReconcileMachines(t *testing.T) {
+	// 複数の VM の問題の VM とスニペットは cloudinit の行のものとして扱う
+	pve := &fakePVE{
+		cluster: []model.ClusterResources{
+			{Type: "qemu", Vmid: 101, Name: "1-1-1-attacker", Instance: instance(1, 1, 1)},
+			{Type: "qemu", Vmid: 102, Name: "1-1-1-target", Instance: instance(1, 1, 1)},
+		},
+		snippets: []string{"1-1-1-attacker.yaml", "1-1-1-target-network.yaml", "1-2-1-target.yaml", "1-2-1-target-network.yaml", "1-3-1-network.yaml"},
+	}
+	mysql := &fakeMysql{
+		rows: []*model.Cloudinit{{ContestID: 1, TeamID: 1, QuestionID: 1, VMID: 101}},
+		machines: []model.Machine{
+			{ContestID: 1, TeamID: 1, QuestionID: 1, Role: "attacker", VMID: 101},
+			{ContestID: 1, TeamID: 1, QuestionID: 1, Role: "target", VMID: 102},
+		},
+	}
+	r := NewReconciler(pve, mysql, &fakeQuestion{}, &model.ReconcileConfig{Grace: time.Hour})
+	report, err := r.Reconcile(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanVMs) != 0 || len(report.MissingVMs) != 0 {
+		t.Errorf("orphan vms = %+v, missing vms = %+v", report.OrphanVMs, report.MissingVMs)
+	}
+	if len(report.StaleSnippets) != 2 || report.StaleSnippets[0].Filename != "1-2-1-target.yaml" || report.StaleSnippets[1].Filename != "1-3-1.yaml" {
+		t.Errorf("stale snippets = %+v", report.StaleSnippets)
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/cockroachdb/errors"
+)
+
+// チームの VNet に割り当てる VLAN タグの範囲
+const (
+	vnetTagMin = 100
+	vnetTagMax = 4094
+)
+
+// NewTeamVNet は VLAN タグから VNet 名とサブネットを決めます
+// タグ 100 → ctf100, 10.0.100.0/24 (ゲートウェイ 10.0.100.1)
+func NewTeamVNet(cid, tid, tag int) model.VNet {
+	return model.VNet{
+		ContestID: cid,
+		TeamID:    tid,
+		Name:      fmt.Sprintf("ctf%d", tag),
+		Tag:       tag,
+		Subnet:    fmt.Sprintf("10.%d.%d.0/24", tag>>8, tag&0xff),
+		Gateway:   fmt.Sprintf("10.%d.%d.1", tag>>8, tag&0xff),
+	}
+}
+
+// VNetHostIP は VNet 内の i 番目の VM のアドレスを返します (.10 から順に割り当てる)
+func VNetHostIP(v model.VNet, i int) (string, error) {
+	if i < 0 || i > 240 {
+		return "", errors.Newf("too many hosts in vnet %s: %d", v.Name, i)
+	}
+	return fmt.Sprintf("10.%d.%d.%d/24", v.Tag>>8, v.Tag&0xff, 10+i), nil
+}
+
+// ensureTeamVNet はチームの VNet がなければ空いている VLAN タグで作成します
+func (r *contestService) ensureTeamVNet(cid, tid int, vnets []model.VNet) (model.VNet, error) {
+	for _, v := range vnets {
+		if v.TeamID == tid {
+			return v, nil
+		}
+	}
+	tags, err := r.mysqlRepo.SelectVNetTags()
+	if err != nil {
+		return model.VNet{}, errors.Wrap(err, "can't get vnet tags")
+	}
+	used := map[int]bool{}
+	for _, t := range tags {
+		used[t] = true
+	}
+	var insertErr error
+	attempts := 0
+	for tag := vnetTagMin; tag <= vnetTagMax && attempts < 5; tag++ {
+		if used[tag] {
+			continue
+		}
+		v := NewTeamVNet(cid, tid, tag)
+		// tag は UNIQUE なので、同時に割り当てられた場合は次のタグを試す
+		if insertErr = r.mysqlRepo.InsertVNet(v); insertErr != nil {
+			attempts++
+			continue
+		}
+		if err := r.pveRepo.CreateVNet(v); err != nil {
+			// 戻せなかった行はタグを使ったまま残るのでログに出す
+			if derr := r.mysqlRepo.DeleteVNet(v); derr != nil {
+				log.Printf("can't delete vnet %s after failed create: %+v", v.Name, derr)
+			}
+			return model.VNet{}, errors.Wrap(err, "can't create vnet")
+		}
+		return v, nil
+	}
+	if insertErr != nil {
+		return model.VNet{}, errors.Wrap(insertErr, "can't allocate vlan tag")
+	}
+	return model.VNet{}, errors.New("no free vlan tag")
+}
+
+// deleteContestVNets はコンテストの VNet をすべて削除します
+func (r *contestService) deleteContestVNets(cid int) error {
+	vnets, err := r.mysqlRepo.SelectVNetsByContestID(cid)
+	if err != nil {
+		return errors.Wrap(err, "can't get vnets")
+	}
+	for _, v := range vnets {
+		if err := r.pveRepo.DeleteVNet(v.Name); err != nil {
+			return errors.Wrapf(err, "can't delete vnet %s", v.Name)
+		}
+		if err := r.mysqlRepo.DeleteVNet(v); err != nil {
+			return errors.Wrap(err, "can't delete vnet")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package service
+
+import "testing"
+
+func TestNewTeamVNet(t *testing.T) {
+	v := NewTeamVNet(1, 2, 300)
+	if v.Name != "ctf300" || v.Subnet != "10.1.44.0/24" || v.Gateway != "10.1.44.1" {
+		t.Errorf("unexpected vnet: %+v", v)
+	}
+	ip, err := VNetHostIP(v, 0)
+	if err != nil || ip != "10.1.44.10/24" {
+		t.Errorf("VNetHostIP() = %q, %v", ip, err)
+	}
+	if _, err := VNetHostIP(v, 241); err == nil {
+		t.Error("VNetHostIP() should fail when the subnet is full")
+	}
+	if len(NewTeamVNet(1, 2, vnetTagMax).Name) > 8 {
+		t.Error("vnet name must be 8 characters or less")
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+	"github.com/cockroachdb/errors"
+)
+
+// GenerateWireGuardKey は WireGuard の鍵ペアを base64 で返します
+func GenerateWireGuardKey() (string, string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", errors.Wrap(err, "can't generate key")
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// WireGuardPublicKey は秘密鍵から公開鍵を計算します
+func WireGuardPublicKey(private string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(private)
+	if err != nil {
+		return "", errors.Wrap(err, "can't decode private key")
+	}
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid private key")
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// VPNClientAddress はチームの VNet のタグからクライアントのアドレスを決めます
+// タグはコンテストをまたいで一意なのでアドレスも重複しない
+func VPNClientAddress(tag int) string {
+	return fmt.Sprintf("10.255.%d.%d/32", tag>>8, tag&0xff)
+}
+
+// vpnForwardChain はピアごとの FORWARD のルールを入れるチェインです
+const vpnForwardChain = "CTF-VPN"
+
+// RenderWireGuardServerConfig はサーバーの wg-quick 用の設定を作ります
+// ピアの AllowedIPs は自分のアドレスのみにし、FORWARD でチームの VNet 以外への転送を落とす
+// ピアごとのルールは wg syncconf でも反映できるように RenderWireGuardForwardRules のチェインに入れる
+func RenderWireGuardServerConfig(conf *model.VPNConfig, peers []model.VPNPeer) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", conf.ServerPrivateKey)
+	fmt.Fprintf(&b, "Address = %s\n", conf.ServerAddress)
+	fmt.Fprintf(&b, "ListenPort = %d\n", conf.ListenPort)
+	rules := []string{"FORWARD -o %i -m state --state RELATED,ESTABLISHED -j ACCEPT", "FORWARD -i %i -j " + vpnForwardChain}
+	fmt.Fprintf(&b, "PostUp = iptables-restore --noflush < %s\n", conf.ForwardRules)
+	for _, r := range rules {
+		fmt.Fprintf(&b, "PostUp = iptables -A %s\n", r)
+	}
+	for _, r := range rules {
+		fmt.Fprintf(&b, "PostDown = iptables -D %s\n", r)
+	}
+	fmt.Fprintf(&b, "PostDown = iptables -F %s\n", vpnForwardChain)
+	fmt.Fprintf(&b, "PostDown = iptables -X %s\n", vpnForwardChain)
+	for _, p := range peers {
+		fmt.Fprintf(&b, "\n# contest %d team %d\n", p.ContestID, p.TeamID)
+		fmt.Fprintf(&b, "[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", p.PublicKey)
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", p.Address)
+	}
+	return b.Bytes()
+}
+
+// RenderWireGuardForwardRules はピアごとの FORWARD のルールを iptables-restore の形式で作ります
+// --noflush で読み込むとチェインだけを空にして作り直すので、ピアの追加と削除がそのまま反映される
+func RenderWireGuardForwardRules(peers []model.VPNPeer) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", vpnForwardChain)
+	for _, p := range peers {
+		fmt.Fprintf(&b, "-A %s -s %s -d %s -j ACCEPT\n", vpnForwardChain, p.Address, p.AllowedIPs)
+	}
+	fmt.Fprintf(&b, "-A %s -j DROP\n", vpnForwardChain)
+	fmt.Fprintf(&b, "COMMIT\n")
+	return b.Bytes()
+}
+
+// RenderWireGuardClientConfig は参加者がダウンロードする .conf を作ります
+func RenderWireGuardClientConfig(conf *model.VPNConfig, serverPublicKey string, peer *model.VPNPeer, privateKey string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey)
+	fmt.Fprintf(&b, "Address = %s\n", peer.Address)
+	if conf.DNS != "" {
+		fmt.Fprintf(&b, "DNS = %s\n", conf.DNS)
+	}
+	fmt.Fprintf(&b, "\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", serverPublicKey)
+	fmt.Fprintf(&b, "Endpoint = %s\n", conf.Endpoint)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", peer.AllowedIPs)
+	fmt.Fprintf(&b, "PersistentKeepalive = 25\n")
+	return b.Bytes()
+}
+
+func (r *contestService) vpnEnabled() bool {
+	return r.vpnConf != nil && r.vpnConf.Endpoint != ""
+}
+
+// ensureTeamVPNPeer はチームのピアがなければ鍵を生成して登録します
+func (r *contestService) ensureTeamVPNPeer(cid, tid int, vnet model.VNet) error {
+	_, err := r.mysqlRepo.SelectVPNPeer(cid, tid)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(err, "can't get vpn peer")
+	}
+	private, public, err := GenerateWireGuardKey()
+	if err != nil {
+		return err
+	}
+	encrypted, err := r.access.Encrypt(private)
+	if err != nil {
+		return errors.Wrap(err, "can't encrypt private key")
+	}
+	peer := model.VPNPeer{
+		ContestID:  cid,
+		TeamID:     tid,
+		PublicKey:  public,
+		PrivateKey: encrypted,
+		Address:    VPNClientAddress(vnet.Tag),
+		AllowedIPs: vnet.Subnet,
+	}
+	if err := r.mysqlRepo.InsertVPNPeer(peer); err != nil {
+		return errors.Wrap(err, "can't insert vpn peer")
+	}
+	return nil
+}
+
+// syncVPNPeers は登録されているピアでサーバーの設定を書き直します
+// 同時に書き直すと古いピアの一覧で上書きすることがあるので 1 つずつ行う
+func (r *contestService) syncVPNPeers() error {
+	r.vpnMu.Lock()
+	defer r.vpnMu.Unlock()
+	peers, err := r.mysqlRepo.SelectVPNPeers()
+	if err != nil {
+		return errors.Wrap(err, "can't get vpn peers")
+	}
+	// 設定ファイルの更新で反映されるので、先にルールを書く
+	if err := r.vpnRepo.WriteForwardRules(RenderWireGuardForwardRules(peers)); err != nil {
+		return errors.Wrap(err, "can't write forward rules")
+	}
+	if err := r.vpnRepo.WriteServerConfig(RenderWireGuardServerConfig(r.vpnConf, peers)); err != nil {
+		return errors.Wrap(err, "can't write server config")
+	}
+	return nil
+}
+
+// GetVPNConfig は tid のチームの WireGuard の設定を返します
+// tid は呼び出し元のユーザーが所属するチームであること
+func (r *contestService) GetVPNConfig(cid, tid int) ([]byte, error) {
+	if !r.vpnEnabled() {
+		return nil, errors.New("vpn is not configured")
+	}
+	peer, err := r.mysqlRepo.SelectVPNPeer(cid, tid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get vpn peer")
+	}
+	private, err := r.access.Decrypt(peer.PrivateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decrypt private key")
+	}
+	serverPublicKey, err := WireGuardPublicKey(r.vpnConf.ServerPrivateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get server public key")
+	}
+	return RenderWireGuardClientConfig(r.vpnConf, serverPublicKey, peer, private), nil
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/LainInTheWired/ctf_backend/contest/model"
+)
+
+func TestWireGuardConfig(t *testing.T) {
+	serverPrivate, serverPublic, err := GenerateWireGuardKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, err := WireGuardPublicKey(serverPrivate); err != nil || pub != serverPublic {
+		t.Fatalf("WireGuardPublicKey() = %q, %v", pub, err)
+	}
+	conf := &model.VPNConfig{Endpoint: "vpn.example.com:51820", ServerPrivateKey: serverPrivate, ServerAddress: "10.255.255.254/16", ListenPort: 51820, ForwardRules: "/etc/wireguard/wg0.rules"}
+	v := NewTeamVNet(1, 2, 300)
+	peer := &model.VPNPeer{ContestID: 1, TeamID: 2, PublicKey: "cGVlcg==", Address: VPNClientAddress(v.Tag), AllowedIPs: v.Subnet}
+
+	client := string(RenderWireGuardClientConfig(conf, serverPublic, peer, "cHJpdmF0ZQ=="))
+	for _, want := range []string{"Address = 10.255.1.44/32", "AllowedIPs = 10.1.44.0/24", "PublicKey = " + serverPublic, "Endpoint = vpn.example.com:51820"} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client config does not contain %q:\n%s", want, client)
+		}
+	}
+
+	server := string(RenderWireGuardServerConfig(conf, []model.VPNPeer{*peer}))
+	for _, want := range []string{"AllowedIPs = 10.255.1.44/32", "PostUp = iptables-restore --noflush < /etc/wireguard/wg0.rules", "FORWARD -i %i -j CTF-VPN"} {
+		if !strings.Contains(server, want) {
+			t.Errorf("server config does not contain %q:\n%s", want, server)
+		}
+	}
+
+	// ピアのルールはチェインを作り直すファイルに書く
+	rules := string(RenderWireGuardForwardRules([]model.VPNPeer{*peer}))
+	want := "*filter\n:CTF-VPN - [0:0]\n-A CTF-VPN -s 10.255.1.44/32 -d 10.1.44.0/24 -j ACCEPT\n-A CTF-VPN -j DROP\nCOMMIT\n"
+	if rules != want {
+		t.Errorf("forward rules = %q", rules)
+	}
+}
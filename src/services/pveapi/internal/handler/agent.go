@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type agentExecRequest struct {
+	Command   []string `json:"command" validate:"required,min=1"`
+	InputData string   `json:"input_data,omitempty"`
+	// true の場合はコマンドの終了を待って結果を返す
+	Wait    bool `json:"wait,omitempty"`
+	Timeout int  `json:"timeout,omitempty" validate:"omitempty,min=1,max=300"` // 秒
+}
+
+type agentFileWriteRequest struct {
+	Path    string `json:"path" validate:"required"`
+	Content string `json:"content"`
+	// base64 の場合は content をデコードせずにそのまま書き込む
+	Encoding string `json:"encoding,omitempty" validate:"omitempty,oneof=base64"`
+}
+
+// agentActor は guest agent を操作したユーザーを返します
+// 権限の確認は呼び出し元 (contest) が行い、操作したユーザーを X-User-ID で渡す
+func agentActor(c echo.Context) (string, error) {
+	actor := c.Request().Header.Get("X-User-ID")
+	if actor == "" {
+		return "", xerrors.New("X-User-ID is required")
+	}
+	return actor, nil
+}
+
+// auditAgent は guest agent の操作を監査ログに残します
+func auditAgent(actor string, action string, vmid int, detail string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	log.Infof("audit: actor=%s action=%s vmid=%d detail=%q result=%s", actor, action, vmid, detail, result)
+}
+
+func (h *PVEHandler) AgentExec(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	vid, err := strconv.Atoi(c.Param("vmid"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	actor, err := agentActor(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+	var req agentExecRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+
+	ctx := c.Request().Context()
+	if !req.Wait {
+		pid, err := serv.AgentExec(ctx, vid, req.Command, req.InputData)
+		auditAgent(actor, "exec", vid, strings.Join(req.Command, " "), err)
+		if err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		return c.JSON(http.StatusAccepted, map[string]int{"pid": pid})
+	}
+	status, err := serv.AgentRun(ctx, vid, req.Command, req.InputData, time.Duration(req.Timeout)*time.Second)
+	auditAgent(actor, "exec", vid, strings.Join(req.Command, " "), err)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+func (h *PVEHandler) AgentExecStatus(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	vid, err := strconv.Atoi(c.Param("vmid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: vmid")})
+	}
+	pid, err := strconv.Atoi(c.Param("pid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: pid")})
+	}
+	if _, err := agentActor(c); err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+	status, err := serv.AgentExecStatus(c.Request().Context(), vid, pid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+func (h *PVEHandler) AgentFileRead(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	vid, err := strconv.Atoi(c.Param("vmid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: vmid")})
+	}
+	actor, err := agentActor(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+	path := c.QueryParam("path")
+	file, err := serv.AgentFileRead(c.Request().Context(), vid, path)
+	auditAgent(actor, "file-read", vid, path, err)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+func (h *PVEHandler) AgentFileWrite(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	vid, err := strconv.Atoi(c.Param("vmid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: vmid")})
+	}
+	actor, err := agentActor(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+	var req agentFileWriteRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	file := &model.AgentFileWrite{
+		Path:    req.Path,
+		Content: req.Content,
+		Base64:  req.Encoding == "base64",
+	}
+	err = serv.AgentFileWrite(c.Request().Context(), vid, file)
+	// 書き込んだ内容 (フラグなど) はログに残さない
+	auditAgent(actor, "file-write", vid, fmt.Sprintf("%s (%d bytes)", req.Path, len(req.Content)), err)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, &SuccessResponse{Data: "success to write file"})
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"github.com/LainInTheWired/ctf-backend/pveapi/service"
+	"github.com/labstack/echo/v4"
+)
+
+// clusterService は ?cluster= のクラスタの PVEService を返します (省略時は最初に登録したクラスタ)
+func (h *PVEHandler) clusterService(c echo.Context) (service.PVEService, error) {
+	return h.clusters.Get(c.QueryParam("cluster"))
+}
+
+// clusterServices は ?cluster= のクラスタ (省略時はすべてのクラスタ) の PVEService を返します
+// スニペットや VNet はどのクラスタに VM を置いても使えるようにすべてのクラスタに作る
+func (h *PVEHandler) clusterServices(c echo.Context) ([]service.PVEService, error) {
+	ids := h.clusters.IDs()
+	if id := c.QueryParam("cluster"); id != "" {
+		ids = []string{id}
+	}
+	services := []service.PVEService{}
+	for _, id := range ids {
+		s, err := h.clusters.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+)
+
+// pveErrorStatus は Proxmox のエラーの種類をレスポンスのステータスコードに変換します
+func pveErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, model.ErrPVENotFound):
+		return http.StatusNotFound
+	case errors.Is(err, model.ErrPVELocked), errors.Is(err, model.ErrPVEExists):
+		return http.StatusConflict
+	case errors.Is(err, model.ErrPVEQuota):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, model.ErrPVEAuth):
+		return http.StatusBadGateway
+	case errors.Is(err, model.ErrGuestUnsupported), errors.Is(err, model.ErrImageFormat):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type firewallRuleRequest struct {
+	Type    string `json:"type" validate:"required,oneof=in out"`
+	Action  string `json:"action" validate:"required,oneof=ACCEPT DROP REJECT"`
+	Proto   string `json:"proto,omitempty"`
+	Dport   string `json:"dport,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Dest    string `json:"dest,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+type setFirewallRequest struct {
+	Enable    bool                  `json:"enable"`
+	PolicyIn  string                `json:"policy_in,omitempty" validate:"omitempty,oneof=ACCEPT DROP REJECT"`
+	PolicyOut string                `json:"policy_out,omitempty" validate:"omitempty,oneof=ACCEPT DROP REJECT"`
+	Groups    []string              `json:"groups,omitempty"`
+	Rules     []firewallRuleRequest `json:"rules,omitempty" validate:"dive"`
+}
+
+func (h *PVEHandler) SetVMFirewall(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	svid := c.Param("vmid")
+	vid, err := strconv.Atoi(svid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// リクエストから構造体にデータをコピー
+	var req setFirewallRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+
+	fw := &model.VMFirewall{
+		Options: model.FirewallOptions{
+			Enable:    req.Enable,
+			PolicyIn:  req.PolicyIn,
+			PolicyOut: req.PolicyOut,
+		},
+		Groups: req.Groups,
+	}
+	for _, r := range req.Rules {
+		fw.Rules = append(fw.Rules, model.FirewallRule{
+			Type:    r.Type,
+			Action:  r.Action,
+			Proto:   r.Proto,
+			Dport:   r.Dport,
+			Source:  r.Source,
+			Dest:    r.Dest,
+			Comment: r.Comment,
+		})
+	}
+	if err := serv.SetVMFirewall(c.Request().Context(), vid, fw); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+
+	resq := &SuccessResponse{
+		Data: "success set firewall",
+	}
+	return c.JSON(http.StatusOK, resq)
+}
+
+func (h *PVEHandler) GetVMFirewall(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	svid := c.Param("vmid")
+	vid, err := strconv.Atoi(svid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	rules, err := serv.GetVMFirewallRules(c.Request().Context(), vid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, rules)
+}
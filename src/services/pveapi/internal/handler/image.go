@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type importImageRequest struct {
+	Node     string `json:"node,omitempty"`
+	Storage  string `json:"storage" validate:"required"`
+	Filename string `json:"filename" validate:"required"`
+	// 空の場合は multipart の file をアップロードする
+	URL               string `json:"url,omitempty" validate:"omitempty,url"`
+	Checksum          string `json:"checksum,omitempty" validate:"omitempty,hexadecimal"`
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty" validate:"required_with=Checksum,omitempty,oneof=md5 sha1 sha224 sha256 sha384 sha512"`
+}
+
+type createImageVMRequest struct {
+	Name    string `json:"name" validate:"required"`
+	Node    string `json:"node,omitempty"`
+	Storage string `json:"storage" validate:"required"`
+	// POST /image が返したボリューム
+	Image  string `json:"image" validate:"required"`
+	CPUs   int    `json:"cpu" validate:"required,min=1"`
+	Memory int    `json:"memory" validate:"required,min=256"`
+	Disk   int    `json:"disk,omitempty" validate:"omitempty,min=1"`
+	Bridge string `json:"bridge,omitempty" validate:"omitempty,alphanum,max=8"`
+	// 最初の起動で使う POST /cloudinit のファイル名
+	Cicustom string `json:"cicustom,omitempty"`
+}
+
+// imageVMResponse は作成した VM の vmid と VM を置いたノードです
+type imageVMResponse struct {
+	Vmid int    `json:"vmid"`
+	Node string `json:"node"`
+}
+
+// ImportImage はクラウドイメージを ?cluster= のクラスタのストレージに取り込みます
+// JSON の場合は url を Proxmox にダウンロードさせ、multipart の場合は file をアップロードする
+func (h *PVEHandler) ImportImage(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	var req importImageRequest
+	var file io.ReadCloser
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		req = importImageRequest{Node: c.FormValue("node"), Storage: c.FormValue("storage"), Filename: c.FormValue("filename")}
+		if req.Filename == "" {
+			req.Filename = fh.Filename
+		}
+		if file, err = fh.Open(); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		defer file.Close()
+	} else {
+		if err := c.Bind(&req); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		if req.URL == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "error: url or multipart file is required"})
+		}
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+
+	img := &model.ImageImport{
+		Node:              req.Node,
+		Storage:           req.Storage,
+		Filename:          req.Filename,
+		URL:               req.URL,
+		Checksum:          req.Checksum,
+		ChecksumAlgorithm: req.ChecksumAlgorithm,
+	}
+	var r io.Reader
+	if file != nil {
+		r = file
+	}
+	res, err := serv.ImportImage(c.Request().Context(), img, r)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// CreateImageVM はクラウドイメージから VM を作ります (テンプレートへの変換は POST /template)
+func (h *PVEHandler) CreateImageVM(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	var req createImageVMRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+
+	vm := &model.VMCreate{
+		Node:     req.Node,
+		Name:     req.Name,
+		Cores:    req.CPUs,
+		Memory:   req.Memory,
+		Disk:     req.Disk,
+		Storage:  req.Storage,
+		Image:    req.Image,
+		Bridge:   req.Bridge,
+		Cicustom: req.Cicustom,
+	}
+	vmid, err := serv.CreateImageVM(c.Request().Context(), vm)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, &imageVMResponse{Vmid: vmid, Node: vm.Node})
+}
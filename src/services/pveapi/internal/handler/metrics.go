@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+// GetVMMetrics は VM の rrddata を返します (?timeframe=hour|day|week|month|year、省略時は hour)
+func (h *PVEHandler) GetVMMetrics(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	vid, err := strconv.Atoi(c.Param("vmid"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	metrics, err := serv.VMMetrics(c.Request().Context(), vid, c.QueryParam("timeframe"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, metrics)
+}
+
+// GetNodeMetrics はノードの rrddata を返します
+func (h *PVEHandler) GetNodeMetrics(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	metrics, err := serv.NodeMetrics(c.Request().Context(), c.Param("node"), c.QueryParam("timeframe"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, metrics)
+}
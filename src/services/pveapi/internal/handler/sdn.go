@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type createVNetRequest struct {
+	VNet    string `json:"vnet" validate:"required,alphanum,max=8"`
+	Tag     int    `json:"tag" validate:"required,min=1,max=4094"`
+	Alias   string `json:"alias,omitempty"`
+	Subnet  string `json:"subnet,omitempty" validate:"omitempty,cidr"`
+	Gateway string `json:"gateway,omitempty" validate:"omitempty,ip"`
+}
+
+func (h *PVEHandler) CreateVNet(c echo.Context) error {
+	// リクエストから構造体にデータをコピー
+	var req createVNetRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+
+	vnet := &model.VNet{
+		Name:    req.VNet,
+		Tag:     req.Tag,
+		Alias:   req.Alias,
+		Subnet:  req.Subnet,
+		Gateway: req.Gateway,
+	}
+	services, err := h.clusterServices(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	for _, serv := range services {
+		if err := serv.CreateVNet(c.Request().Context(), vnet); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+	}
+
+	resq := &SuccessResponse{
+		Data: "success create vnet",
+	}
+	return c.JSON(http.StatusOK, resq)
+}
+
+func (h *PVEHandler) DeleteVNet(c echo.Context) error {
+	vnet := c.Param("vnet")
+	if vnet == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "error: param"})
+	}
+	services, err := h.clusterServices(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	for _, serv := range services {
+		if err := serv.DeleteVNet(c.Request().Context(), vnet); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+	}
+
+	resq := &SuccessResponse{
+		Data: "success delete vnet",
+	}
+	return c.JSON(http.StatusOK, resq)
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 
 	"github.com/LainInTheWired/ctf-backend/pveapi/model"
@@ -19,7 +20,7 @@ type PVEParam struct {
 
 // 依存関係用の構造体
 type PVEHandler struct {
-	serv service.PVEService
+	clusters service.Clusters
 }
 
 //	type createVMRequest struct {
@@ -44,6 +45,19 @@ type createVMRequest struct {
 	Gateway  string `json:"gateway" validate:"omitempty,ip"`
 	OS       string `json:"os,omitempty"`
 	Cicustom string `json:"cicustom,omitempty" validate:"required"`
+	// クローン方式 full または linked (省略時は設定値)
+	Mode    string `json:"mode,omitempty" validate:"omitempty,oneof=full linked"`
+	Storage string `json:"storage,omitempty"`
+	Pool    string `json:"pool,omitempty"`
+	// net0 を付け替える VNet (省略時はテンプレートのまま)
+	Bridge string `json:"bridge,omitempty" validate:"omitempty,alphanum,max=8"`
+	// テンプレートの種類 qemu または lxc (省略時はテンプレートに合わせる)
+	Backend string `json:"backend,omitempty" validate:"omitempty,oneof=qemu lxc"`
+	// VM に付けるタグ (コンテストのインスタンスの場合のみ)
+	ContestID  int    `json:"contest_id,omitempty" validate:"omitempty,min=0"`
+	TeamID     int    `json:"team_id,omitempty" validate:"omitempty,min=0"`
+	QuestionID int    `json:"question_id,omitempty" validate:"omitempty,min=0"`
+	CreatedBy  string `json:"created_by,omitempty" validate:"omitempty,max=32"`
 }
 type CloneQuestionsRequest struct {
 	QID   int    `json"qid" validate:"required"`
@@ -59,12 +73,18 @@ type deleteVMRequest struct {
 }
 
 type CloudinitRequest struct {
-	Filename  string   `json:"filename" validation:"required"`
-	Hostname  string   `json:"hostname" validation:"required"`
+	Filename  string   `json:"filename" validate:"required"`
+	Hostname  string   `json:"hostname" validate:"required"`
 	Sshkeys   []string `json:"sshkeys"`
 	SshPwauth string   `json:"ssh_pwauth"`
 	Username  string   `json:"username"`
 	Passwd    string   `json:"passwd"`
+	// 問題ごとのベースの設定とチームごとの上書き (override が優先)
+	Base          *model.CloudinitConfig `json:"base,omitempty"`
+	Override      *model.CloudinitConfig `json:"override,omitempty"`
+	NetworkConfig *model.NetworkConfig   `json:"network_config,omitempty"`
+	MetaData      *model.MetaData        `json:"meta_data,omitempty"`
+	VendorData    *model.CloudinitConfig `json:"vendor_data,omitempty"`
 }
 
 type TemplateRequest struct {
@@ -74,8 +94,16 @@ type TemplateRequest struct {
 type SuccessResponse struct {
 	Data string `json:"data"`
 }
+
+// createVMResponse は作成した VM の vmid と VM を置いたクラスタです
+type createVMResponse struct {
+	Data    string `json:"data"`
+	Cluster string `json:"cluster"`
+	// ゲストの種類 (qemu / lxc)。コンテナには cicustom のパスワードが設定されない
+	Type string `json:"type"`
+}
 type DeleteCloudinit struct {
-	Filename string `json:"filename"`
+	Filename string `json:"filename" validate:"required"`
 }
 
 // // VMConfig は作成するVMの設定を保持します
@@ -93,9 +121,9 @@ type DeleteCloudinit struct {
 // 	Description    string `json:"description"` // VMの説明（オプション）
 // }
 
-func NewPVEAPI(s service.PVEService) *PVEHandler {
+func NewPVEAPI(c service.Clusters) *PVEHandler {
 	return &PVEHandler{
-		serv: s,
+		clusters: c,
 	}
 }
 
@@ -124,12 +152,20 @@ func (h *PVEHandler) CreateCloudinitVM(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 
-	node, err := h.serv.SelectNode(req.CPUs, req.Memory, req.Disk)
+	// ?cluster= を省略した場合はクローン元のテンプレートがあるクラスタから最も負荷の低いノードを選ぶ
+	placement, err := h.clusters.Place(c.Request().Context(), c.QueryParam("cluster"), req.Cloneid, req.CPUs, req.Memory, req.Disk)
 	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
+	serv, err := h.clusters.Get(placement.Cluster)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	node := placement.Node
 	conf := &model.VMEdit{}
 	if req.IP == "" {
 		conf = &model.VMEdit{
@@ -149,23 +185,47 @@ func (h *PVEHandler) CreateCloudinitVM(c echo.Context) error {
 		}
 	}
 
+	conf.Tags = model.InstanceTags{
+		ContestID:  req.ContestID,
+		TeamID:     req.TeamID,
+		QuestionID: req.QuestionID,
+		CreatedBy:  req.CreatedBy,
+	}.String()
+
 	fmt.Printf("%+v", conf)
 
-	vmid, err := h.serv.CreateCloudinitVM(req.Name, req.Disk, conf, req.Cloneid)
+	clone := &model.VMClone{
+		Name:    req.Name,
+		Cloneid: req.Cloneid,
+		Mode:    req.Mode,
+		Storage: req.Storage,
+		Pool:    req.Pool,
+		Type:    req.Backend,
+	}
+
+	vmid, err := serv.CreateCloudinitVM(c.Request().Context(), req.Disk, conf, clone, req.Bridge)
 	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 
 	}
 	svmid := strconv.Itoa(vmid)
-	resq := &SuccessResponse{
-		Data: svmid,
+	resq := &createVMResponse{
+		Data:    svmid,
+		Cluster: placement.Cluster,
+		Type:    clone.Type,
 	}
 	return c.JSON(http.StatusOK, resq)
 }
 
 func (h *PVEHandler) DeleteVM(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
 	// リクエストから構造体にデータをコピー
 	var req deleteVMRequest
 	if err := c.Bind(&req); err != nil {
@@ -180,10 +240,10 @@ func (h *PVEHandler) DeleteVM(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 
-	if err := h.serv.DeleteVMByVmid(req.ID); err != nil {
+	if err := serv.DeleteVMByVmid(c.Request().Context(), req.ID); err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 	resq := &SuccessResponse{
 		Data: "success delete vm",
@@ -206,24 +266,40 @@ func (h *PVEHandler) Cloudinit(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 
-	users := []model.User{{
-		Name:              req.Username,
-		Sudo:              "ALL=(ALL) NOPASSWD:ALL",
-		Shell:             "/bin/bash",
-		PlainTextPasswd:   req.Passwd,
-		SshPwauth:         req.SshPwauth,
-		SshAuthorizedKeys: req.Sshkeys,
-	},
+	// hostname と username などの項目は上書きの一部として扱う
+	override := &model.CloudinitConfig{
+		Hostname: req.Hostname,
+		FQDN:     req.Hostname,
 	}
-	if err := h.serv.GenerateCloudinit(req.Hostname, users, req.Filename, 1); err != nil {
-		wrappedErr := xerrors.Errorf(": %w", err)
-		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	if req.Username != "" {
+		override.SshPwauth = 1
+		override.Users = []model.User{{
+			Name:              req.Username,
+			Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+			Shell:             "/bin/bash",
+			PlainTextPasswd:   req.Passwd,
+			SshPwauth:         req.SshPwauth,
+			SshAuthorizedKeys: req.Sshkeys,
+		}}
+	}
+	doc := &model.CloudinitDocument{
+		User:    service.MergeCloudinit(req.Base, service.MergeCloudinit(override, req.Override)),
+		Network: req.NetworkConfig,
+		Meta:    req.MetaData,
+		Vendor:  req.VendorData,
 	}
-	if err := h.serv.TransferFileViaSCP(req.Filename); err != nil {
+	services, err := h.clusterServices(c)
+	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	for _, serv := range services {
+		if err := serv.GenerateCloudinit(req.Filename, doc); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
 	}
 
 	resq := &SuccessResponse{
@@ -231,6 +307,35 @@ func (h *PVEHandler) Cloudinit(c echo.Context) error {
 	}
 	return c.JSON(http.StatusOK, resq)
 }
+
+// ListCloudinit は ?cluster= のクラスタ (省略時はすべてのクラスタ) のスニペットのファイル名を返します
+func (h *PVEHandler) ListCloudinit(c echo.Context) error {
+	services, err := h.clusterServices(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	found := map[string]bool{}
+	names := []string{}
+	for _, serv := range services {
+		ns, err := serv.ListCloudinitFiles()
+		if err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		for _, n := range ns {
+			if !found[n] {
+				found[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	sort.Strings(names)
+	return c.JSON(http.StatusOK, names)
+}
+
 func (h *PVEHandler) DeleteCloudinit(c echo.Context) error {
 	// リクエストから構造体にデータをコピー
 	var req DeleteCloudinit
@@ -246,10 +351,18 @@ func (h *PVEHandler) DeleteCloudinit(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 
-	if err := h.serv.DeleteCloudinitFile(req.Filename); err != nil {
+	services, err := h.clusterServices(c)
+	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	for _, serv := range services {
+		if err := serv.DeleteCloudinitFile(req.Filename); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
 	}
 
 	resq := &SuccessResponse{
@@ -259,6 +372,12 @@ func (h *PVEHandler) DeleteCloudinit(c echo.Context) error {
 }
 
 func (h *PVEHandler) ToTemplate(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
 	// リクエストから構造体にデータをコピー
 	var req TemplateRequest
 	if err := c.Bind(&req); err != nil {
@@ -273,10 +392,10 @@ func (h *PVEHandler) ToTemplate(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 
-	if err := h.serv.Template(req.ID); err != nil {
+	if err := serv.Template(c.Request().Context(), req.ID); err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 	resq := &SuccessResponse{
 		Data: "success to template",
@@ -284,7 +403,36 @@ func (h *PVEHandler) ToTemplate(c echo.Context) error {
 	return c.JSON(http.StatusOK, resq)
 }
 
+// GetVMStatus は VM が使えるようになるまでの段階ごとの状態を返します
+func (h *PVEHandler) GetVMStatus(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	vid, err := strconv.Atoi(c.Param("vmid"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	status, err := serv.VMReadiness(c.Request().Context(), vid)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
 func (h *PVEHandler) GetIps(c echo.Context) error {
+	serv, err := h.clusterService(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
 	// リクエストから構造体にデータをコピー
 	svid := c.Param("vmid")
 	vid, err := strconv.Atoi(svid)
@@ -293,11 +441,11 @@ func (h *PVEHandler) GetIps(c echo.Context) error {
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
-	ips, err := h.serv.GetIps(vid)
+	ips, err := serv.GetIps(c.Request().Context(), vid)
 	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 	// resq := &SuccessResponse{
 	// 	Data: json.Marshal(ips),
@@ -305,21 +453,38 @@ func (h *PVEHandler) GetIps(c echo.Context) error {
 	return c.JSON(http.StatusOK, ips)
 }
 func (h *PVEHandler) GetClusterResource(c echo.Context) error {
-	cluster, err := h.serv.GetClusterResource()
+	// ?contest_id= などでコンテストの VM だけに絞り込む (?cluster= を省略した場合はすべてのクラスタ)
+	filter := model.InstanceTags{CreatedBy: c.QueryParam("created_by")}
+	for key, id := range map[string]*int{"contest_id": &filter.ContestID, "team_id": &filter.TeamID, "question_id": &filter.QuestionID} {
+		if v := c.QueryParam(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: %s", key)})
+			}
+			*id = n
+		}
+	}
+	cluster, err := h.clusters.GetClusterResource(c.Request().Context(), c.QueryParam("cluster"), filter)
 	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 	return c.JSON(http.StatusOK, cluster)
 }
 
 func (h *PVEHandler) EditVMACL(c echo.Context) error {
-	err := h.serv.EditVMACL()
+	serv, err := h.clusterService(c)
 	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	err = serv.EditVMACL(c.Request().Context())
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
 	return c.JSON(http.StatusOK, "scesss")
 }
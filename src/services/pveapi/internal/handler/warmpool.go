@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+// GetWarmPool は ?cluster= のクラスタ (省略時はすべて) のウォームプールの状態を返します
+func (h *PVEHandler) GetWarmPool(c echo.Context) error {
+	services, err := h.clusterServices(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	statuses := []model.WarmPoolStatus{}
+	for _, serv := range services {
+		statuses = append(statuses, serv.WarmPool(c.Request().Context())...)
+	}
+	return c.JSON(http.StatusOK, statuses)
+}
+
+// RefillWarmPool はバックグラウンドの補充を待たずに足りない VM をクローンします
+func (h *PVEHandler) RefillWarmPool(c echo.Context) error {
+	services, err := h.clusterServices(c)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(pveErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	statuses := []model.WarmPoolStatus{}
+	for _, serv := range services {
+		statuses = append(statuses, serv.RefillWarmPool(c.Request().Context())...)
+	}
+	return c.JSON(http.StatusOK, statuses)
+}
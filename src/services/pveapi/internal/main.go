@@ -10,6 +10,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/LainInTheWired/ctf-backend/pveapi/handler"
@@ -135,35 +137,48 @@ func main() {
 	reddb, err := NewRedisClient()
 	if err != nil {
 		xerrors.Errorf("redis connetciono error: %w", err.Error())
+	} else {
+		defer reddb.Close()
 	}
-	defer reddb.Close()
 
 	// proxmoxapi初期化処理
-	config := &model.PVEConfig{
-		APIURL:        os.Getenv("PROXMOX_API_URL"),
-		Authorization: os.Getenv("PROXMOX_API_TOKEN"),
-	}
-	// httpclinet auth middleware
-	// カスタムトランスポートを作成
-	// カスタム Transport を設定（InsecureSkipVerify は本番環境では false に）
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // 本番では false にする
+	// PROXMOX_CLUSTERS=pve1,pve2 の場合はクラスタごとに PVE1_PROXMOX_API_URL などを読む
+	configs := []*model.PVEConfig{}
+	if ids := os.Getenv("PROXMOX_CLUSTERS"); ids != "" {
+		for _, id := range strings.Split(ids, ",") {
+			id = strings.TrimSpace(id)
+			configs = append(configs, loadPVEConfig(id, envPrefix(id)))
+		}
+	} else {
+		configs = append(configs, loadPVEConfig(service.DefaultClusterID, ""))
 	}
 
-	// カスタム AuthTransport を作成
-	authTransport := &MiddlewareTransport{
-		Transport: tr,
-		Token:     config.Authorization,
-	}
-	// カスタム HTTP クライアントの作成
-	client := &http.Client{
-		Transport: authTransport,
-		Timeout:   60 * time.Second,
+	services := []service.PVEService{}
+	for _, config := range configs {
+		// 設定のバリデーション
+		if config.APIURL == "" || config.Authorization == "" {
+			log.Fatalf("必要な環境変数が設定されていません。クラスタ %s の PROXMOX_API_URL および PROXMOX_AUTHORIZATION を設定してください。", config.ID)
+		}
+		if config.Snippet.StorageID == "" {
+			log.Fatalf("必要な環境変数が設定されていません。クラスタ %s の SNIPPET_STORAGE_ID を設定してください。", config.ID)
+		}
+		snippets, err := repository.NewSnippetStore(&config.Snippet)
+		if err != nil {
+			log.Fatalf("snippet store error: %v", err)
+		}
+		// クラスタのキャッシュは Redis で共有する (接続できない場合はプロセス内に持つ)
+		// ウォームプールの払い出しも Redis で記録して複数のプロセスで二重に払い出さない
+		cacheStore := repository.NewMemoryClusterCacheStore()
+		claims := repository.NewMemoryWarmClaimStore()
+		if reddb != nil {
+			cacheStore = repository.NewRedisClusterCacheStore(reddb, config.ID)
+			claims = repository.NewRedisWarmClaimStore(reddb, config.ID)
+		}
+		services = append(services, newClusterService(config, newPVEClient(config), snippets, cacheStore, claims))
 	}
-
-	// 設定のバリデーション
-	if config.APIURL == "" || config.Authorization == "" {
-		log.Fatal("必要な環境変数が設定されていません。PROXMOX_API_URL および PROXMOX_AUTHORIZATION を設定してください。")
+	clusters, err := service.NewClusters(configs, services)
+	if err != nil {
+		log.Fatalf("cluster config error: %v", err)
 	}
 
 	// echo初期化処理
@@ -190,21 +205,134 @@ func main() {
 	// アクセスログを出力
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Validator = myvalidator.NewValidator()
+	registerRoutes(e, clusters)
+
+	e.Start(":8000")
+}
 
+// envPrefix はクラスタ id の環境変数の接頭辞を返します (例: pve-2 -> PVE_2_)
+func envPrefix(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(id)) + "_"
+}
+
+// loadPVEConfig は prefix を付けた環境変数からクラスタ id の設定を読みます
+func loadPVEConfig(id string, prefix string) *model.PVEConfig {
+	env := func(key string) string { return os.Getenv(prefix + key) }
+	config := &model.PVEConfig{
+		ID:            id,
+		APIURL:        env("PROXMOX_API_URL"),
+		Authorization: env("PROXMOX_API_TOKEN"),
+		CloneMode:     env("PROXMOX_CLONE_MODE"),
+		CloneStorage:  env("PROXMOX_CLONE_STORAGE"),
+		Pool:          env("PROXMOX_POOL"),
+		Snippet: model.SnippetConfig{
+			Backend:        env("SNIPPET_BACKEND"),
+			StorageID:      env("SNIPPET_STORAGE_ID"),
+			Dir:            env("SNIPPET_DIR"),
+			SFTPHost:       env("SNIPPET_SFTP_HOST"),
+			SFTPUser:       env("SNIPPET_SFTP_USER"),
+			SFTPKeyPath:    env("SNIPPET_SFTP_KEY"),
+			KnownHostsPath: env("SNIPPET_SFTP_KNOWN_HOSTS"),
+		},
+		SDNZone:     env("PROXMOX_SDN_ZONE"),
+		SDNZoneType: env("PROXMOX_SDN_ZONE_TYPE"),
+		SDNBridge:   env("PROXMOX_SDN_BRIDGE"),
+	}
+	// 空や不正な値の場合はリポジトリのデフォルト値を使う
+	config.RequestTimeout, _ = time.ParseDuration(env("PROXMOX_REQUEST_TIMEOUT"))
+	config.TaskTimeout, _ = time.ParseDuration(env("PROXMOX_TASK_TIMEOUT"))
+	config.LockRetries, _ = strconv.Atoi(env("PROXMOX_LOCK_RETRIES"))
+	config.Cache.MaxStale, _ = time.ParseDuration(env("CLUSTER_CACHE_MAX_STALE"))
+	config.Cache.RefreshInterval, _ = time.ParseDuration(env("CLUSTER_CACHE_REFRESH_INTERVAL"))
+	// WARM_POOL=9000=2,9001=1 の場合はテンプレート 9000 を 2 台、9001 を 1 台用意しておく
+	sizes, err := service.ParseWarmPoolSizes(env("WARM_POOL"))
+	if err != nil {
+		log.Fatalf("WARM_POOL error: %v", err)
+	}
+	config.WarmPool.Sizes = sizes
+	config.WarmPool.Interval = time.Minute
+	if d, err := time.ParseDuration(env("WARM_POOL_INTERVAL")); err == nil {
+		config.WarmPool.Interval = d
+	}
+	if config.SDNZoneType == "" {
+		config.SDNZoneType = "vlan"
+	}
+	if config.CloneMode == "" {
+		config.CloneMode = model.CloneModeFull
+	}
+	return config
+}
+
+// newPVEClient はクラスタのトークンを付けてリクエストする HTTP クライアントを作ります
+func newPVEClient(config *model.PVEConfig) *http.Client {
+	// httpclinet auth middleware
+	// カスタムトランスポートを作成
+	// カスタム Transport を設定（InsecureSkipVerify は本番環境では false に）
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // 本番では false にする
+	}
+
+	// カスタム AuthTransport を作成
+	authTransport := &MiddlewareTransport{
+		Transport: tr,
+		Token:     config.Authorization,
+	}
+	// カスタム HTTP クライアントの作成
+	return &http.Client{
+		Transport: authTransport,
+		Timeout:   60 * time.Second,
+	}
+}
+
+// newClusterService はクラスタ 1 つ分の依存関係を組み立てます
+// テストでは偽の Proxmox に向けた client を渡す
+func newClusterService(config *model.PVEConfig, client *http.Client, snippets repository.SnippetStore, cacheStore repository.ClusterCacheStore, claims repository.WarmClaimStore) service.PVEService {
 	// p := service.NewPVEClient(config)
-	r := repository.NewPVERepository(config, client)
-	s := service.NewPVEService(r)
-	h := handler.NewPVEAPI(s)
+	r := repository.NewCachedPVERepository(repository.NewPVERepository(config, client), cacheStore, &config.Cache)
+	go r.Run(context.Background())
+	s := service.NewPVEService(r, snippets, claims, config)
+	go s.RunWarmPool(context.Background())
+	return s
+}
+
+// registerRoutes はルーティングを登録します
+func registerRoutes(e *echo.Echo, clusters service.Clusters) {
+	e.Validator = myvalidator.NewValidator()
+
+	h := handler.NewPVEAPI(clusters)
 
 	e.GET("/", hello)
 	e.POST("/vm", h.CreateCloudinitVM)
 	e.DELETE("/vm", h.DeleteVM)
 	e.POST("/cloudinit", h.Cloudinit)
+	e.GET("/cloudinit", h.ListCloudinit)
 	e.DELETE("/cloudinit", h.DeleteCloudinit)
 	e.POST("/template", h.ToTemplate)
+	e.POST("/image", h.ImportImage)
+	e.POST("/vm/image", h.CreateImageVM)
 	e.GET("/vm/:vmid/ips", h.GetIps)
+	e.GET("/vm/:vmid/status", h.GetVMStatus)
+	e.GET("/vm/:vmid/metrics", h.GetVMMetrics)
+	e.GET("/node/:node/metrics", h.GetNodeMetrics)
+	e.POST("/vm/:vmid/suspend-idle", h.SuspendIdle)
+	e.POST("/vm/:vmid/resume", h.Resume)
 	e.GET("/cluster", h.GetClusterResource)
+	e.GET("/warm-pool", h.GetWarmPool)
+	e.POST("/warm-pool/refill", h.RefillWarmPool)
+	e.POST("/sdn/vnet", h.CreateVNet)
+	e.DELETE("/sdn/vnet/:vnet", h.DeleteVNet)
+	e.GET("/vm/:vmid/firewall", h.GetVMFirewall)
+	e.PUT("/vm/:vmid/firewall", h.SetVMFirewall)
+	// QEMU guest agent (呼び出し元が管理者か確認してから X-User-ID を付けて呼ぶ)
+	e.POST("/vm/:vmid/agent/exec", h.AgentExec)
+	e.GET("/vm/:vmid/agent/exec/:pid", h.AgentExecStatus)
+	e.GET("/vm/:vmid/agent/file", h.AgentFileRead)
+	e.PUT("/vm/:vmid/agent/file", h.AgentFileWrite)
 	// e.PUT("/test/vmacl", h.EditVMACL)
 
 	// e.GET("/vm", h.GetVM)
@@ -212,8 +340,6 @@ func main() {
 	// e.POST("/getnode", h.GetNodeTestHander)
 	// e.DELETE("/deletevm", h.DeleteVM)
 	// e.POST("/cloneque", h.CloneQuestions)
-
-	e.Start(":8000")
 }
 
 func hello(c echo.Context) error {
@@ -1,58 +1,192 @@
 package main
 
 import (
-	"crypto/tls"
-	"log"
+	"encoding/json"
 	"net/http"
-	"os"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/LainInTheWired/ctf-backend/pveapi/pvefake"
+	"github.com/LainInTheWired/ctf-backend/pveapi/repository"
+	"github.com/LainInTheWired/ctf-backend/pveapi/service"
+	"github.com/labstack/echo/v4"
 )
 
-var app *App
+// newTestCluster は偽の Proxmox に接続したクラスタ id の PVEService を作ります
+func newTestCluster(t *testing.T, id string, cpu float64) (*pvefake.Server, *model.PVEConfig, service.PVEService) {
+	fake := pvefake.NewServer(pvefake.Node{Name: "pve01", CPU: cpu, Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	t.Cleanup(fake.Close)
+	fake.Token = "ctf@pve!token=" + id
+	fake.AddVM(pvefake.VM{Vmid: 9000, Node: "pve01", Template: true, Config: map[string]string{
+		"scsi0": "vmdisk:base-9000-disk-0,size=16G",
+		"net0":  "virtio=BC:24:11:00:00:01,bridge=vmbr0",
+	}})
 
-func TestMain(m *testing.M) {
-	var err error
+	config := &model.PVEConfig{
+		ID:               id,
+		APIURL:           fake.URL,
+		Authorization:    fake.Token,
+		CloneMode:        model.CloneModeFull,
+		Snippet:          model.SnippetConfig{Backend: repository.SnippetBackendNFS, StorageID: "cephfs", Dir: t.TempDir()},
+		TaskPollInterval: time.Millisecond,
+		LockBackoff:      time.Millisecond,
+	}
+	snippets, err := repository.NewSnippetStore(&config.Snippet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 本番と同じく Authorization ヘッダーはトランスポートで付与する
+	client := &http.Client{Transport: &MiddlewareTransport{Transport: fake.Client().Transport, Token: config.Authorization}}
+	return fake, config, newClusterService(config, client, snippets, repository.NewMemoryClusterCacheStore(), repository.NewMemoryWarmClaimStore())
+}
 
+// newTestApp は偽の Proxmox に接続した echo を作ります
+func newTestApp(t *testing.T) (*pvefake.Server, *echo.Echo) {
+	fake, config, s := newTestCluster(t, service.DefaultClusterID, 0.2)
+	clusters, err := service.NewClusters([]*model.PVEConfig{config}, []service.PVEService{s})
 	if err != nil {
-		log.Fatalf("Failed to initialize app: %v", err)
+		t.Fatal(err)
 	}
+	e := echo.New()
+	registerRoutes(e, clusters)
+	return fake, e
+}
 
-	// proxmoxapi初期化処理
-	config := &model.PVEConfig{
-		APIURL:        os.Getenv("PROXMOX_API_URL"),
-		Authorization: os.Getenv("PROXMOX_API_TOKEN"),
+func doJSON(t *testing.T, e *echo.Echo, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestVMLifecycle(t *testing.T) {
+	fake, e := newTestApp(t)
+
+	if rec := doJSON(t, e, http.MethodPost, "/cloudinit", `{"filename":"1-1-1.yaml","hostname":"q1","username":"ctf","sshkeys":["ssh-ed25519 AAAA test"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST /cloudinit = %d %s", rec.Code, rec.Body)
 	}
-	// httpclinet auth middleware
-	// カスタムトランスポートを作成
-	// カスタム Transport を設定（InsecureSkipVerify は本番環境では false に）
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // 本番では false にする
+
+	rec := doJSON(t, e, http.MethodPost, "/vm", `{"cloneid":9000,"name":"q1","cpu":2,"memory":2048,"disk":20,"cicustom":"1-1-1.yaml"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /vm = %d %s", rec.Code, rec.Body)
+	}
+	var created struct {
+		Data string `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	vmid, err := strconv.Atoi(created.Data)
+	if err != nil {
+		t.Fatalf("invalid vmid: %q", created.Data)
+	}
+	vm, ok := fake.VM(vmid)
+	if !ok || vm.Status != "running" || vm.Config["cores"] != "2" {
+		t.Fatalf("vm = %+v", vm)
 	}
 
-	// カスタム AuthTransport を作成
-	authTransport := &MiddlewareTransport{
-		Transport: tr,
-		Token:     config.Authorization,
+	rec = doJSON(t, e, http.MethodGet, "/cluster", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"vmid":`+created.Data) {
+		t.Errorf("GET /cluster = %d %s", rec.Code, rec.Body)
 	}
-	// カスタム HTTP クライアントの作成
-	client := &http.Client{
-		Transport: authTransport,
-		Timeout:   60 * time.Second,
+
+	// qemu-guest-agent が応答しない間は取得できない
+	if rec := doJSON(t, e, http.MethodGet, "/vm/"+created.Data+"/ips", ""); rec.Code == http.StatusOK {
+		t.Errorf("GET /vm/:vmid/ips without agent = %d", rec.Code)
+	}
+	fake.SetAgentIPs(vmid, map[string][]string{"eth0": {"10.0.0.5"}})
+	if rec := doJSON(t, e, http.MethodGet, "/vm/"+created.Data+"/ips", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "10.0.0.5") {
+		t.Errorf("GET /vm/:vmid/ips = %d %s", rec.Code, rec.Body)
 	}
 
-	// 設定のバリデーション
-	if config.APIURL == "" || config.Authorization == "" {
-		log.Fatal("必要な環境変数が設定されていません。PROXMOX_API_URL および PROXMOX_AUTHORIZATION を設定してください。")
+	if rec := doJSON(t, e, http.MethodDelete, "/vm", `{"id":`+created.Data+`}`); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /vm = %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fake.VM(vmid); ok {
+		t.Errorf("vm %d was not deleted", vmid)
 	}
+}
 
-	code := m.Run()
+func TestLockedVMConflict(t *testing.T) {
+	fake, e := newTestApp(t)
+	fake.AddVM(pvefake.VM{Vmid: 150, Node: "pve01", Status: "running"})
+	fake.LockVM(150, 100)
+	if rec := doJSON(t, e, http.MethodPost, "/template", `{"id":150}`); rec.Code != http.StatusConflict {
+		t.Errorf("POST /template on locked vm = %d %s", rec.Code, rec.Body)
+	}
+}
 
-	// テスト終了後のクリーンアップ
-	app.DB.Close()
-	app.Redis.Close()
+func TestMultiCluster(t *testing.T) {
+	fakeA, confA, a := newTestCluster(t, "pve-a", 0.8)
+	fakeB, confB, b := newTestCluster(t, "pve-b", 0.1)
+	fakeA.AddVM(pvefake.VM{Vmid: 9001, Node: "pve01", Template: true, Config: map[string]string{
+		"scsi0": "vmdisk:base-9001-disk-0,size=16G",
+	}})
+	clusters, err := service.NewClusters([]*model.PVEConfig{confA, confB}, []service.PVEService{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	registerRoutes(e, clusters)
+
+	// スニペットはどちらのクラスタにも作る
+	if rec := doJSON(t, e, http.MethodPost, "/cloudinit", `{"filename":"1-1-1.yaml","hostname":"q1"}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST /cloudinit = %d %s", rec.Code, rec.Body)
+	}
+	for _, id := range []string{"pve-a", "pve-b", ""} {
+		rec := doJSON(t, e, http.MethodGet, "/cloudinit?cluster="+id, "")
+		if !strings.Contains(rec.Body.String(), "1-1-1.yaml") {
+			t.Errorf("GET /cloudinit?cluster=%s = %s", id, rec.Body)
+		}
+	}
 
-	os.Exit(code)
+	// 負荷の低い pve-b に置かれる
+	rec := doJSON(t, e, http.MethodPost, "/vm", `{"cloneid":9000,"name":"q1","cpu":2,"memory":2048,"disk":20,"cicustom":"1-1-1.yaml"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /vm = %d %s", rec.Code, rec.Body)
+	}
+	var created struct {
+		Data    string `json:"data"`
+		Cluster string `json:"cluster"`
+		Type    string `json:"type"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	vmid, _ := strconv.Atoi(created.Data)
+	if created.Cluster != "pve-b" || created.Type != model.GuestQEMU {
+		t.Fatalf("created on cluster %q as %q", created.Cluster, created.Type)
+	}
+	if _, ok := fakeB.VM(vmid); !ok {
+		t.Fatalf("vm %d not found in pve-b", vmid)
+	}
+
+	// ?cluster= で指定したクラスタに送られる
+	rec = doJSON(t, e, http.MethodGet, "/cluster", "")
+	if !strings.Contains(rec.Body.String(), `"cluster":"pve-b"`) || !strings.Contains(rec.Body.String(), `"cluster":"pve-a"`) {
+		t.Errorf("GET /cluster = %s", rec.Body)
+	}
+	if rec := doJSON(t, e, http.MethodDelete, "/vm?cluster=pve-a", `{"id":`+created.Data+`}`); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE /vm?cluster=pve-a = %d %s", rec.Code, rec.Body)
+	}
+	if rec := doJSON(t, e, http.MethodDelete, "/vm?cluster=pve-b", `{"id":`+created.Data+`}`); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /vm?cluster=pve-b = %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := fakeB.VM(vmid); ok {
+		t.Errorf("vm %d was not deleted", vmid)
+	}
+	if fakeA.Hits("POST", "/nodes/pve01/qemu/9000/clone") != 0 {
+		t.Errorf("pve-a received clone request")
+	}
+
+	// クローン元のテンプレートが pve-a にしかない場合は負荷が高くても pve-a に置かれる
+	rec = doJSON(t, e, http.MethodPost, "/vm", `{"cloneid":9001,"name":"q2","cpu":2,"memory":2048,"disk":20,"cicustom":"1-1-1.yaml"}`)
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	if rec.Code != http.StatusOK || created.Cluster != "pve-a" {
+		t.Errorf("POST /vm with template only in pve-a = %d %s", rec.Code, rec.Body)
+	}
+	if rec := doJSON(t, e, http.MethodGet, "/vm/1/status?cluster=unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown cluster = %d", rec.Code)
+	}
 }
@@ -0,0 +1,27 @@
+package model
+
+// AgentExecStatus は QEMU guest agent の exec-status のレスポンスです
+// Proxmox は真偽値を 0/1 で返す
+type AgentExecStatus struct {
+	Exited       int    `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal,omitempty"`
+	OutData      string `json:"out-data,omitempty"`
+	ErrData      string `json:"err-data,omitempty"`
+	OutTruncated int    `json:"out-truncated,omitempty"`
+	ErrTruncated int    `json:"err-truncated,omitempty"`
+}
+
+// AgentFile は QEMU guest agent の file-read のレスポンスです
+type AgentFile struct {
+	Content   string `json:"content"`
+	Truncated int    `json:"truncated,omitempty"`
+}
+
+// AgentFileWrite は VM に書き込むファイルです
+type AgentFileWrite struct {
+	Path    string
+	Content string
+	// Content がすでに base64 でエンコードされている場合 (バイナリを書き込む場合)
+	Base64 bool
+}
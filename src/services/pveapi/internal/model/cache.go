@@ -0,0 +1,35 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Redis に保存するクラスタのキャッシュのキー (%s はクラスタの ID)
+// 他のサービスからも vmid からノードを引けるように公開しておく
+const (
+	ClusterCacheSnapshotKey = "pve:%s:snapshot" // ClusterSnapshot の JSON
+	ClusterCacheVMNodeKey   = "pve:%s:vmnode"   // vmid -> ノード名 のハッシュ
+	ClusterCacheVMTypeKey   = "pve:%s:vmtype"   // vmid -> qemu / lxc のハッシュ
+	ClusterCacheUpdatedKey  = "pve:%s:updated"  // 取得を始めた時刻 (unix ミリ秒)
+	// 最後に VM を変更した時刻 (unix ミリ秒)。これより前に取得したスナップショットは使わない
+	ClusterCacheInvalidatedKey = "pve:%s:invalidated"
+)
+
+// ClusterCacheKey はクラスタ cluster のキャッシュのキーを返します
+func ClusterCacheKey(key string, cluster string) string {
+	return fmt.Sprintf(key, cluster)
+}
+
+// ClusterSnapshot はある時点の /cluster/resources と /nodes の結果です
+type ClusterSnapshot struct {
+	Resources []ClusterResources `json:"resources"`
+	Nodes     []NodeList         `json:"nodes"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// CacheConfig はクラスタのキャッシュの設定です
+type CacheConfig struct {
+	MaxStale        time.Duration // これより古いキャッシュは使わずに Proxmox に問い合わせる
+	RefreshInterval time.Duration // バックグラウンドで更新する間隔 (0 の場合は更新しない)
+}
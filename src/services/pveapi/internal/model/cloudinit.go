@@ -2,23 +2,102 @@ package model
 
 // CloudConfig represents the top-level cloud-init configuration
 type CloudinitConfig struct {
-	Hostname  string   `yaml:"hostname,omitempty"`
-	FQDN      string   `yaml:"fqdn,omitempty"`
-	SshPwauth int      `yaml:"ssh_pwauth,omitempty"`
-	Users     []User   `yaml:"users,omitempty"`
-	Packages  []string `yaml:"packages,omitempty"`
-	RunCmd    []string `yaml:"runcmd,omitempty"`
+	Hostname       string      `yaml:"hostname,omitempty" json:"hostname,omitempty"`
+	FQDN           string      `yaml:"fqdn,omitempty" json:"fqdn,omitempty"`
+	SshPwauth      int         `yaml:"ssh_pwauth,omitempty" json:"ssh_pwauth,omitempty"`
+	Users          []User      `yaml:"users,omitempty" json:"users,omitempty"`
+	Chpasswd       *Chpasswd   `yaml:"chpasswd,omitempty" json:"chpasswd,omitempty"`
+	PackageUpdate  *bool       `yaml:"package_update,omitempty" json:"package_update,omitempty"`
+	PackageUpgrade *bool       `yaml:"package_upgrade,omitempty" json:"package_upgrade,omitempty"`
+	Packages       []string    `yaml:"packages,omitempty" json:"packages,omitempty"`
+	WriteFiles     []WriteFile `yaml:"write_files,omitempty" json:"write_files,omitempty"`
+	BootCmd        []string    `yaml:"bootcmd,omitempty" json:"bootcmd,omitempty"`
+	RunCmd         []string    `yaml:"runcmd,omitempty" json:"runcmd,omitempty"`
 }
 
 // User represents a user configuration in cloud-init
 type User struct {
-	Name string `yaml:"name"`
-	Sudo string `yaml:"sudo,omitempty"`
-	// Passwd            string   `yaml:"passwd,omitempty"`
-	PlainTextPasswd   string   `yaml:"plain_text_passwd,omitempty"`
-	Groups            string   `yaml:"groups,omitempty"`
-	Shell             string   `yaml:"shell,omitempty"`
-	LockPasswd        bool     `yaml:"lock_passwd"`
-	SshAuthorizedKeys []string `yaml:"ssh-authorized-keys,omitempty"`
-	SshPwauth         string   `yaml:"ssh_pwauth,omitempty"`
+	Name string `yaml:"name" json:"name"`
+	Sudo string `yaml:"sudo,omitempty" json:"sudo,omitempty"`
+	// SHA-512 crypt のハッシュ
+	Passwd string `yaml:"passwd,omitempty" json:"passwd,omitempty"`
+	// 平文のパスワードはスニペットに書き出さず、生成時に Passwd へハッシュ化する
+	PlainTextPasswd   string   `yaml:"-" json:"plain_text_passwd,omitempty"`
+	Groups            string   `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Shell             string   `yaml:"shell,omitempty" json:"shell,omitempty"`
+	LockPasswd        bool     `yaml:"lock_passwd" json:"lock_passwd"`
+	SshAuthorizedKeys []string `yaml:"ssh-authorized-keys,omitempty" json:"ssh_authorized_keys,omitempty"`
+	SshPwauth         string   `yaml:"ssh_pwauth,omitempty" json:"ssh_pwauth,omitempty"`
 }
+
+// Chpasswd は cloud-init の chpasswd モジュールの設定です
+type Chpasswd struct {
+	Expire *bool          `yaml:"expire,omitempty" json:"expire,omitempty"`
+	Users  []ChpasswdUser `yaml:"users,omitempty" json:"users,omitempty"`
+}
+
+type ChpasswdUser struct {
+	Name     string `yaml:"name" json:"name"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+	// text / hash / RANDOM
+	Type string `yaml:"type,omitempty" json:"type,omitempty"`
+}
+
+// WriteFile は cloud-init の write_files の 1 エントリです
+type WriteFile struct {
+	Path        string `yaml:"path" json:"path"`
+	Content     string `yaml:"content,omitempty" json:"content,omitempty"`
+	Owner       string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Permissions string `yaml:"permissions,omitempty" json:"permissions,omitempty"`
+	Encoding    string `yaml:"encoding,omitempty" json:"encoding,omitempty"`
+	Append      bool   `yaml:"append,omitempty" json:"append,omitempty"`
+	Defer       bool   `yaml:"defer,omitempty" json:"defer,omitempty"`
+}
+
+// NetworkConfig は network-config (version 2) のスニペットです
+type NetworkConfig struct {
+	Version   int                 `yaml:"version" json:"version"`
+	Ethernets map[string]Ethernet `yaml:"ethernets,omitempty" json:"ethernets,omitempty"`
+}
+
+type Ethernet struct {
+	Match       *EthernetMatch `yaml:"match,omitempty" json:"match,omitempty"`
+	SetName     string         `yaml:"set-name,omitempty" json:"set_name,omitempty"`
+	Dhcp4       bool           `yaml:"dhcp4,omitempty" json:"dhcp4,omitempty"`
+	Dhcp6       bool           `yaml:"dhcp6,omitempty" json:"dhcp6,omitempty"`
+	Addresses   []string       `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+	Gateway4    string         `yaml:"gateway4,omitempty" json:"gateway4,omitempty"`
+	Nameservers *Nameservers   `yaml:"nameservers,omitempty" json:"nameservers,omitempty"`
+}
+
+type EthernetMatch struct {
+	MACAddress string `yaml:"macaddress,omitempty" json:"macaddress,omitempty"`
+	Name       string `yaml:"name,omitempty" json:"name,omitempty"`
+}
+
+type Nameservers struct {
+	Addresses []string `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty" json:"search,omitempty"`
+}
+
+// MetaData は meta-data のスニペットです
+type MetaData struct {
+	InstanceID    string `yaml:"instance-id,omitempty" json:"instance_id,omitempty"`
+	LocalHostname string `yaml:"local-hostname,omitempty" json:"local_hostname,omitempty"`
+}
+
+// CloudinitDocument は 1 台の VM に渡す cloud-init スニペット一式です
+type CloudinitDocument struct {
+	User    *CloudinitConfig
+	Network *NetworkConfig
+	Meta    *MetaData
+	Vendor  *CloudinitConfig
+}
+
+// cicustom で参照するスニペットの種類
+const (
+	SnippetUser    = "user"
+	SnippetNetwork = "network"
+	SnippetMeta    = "meta"
+	SnippetVendor  = "vendor"
+)
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Proxmox API のエラーの種類 (errors.Is で判定する)
+var (
+	ErrPVENotFound = errors.New("proxmox: not found")
+	ErrPVELocked   = errors.New("proxmox: resource is locked")
+	ErrPVEQuota    = errors.New("proxmox: quota exceeded")
+	ErrPVEAuth     = errors.New("proxmox: authentication failed")
+	ErrPVEExists   = errors.New("proxmox: already exists")
+	// LXC のコンテナに guest agent の操作をした場合など
+	ErrGuestUnsupported = errors.New("proxmox: not supported by guest type")
+	// qcow2 と raw 以外のクラウドイメージを取り込もうとした場合
+	ErrImageFormat = errors.New("proxmox: image must be qcow2 or raw")
+)
+
+// PVEError は Proxmox API やタスクが返したエラーです
+type PVEError struct {
+	Method     string
+	Path       string
+	StatusCode int               // タスクの失敗の場合は 0
+	Message    string            // ステータス行またはタスクの exitstatus
+	Errors     map[string]string // パラメーターごとのエラー
+	Kind       error             // ErrPVENotFound などの種類 (不明な場合は nil)
+}
+
+func (e *PVEError) Error() string {
+	msg := fmt.Sprintf("proxmox %s %s: %d %s", e.Method, e.Path, e.StatusCode, e.Message)
+	if len(e.Errors) > 0 {
+		msg += fmt.Sprintf(" %v", e.Errors)
+	}
+	return msg
+}
+
+func (e *PVEError) Unwrap() error {
+	return e.Kind
+}
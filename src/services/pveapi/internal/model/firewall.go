@@ -0,0 +1,28 @@
+package model
+
+// FirewallRule は VM の Proxmox ファイアウォールのルールです
+type FirewallRule struct {
+	Pos     int    `json:"pos"`
+	Type    string `json:"type"`   // in / out / group
+	Action  string `json:"action"` // ACCEPT / DROP / REJECT、type が group の場合はセキュリティグループ名
+	Proto   string `json:"proto,omitempty"`
+	Dport   string `json:"dport,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Dest    string `json:"dest,omitempty"`
+	Enable  int    `json:"enable"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// FirewallOptions は VM のファイアウォールの有効化とデフォルトのポリシーです
+type FirewallOptions struct {
+	Enable    bool   `json:"enable"`
+	PolicyIn  string `json:"policy_in,omitempty"`
+	PolicyOut string `json:"policy_out,omitempty"`
+}
+
+// VMFirewall は VM に適用するファイアウォールの設定一式です
+type VMFirewall struct {
+	Options FirewallOptions `json:"options"`
+	Groups  []string        `json:"groups,omitempty"`
+	Rules   []FirewallRule  `json:"rules,omitempty"`
+}
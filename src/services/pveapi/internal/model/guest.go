@@ -0,0 +1,26 @@
+package model
+
+// ゲストの種類 (/cluster/resources の type と API のパスの /nodes/{node}/{type})
+const (
+	GuestQEMU = "qemu"
+	GuestLXC  = "lxc"
+)
+
+// Guest は vmid の VM またはコンテナがあるノードと種類です
+type Guest struct {
+	Node string `json:"node"`
+	Type string `json:"type"`
+}
+
+// IsGuestType は QEMU の VM か LXC のコンテナの場合に true を返します
+func IsGuestType(t string) bool {
+	return t == GuestQEMU || t == GuestLXC
+}
+
+// LXCInterface は /nodes/{node}/lxc/{vmid}/interfaces のレスポンスです
+type LXCInterface struct {
+	Name   string `json:"name"`
+	Hwaddr string `json:"hwaddr"`
+	Inet   string `json:"inet"`  // 例: 10.0.1.10/24
+	Inet6  string `json:"inet6"` // 例: fe80::1/64
+}
@@ -0,0 +1,39 @@
+package model
+
+// ImageContent はクラウドイメージを置くストレージの content の種類です
+// import の content を有効にしたストレージ (local など) だけが受け取れる
+const ImageContent = "import"
+
+// ImageImport はストレージに取り込むクラウドイメージです
+// URL が空の場合はアップロードされたファイルを取り込む
+type ImageImport struct {
+	Node     string // 空の場合は最も負荷の低いノード
+	Storage  string
+	Filename string // 例: noble-server-cloudimg-amd64.qcow2 (拡張子で形式を判定する)
+	URL      string
+	// ダウンロードしたファイルを確認するハッシュ (URL の場合のみ)
+	Checksum          string
+	ChecksumAlgorithm string // sha256 / sha512 など
+}
+
+// ImportedImage は取り込んだイメージのボリュームです
+type ImportedImage struct {
+	Node  string `json:"node"`
+	Volid string `json:"volid"` // 例: local:import/noble-server-cloudimg-amd64.qcow2
+}
+
+// VMCreate はクラウドイメージから作る VM の設定です
+// ディスクはイメージを import-from で取り込み、cloud-init のドライブと guest agent を有効にする
+type VMCreate struct {
+	Vmid    int // 0 の場合は次の空いている vmid
+	Node    string
+	Name    string
+	Cores   int
+	Memory  int    // MB
+	Disk    int    // GB (0 の場合はイメージのまま)
+	Storage string // VM のディスクと cloud-init のドライブを置くストレージ
+	Image   string // 取り込むイメージのボリューム
+	Bridge  string
+	// 最初の起動で使う user-data のスニペット (空の場合は使わない)
+	Cicustom string
+}
@@ -0,0 +1,46 @@
+package model
+
+// rrddata の期間 (Proxmox の timeframe)
+const (
+	TimeframeHour  = "hour"
+	TimeframeDay   = "day"
+	TimeframeWeek  = "week"
+	TimeframeMonth = "month"
+	TimeframeYear  = "year"
+)
+
+// ValidTimeframe は Proxmox が受け付ける timeframe かどうかを返します
+func ValidTimeframe(tf string) bool {
+	switch tf {
+	case TimeframeHour, TimeframeDay, TimeframeWeek, TimeframeMonth, TimeframeYear:
+		return true
+	}
+	return false
+}
+
+// RRDData は rrddata の 1 点 (期間ごとの平均) です
+// VM が停止していた時刻などは time 以外が返らないため 0 になる
+type RRDData struct {
+	Time      int64   `json:"time"`
+	CPU       float64 `json:"cpu"` // 0-1 (maxcpu 個の CPU に対する割合)
+	MaxCPU    float64 `json:"maxcpu"`
+	Mem       float64 `json:"mem,omitempty"` // VM のみ (bytes)
+	MaxMem    float64 `json:"maxmem,omitempty"`
+	MemUsed   float64 `json:"memused,omitempty"` // ノードのみ (bytes)
+	MemTotal  float64 `json:"memtotal,omitempty"`
+	NetIn     float64 `json:"netin"` // bytes/s
+	NetOut    float64 `json:"netout"`
+	DiskRead  float64 `json:"diskread,omitempty"` // VM のみ (bytes/s)
+	DiskWrite float64 `json:"diskwrite,omitempty"`
+	LoadAvg   float64 `json:"loadavg,omitempty"` // ノードのみ
+	IOWait    float64 `json:"iowait,omitempty"`
+}
+
+// Metrics は VM またはノードの rrddata です
+type Metrics struct {
+	Cluster   string    `json:"cluster,omitempty"`
+	Node      string    `json:"node"`
+	Vmid      int       `json:"vmid,omitempty"`
+	Timeframe string    `json:"timeframe"`
+	Data      []RRDData `json:"data"`
+}
@@ -0,0 +1,46 @@
+package model
+
+// アイドル状態の VM の止め方
+const (
+	IdleModeSuspend   = "suspend"   // メモリに残したまま一時停止する (すぐに再開できる)
+	IdleModeHibernate = "hibernate" // メモリをディスクに書き出して停止する (ホストのメモリを空ける)
+)
+
+// VM の電源の状態
+const (
+	PowerRunning    = "running"
+	PowerPaused     = "paused"     // suspend で一時停止している
+	PowerHibernated = "hibernated" // hibernate で停止している
+	PowerStopped    = "stopped"
+)
+
+// IdlePolicy はアイドル状態の VM を止める条件です
+type IdlePolicy struct {
+	Mode string `json:"mode"`
+	// 直近 IdleMinutes 分の送受信がすべて Threshold 以下ならアイドルとみなす
+	IdleMinutes int     `json:"idle_minutes"`
+	Threshold   float64 `json:"threshold"` // netin + netout (bytes/s)
+}
+
+// PowerState は VM の電源の状態と直前の操作の結果です
+type PowerState struct {
+	Vmid  int    `json:"vmid"`
+	State string `json:"state"`
+	// SuspendIdle でアイドルと判定された
+	Idle bool `json:"idle,omitempty"`
+	// 今回の呼び出しで止めた・再開した
+	Changed bool `json:"changed"`
+}
+
+// PowerStateOf は status/current のレスポンスから電源の状態を返します
+func PowerStateOf(s *VMStatus) string {
+	switch {
+	case s.Status == "running" && s.QMPStatus == "paused":
+		return PowerPaused
+	case s.Status == "running":
+		return PowerRunning
+	case s.Lock == "suspended":
+		return PowerHibernated
+	}
+	return PowerStopped
+}
@@ -1,9 +1,54 @@
 package model
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 // ProxmoxConfig はProxmoxへの接続設定を保持します
 type PVEConfig struct {
+	// クラスタの ID (複数のクラスタを登録する場合に区別する。cloudinit.cluster_id に保存される)
+	ID            string
 	APIURL        string
 	Authorization string
+	// クローン時のデフォルト設定
+	CloneMode    string // "full" または "linked"
+	CloneStorage string // フルクローン時の保存先ストレージ
+	Pool         string // クローンしたVMを追加するリソースプール
+	Snippet      SnippetConfig
+	// チームごとの VNet を作る SDN ゾーン
+	SDNZone     string
+	SDNZoneType string // "vlan" など
+	SDNBridge   string // VLAN ゾーンが使うブリッジ
+	// API 呼び出しのタイムアウトとリトライ (0 の場合はデフォルト値)
+	RequestTimeout   time.Duration // 1 回のリクエストのタイムアウト
+	TaskTimeout      time.Duration // 非同期タスクの終了を待つ上限
+	TaskPollInterval time.Duration
+	LockRetries      int           // ロック中のエラーをリトライする回数
+	LockBackoff      time.Duration // 最初のリトライまでの待ち時間 (以降倍にする)
+	// クラスタのリソース一覧のキャッシュ
+	Cache CacheConfig
+	// テンプレートごとのクローン済みの VM
+	WarmPool WarmPoolConfig
+}
+
+// Placement は VM を作成するクラスタとノードです
+type Placement struct {
+	Cluster string  `json:"cluster"`
+	Node    string  `json:"node"`
+	CPU     float64 `json:"cpu"` // 選んだ時点のノードの CPU 負荷
+}
+
+// SnippetConfig は cloud-init スニペットの保存先を保持します
+type SnippetConfig struct {
+	Backend        string // "sftp" または "nfs"
+	StorageID      string // Proxmox 側のストレージID (例: cephfs)
+	Dir            string // スニペットを保存するディレクトリ
+	SFTPHost       string // host:port
+	SFTPUser       string
+	SFTPKeyPath    string
+	KnownHostsPath string
 }
 
 // VMConfig は作成するVMの設定を保持します
@@ -43,6 +88,10 @@ type VMConfig struct {
 	SMBIOS1    string `json:"smbios1"`
 	Memory     string `json:"memory"`
 	ScsiHW     string `json:"scsihw"`
+	Template   int    `json:"template"`
+	// LXC のコンテナの設定
+	Hostname string `json:"hostname"`
+	Rootfs   string `json:"rootfs"`
 }
 
 // type NodeList struct {
@@ -88,6 +137,7 @@ type VMList struct {
 type VMEdit struct {
 	Vmid     int
 	Node     string
+	Name     string
 	CPU      string
 	Cores    int
 	Boot     string
@@ -95,7 +145,53 @@ type VMEdit struct {
 	Ipconfig []string
 	Memory   int
 	Scsi     []string
+	Net      []string
 	Cicustom string
+	// user-data 以外のスニペット (存在する場合のみ)
+	CicustomNetwork string
+	CicustomMeta    string
+	CicustomVendor  string
+	// Proxmox のタグ (; 区切り)
+	Tags string
+	// 設定から削除する項目 (例: cicustom)
+	Delete []string
+}
+
+const (
+	CloneModeFull   = "full"
+	CloneModeLinked = "linked"
+)
+
+// VMClone はクローンの設定を保持します
+type VMClone struct {
+	Name    string
+	Newid   int
+	Cloneid int
+	Node    string // クローン元のノード
+	Target  string // クローン先のノード
+	Mode    string // CloneModeFull または CloneModeLinked
+	Storage string // フルクローン時のみ有効
+	Pool    string
+	// テンプレートの種類 (GuestQEMU / GuestLXC)。空の場合はテンプレートから決める
+	Type string
+}
+
+// Pool は Proxmox のリソースプールです
+type Pool struct {
+	PoolID  string `json:"poolid"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Disk は scsi0 などのディスク設定を分解したものです
+// 例: "vmdisk:base-9000-disk-0,discard=on,size=16G"
+type Disk struct {
+	Storage string
+	Volume  string
+	Options []string
+}
+
+func (d *Disk) String() string {
+	return strings.Join(append([]string{fmt.Sprintf("%s:%s", d.Storage, d.Volume)}, d.Options...), ",")
 }
 
 type VMDelete struct {
@@ -104,8 +200,18 @@ type VMDelete struct {
 }
 
 type ResponsePVE[T any] struct {
-	Data   T                 `json:"data"`
-	Errors map[string]string `json:"errors,omitempty"`
+	Data    T                 `json:"data"`
+	Errors  map[string]string `json:"errors,omitempty"`
+	Message string            `json:"message,omitempty"`
+}
+
+// TaskStatus は /nodes/{node}/tasks/{upid}/status のレスポンスです
+type TaskStatus struct {
+	UPID       string `json:"upid"`
+	Node       string `json:"node"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`     // running / stopped
+	ExitStatus string `json:"exitstatus"` // 終了時のみ、成功した場合は OK
 }
 
 type ClusterResources struct {
@@ -127,6 +233,12 @@ type ClusterResources struct {
 	Disk      int     `json:"disk"`
 	Netout    int     `json:"netout"`
 	Vmid      int     `json:"vmid"`
+	Tags      string  `json:"tags,omitempty"`
+	Pool      string  `json:"pool,omitempty"`
+	// リソースがあるクラスタの ID (pveapi が付ける)
+	Cluster string `json:"cluster,omitempty"`
+	// Tags から取り出したコンテストの情報 (コンテストの VM のみ)
+	Instance *InstanceTags `json:"instance,omitempty"`
 }
 
 type NetworkIntQumeAgent struct {
@@ -142,11 +254,13 @@ type NetworkIntQumeAgent struct {
 	} `json:"statistics"`
 	Name            string `json:"name"`
 	HardwareAddress string `json:"hardware-address"`
-	IPAddresses     []struct {
-		IPAddressType string `json:"ip-address-type"`
-		Prefix        int    `json:"prefix"`
-		IPAddress     string `json:"ip-address"`
-	} `json:"ip-addresses"`
+	IPAddresses     []IPAddress `json:"ip-addresses"`
+}
+
+type IPAddress struct {
+	IPAddressType string `json:"ip-address-type"`
+	Prefix        int    `json:"prefix"`
+	IPAddress     string `json:"ip-address"`
 }
 
 // type ClusterResources struct {
@@ -0,0 +1,34 @@
+package model
+
+// VM が使えるようになるまでの段階 (この順に確認する)
+const (
+	StageRunning   = "running"    // VM が起動している
+	StageAgent     = "agent"      // QEMU guest agent が応答する
+	StageCloudinit = "cloud-init" // cloud-init が終わっている
+	StageIP        = "ip"         // ループバック以外の IP アドレスがある
+)
+
+// VMStatus は /nodes/{node}/qemu/{vmid}/status/current のレスポンスです
+type VMStatus struct {
+	Status    string `json:"status"`    // running / stopped
+	QMPStatus string `json:"qmpstatus"` // running / paused など
+	Agent     int    `json:"agent"`     // guest agent が有効な場合は 1
+	Uptime    int    `json:"uptime"`
+	Lock      string `json:"lock"` // ハイバネート中は suspended
+}
+
+// ReadinessStage は段階ごとの確認結果です
+type ReadinessStage struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// VMReadiness は VM が使えるかどうかを表します
+// Ready はすべての段階を通過した場合のみ true
+type VMReadiness struct {
+	Vmid   int                 `json:"vmid"`
+	Ready  bool                `json:"ready"`
+	Stages []ReadinessStage    `json:"stages"`
+	IPs    map[string][]string `json:"ips,omitempty"`
+}
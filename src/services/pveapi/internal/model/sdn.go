@@ -0,0 +1,23 @@
+package model
+
+// VNet はチームごとに作成する SDN の VNet とサブネットです
+type VNet struct {
+	Name    string `json:"vnet"`
+	Zone    string `json:"zone"`
+	Tag     int    `json:"tag"`
+	Alias   string `json:"alias,omitempty"`
+	Subnet  string `json:"subnet,omitempty"`  // 例: 10.0.100.0/24
+	Gateway string `json:"gateway,omitempty"` // 例: 10.0.100.1
+}
+
+type SDNZone struct {
+	Zone   string `json:"zone"`
+	Type   string `json:"type"`
+	Bridge string `json:"bridge,omitempty"`
+}
+
+type SDNSubnet struct {
+	Subnet  string `json:"subnet"`
+	CIDR    string `json:"cidr"`
+	Gateway string `json:"gateway,omitempty"`
+}
@@ -0,0 +1,80 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// タグはすべてこの接頭辞で始める (手動で付けたタグと区別するため)
+const tagPrefix = "ctf-"
+
+// Proxmox のタグに使えない文字
+var invalidTagChars = regexp.MustCompile(`[^a-z0-9_\-+.]`)
+
+// InstanceTags はコンテストの VM に付ける Proxmox のタグです
+// 例: ctf-contest-1;ctf-team-2;ctf-question-3;ctf-by-contest
+// ウォームプールの VM はクローン元のテンプレートを付ける (例: ctf-warm-9000;ctf-by-warmpool)
+type InstanceTags struct {
+	ContestID  int    `json:"contest_id,omitempty"`
+	TeamID     int    `json:"team_id,omitempty"`
+	QuestionID int    `json:"question_id,omitempty"`
+	Warm       int    `json:"warm,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+}
+
+func (t InstanceTags) IsZero() bool {
+	return t == InstanceTags{}
+}
+
+// String は Proxmox の tags パラメータの形式 (; 区切り) に変換します
+func (t InstanceTags) String() string {
+	tags := []string{}
+	if t.ContestID != 0 {
+		tags = append(tags, fmt.Sprintf("%scontest-%d", tagPrefix, t.ContestID))
+	}
+	if t.TeamID != 0 {
+		tags = append(tags, fmt.Sprintf("%steam-%d", tagPrefix, t.TeamID))
+	}
+	if t.QuestionID != 0 {
+		tags = append(tags, fmt.Sprintf("%squestion-%d", tagPrefix, t.QuestionID))
+	}
+	if t.Warm != 0 {
+		tags = append(tags, fmt.Sprintf("%swarm-%d", tagPrefix, t.Warm))
+	}
+	if by := invalidTagChars.ReplaceAllString(strings.ToLower(t.CreatedBy), "-"); by != "" {
+		tags = append(tags, tagPrefix+"by-"+by)
+	}
+	return strings.Join(tags, ";")
+}
+
+// ParseInstanceTags は Proxmox が返す tags から InstanceTags を取り出します
+// ctf- で始まらないタグは無視する
+func ParseInstanceTags(tags string) InstanceTags {
+	t := InstanceTags{}
+	for _, tag := range strings.FieldsFunc(tags, func(r rune) bool { return r == ';' || r == ',' || r == ' ' }) {
+		rest, ok := strings.CutPrefix(tag, tagPrefix)
+		if !ok {
+			continue
+		}
+		key, value, ok := strings.Cut(rest, "-")
+		if !ok {
+			continue
+		}
+		id, _ := strconv.Atoi(value)
+		switch key {
+		case "contest":
+			t.ContestID = id
+		case "team":
+			t.TeamID = id
+		case "question":
+			t.QuestionID = id
+		case "warm":
+			t.Warm = id
+		case "by":
+			t.CreatedBy = value
+		}
+	}
+	return t
+}
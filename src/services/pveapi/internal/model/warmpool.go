@@ -0,0 +1,30 @@
+package model
+
+import "time"
+
+// WarmPoolCreatedBy はウォームプールの VM の created-by タグに使う名前です
+const WarmPoolCreatedBy = "warmpool"
+
+// WarmPoolConfig はクラスタのウォームプールの設定です
+// テンプレートごとにクローン済みで停止した VM を用意しておき、CreateCloudinitVM で払い出す
+type WarmPoolConfig struct {
+	// テンプレートの vmid ごとに用意しておく VM の数
+	Sizes map[int]int
+	// バックグラウンドで補充する間隔 (0 の場合は補充しない)
+	Interval time.Duration
+}
+
+// WarmPoolStatus はテンプレート 1 つ分のウォームプールの状態です
+type WarmPoolStatus struct {
+	Cluster  string `json:"cluster"`
+	Template int    `json:"template"`
+	Size     int    `json:"size"`
+	// 払い出せる VM の数
+	Ready int `json:"ready"`
+	// 今回の補充で作成した VM
+	Created []int  `json:"created,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WarmClaimKey は払い出し中のウォームプールの VM を表す Redis のキーです (クラスタの ID と vmid)
+const WarmClaimKey = "pve:%s:warm-claim:%d"
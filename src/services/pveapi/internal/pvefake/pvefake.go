@@ -0,0 +1,1099 @@
+// Package pvefake はテスト用に Proxmox VE の API を httptest でシミュレートします
+// pveRepository が使うエンドポイントだけを実装し、クローンなどは非同期タスクとして扱います
+package pvefake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+)
+
+// Node は偽のクラスタのノードです
+type Node struct {
+	Name    string
+	Status  string // 省略時は online
+	CPU     float64
+	Maxcpu  int
+	Maxmem  int64
+	Maxdisk int64
+	// rrddata で返す値
+	RRD []model.RRDData
+}
+
+// VM は偽のクラスタ上の VM または LXC のコンテナです
+type VM struct {
+	Vmid     int
+	Node     string
+	Type     string // qemu / lxc (省略時は qemu)
+	Name     string
+	Status   string // running / stopped
+	Template bool
+	Pool     string
+	Config   map[string]string
+	// 実行中のタスクの種類 (clone など)。空でなければロックされている
+	Lock string
+	// qemu-guest-agent が返すインターフェースごとのアドレス
+	AgentIPs map[string][]string
+	// guest agent で読み書きできるファイル (パスごとの内容)
+	Files map[string]string
+	// rrddata で返す値
+	RRD []model.RRDData
+	// suspend で一時停止している (Status は running のまま)
+	Paused bool
+	// suspend (todisk=1) でハイバネートしている (Status は stopped)
+	Hibernated bool
+}
+
+type process struct {
+	polls  int
+	status model.AgentExecStatus
+}
+
+type task struct {
+	upid  string
+	node  string
+	polls int // 終了までに必要な残りのステータス確認の回数
+	exit  string
+	done  func(ok bool)
+}
+
+// Server は偽の Proxmox API サーバーです
+type Server struct {
+	*httptest.Server
+	// Authorization ヘッダーに期待するトークン (空の場合は確認しない)
+	Token string
+	// タスクが終了するまでに必要なステータス確認の回数
+	TaskPolls int
+	// guest agent の exec で実行されるコマンド (nil の場合は終了コード 0 で何も出力しない)
+	Exec func(vmid int, command []string, input string) (exitcode int, out string, errOut string)
+
+	mu     sync.Mutex
+	nodes  []Node
+	vms    map[int]*VM
+	tasks  map[string]*task
+	acls   []url.Values
+	pools  map[string]bool
+	procs  map[int]*process
+	hits   map[string]int    // "GET /cluster/resources" などのリクエストの回数
+	locks  map[int]int       // vmid ごとに残りのロックエラーの回数
+	fails  map[string]string // タスクの種類ごとに失敗させる exitstatus
+	nextID int
+	seq    int
+
+	// ストレージに置かれたイメージ ("node/storage:import/file" ごとの URL またはアップロードされた内容)
+	volumes map[string]string
+}
+
+// NewServer は nodes を持つ偽のクラスタを起動します。終了時に Close すること
+func NewServer(nodes ...Node) *Server {
+	s := &Server{
+		TaskPolls: 1,
+		vms:       map[int]*VM{},
+		tasks:     map[string]*task{},
+		locks:     map[int]int{},
+		hits:      map[string]int{},
+		fails:     map[string]string{},
+		pools:     map[string]bool{},
+		procs:     map[int]*process{},
+		volumes:   map[string]string{},
+		nextID:    100,
+	}
+	for _, n := range nodes {
+		if n.Status == "" {
+			n.Status = "online"
+		}
+		s.nodes = append(s.nodes, n)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /nodes", s.listNodes)
+	// VM とコンテナは /nodes/{node}/qemu と /nodes/{node}/lxc の同じ形の API で操作する
+	for _, kind := range []string{model.GuestQEMU, model.GuestLXC} {
+		base := "/nodes/{node}/" + kind
+		mux.HandleFunc("GET "+base, s.listVMs)
+		mux.HandleFunc("GET "+base+"/{vmid}/config", s.getConfig)
+		mux.HandleFunc("POST "+base+"/{vmid}/clone", s.clone)
+		mux.HandleFunc("POST "+base+"/{vmid}/status/{action}", s.status)
+		mux.HandleFunc("PUT "+base+"/{vmid}/resize", s.resize)
+		mux.HandleFunc("POST "+base+"/{vmid}/template", s.template)
+		mux.HandleFunc("DELETE "+base+"/{vmid}", s.deleteVM)
+		mux.HandleFunc("GET "+base+"/{vmid}/status/current", s.currentStatus)
+		mux.HandleFunc("GET "+base+"/{vmid}/rrddata", s.vmRRDData)
+	}
+	// Proxmox と同じく VM の設定は POST、コンテナの設定は PUT で変更する
+	mux.HandleFunc("POST /nodes/{node}/qemu/{vmid}/config", s.editConfig)
+	mux.HandleFunc("PUT /nodes/{node}/lxc/{vmid}/config", s.editConfig)
+	mux.HandleFunc("GET /nodes/{node}/lxc/{vmid}/interfaces", s.lxcInterfaces)
+	mux.HandleFunc("GET /nodes/{node}/qemu/{vmid}/agent/network-get-interfaces", s.agentInterfaces)
+	mux.HandleFunc("GET /nodes/{node}/rrddata", s.nodeRRDData)
+	mux.HandleFunc("POST /nodes/{node}/qemu/{vmid}/agent/ping", s.agentPing)
+	mux.HandleFunc("POST /nodes/{node}/qemu/{vmid}/agent/exec", s.agentExec)
+	mux.HandleFunc("GET /nodes/{node}/qemu/{vmid}/agent/exec-status", s.agentExecStatus)
+	mux.HandleFunc("GET /nodes/{node}/qemu/{vmid}/agent/file-read", s.agentFileRead)
+	mux.HandleFunc("POST /nodes/{node}/qemu/{vmid}/agent/file-write", s.agentFileWrite)
+	mux.HandleFunc("GET /nodes/{node}/tasks/{upid}/status", s.taskStatus)
+	mux.HandleFunc("POST /nodes/{node}/qemu", s.createVM)
+	mux.HandleFunc("POST /nodes/{node}/storage/{storage}/download-url", s.downloadURL)
+	mux.HandleFunc("POST /nodes/{node}/storage/{storage}/upload", s.upload)
+	mux.HandleFunc("GET /cluster/resources", s.clusterResources)
+	mux.HandleFunc("GET /cluster/nextid", s.nextVMID)
+	mux.HandleFunc("PUT /access/acl", s.editACL)
+	mux.HandleFunc("GET /pools", s.listPools)
+	mux.HandleFunc("POST /pools", s.createPool)
+	mux.HandleFunc("PUT /pools/{poolid}", s.updatePool)
+	s.Server = httptest.NewServer(s.auth(mux))
+	return s
+}
+
+// Hits は method と path へのリクエストの回数を返します
+func (s *Server) Hits(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[method+" "+path]
+}
+
+// Pools は作成されたリソースプールを昇順で返します
+func (s *Server) Pools() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.poolIDs()
+}
+
+func (s *Server) poolIDs() []string {
+	ids := []string{}
+	for id := range s.pools {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// AddVM は VM を直接追加します (テンプレートの用意などに使う)
+func (s *Server) AddVM(vm VM) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if vm.Status == "" {
+		vm.Status = "stopped"
+	}
+	if vm.Type == "" {
+		vm.Type = model.GuestQEMU
+	}
+	if vm.Config == nil {
+		vm.Config = map[string]string{}
+	}
+	if vm.Files == nil {
+		vm.Files = map[string]string{}
+	}
+	s.vms[vm.Vmid] = &vm
+}
+
+// VM は vmid の VM のコピーを返します
+func (s *Server) VM(vmid int) (VM, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vms[vmid]
+	if !ok {
+		return VM{}, false
+	}
+	c := *vm
+	c.Config = map[string]string{}
+	for k, v := range vm.Config {
+		c.Config[k] = v
+	}
+	c.Files = map[string]string{}
+	for k, v := range vm.Files {
+		c.Files[k] = v
+	}
+	return c, true
+}
+
+// VMs はすべての VM の vmid を昇順で返します
+func (s *Server) VMs() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []int{}
+	for id := range s.vms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// ACLs はこれまでに設定された ACL のパラメーターを返します
+func (s *Server) ACLs() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]url.Values{}, s.acls...)
+}
+
+// Volume はノードのストレージに置かれたイメージの URL またはアップロードされた内容を返します
+func (s *Server) Volume(node string, volid string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.volumes[node+"/"+volid]
+	return v, ok
+}
+
+// LockVM は vmid への次の n 回の変更を「ロック中」で失敗させます
+func (s *Server) LockVM(vmid int, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locks[vmid] = n
+}
+
+// FailTasks は種類が typ のタスク (qmclone など) を exitstatus で失敗させます
+func (s *Server) FailTasks(typ string, exitstatus string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fails[typ] = exitstatus
+}
+
+// SetAgentIPs は qemu-guest-agent が返すアドレスを設定します
+func (s *Server) SetAgentIPs(vmid int, ips map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if vm, ok := s.vms[vmid]; ok {
+		vm.AgentIPs = ips
+	}
+}
+
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" && r.Header.Get("Authorization") != "PVEAPIToken="+s.Token {
+			writeError(w, http.StatusUnauthorized, "authentication failure")
+			return
+		}
+		s.mu.Lock()
+		s.hits[r.Method+" "+r.URL.Path]++
+		s.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeError は Proxmox と同じく data を null にしてエラーを返します
+// 実際の Proxmox は理由をステータス行に入れるが、httptest では変えられないので message に入れる
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"data": nil, "message": message + "\n"})
+}
+
+func writeData(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+// pathKind はパスが /nodes/{node}/lxc 以下であれば lxc、それ以外は qemu を返します
+func pathKind(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/nodes/"+r.PathValue("node")+"/lxc") {
+		return model.GuestLXC
+	}
+	return model.GuestQEMU
+}
+
+// lookupVM はパスのノードと種類、vmid から VM を探します。呼び出し元で mu をロックすること
+func (s *Server) lookupVM(w http.ResponseWriter, r *http.Request) *VM {
+	node := r.PathValue("node")
+	vmid, err := strconv.Atoi(r.PathValue("vmid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid vmid")
+		return nil
+	}
+	vm, ok := s.vms[vmid]
+	if kind := pathKind(r); !ok || vm.Node != node || vm.Type != kind {
+		dir := "qemu-server"
+		if kind == model.GuestLXC {
+			dir = "lxc"
+		}
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Configuration file 'nodes/%s/%s/%d.conf' does not exist", node, dir, vmid))
+		return nil
+	}
+	return vm
+}
+
+// taskType はコンテナのタスクの種類を Proxmox と同じく vz で始まる名前 (vzstart など) にします
+func taskType(vm *VM, typ string) string {
+	if vm.Type == model.GuestLXC {
+		return "vz" + strings.TrimPrefix(typ, "qm")
+	}
+	return typ
+}
+
+// checkLock は VM がロック中であればエラーを返します。呼び出し元で mu をロックすること
+func (s *Server) checkLock(w http.ResponseWriter, vm *VM) bool {
+	if n := s.locks[vm.Vmid]; n > 0 {
+		s.locks[vm.Vmid] = n - 1
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d is locked (backup)", vm.Vmid))
+		return false
+	}
+	if vm.Lock != "" {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d is locked (%s)", vm.Vmid, vm.Lock))
+		return false
+	}
+	return true
+}
+
+// startTask はタスクを登録して UPID を返します。done はタスクの終了時に成否とともに呼ばれます
+// 呼び出し元で mu をロックすること
+func (s *Server) startTask(w http.ResponseWriter, node string, typ string, vmid int, done func(ok bool)) {
+	s.seq++
+	upid := fmt.Sprintf("UPID:%s:%08X:%08X:%08X:%s:%d:root@pam:", node, s.seq, s.seq, s.seq, typ, vmid)
+	exit := "OK"
+	if e, ok := s.fails[typ]; ok {
+		exit = e
+	}
+	s.tasks[upid] = &task{upid: upid, node: node, polls: s.TaskPolls, exit: exit, done: done}
+	writeData(w, upid)
+}
+
+func (s *Server) taskStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[r.PathValue("upid")]
+	if !ok || t.node != r.PathValue("node") {
+		writeError(w, http.StatusInternalServerError, "no such task")
+		return
+	}
+	if t.polls > 0 {
+		t.polls--
+		writeData(w, model.TaskStatus{UPID: t.upid, Node: t.node, Status: "running"})
+		return
+	}
+	if t.done != nil {
+		t.done(t.exit == "OK")
+		t.done = nil
+	}
+	writeData(w, model.TaskStatus{UPID: t.upid, Node: t.node, Status: "stopped", ExitStatus: t.exit})
+}
+
+func (s *Server) listNodes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := []model.NodeList{}
+	for _, n := range s.nodes {
+		nodes = append(nodes, model.NodeList{
+			ID:      "node/" + n.Name,
+			Node:    n.Name,
+			Type:    "node",
+			Status:  n.Status,
+			CPU:     n.CPU,
+			Maxcpu:  n.Maxcpu,
+			Maxmem:  n.Maxmem,
+			Maxdisk: n.Maxdisk,
+		})
+	}
+	writeData(w, nodes)
+}
+
+func (s *Server) listVMs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vms := []model.VMList{}
+	for _, id := range s.sortedIDs() {
+		vm := s.vms[id]
+		if vm.Node != r.PathValue("node") || vm.Type != pathKind(r) {
+			continue
+		}
+		vms = append(vms, model.VMList{Vmid: vm.Vmid, Name: vm.Name, Status: vm.Status})
+	}
+	writeData(w, vms)
+}
+
+func (s *Server) sortedIDs() []int {
+	ids := []int{}
+	for id := range s.vms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil {
+		return
+	}
+	conf := map[string]any{"name": vm.Name}
+	if vm.Type == model.GuestLXC {
+		conf = map[string]any{"hostname": vm.Name}
+	}
+	for k, v := range vm.Config {
+		conf[k] = v
+	}
+	if vm.Template {
+		conf["template"] = 1
+	}
+	if vm.Lock != "" {
+		conf["lock"] = vm.Lock
+	}
+	writeData(w, conf)
+}
+
+func (s *Server) editConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil || !s.checkLock(w, vm) {
+		return
+	}
+	r.ParseForm()
+	for k := range r.PostForm {
+		switch k {
+		case "name", "hostname":
+			vm.Name = r.PostForm.Get(k)
+		case "delete":
+			for _, key := range strings.Split(r.PostForm.Get(k), ",") {
+				delete(vm.Config, key)
+			}
+		default:
+			vm.Config[k] = r.PostForm.Get(k)
+		}
+	}
+	// コンテナの設定の変更はタスクにならずにすぐ終わる
+	if vm.Type == model.GuestLXC {
+		writeData(w, nil)
+		return
+	}
+	s.startTask(w, vm.Node, "qmconfig", vm.Vmid, nil)
+}
+
+func (s *Server) clone(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src := s.lookupVM(w, r)
+	if src == nil || !s.checkLock(w, src) {
+		return
+	}
+	r.ParseForm()
+	newid, err := strconv.Atoi(r.PostForm.Get("newid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid newid")
+		return
+	}
+	if pool := r.PostForm.Get("pool"); pool != "" && !s.pools[pool] {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("pool '%s' does not exist", pool))
+		return
+	}
+	if _, ok := s.vms[newid]; ok {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to create VM %d: config file already exists", newid))
+		return
+	}
+	if r.PostForm.Get("full") == "0" && !src.Template {
+		writeError(w, http.StatusInternalServerError, "Linked clone feature is not supported for drive 'scsi0'")
+		return
+	}
+	// テンプレートは full を省略するとリンククローンになる
+	linked := src.Template && r.PostForm.Get("full") != "1"
+	target := r.PostForm.Get("target")
+	if target == "" {
+		target = src.Node
+	}
+	// クローン中の VM はタスクが終わるまでロックされる
+	name := r.PostForm.Get("name")
+	if src.Type == model.GuestLXC {
+		name = r.PostForm.Get("hostname")
+	}
+	vm := &VM{
+		Vmid:   newid,
+		Node:   target,
+		Type:   src.Type,
+		Name:   name,
+		Status: "stopped",
+		Pool:   r.PostForm.Get("pool"),
+		Config: map[string]string{},
+		Files:  map[string]string{},
+		Lock:   "clone",
+	}
+	for k, v := range src.Config {
+		vm.Config[k] = cloneVolume(v, newid, linked, r.PostForm.Get("storage"))
+	}
+	s.vms[newid] = vm
+	s.startTask(w, src.Node, taskType(src, "qmclone"), src.Vmid, func(ok bool) {
+		if !ok {
+			delete(s.vms, newid)
+			return
+		}
+		vm.Lock = ""
+	})
+}
+
+// volumePattern はディスクの値の <storage>:[base-<vmid>-disk-N/](base|vm)-<vmid>-(disk-N|cloudinit) です
+var volumePattern = regexp.MustCompile(`^([^:,]+):(?:base-\d+-disk-\d+/)?(base|vm)-(\d+)-(disk-\d+|cloudinit)(,.*)?$`)
+
+// cloneVolume は Proxmox と同じ名前でクローン先のディスクを返します
+// リンククローンは base-<src>-disk-N/vm-<new>-disk-N、フルクローンは vm-<new>-disk-N (storage を指定した場合はそのストレージ)
+func cloneVolume(spec string, newid int, linked bool, storage string) string {
+	m := volumePattern.FindStringSubmatch(spec)
+	if m == nil {
+		return spec
+	}
+	store, kind, src, disk, opts := m[1], m[2], m[3], m[4], m[5]
+	vol := fmt.Sprintf("vm-%d-%s", newid, disk)
+	if linked && kind == "base" && disk != "cloudinit" {
+		return fmt.Sprintf("%s:base-%s-%s/%s%s", store, src, disk, vol, opts)
+	}
+	if storage != "" && !linked {
+		store = storage
+	}
+	return store + ":" + vol + opts
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil || !s.checkLock(w, vm) {
+		return
+	}
+	switch action := r.PathValue("action"); action {
+	case "start":
+		if vm.Template {
+			writeError(w, http.StatusInternalServerError, "you can't start a vm if it's a template")
+			return
+		}
+		s.startTask(w, vm.Node, taskType(vm, "qmstart"), vm.Vmid, func(ok bool) {
+			if ok {
+				vm.Status = "running"
+				vm.Hibernated = false
+			}
+		})
+	case "suspend":
+		if vm.Status != "running" {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d not running", vm.Vmid))
+			return
+		}
+		r.ParseForm()
+		if r.PostForm.Get("todisk") == "1" {
+			s.startTask(w, vm.Node, taskType(vm, "qmsuspend"), vm.Vmid, func(ok bool) {
+				if ok {
+					vm.Status = "stopped"
+					vm.Paused = false
+					vm.Hibernated = true
+				}
+			})
+			return
+		}
+		s.startTask(w, vm.Node, taskType(vm, "qmpause"), vm.Vmid, func(ok bool) {
+			if ok {
+				vm.Paused = true
+			}
+		})
+	case "resume":
+		if !vm.Paused {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d not paused", vm.Vmid))
+			return
+		}
+		s.startTask(w, vm.Node, taskType(vm, "qmresume"), vm.Vmid, func(ok bool) {
+			if ok {
+				vm.Paused = false
+			}
+		})
+	case "stop", "shutdown":
+		s.startTask(w, vm.Node, taskType(vm, "qm"+action), vm.Vmid, func(ok bool) {
+			if ok {
+				vm.Status = "stopped"
+			}
+		})
+	default:
+		writeError(w, http.StatusNotImplemented, "Method 'POST /nodes/{node}/qemu/{vmid}/status/"+action+"' not implemented")
+	}
+}
+
+func (s *Server) currentStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil {
+		return
+	}
+	status := model.VMStatus{Status: vm.Status, QMPStatus: vm.Status, Agent: 1}
+	if vm.Paused {
+		status.QMPStatus = "paused"
+	}
+	if vm.Hibernated {
+		status.Lock = "suspended"
+	}
+	writeData(w, status)
+}
+
+// checkTimeframe は Proxmox と同じく timeframe を必須にします
+func checkTimeframe(w http.ResponseWriter, r *http.Request) bool {
+	if !model.ValidTimeframe(r.URL.Query().Get("timeframe")) {
+		writeError(w, http.StatusBadRequest, "Parameter verification failed.")
+		return false
+	}
+	return true
+}
+
+func (s *Server) vmRRDData(w http.ResponseWriter, r *http.Request) {
+	if !checkTimeframe(w, r) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil {
+		return
+	}
+	writeData(w, append([]model.RRDData{}, vm.RRD...))
+}
+
+func (s *Server) nodeRRDData(w http.ResponseWriter, r *http.Request) {
+	if !checkTimeframe(w, r) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.nodes {
+		if n.Name == r.PathValue("node") {
+			writeData(w, append([]model.RRDData{}, n.RRD...))
+			return
+		}
+	}
+	writeError(w, http.StatusInternalServerError, fmt.Sprintf("hostname lookup '%s' failed - failed to get address info for: %s: Name or service not known", r.PathValue("node"), r.PathValue("node")))
+}
+
+func (s *Server) resize(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil || !s.checkLock(w, vm) {
+		return
+	}
+	r.ParseForm()
+	disk := r.PostForm.Get("disk")
+	spec, ok := vm.Config[disk]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("disk '%s' does not exist", disk))
+		return
+	}
+	opts := []string{}
+	for _, o := range strings.Split(spec, ",") {
+		if !strings.HasPrefix(o, "size=") {
+			opts = append(opts, o)
+		}
+	}
+	vm.Config[disk] = strings.Join(append(opts, "size="+r.PostForm.Get("size")), ",")
+	s.startTask(w, vm.Node, taskType(vm, "resize"), vm.Vmid, nil)
+}
+
+func (s *Server) template(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil || !s.checkLock(w, vm) {
+		return
+	}
+	if vm.Status == "running" {
+		writeError(w, http.StatusInternalServerError, "you can't convert a running VM to a template")
+		return
+	}
+	s.startTask(w, vm.Node, taskType(vm, "qmtemplate"), vm.Vmid, func(ok bool) {
+		if !ok {
+			return
+		}
+		// テンプレートにするとディスクは base-<vmid>-disk-N に名前が変わる
+		vm.Template = true
+		for k, v := range vm.Config {
+			vm.Config[k] = strings.Replace(v, fmt.Sprintf(":vm-%d-disk-", vm.Vmid), fmt.Sprintf(":base-%d-disk-", vm.Vmid), 1)
+		}
+	})
+}
+
+func (s *Server) deleteVM(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil || !s.checkLock(w, vm) {
+		return
+	}
+	if vm.Status == "running" {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d is running - destroy failed", vm.Vmid))
+		return
+	}
+	vm.Lock = "destroyed"
+	s.startTask(w, vm.Node, taskType(vm, "qmdestroy"), vm.Vmid, func(ok bool) {
+		vm.Lock = ""
+		if ok {
+			delete(s.vms, vm.Vmid)
+		}
+	})
+}
+
+// lookupAgent は guest agent が応答する VM を探します。呼び出し元で mu をロックすること
+// AgentIPs が nil の VM は agent が起動していないものとして扱う
+func (s *Server) lookupAgent(w http.ResponseWriter, r *http.Request) *VM {
+	vm := s.lookupVM(w, r)
+	if vm == nil {
+		return nil
+	}
+	if vm.Status != "running" {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d is not running", vm.Vmid))
+		return nil
+	}
+	if vm.AgentIPs == nil {
+		writeError(w, http.StatusInternalServerError, "QEMU guest agent is not running")
+		return nil
+	}
+	return vm
+}
+
+func (s *Server) agentInterfaces(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupAgent(w, r)
+	if vm == nil {
+		return
+	}
+	names := []string{}
+	for name := range vm.AgentIPs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []map[string]any{}
+	for _, name := range names {
+		addrs := []map[string]any{}
+		for _, ip := range vm.AgentIPs[name] {
+			typ := "ipv4"
+			if strings.Contains(ip, ":") {
+				typ = "ipv6"
+			}
+			addrs = append(addrs, map[string]any{"ip-address": ip, "ip-address-type": typ, "prefix": 24})
+		}
+		result = append(result, map[string]any{"name": name, "ip-addresses": addrs})
+	}
+	writeData(w, map[string]any{"result": result})
+}
+
+// lxcInterfaces はコンテナのインターフェースを返します
+// net0 に静的な ip= があればそのアドレスを、なければ AgentIPs を eth0 のアドレスとして返す
+func (s *Server) lxcInterfaces(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupVM(w, r)
+	if vm == nil {
+		return
+	}
+	if vm.Status != "running" {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("CT %d not running", vm.Vmid))
+		return
+	}
+	ifs := []model.LXCInterface{{Name: "lo", Hwaddr: "00:00:00:00:00:00", Inet: "127.0.0.1/8", Inet6: "::1/128"}}
+	eth0 := model.LXCInterface{Name: "eth0", Hwaddr: "BC:24:11:00:00:01"}
+	for _, o := range strings.Split(vm.Config["net0"], ",") {
+		if ip, ok := strings.CutPrefix(o, "ip="); ok && ip != "dhcp" && ip != "manual" {
+			eth0.Inet = ip
+		}
+	}
+	if eth0.Inet == "" && len(vm.AgentIPs["eth0"]) > 0 {
+		eth0.Inet = vm.AgentIPs["eth0"][0] + "/24"
+	}
+	writeData(w, append(ifs, eth0))
+}
+
+func (s *Server) clusterResources(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []model.ClusterResources{}
+	for _, n := range s.nodes {
+		res = append(res, model.ClusterResources{
+			ID:      "node/" + n.Name,
+			Type:    "node",
+			Node:    n.Name,
+			Status:  n.Status,
+			CPU:     n.CPU,
+			Maxcpu:  n.Maxcpu,
+			Maxmem:  n.Maxmem,
+			Maxdisk: n.Maxdisk,
+		})
+	}
+	for _, id := range s.sortedIDs() {
+		vm := s.vms[id]
+		template := 0
+		if vm.Template {
+			template = 1
+		}
+		res = append(res, model.ClusterResources{
+			ID:       fmt.Sprintf("%s/%d", vm.Type, vm.Vmid),
+			Type:     vm.Type,
+			Vmid:     vm.Vmid,
+			Name:     vm.Name,
+			Node:     vm.Node,
+			Status:   vm.Status,
+			Template: template,
+			Tags:     vm.Config["tags"],
+			Pool:     vm.Pool,
+		})
+	}
+	writeData(w, res)
+}
+
+func (s *Server) nextVMID(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID
+	for {
+		if _, ok := s.vms[id]; !ok {
+			break
+		}
+		id++
+	}
+	writeData(w, strconv.Itoa(id))
+}
+
+func (s *Server) editACL(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.ParseForm()
+	if r.PostForm.Get("path") == "" || r.PostForm.Get("roles") == "" {
+		writeError(w, http.StatusBadRequest, "parameter verification failed")
+		return
+	}
+	s.acls = append(s.acls, r.PostForm)
+	writeData(w, nil)
+}
+
+func (s *Server) listPools(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pools := []map[string]string{}
+	for _, id := range s.poolIDs() {
+		pools = append(pools, map[string]string{"poolid": id})
+	}
+	writeData(w, pools)
+}
+
+func (s *Server) createPool(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.ParseForm()
+	id := r.PostForm.Get("poolid")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "parameter verification failed")
+		return
+	}
+	if s.pools[id] {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("pool '%s' already exists", id))
+		return
+	}
+	s.pools[id] = true
+	writeData(w, nil)
+}
+
+func (s *Server) updatePool(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("poolid")
+	if !s.pools[id] {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("pool '%s' does not exist", id))
+		return
+	}
+	r.ParseForm()
+	vmid, _ := strconv.Atoi(r.PostForm.Get("vms"))
+	vm, ok := s.vms[vmid]
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("no such VM ID '%d'", vmid))
+		return
+	}
+	if vm.Pool != "" && vm.Pool != id && r.PostForm.Get("allow-move") != "1" {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d belongs already to pool '%s'", vmid, vm.Pool))
+		return
+	}
+	vm.Pool = id
+	writeData(w, nil)
+}
+
+func (s *Server) agentPing(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lookupAgent(w, r) == nil {
+		return
+	}
+	writeData(w, map[string]any{})
+}
+
+func (s *Server) agentExec(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupAgent(w, r)
+	if vm == nil {
+		return
+	}
+	r.ParseForm()
+	command := r.PostForm["command"]
+	if len(command) == 0 {
+		writeError(w, http.StatusBadRequest, "parameter verification failed")
+		return
+	}
+	status := model.AgentExecStatus{Exited: 1}
+	if s.Exec != nil {
+		status.ExitCode, status.OutData, status.ErrData = s.Exec(vm.Vmid, command, r.PostForm.Get("input-data"))
+	}
+	s.seq++
+	s.procs[s.seq] = &process{polls: s.TaskPolls, status: status}
+	writeData(w, map[string]int{"pid": s.seq})
+}
+
+func (s *Server) agentExecStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lookupAgent(w, r) == nil {
+		return
+	}
+	pid, _ := strconv.Atoi(r.URL.Query().Get("pid"))
+	p, ok := s.procs[pid]
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Agent error: Invalid parameter 'pid': PID %d does not exist", pid))
+		return
+	}
+	if p.polls > 0 {
+		p.polls--
+		writeData(w, map[string]int{"exited": 0})
+		return
+	}
+	writeData(w, p.status)
+}
+
+func (s *Server) agentFileRead(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupAgent(w, r)
+	if vm == nil {
+		return
+	}
+	content, ok := vm.Files[r.URL.Query().Get("file")]
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Agent error: No such file or directory")
+		return
+	}
+	writeData(w, model.AgentFile{Content: content})
+}
+
+func (s *Server) agentFileWrite(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := s.lookupAgent(w, r)
+	if vm == nil {
+		return
+	}
+	r.ParseForm()
+	content := r.PostForm.Get("content")
+	// encode=0 の場合は base64 のまま渡される
+	if r.PostForm.Get("encode") == "0" {
+		b, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "content is not base64")
+			return
+		}
+		content = string(b)
+	}
+	vm.Files[r.PostForm.Get("file")] = content
+	writeData(w, nil)
+}
+
+// importVolid はストレージの import の content に置くイメージのボリューム ID を返します
+func importVolid(r *http.Request, filename string) string {
+	return r.PathValue("storage") + ":import/" + filename
+}
+
+func (s *Server) downloadURL(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.PostForm.Get("content") != "import" || r.PostForm.Get("url") == "" || r.PostForm.Get("filename") == "" {
+		writeError(w, http.StatusBadRequest, "Parameter verification failed.")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := r.PathValue("node") + "/" + importVolid(r, r.PostForm.Get("filename"))
+	url := r.PostForm.Get("url")
+	s.startTask(w, r.PathValue("node"), "download", 0, func(ok bool) {
+		if ok {
+			s.volumes[key] = url
+		}
+	})
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f, fh, err := r.FormFile("filename")
+	if err != nil || r.FormValue("content") != "import" {
+		writeError(w, http.StatusBadRequest, "Parameter verification failed.")
+		return
+	}
+	defer f.Close()
+	var b strings.Builder
+	if _, err := io.Copy(&b, f); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := r.PathValue("node") + "/" + importVolid(r, fh.Filename)
+	s.startTask(w, r.PathValue("node"), "imgcopy", 0, func(ok bool) {
+		if ok {
+			s.volumes[key] = b.String()
+		}
+	})
+}
+
+func (s *Server) createVM(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.ParseForm()
+	vmid, err := strconv.Atoi(r.PostForm.Get("vmid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid vmid")
+		return
+	}
+	if _, ok := s.vms[vmid]; ok {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to create VM %d - VM %d already exists", vmid, vmid))
+		return
+	}
+	node := r.PathValue("node")
+	// import-from のイメージがノードのストレージになければ失敗させる
+	storage, from, _ := strings.Cut(r.PostForm.Get("scsi0"), ":0,import-from=")
+	if _, ok := s.volumes[node+"/"+from]; !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("volume '%s' does not exist", from))
+		return
+	}
+	vm := &VM{
+		Vmid:   vmid,
+		Node:   node,
+		Type:   model.GuestQEMU,
+		Name:   r.PostForm.Get("name"),
+		Status: "stopped",
+		Config: map[string]string{},
+		Files:  map[string]string{},
+		Lock:   "create",
+	}
+	for k := range r.PostForm {
+		if k != "vmid" && k != "name" {
+			vm.Config[k] = r.PostForm.Get(k)
+		}
+	}
+	vm.Config["scsi0"] = fmt.Sprintf("%s:vm-%d-disk-0,size=2G", storage, vmid)
+	s.vms[vmid] = vm
+	s.startTask(w, node, "qmcreate", vmid, func(ok bool) {
+		if !ok {
+			delete(s.vms, vmid)
+			return
+		}
+		vm.Lock = ""
+	})
+}
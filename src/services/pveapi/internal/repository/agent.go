@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+func (r *pveRepository) agentPath(node string, vmid int, command string) string {
+	return r.guestPath(node, vmid, "/agent/"+command)
+}
+
+// AgentPing は guest agent が応答するかを確認します
+func (r *pveRepository) AgentPing(ctx context.Context, node string, vmid int) error {
+	if r.lxc() {
+		return errLXCAgent("ping guest agent")
+	}
+	if err := r.request(ctx, http.MethodPost, r.agentPath(node, vmid, "ping"), url.Values{}, nil); err != nil {
+		return xerrors.Errorf("can't ping guest agent: %w", err)
+	}
+	return nil
+}
+
+// AgentExec は VM の中でコマンドを実行して pid を返します (終了は待たない)
+func (r *pveRepository) AgentExec(ctx context.Context, node string, vmid int, command []string, input string) (int, error) {
+	if r.lxc() {
+		return 0, errLXCAgent("exec command")
+	}
+	formData := url.Values{}
+	// command は引数ごとに繰り返して渡す
+	for _, c := range command {
+		formData.Add("command", c)
+	}
+	if input != "" {
+		formData.Set("input-data", input)
+	}
+	var res struct {
+		Pid int `json:"pid"`
+	}
+	if err := r.request(ctx, http.MethodPost, r.agentPath(node, vmid, "exec"), formData, &res); err != nil {
+		return 0, xerrors.Errorf("can't exec command: %w", err)
+	}
+	return res.Pid, nil
+}
+
+func (r *pveRepository) AgentExecStatus(ctx context.Context, node string, vmid int, pid int) (*model.AgentExecStatus, error) {
+	if r.lxc() {
+		return nil, errLXCAgent("get exec status")
+	}
+	formData := url.Values{}
+	formData.Set("pid", strconv.Itoa(pid))
+	status := &model.AgentExecStatus{}
+	if err := r.request(ctx, http.MethodGet, r.agentPath(node, vmid, "exec-status"), formData, status); err != nil {
+		return nil, xerrors.Errorf("can't get exec status: %w", err)
+	}
+	return status, nil
+}
+
+func (r *pveRepository) AgentFileRead(ctx context.Context, node string, vmid int, path string) (*model.AgentFile, error) {
+	if r.lxc() {
+		return nil, errLXCAgent("read file")
+	}
+	formData := url.Values{}
+	formData.Set("file", path)
+	file := &model.AgentFile{}
+	if err := r.request(ctx, http.MethodGet, r.agentPath(node, vmid, "file-read"), formData, file); err != nil {
+		return nil, xerrors.Errorf("can't read file: %w", err)
+	}
+	return file, nil
+}
+
+func (r *pveRepository) AgentFileWrite(ctx context.Context, node string, vmid int, file *model.AgentFileWrite) error {
+	if r.lxc() {
+		return errLXCAgent("write file")
+	}
+	formData := url.Values{}
+	formData.Set("file", file.Path)
+	formData.Set("content", file.Content)
+	// encode=1 の場合は Proxmox が base64 にエンコードしてから渡す
+	if file.Base64 {
+		formData.Set("encode", "0")
+	}
+	if err := r.request(ctx, http.MethodPost, r.agentPath(node, vmid, "file-write"), formData, nil); err != nil {
+		return xerrors.Errorf("can't write file: %w", err)
+	}
+	return nil
+}
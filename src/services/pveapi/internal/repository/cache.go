@@ -0,0 +1,412 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultCacheMaxStale = 10 * time.Second
+	// キャッシュにない vmid を聞かれたときに Proxmox に問い合わせ直す最短の間隔
+	// (存在しない vmid で何度も /cluster/resources を取得しないため)
+	cacheMissRefreshAge = time.Second
+)
+
+// ClusterCacheStore はクラスタのスナップショットの保存先です
+// Redis に保存すると pveapi の複数のプロセスや他のサービスと共有できる
+type ClusterCacheStore interface {
+	// Load は保存されたスナップショットを返します
+	// ない場合や Invalidate より前に取得したものの場合は nil を返す
+	Load(ctx context.Context) (*model.ClusterSnapshot, error)
+	// LookupNode は vmid の VM があるノードと種類、スナップショットの時刻を返します
+	// 使えるスナップショットがない場合は時刻がゼロ値、VM がない場合はノードが空になる
+	LookupNode(ctx context.Context, vmid int) (model.Guest, time.Time, error)
+	Save(ctx context.Context, snap *model.ClusterSnapshot) error
+	// Invalidate は at より前に取得したスナップショットを使えなくします
+	Invalidate(ctx context.Context, at time.Time) error
+}
+
+type redisClusterCacheStore struct {
+	client *redis.Client
+	// クラスタごとのキー
+	snapshotKey    string
+	vmNodeKey      string
+	vmTypeKey      string
+	updatedKey     string
+	invalidatedKey string
+}
+
+// NewRedisClusterCacheStore はクラスタ cluster のスナップショットを Redis に保存します
+func NewRedisClusterCacheStore(client *redis.Client, cluster string) ClusterCacheStore {
+	return &redisClusterCacheStore{
+		client:         client,
+		snapshotKey:    model.ClusterCacheKey(model.ClusterCacheSnapshotKey, cluster),
+		vmNodeKey:      model.ClusterCacheKey(model.ClusterCacheVMNodeKey, cluster),
+		vmTypeKey:      model.ClusterCacheKey(model.ClusterCacheVMTypeKey, cluster),
+		updatedKey:     model.ClusterCacheKey(model.ClusterCacheUpdatedKey, cluster),
+		invalidatedKey: model.ClusterCacheKey(model.ClusterCacheInvalidatedKey, cluster),
+	}
+}
+
+func unixMilli(s string) time.Time {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// validSince は使えるスナップショットの時刻を返します (ない場合はゼロ値)
+func validSince(updated, invalidated string) time.Time {
+	u := unixMilli(updated)
+	if u.IsZero() || u.Before(unixMilli(invalidated)) {
+		return time.Time{}
+	}
+	return u
+}
+
+func (r *redisClusterCacheStore) Load(ctx context.Context) (*model.ClusterSnapshot, error) {
+	vals, err := r.client.MGet(ctx, r.snapshotKey, r.updatedKey, r.invalidatedKey).Result()
+	if err != nil {
+		return nil, xerrors.Errorf("can't get cluster cache: %w", err)
+	}
+	data, _ := vals[0].(string)
+	updated, _ := vals[1].(string)
+	invalidated, _ := vals[2].(string)
+	if data == "" || validSince(updated, invalidated).IsZero() {
+		return nil, nil
+	}
+	snap := &model.ClusterSnapshot{}
+	if err := json.Unmarshal([]byte(data), snap); err != nil {
+		return nil, xerrors.Errorf("can't unmarshal cluster cache: %w", err)
+	}
+	return snap, nil
+}
+
+func (r *redisClusterCacheStore) LookupNode(ctx context.Context, vmid int) (model.Guest, time.Time, error) {
+	pipe := r.client.Pipeline()
+	node := pipe.HGet(ctx, r.vmNodeKey, strconv.Itoa(vmid))
+	typ := pipe.HGet(ctx, r.vmTypeKey, strconv.Itoa(vmid))
+	times := pipe.MGet(ctx, r.updatedKey, r.invalidatedKey)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return model.Guest{}, time.Time{}, xerrors.Errorf("can't get cluster cache: %w", err)
+	}
+	updated, _ := times.Val()[0].(string)
+	invalidated, _ := times.Val()[1].(string)
+	g := model.Guest{Node: node.Val(), Type: typ.Val()}
+	// 種類を保存する前のキャッシュは VM だけを入れている
+	if g.Node != "" && g.Type == "" {
+		g.Type = model.GuestQEMU
+	}
+	return g, validSince(updated, invalidated), nil
+}
+
+func (r *redisClusterCacheStore) Save(ctx context.Context, snap *model.ClusterSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return xerrors.Errorf("can't marshal cluster cache: %w", err)
+	}
+	index := map[string]any{}
+	types := map[string]any{}
+	for _, res := range snap.Resources {
+		if model.IsGuestType(res.Type) {
+			index[strconv.Itoa(res.Vmid)] = res.Node
+			types[strconv.Itoa(res.Vmid)] = res.Type
+		}
+	}
+	// 読み込み中に途中の状態が見えないようにまとめて書き込む
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.vmNodeKey, r.vmTypeKey)
+		if len(index) > 0 {
+			pipe.HSet(ctx, r.vmNodeKey, index)
+			pipe.HSet(ctx, r.vmTypeKey, types)
+		}
+		pipe.Set(ctx, r.snapshotKey, data, 0)
+		pipe.Set(ctx, r.updatedKey, snap.UpdatedAt.UnixMilli(), 0)
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("can't save cluster cache: %w", err)
+	}
+	return nil
+}
+
+func (r *redisClusterCacheStore) Invalidate(ctx context.Context, at time.Time) error {
+	if err := r.client.Set(ctx, r.invalidatedKey, at.UnixMilli(), 0).Err(); err != nil {
+		return xerrors.Errorf("can't invalidate cluster cache: %w", err)
+	}
+	return nil
+}
+
+// memoryClusterCacheStore はプロセス内だけで使うスナップショットの保存先です (Redis がない場合とテスト用)
+type memoryClusterCacheStore struct {
+	mu          sync.Mutex
+	snap        *model.ClusterSnapshot
+	index       map[int]model.Guest
+	invalidated time.Time
+}
+
+func NewMemoryClusterCacheStore() ClusterCacheStore {
+	return &memoryClusterCacheStore{}
+}
+
+func (m *memoryClusterCacheStore) valid() bool {
+	return m.snap != nil && !m.snap.UpdatedAt.Before(m.invalidated)
+}
+
+func (m *memoryClusterCacheStore) Load(ctx context.Context) (*model.ClusterSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.valid() {
+		return nil, nil
+	}
+	return m.snap, nil
+}
+
+func (m *memoryClusterCacheStore) LookupNode(ctx context.Context, vmid int) (model.Guest, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.valid() {
+		return model.Guest{}, time.Time{}, nil
+	}
+	return m.index[vmid], m.snap.UpdatedAt, nil
+}
+
+func (m *memoryClusterCacheStore) Save(ctx context.Context, snap *model.ClusterSnapshot) error {
+	index := map[int]model.Guest{}
+	for _, res := range snap.Resources {
+		if model.IsGuestType(res.Type) {
+			index[res.Vmid] = model.Guest{Node: res.Node, Type: res.Type}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap = snap
+	m.index = index
+	return nil
+}
+
+func (m *memoryClusterCacheStore) Invalidate(ctx context.Context, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if at.After(m.invalidated) {
+		m.invalidated = at
+	}
+	return nil
+}
+
+// ClusterCache は /cluster/resources と /nodes をキャッシュする PVERepository です
+// VM を変更する操作の後はキャッシュを無効にし、MaxStale より古いキャッシュは使わない
+type ClusterCache interface {
+	PVERepository
+	// Refresh はキャッシュの時刻に関係なく Proxmox から取得し直します
+	Refresh(ctx context.Context) (*model.ClusterSnapshot, error)
+	// Run は ctx が終わるまで設定の間隔でキャッシュを更新します
+	Run(ctx context.Context)
+}
+
+type cachedPVERepository struct {
+	PVERepository
+	store ClusterCacheStore
+	conf  *model.CacheConfig
+	now   func() time.Time
+
+	// 同時に期限が切れたときに Proxmox への問い合わせを 1 回にまとめる
+	mu sync.Mutex
+}
+
+func NewCachedPVERepository(r PVERepository, store ClusterCacheStore, conf *model.CacheConfig) ClusterCache {
+	if conf.MaxStale == 0 {
+		conf.MaxStale = defaultCacheMaxStale
+	}
+	return &cachedPVERepository{
+		PVERepository: r,
+		store:         store,
+		conf:          conf,
+		now:           time.Now,
+	}
+}
+
+func (c *cachedPVERepository) fresh(updatedAt time.Time, maxAge time.Duration) bool {
+	return !updatedAt.IsZero() && c.now().Sub(updatedAt) < maxAge
+}
+
+// snapshot は maxAge より新しいスナップショットを返します (なければ Proxmox から取得する)
+func (c *cachedPVERepository) snapshot(ctx context.Context, maxAge time.Duration) (*model.ClusterSnapshot, error) {
+	// Redis に接続できない場合は Proxmox から直接取得する
+	snap, err := c.store.Load(ctx)
+	if err != nil {
+		log.Printf("cluster cache: %+v", err)
+	}
+	if snap != nil && c.fresh(snap.UpdatedAt, maxAge) {
+		return snap, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// 待っている間に他の呼び出しが取得していればそれを使う
+	if snap, err := c.store.Load(ctx); err == nil && snap != nil && c.fresh(snap.UpdatedAt, maxAge) {
+		return snap, nil
+	}
+	return c.fetch(ctx)
+}
+
+func (c *cachedPVERepository) fetch(ctx context.Context) (*model.ClusterSnapshot, error) {
+	// 取得中に VM が変更された場合に無効になるように、取得を始めた時刻を記録する
+	snap := &model.ClusterSnapshot{UpdatedAt: c.now()}
+	var err error
+	if snap.Resources, err = c.PVERepository.GetClusterResourcesList(ctx); err != nil {
+		return nil, xerrors.Errorf("can't refresh cluster cache: %w", err)
+	}
+	if snap.Nodes, err = c.PVERepository.GetNodeList(ctx); err != nil {
+		return nil, xerrors.Errorf("can't refresh cluster cache: %w", err)
+	}
+	if err := c.store.Save(ctx, snap); err != nil {
+		log.Printf("cluster cache: %+v", err)
+	}
+	return snap, nil
+}
+
+func (c *cachedPVERepository) Refresh(ctx context.Context) (*model.ClusterSnapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fetch(ctx)
+}
+
+func (c *cachedPVERepository) Run(ctx context.Context) {
+	if c.conf.RefreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.conf.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// 他のプロセスが更新したばかりなら取得しない
+			if _, err := c.snapshot(ctx, c.conf.RefreshInterval/2); err != nil {
+				log.Printf("cluster cache: %+v", err)
+			}
+		}
+	}
+}
+
+func (c *cachedPVERepository) invalidate(ctx context.Context) {
+	if err := c.store.Invalidate(context.WithoutCancel(ctx), c.now()); err != nil {
+		log.Printf("cluster cache: %+v", err)
+	}
+}
+
+func (c *cachedPVERepository) GetClusterResourcesList(ctx context.Context) ([]model.ClusterResources, error) {
+	snap, err := c.snapshot(ctx, c.conf.MaxStale)
+	if err != nil {
+		return nil, err
+	}
+	// 呼び出し元が書き換えてもキャッシュに影響しないようにコピーを返す
+	return append([]model.ClusterResources{}, snap.Resources...), nil
+}
+
+func (c *cachedPVERepository) GetNodeList(ctx context.Context) ([]model.NodeList, error) {
+	snap, err := c.snapshot(ctx, c.conf.MaxStale)
+	if err != nil {
+		return nil, err
+	}
+	return append([]model.NodeList{}, snap.Nodes...), nil
+}
+
+func (c *cachedPVERepository) LookupVMNode(ctx context.Context, vmid int) (string, error) {
+	g, err := c.LookupGuest(ctx, vmid)
+	if err != nil {
+		return "", err
+	}
+	return g.Node, nil
+}
+
+func (c *cachedPVERepository) LookupGuest(ctx context.Context, vmid int) (*model.Guest, error) {
+	g, updatedAt, err := c.store.LookupNode(ctx, vmid)
+	if err != nil {
+		log.Printf("cluster cache: %+v", err)
+	}
+	if g.Node != "" && c.fresh(updatedAt, c.conf.MaxStale) {
+		return &g, nil
+	}
+	// キャッシュにない場合は作成されたばかりかもしれないので取得し直す
+	maxAge := c.conf.MaxStale
+	if g.Node == "" && c.fresh(updatedAt, c.conf.MaxStale) {
+		maxAge = min(maxAge, cacheMissRefreshAge)
+	}
+	snap, err := c.snapshot(ctx, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	return findGuest(snap.Resources, vmid)
+}
+
+// ForGuest はキャッシュを共有したまま kind のゲストを操作するリポジトリを返します
+func (c *cachedPVERepository) ForGuest(kind string) PVERepository {
+	return &cachedPVERepository{
+		PVERepository: c.PVERepository.ForGuest(kind),
+		store:         c.store,
+		conf:          c.conf,
+		now:           c.now,
+	}
+}
+
+func (c *cachedPVERepository) CloneVM(ctx context.Context, clone *model.VMClone) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.CloneVM(ctx, clone)
+}
+
+func (c *cachedPVERepository) EditVM(ctx context.Context, vmedit model.VMEdit) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.EditVM(ctx, vmedit)
+}
+
+func (c *cachedPVERepository) DeleteVM(ctx context.Context, vmdelete *model.VMDelete) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.DeleteVM(ctx, vmdelete)
+}
+
+func (c *cachedPVERepository) Boot(ctx context.Context, node string, vmid int) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.Boot(ctx, node, vmid)
+}
+
+func (c *cachedPVERepository) Shutdown(ctx context.Context, node string, vmid int) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.Shutdown(ctx, node, vmid)
+}
+
+func (c *cachedPVERepository) Suspend(ctx context.Context, node string, vmid int, toDisk bool) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.Suspend(ctx, node, vmid, toDisk)
+}
+
+func (c *cachedPVERepository) Resume(ctx context.Context, node string, vmid int) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.Resume(ctx, node, vmid)
+}
+
+func (c *cachedPVERepository) AddPoolVM(ctx context.Context, poolid string, vmid int) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.AddPoolVM(ctx, poolid, vmid)
+}
+
+func (c *cachedPVERepository) Template(ctx context.Context, node string, vmid int) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.Template(ctx, node, vmid)
+}
+
+func (c *cachedPVERepository) CreateVM(ctx context.Context, vm *model.VMCreate) error {
+	defer c.invalidate(ctx)
+	return c.PVERepository.CreateVM(ctx, vm)
+}
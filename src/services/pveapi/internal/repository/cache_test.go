@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/LainInTheWired/ctf-backend/pveapi/pvefake"
+	"golang.org/x/xerrors"
+)
+
+func TestClusterCache(t *testing.T) {
+	ctx := context.Background()
+	fake, inner := newFakeRepository(t, pvefake.Node{Name: "pve01"}, pvefake.Node{Name: "pve02"})
+	fake.AddVM(pvefake.VM{Vmid: 9000, Node: "pve02", Template: true, Config: map[string]string{"scsi0": "vmdisk:base-9000-disk-0,size=16G"}})
+	store := NewMemoryClusterCacheStore()
+	c := NewCachedPVERepository(inner, store, &model.CacheConfig{MaxStale: time.Minute}).(*cachedPVERepository)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	resources := func() int { return fake.Hits("GET", "/cluster/resources") }
+
+	for i := 0; i < 3; i++ {
+		node, err := c.LookupVMNode(ctx, 9000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node != "pve02" {
+			t.Errorf("LookupVMNode(9000) = %q", node)
+		}
+	}
+	if _, err := c.GetNodeList(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if resources() != 1 || fake.Hits("GET", "/nodes") != 1 {
+		t.Fatalf("cluster fetched %d times, nodes %d times", resources(), fake.Hits("GET", "/nodes"))
+	}
+
+	// 作成したばかりの VM はキャッシュを無効にしているので見つかる
+	now = now.Add(time.Second)
+	clone := &model.VMClone{Name: "q1", Cloneid: 9000, Newid: 100, Node: "pve02", Target: "pve01", Mode: model.CloneModeFull}
+	if err := c.CloneVM(ctx, clone); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	if node, err := c.LookupVMNode(ctx, 100); err != nil || node != "pve01" {
+		t.Fatalf("LookupVMNode(100) = %q, %v", node, err)
+	}
+	if resources() != 2 {
+		t.Errorf("cluster fetched %d times after clone", resources())
+	}
+
+	// 存在しない vmid では何度も取得しない
+	now = now.Add(2 * time.Second)
+	for i := 0; i < 3; i++ {
+		if _, err := c.LookupVMNode(ctx, 404); !xerrors.Is(err, model.ErrPVENotFound) {
+			t.Fatalf("LookupVMNode(404) error = %v", err)
+		}
+	}
+	if resources() != 3 {
+		t.Errorf("cluster fetched %d times after misses", resources())
+	}
+
+	// MaxStale を過ぎたら取得し直す
+	now = now.Add(time.Minute)
+	if _, err := c.GetClusterResourcesList(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if resources() != 4 {
+		t.Errorf("cluster fetched %d times after max stale", resources())
+	}
+}
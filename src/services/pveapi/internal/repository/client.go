@@ -0,0 +1,213 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+// 設定が省略されたときの値
+const (
+	defaultRequestTimeout   = 30 * time.Second
+	defaultTaskTimeout      = 10 * time.Minute
+	defaultTaskPollInterval = 2 * time.Second
+	defaultLockRetries      = 6
+	defaultLockBackoff      = time.Second
+	maxLockBackoff          = 30 * time.Second
+)
+
+// classifyPVEError はステータスコードとメッセージからエラーの種類を判定します
+// Proxmox は存在しない VM やロック中の VM に対しても 500 を返すのでメッセージも見る
+func classifyPVEError(status int, message string) error {
+	msg := strings.ToLower(message)
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden ||
+		strings.Contains(msg, "permission check failed") || strings.Contains(msg, "authentication failure"):
+		return model.ErrPVEAuth
+	case strings.Contains(msg, "is locked") || strings.Contains(msg, "can't lock file"):
+		return model.ErrPVELocked
+	case strings.Contains(msg, "quota") || strings.Contains(msg, "not enough") || strings.Contains(msg, "no space left"):
+		return model.ErrPVEQuota
+	case strings.Contains(msg, "already exists"):
+		return model.ErrPVEExists
+	case status == http.StatusNotFound || strings.Contains(msg, "does not exist") || strings.Contains(msg, "no such"):
+		return model.ErrPVENotFound
+	}
+	return nil
+}
+
+// lockBackoff は attempt 回目のリトライまでの待ち時間です (指数的に増やす)
+func (r *pveRepository) lockBackoff(attempt int) time.Duration {
+	d := r.pveConf.LockBackoff << attempt
+	if d <= 0 || d > maxLockBackoff {
+		return maxLockBackoff
+	}
+	return d
+}
+
+// sleepContext は d だけ待ちます。ctx がキャンセルされた場合はそのエラーを返します
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// doRequest は 1 回だけ API を呼び出し、レスポンスの data を out に入れます
+func (r *pveRepository) doRequest(ctx context.Context, method string, path string, formData url.Values, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, r.pveConf.RequestTimeout)
+	defer cancel()
+
+	endpoint := r.pveConf.APIURL + path
+	var body io.Reader
+	if method == http.MethodGet || method == http.MethodDelete {
+		// GET と DELETE のパラメーターはクエリで渡す
+		if len(formData) > 0 {
+			endpoint += "?" + formData.Encode()
+		}
+	} else {
+		body = strings.NewReader(formData.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return xerrors.Errorf("can't create http request: %w", err)
+	}
+	// ヘッダーの設定
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	// リクエストの送信
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return xerrors.Errorf("fail http request: %w", err)
+	}
+	defer resp.Body.Close()
+	return decodeResponse(method, path, resp, out)
+}
+
+// decodeResponse はエラーのレスポンスを PVEError にし、成功した場合は data を out に入れます
+func decodeResponse(method string, path string, resp *http.Response, out any) error {
+	// レスポンスの読み取り
+	rbody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return xerrors.Errorf("can't read response body: %w", err)
+	}
+
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		// Proxmox はエラーの理由をステータス行 (バージョンによっては本文の message) に入れる
+		message := strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode)))
+		var pveresp model.ResponsePVE[json.RawMessage]
+		json.Unmarshal(rbody, &pveresp)
+		if pveresp.Message != "" {
+			message = strings.TrimSpace(pveresp.Message)
+		}
+		return &model.PVEError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Message:    message,
+			Errors:     pveresp.Errors,
+			Kind:       classifyPVEError(resp.StatusCode, message),
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	pveresp := model.ResponsePVE[any]{Data: out}
+	if err := json.Unmarshal(rbody, &pveresp); err != nil {
+		return xerrors.Errorf("can't unmarshal response body: %w", err)
+	}
+	return nil
+}
+
+// retryLocked は fn が ErrPVELocked を返す間、間隔を広げながら再実行します
+func (r *pveRepository) retryLocked(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !xerrors.Is(err, model.ErrPVELocked) || attempt >= r.pveConf.LockRetries {
+			return err
+		}
+		if serr := sleepContext(ctx, r.lockBackoff(attempt)); serr != nil {
+			return xerrors.Errorf("%v: %w", err, serr)
+		}
+	}
+}
+
+// request は API を呼び出します。ロック中のエラーはバックオフしながらリトライします
+func (r *pveRepository) request(ctx context.Context, method string, path string, formData url.Values, out any) error {
+	return r.retryLocked(ctx, func() error {
+		return r.doRequest(ctx, method, path, formData, out)
+	})
+}
+
+// task は非同期タスクを起動する API を呼び出し、タスクの終了まで待ちます
+// タスクがロックで失敗した場合もリトライします
+func (r *pveRepository) task(ctx context.Context, method string, path string, formData url.Values) error {
+	return r.retryLocked(ctx, func() error {
+		var upid string
+		if err := r.doRequest(ctx, method, path, formData, &upid); err != nil {
+			return err
+		}
+		// リサイズなどバージョンによってタスクを返さない API がある
+		if upid == "" {
+			return nil
+		}
+		return r.WaitTask(ctx, upid)
+	})
+}
+
+// parseUPIDNode は UPID:node:pid:pstart:starttime:type:id:user: からノード名を取り出します
+func parseUPIDNode(upid string) (string, error) {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 3 || parts[0] != "UPID" || parts[1] == "" {
+		return "", xerrors.Errorf("invalid upid: %q", upid)
+	}
+	return parts[1], nil
+}
+
+// WaitTask はタスクが終了するまでステータスを確認し、失敗した場合はエラーを返します
+func (r *pveRepository) WaitTask(ctx context.Context, upid string) error {
+	node, err := parseUPIDNode(upid)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.pveConf.TaskTimeout)
+	defer cancel()
+
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", node, url.PathEscape(upid))
+	for {
+		var status model.TaskStatus
+		if err := r.doRequest(ctx, http.MethodGet, path, url.Values{}, &status); err != nil {
+			return xerrors.Errorf("can't get task status: %w", err)
+		}
+		if status.Status == "stopped" {
+			if status.ExitStatus == "OK" || strings.HasPrefix(status.ExitStatus, "WARNINGS") {
+				return nil
+			}
+			return &model.PVEError{
+				Method:  "TASK",
+				Path:    upid,
+				Message: status.ExitStatus,
+				Kind:    classifyPVEError(0, status.ExitStatus),
+			}
+		}
+		if err := sleepContext(ctx, r.pveConf.TaskPollInterval); err != nil {
+			return xerrors.Errorf("wait task %s: %w", upid, err)
+		}
+	}
+}
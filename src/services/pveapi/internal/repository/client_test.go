@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+func newTestRepository(t *testing.T, h http.Handler) *pveRepository {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	conf := &model.PVEConfig{
+		APIURL:           srv.URL,
+		TaskPollInterval: time.Millisecond,
+		LockBackoff:      time.Millisecond,
+		LockRetries:      3,
+	}
+	return NewPVERepository(conf, srv.Client()).(*pveRepository)
+}
+
+func TestTaskRetriesLocked(t *testing.T) {
+	calls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes/pve01/qemu/100/status/start", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"data":null,"message":"VM 100 is locked (clone)\n"}`))
+			return
+		}
+		w.Write([]byte(`{"data":"UPID:pve01:0001:0002:0003:qmstart:100:root@pam:"}`))
+	})
+	polls := 0
+	mux.HandleFunc("/nodes/pve01/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 2 {
+			w.Write([]byte(`{"data":{"status":"running"}}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"status":"stopped","exitstatus":"OK"}}`))
+	})
+	r := newTestRepository(t, mux)
+	if err := r.Boot(context.Background(), "pve01", 100); err != nil {
+		t.Fatalf("Boot() error = %+v", err)
+	}
+	if calls != 3 || polls != 2 {
+		t.Errorf("calls = %d, polls = %d", calls, polls)
+	}
+}
+
+func TestTaskFailure(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes/pve01/qemu/100/clone", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":"UPID:pve01:0001:0002:0003:qmclone:100:root@pam:"}`))
+	})
+	mux.HandleFunc("/nodes/pve01/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"status":"stopped","exitstatus":"disk quota exceeded"}}`))
+	})
+	r := newTestRepository(t, mux)
+	err := r.CloneVM(context.Background(), &model.VMClone{Node: "pve01", Cloneid: 100, Newid: 101})
+	if !xerrors.Is(err, model.ErrPVEQuota) {
+		t.Fatalf("CloneVM() error = %v, want quota", err)
+	}
+}
+
+func TestClassifyPVEError(t *testing.T) {
+	tests := []struct {
+		status  int
+		message string
+		want    error
+	}{
+		{401, "authentication failure", model.ErrPVEAuth},
+		{403, "Permission check failed (/vms/100, VM.Clone)", model.ErrPVEAuth},
+		{500, "VM 100 is locked (clone)", model.ErrPVELocked},
+		{500, "can't lock file '/var/lock/qemu-server/lock-100.conf' - got timeout", model.ErrPVELocked},
+		{500, "Configuration file 'nodes/pve01/qemu-server/100.conf' does not exist", model.ErrPVENotFound},
+		{404, "", model.ErrPVENotFound},
+		{500, "no space left on device", model.ErrPVEQuota},
+		{500, "pool 'ctf-contest-1' already exists", model.ErrPVEExists},
+		{500, "unexpected", nil},
+	}
+	for _, tt := range tests {
+		if got := classifyPVEError(tt.status, tt.message); got != tt.want {
+			t.Errorf("classifyPVEError(%d, %q) = %v, want %v", tt.status, tt.message, got, tt.want)
+		}
+	}
+}
@@ -1,10 +1,9 @@
 package repository
 
 import (
+	"crypto/rand"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"math/big"
 
 	"github.com/LainInTheWired/ctf-backend/pveapi/model"
 	"github.com/amoghe/go-crypt"
@@ -24,93 +23,104 @@ func GenerateSHA512CryptHash(password, salt string, rounds int) (string, error)
 	return hashed, nil
 }
 
-func (r *pveRepository) CloudinitGenerator(fname string, host string, fqdn string, sshPwauth int, users []model.User) error {
-	// salt := "randomsalt" // 任意のソルトを設定
+const (
+	// crypt のソルトに使える文字
+	saltChars = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	saltLen   = 16
+	// SHA-512 crypt の反復回数
+	sha512CryptRounds = 100000
+)
 
-	for i, u := range users {
-		users[i].PlainTextPasswd = u.PlainTextPasswd
-		users[i].LockPasswd = false
+// GenerateSalt は crypt 用のランダムなソルトを生成します
+func GenerateSalt() (string, error) {
+	salt := make([]byte, saltLen)
+	for i := range salt {
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(saltChars))))
+		if err != nil {
+			return "", err
+		}
+		salt[i] = saltChars[index.Int64()]
 	}
-	fmt.Println(users)
+	return string(salt), nil
+}
 
-	config := model.CloudinitConfig{
-		Hostname:  host,
-		Users:     users,
-		FQDN:      fqdn,
-		SshPwauth: sshPwauth,
-		Packages: []string{
-			"git",
-			"curl",
-			"qemu-guest-agent",
-		},
-	}
-	fmt.Printf("%+v", users)
-	yamlData, err := yaml.Marshal(&config)
+// HashPassword はランダムなソルトで SHA-512 Crypt ハッシュを生成します
+func HashPassword(password string) (string, error) {
+	salt, err := GenerateSalt()
 	if err != nil {
-		fmt.Printf("Error marshalling YAML: %v\n", err)
-		return nil
+		return "", errors.Wrap(err, "can't generate salt")
 	}
-	yamlData = append([]byte("#cloud-config\n"), yamlData...)
-
-	// ファイルに書き出し
-	err = os.WriteFile(fname, yamlData, 0644)
+	hashed, err := GenerateSHA512CryptHash(password, salt, sha512CryptRounds)
 	if err != nil {
-		fmt.Printf("Error writing YAML to file: %v\n", err)
-		return nil
+		return "", errors.Wrap(err, "can't hash password")
 	}
-	return nil
+	return hashed, nil
 }
 
-func (r *pveRepository) TransferFileViaSCP(fname string) error {
-	localPath := fname
-	remoteUser := "root"
-	// remoteHost := "10.0.10.30"
-	remoteHost := os.Getenv("CLOUDINIT_FILESERVER_IP")
-	remotePath := "/mnt/pve/cephfs/snippets/"
-	cmd := exec.Command("scp",
-		"-i", "/ssh/id_ed25519",
-		"-o", "StrictHostKeyChecking=no",
-		localPath,
-		fmt.Sprintf("%s@%s:%s", remoteUser, remoteHost, remotePath),
-	)
-
-	// コマンドの標準出力と標準エラーを取得
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	// コマンドの実行
-	if err := cmd.Run(); err != nil {
-		return errors.Wrap(err, "failed scp")
+// hashPasswords は平文のパスワードをハッシュに置き換えた設定のコピーを返します
+func hashPasswords(conf *model.CloudinitConfig) (*model.CloudinitConfig, error) {
+	hashed := *conf
+	hashed.Users = append([]model.User{}, conf.Users...)
+	for i, u := range hashed.Users {
+		if u.PlainTextPasswd == "" {
+			continue
+		}
+		passwd, err := HashPassword(u.PlainTextPasswd)
+		if err != nil {
+			return nil, err
+		}
+		hashed.Users[i].Passwd = passwd
+		hashed.Users[i].PlainTextPasswd = ""
+		hashed.Users[i].LockPasswd = false
+	}
+	if conf.Chpasswd != nil {
+		chpasswd := *conf.Chpasswd
+		chpasswd.Users = append([]model.ChpasswdUser{}, conf.Chpasswd.Users...)
+		for i, u := range chpasswd.Users {
+			if u.Type != "" && u.Type != "text" {
+				continue
+			}
+			passwd, err := HashPassword(u.Password)
+			if err != nil {
+				return nil, err
+			}
+			chpasswd.Users[i].Password = passwd
+			chpasswd.Users[i].Type = "hash"
+		}
+		hashed.Chpasswd = &chpasswd
 	}
-	return nil
+	return &hashed, nil
 }
 
-func (r *pveRepository) DeleteFile(fname string) error {
-	remoteUser := "root"
-	remoteHost := os.Getenv("CLOUDINIT_FILESERVER_IP")
-	remotePath := "/mnt/pve/cephfs/snippets/"
-
-	// リモート上のファイルの完全なパスを作成
-	remoteFilePath := filepath.Join(remotePath, fname)
-
-	// 実行するリモートコマンドを定義
-	remoteCmd := fmt.Sprintf("rm -f %s", remoteFilePath)
-
-	// ssh コマンドの構築
-	cmd := exec.Command("ssh",
-		"-i", "/ssh/id_ed25519",
-		"-o", "StrictHostKeyChecking=no",
-		fmt.Sprintf("%s@%s", remoteUser, remoteHost),
-		remoteCmd,
-	)
+// CloudinitGenerator は cloud-init の user-data / vendor-data を生成します
+// パスワードは SHA-512 Crypt のハッシュとしてのみ書き出します
+func (r *pveRepository) CloudinitGenerator(conf *model.CloudinitConfig) ([]byte, error) {
+	conf, err := hashPasswords(conf)
+	if err != nil {
+		return nil, err
+	}
+	yamlData, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't marshal cloudinit yaml")
+	}
+	yamlData = append([]byte("#cloud-config\n"), yamlData...)
+	return yamlData, nil
+}
 
-	// コマンドの標準出力と標準エラーを取得
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// NetworkConfigGenerator は cloud-init の network-config を生成します
+func (r *pveRepository) NetworkConfigGenerator(conf *model.NetworkConfig) ([]byte, error) {
+	yamlData, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't marshal network-config yaml")
+	}
+	return yamlData, nil
+}
 
-	// コマンドの実行
-	if err := cmd.Run(); err != nil {
-		return errors.Wrap(err, "failed to delete remote file via ssh")
+// MetaDataGenerator は cloud-init の meta-data を生成します
+func (r *pveRepository) MetaDataGenerator(conf *model.MetaData) ([]byte, error) {
+	yamlData, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't marshal meta-data yaml")
 	}
-	return nil
+	return yamlData, nil
 }
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+)
+
+func TestCloudinitGeneratorHashesPasswords(t *testing.T) {
+	r := &pveRepository{}
+	conf := &model.CloudinitConfig{
+		Users:    []model.User{{Name: "ctf", PlainTextPasswd: "secret-password"}},
+		Chpasswd: &model.Chpasswd{Users: []model.ChpasswdUser{{Name: "root", Password: "secret-password", Type: "text"}}},
+	}
+	a, err := r.CloudinitGenerator(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.CloudinitGenerator(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(a), "secret-password") || strings.Contains(string(a), "plain_text_passwd") {
+		t.Fatalf("plain text password in user-data:\n%s", a)
+	}
+	if !strings.Contains(string(a), "$6$rounds=") || !strings.Contains(string(a), "type: hash") {
+		t.Fatalf("password is not hashed:\n%s", a)
+	}
+	// ソルトは毎回ランダム
+	if string(a) == string(b) {
+		t.Fatal("same hash generated twice")
+	}
+	// 呼び出し元の設定は変更しない
+	if conf.Users[0].PlainTextPasswd != "secret-password" || conf.Chpasswd.Users[0].Type != "text" {
+		t.Fatalf("input was modified: %+v", conf)
+	}
+}
@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+// firewallPath は /nodes/{node}/{qemu|lxc}/{vmid}/firewall 以下のパスを作ります
+func (r *pveRepository) firewallPath(node string, vmid int, path string) string {
+	return r.guestPath(node, vmid, "/firewall"+path)
+}
+
+func (r *pveRepository) EditFirewallOptions(ctx context.Context, node string, vmid int, opts *model.FirewallOptions) error {
+	formData := url.Values{}
+	if opts.Enable {
+		formData.Set("enable", "1")
+	} else {
+		formData.Set("enable", "0")
+	}
+	if opts.PolicyIn != "" {
+		formData.Set("policy_in", opts.PolicyIn)
+	}
+	if opts.PolicyOut != "" {
+		formData.Set("policy_out", opts.PolicyOut)
+	}
+	if err := r.request(ctx, http.MethodPut, r.firewallPath(node, vmid, "/options"), formData, nil); err != nil {
+		return xerrors.Errorf("can't edit firewall options: %w", err)
+	}
+	return nil
+}
+
+func (r *pveRepository) ListFirewallRules(ctx context.Context, node string, vmid int) ([]model.FirewallRule, error) {
+	rules := []model.FirewallRule{}
+	if err := r.request(ctx, http.MethodGet, r.firewallPath(node, vmid, "/rules"), url.Values{}, &rules); err != nil {
+		return nil, xerrors.Errorf("can't list firewall rules: %w", err)
+	}
+	return rules, nil
+}
+
+func (r *pveRepository) CreateFirewallRule(ctx context.Context, node string, vmid int, rule *model.FirewallRule) error {
+	formData := url.Values{}
+	formData.Set("type", rule.Type)
+	formData.Set("action", rule.Action)
+	formData.Set("enable", strconv.Itoa(rule.Enable))
+	if rule.Proto != "" {
+		formData.Set("proto", rule.Proto)
+	}
+	if rule.Dport != "" {
+		formData.Set("dport", rule.Dport)
+	}
+	if rule.Source != "" {
+		formData.Set("source", rule.Source)
+	}
+	if rule.Dest != "" {
+		formData.Set("dest", rule.Dest)
+	}
+	if rule.Comment != "" {
+		formData.Set("comment", rule.Comment)
+	}
+	// pos を指定しないと先頭に追加されるので、末尾の位置を指定する
+	formData.Set("pos", strconv.Itoa(rule.Pos))
+	if err := r.request(ctx, http.MethodPost, r.firewallPath(node, vmid, "/rules"), formData, nil); err != nil {
+		return xerrors.Errorf("can't create firewall rule: %w", err)
+	}
+	return nil
+}
+
+func (r *pveRepository) DeleteFirewallRule(ctx context.Context, node string, vmid int, pos int) error {
+	if err := r.request(ctx, http.MethodDelete, r.firewallPath(node, vmid, fmt.Sprintf("/rules/%d", pos)), url.Values{}, nil); err != nil {
+		return xerrors.Errorf("can't delete firewall rule: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+func storagePath(node string, storage string, path string) string {
+	return fmt.Sprintf("/nodes/%s/storage/%s%s", node, storage, path)
+}
+
+func (r *pveRepository) DownloadImage(ctx context.Context, img *model.ImageImport) error {
+	formData := url.Values{}
+	formData.Set("content", model.ImageContent)
+	formData.Set("filename", img.Filename)
+	formData.Set("url", img.URL)
+	if img.Checksum != "" {
+		formData.Set("checksum", img.Checksum)
+		formData.Set("checksum-algorithm", img.ChecksumAlgorithm)
+	}
+	// ダウンロードが終わるまで待つ
+	if err := r.task(ctx, http.MethodPost, storagePath(img.Node, img.Storage, "/download-url"), formData); err != nil {
+		return xerrors.Errorf("can't download image: %w", err)
+	}
+	return nil
+}
+
+func (r *pveRepository) UploadImage(ctx context.Context, img *model.ImageImport, file io.Reader) error {
+	path := storagePath(img.Node, img.Storage, "/upload")
+	// イメージは大きいのでメモリに読み込まずにそのまま送る
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := mw.WriteField("content", model.ImageContent)
+		if err == nil {
+			var part io.Writer
+			if part, err = mw.CreateFormFile("filename", img.Filename); err == nil {
+				_, err = io.Copy(part, file)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	// 1 回のリクエストのタイムアウトでは大きなイメージを送り切れないのでタスクと同じ上限にする
+	uctx, cancel := context.WithTimeout(ctx, r.pveConf.TaskTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(uctx, http.MethodPost, r.pveConf.APIURL+path, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return xerrors.Errorf("can't create http request: %w", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return xerrors.Errorf("fail http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var upid string
+	if err := decodeResponse(http.MethodPost, path, resp, &upid); err != nil {
+		return xerrors.Errorf("can't upload image: %w", err)
+	}
+	// アップロードした一時ファイルをストレージに移すタスクが終わるまで待つ
+	if upid != "" {
+		if err := r.WaitTask(ctx, upid); err != nil {
+			return xerrors.Errorf("can't upload image: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *pveRepository) CreateVM(ctx context.Context, vm *model.VMCreate) error {
+	formData := url.Values{}
+	formData.Set("vmid", strconv.Itoa(vm.Vmid))
+	formData.Set("name", vm.Name)
+	formData.Set("cores", strconv.Itoa(vm.Cores))
+	formData.Set("memory", strconv.Itoa(vm.Memory))
+	formData.Set("ostype", "l26")
+	formData.Set("scsihw", "virtio-scsi-pci")
+	// import-from でイメージをコピーしてディスクにする (イメージはそのまま残る)
+	formData.Set("scsi0", fmt.Sprintf("%s:0,import-from=%s", vm.Storage, vm.Image))
+	formData.Set("ide2", fmt.Sprintf("%s:cloudinit", vm.Storage))
+	formData.Set("boot", "order=scsi0")
+	// クラウドイメージはシリアルコンソールを使う
+	formData.Set("serial0", "socket")
+	formData.Set("vga", "serial0")
+	formData.Set("agent", "enabled=1")
+	formData.Set("net0", fmt.Sprintf("virtio,bridge=%s", vm.Bridge))
+	formData.Set("ipconfig0", "ip=dhcp")
+	if vm.Cicustom != "" {
+		formData.Set("cicustom", fmt.Sprintf("user=%s:snippets/%s", r.pveConf.Snippet.StorageID, vm.Cicustom))
+	}
+	// ディスクのコピーが終わるまで VM はロックされている
+	if err := r.task(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/qemu", vm.Node), formData); err != nil {
+		return xerrors.Errorf("can't create vm: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/LainInTheWired/ctf-backend/pveapi/pvefake"
+	"golang.org/x/xerrors"
+)
+
+func TestImportImageAndCreateVM(t *testing.T) {
+	ctx := context.Background()
+	fake, r := newFakeRepository(t, pvefake.Node{Name: "pve01"})
+
+	dl := &model.ImageImport{Node: "pve01", Storage: "local", Filename: "noble.qcow2", URL: "https://cloud-images.ubuntu.com/noble.img"}
+	if err := r.DownloadImage(ctx, dl); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := fake.Volume("pve01", "local:import/noble.qcow2"); !ok || v != dl.URL {
+		t.Errorf("downloaded volume = %q %v", v, ok)
+	}
+	up := &model.ImageImport{Node: "pve01", Storage: "local", Filename: "alpine.raw"}
+	if err := r.UploadImage(ctx, up, strings.NewReader("raw image")); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := fake.Volume("pve01", "local:import/alpine.raw"); !ok || v != "raw image" {
+		t.Errorf("uploaded volume = %q %v", v, ok)
+	}
+
+	vm := &model.VMCreate{Vmid: 120, Node: "pve01", Name: "noble", Cores: 2, Memory: 2048, Storage: "vmdisk", Image: "local:import/noble.qcow2", Bridge: "vmbr0", Cicustom: "build-1.yaml"}
+	if err := r.CreateVM(ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+	created, ok := fake.VM(120)
+	if !ok || created.Lock != "" || created.Config["ide2"] != "vmdisk:cloudinit" || created.Config["agent"] != "enabled=1" ||
+		!strings.Contains(created.Config["cicustom"], "snippets/build-1.yaml") {
+		t.Errorf("created vm = %+v", created)
+	}
+
+	// 取り込んでいないイメージからは作れない
+	vm = &model.VMCreate{Vmid: 121, Node: "pve01", Name: "missing", Cores: 1, Memory: 512, Storage: "vmdisk", Image: "local:import/missing.qcow2", Bridge: "vmbr0"}
+	if err := r.CreateVM(ctx, vm); !xerrors.Is(err, model.ErrPVENotFound) {
+		t.Errorf("CreateVM() error = %v, want ErrPVENotFound", err)
+	}
+}
@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+// lxcInterfaces はコンテナのインターフェースを guest agent と同じ形で返します
+func (r *pveRepository) lxcInterfaces(ctx context.Context, node string, vmid int) ([]model.NetworkIntQumeAgent, error) {
+	ifs := []model.LXCInterface{}
+	if err := r.request(ctx, http.MethodGet, r.guestPath(node, vmid, "/interfaces"), url.Values{}, &ifs); err != nil {
+		return nil, xerrors.Errorf("can't get container interfaces: %w", err)
+	}
+	return LXCInterfaces(ifs), nil
+}
+
+// LXCInterfaces は /interfaces の inet と inet6 (CIDR) をアドレスとプレフィックス長に分けます
+func LXCInterfaces(ifs []model.LXCInterface) []model.NetworkIntQumeAgent {
+	res := []model.NetworkIntQumeAgent{}
+	for _, i := range ifs {
+		n := model.NetworkIntQumeAgent{Name: i.Name, HardwareAddress: i.Hwaddr}
+		for _, a := range []struct{ typ, cidr string }{{"ipv4", i.Inet}, {"ipv6", i.Inet6}} {
+			if a.cidr == "" {
+				continue
+			}
+			addr, prefix, _ := strings.Cut(a.cidr, "/")
+			p, _ := strconv.Atoi(prefix)
+			n.IPAddresses = append(n.IPAddresses, model.IPAddress{IPAddressType: a.typ, Prefix: p, IPAddress: addr})
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// errLXCAgent はコンテナに guest agent の操作をしたときのエラーです
+func errLXCAgent(op string) error {
+	return xerrors.Errorf("can't %s: lxc container has no guest agent: %w", op, model.ErrGuestUnsupported)
+}
@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+// rrdQuery は期間ごとの平均値を取得するクエリです
+func rrdQuery(timeframe string) url.Values {
+	q := url.Values{}
+	q.Set("timeframe", timeframe)
+	q.Set("cf", "AVERAGE")
+	return q
+}
+
+func (r *pveRepository) GetVMRRDData(ctx context.Context, node string, vmid int, timeframe string) ([]model.RRDData, error) {
+	data := []model.RRDData{}
+	path := r.guestPath(node, vmid, "/rrddata")
+	if err := r.request(ctx, http.MethodGet, path, rrdQuery(timeframe), &data); err != nil {
+		return nil, xerrors.Errorf("can't get vm rrddata: %w", err)
+	}
+	return data, nil
+}
+
+func (r *pveRepository) GetNodeRRDData(ctx context.Context, node string, timeframe string) ([]model.RRDData, error) {
+	data := []model.RRDData{}
+	path := fmt.Sprintf("/nodes/%s/rrddata", node)
+	if err := r.request(ctx, http.MethodGet, path, rrdQuery(timeframe), &data); err != nil {
+		return nil, xerrors.Errorf("can't get node rrddata: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+func (r *pveRepository) ListPools(ctx context.Context) ([]model.Pool, error) {
+	pools := []model.Pool{}
+	if err := r.request(ctx, http.MethodGet, "/pools", url.Values{}, &pools); err != nil {
+		return nil, xerrors.Errorf("can't list pools: %w", err)
+	}
+	return pools, nil
+}
+
+func (r *pveRepository) CreatePool(ctx context.Context, pool *model.Pool) error {
+	formData := url.Values{}
+	formData.Set("poolid", pool.PoolID)
+	if pool.Comment != "" {
+		formData.Set("comment", pool.Comment)
+	}
+	if err := r.request(ctx, http.MethodPost, "/pools", formData, nil); err != nil {
+		return xerrors.Errorf("can't create pool: %w", err)
+	}
+	return nil
+}
+
+func (r *pveRepository) AddPoolVM(ctx context.Context, poolid string, vmid int) error {
+	formData := url.Values{}
+	formData.Set("vms", strconv.Itoa(vmid))
+	formData.Set("allow-move", "1")
+	if err := r.request(ctx, http.MethodPut, "/pools/"+url.PathEscape(poolid), formData, nil); err != nil {
+		return xerrors.Errorf("can't add vm to pool: %w", err)
+	}
+	return nil
+}
@@ -1,24 +1,23 @@
 package repository
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
 	"github.com/LainInTheWired/ctf-backend/pveapi/model"
-	"github.com/cockroachdb/errors"
 	"golang.org/x/xerrors"
 )
 
 type pveRepository struct {
 	pveConf    *model.PVEConfig
 	HTTPClient *http.Client
+	// 操作するゲストの種類 (/nodes/{node}/qemu または /nodes/{node}/lxc)
+	guest string
 }
 
 // ProxmoxConfig はProxmoxへの接続設定を保持します
@@ -28,112 +27,158 @@ type PVEConfig struct {
 }
 
 type PVERepository interface {
-	CloneVM(name string, id int, cnode string, cloneid int, tnode string) error
-	GetVM(string) (*model.VMConfig, error)
-	EditVM(model.VMEdit) error
-	GetNodeList() ([]model.NodeList, error)
-	GetVMList(nodes *model.NodeList) ([]model.VMList, error)
-	DeleteVM(vmdelete *model.VMDelete) error
-	CloudinitGenerator(fname string, host string, fqdn string, sshPwauth int, users []model.User) error
-	TransferFileViaSCP(fname string) error
-	NextVMID() (string, error)
-	GetClusterResourcesList() ([]model.ClusterResources, error)
-	ResizeDisk(node string, disk string, size int, vmid int) error
-	Boot(node string, vmid int) error
-	Shutdown(node string, vmid int) error
-	Template(node string, vmid int) error
-	DeleteFile(fname string) error
-	GetNetIntFormQumeAgent(node string, vmid int) ([]model.NetworkIntQumeAgent, error)
-	EditVMACL(vmid int) error
+	CloneVM(ctx context.Context, clone *model.VMClone) error
+	GetVM(ctx context.Context, node string, vmid int) (*model.VMConfig, error)
+	EditVM(ctx context.Context, vmedit model.VMEdit) error
+	GetNodeList(ctx context.Context) ([]model.NodeList, error)
+	GetVMList(ctx context.Context, nodes *model.NodeList) ([]model.VMList, error)
+	DeleteVM(ctx context.Context, vmdelete *model.VMDelete) error
+	CloudinitGenerator(conf *model.CloudinitConfig) ([]byte, error)
+	NetworkConfigGenerator(conf *model.NetworkConfig) ([]byte, error)
+	MetaDataGenerator(conf *model.MetaData) ([]byte, error)
+	NextVMID(ctx context.Context) (string, error)
+	GetClusterResourcesList(ctx context.Context) ([]model.ClusterResources, error)
+	// LookupVMNode は vmid の VM があるノードを返します
+	LookupVMNode(ctx context.Context, vmid int) (string, error)
+	// LookupGuest は vmid の VM またはコンテナがあるノードと種類を返します
+	LookupGuest(ctx context.Context, vmid int) (*model.Guest, error)
+	// ForGuest は kind (qemu / lxc) のゲストを操作するリポジトリを返します
+	// VM を操作するメソッドは同じ形の /nodes/{node}/lxc 以下の API を使う
+	ForGuest(kind string) PVERepository
+	ResizeDisk(ctx context.Context, node string, disk string, size int, vmid int) error
+	Boot(ctx context.Context, node string, vmid int) error
+	Shutdown(ctx context.Context, node string, vmid int) error
+	Suspend(ctx context.Context, node string, vmid int, toDisk bool) error
+	Resume(ctx context.Context, node string, vmid int) error
+	Template(ctx context.Context, node string, vmid int) error
+	GetNetIntFormQumeAgent(ctx context.Context, node string, vmid int) ([]model.NetworkIntQumeAgent, error)
+	GetVMStatus(ctx context.Context, node string, vmid int) (*model.VMStatus, error)
+	// timeframe は hour / day / week / month / year
+	GetVMRRDData(ctx context.Context, node string, vmid int, timeframe string) ([]model.RRDData, error)
+	GetNodeRRDData(ctx context.Context, node string, timeframe string) ([]model.RRDData, error)
+	AgentPing(ctx context.Context, node string, vmid int) error
+	AgentExec(ctx context.Context, node string, vmid int, command []string, input string) (int, error)
+	AgentExecStatus(ctx context.Context, node string, vmid int, pid int) (*model.AgentExecStatus, error)
+	AgentFileRead(ctx context.Context, node string, vmid int, path string) (*model.AgentFile, error)
+	AgentFileWrite(ctx context.Context, node string, vmid int, file *model.AgentFileWrite) error
+	EditVMACL(ctx context.Context, vmid int) error
+	WaitTask(ctx context.Context, upid string) error
+	ListSDNZones(ctx context.Context) ([]model.SDNZone, error)
+	ListPools(ctx context.Context) ([]model.Pool, error)
+	CreatePool(ctx context.Context, pool *model.Pool) error
+	// AddPoolVM は VM をリソースプールに移します (別のプールに入っている場合はそこから外す)
+	AddPoolVM(ctx context.Context, poolid string, vmid int) error
+	CreateSDNZone(ctx context.Context, zone *model.SDNZone) error
+	CreateVNet(ctx context.Context, vnet *model.VNet) error
+	DeleteVNet(ctx context.Context, name string) error
+	CreateSubnet(ctx context.Context, vnet *model.VNet) error
+	ListSubnets(ctx context.Context, name string) ([]model.SDNSubnet, error)
+	DeleteSubnet(ctx context.Context, name string, subnet string) error
+	ApplySDN(ctx context.Context) error
+	EditFirewallOptions(ctx context.Context, node string, vmid int, opts *model.FirewallOptions) error
+	ListFirewallRules(ctx context.Context, node string, vmid int) ([]model.FirewallRule, error)
+	CreateFirewallRule(ctx context.Context, node string, vmid int, rule *model.FirewallRule) error
+	DeleteFirewallRule(ctx context.Context, node string, vmid int, pos int) error
+	// DownloadImage は Proxmox に URL のクラウドイメージをストレージへダウンロードさせます
+	DownloadImage(ctx context.Context, img *model.ImageImport) error
+	// UploadImage は file をクラウドイメージとしてストレージへアップロードします
+	UploadImage(ctx context.Context, img *model.ImageImport, file io.Reader) error
+	// CreateVM はクラウドイメージのディスクで新しい VM を作ります
+	CreateVM(ctx context.Context, vm *model.VMCreate) error
 }
 
 func NewPVERepository(conf *model.PVEConfig, client *http.Client) PVERepository {
-	return &pveRepository{
-		pveConf:    conf,
-		HTTPClient: client,
+	if conf.RequestTimeout == 0 {
+		conf.RequestTimeout = defaultRequestTimeout
 	}
-}
-
-func (r *pveRepository) GetNodeList() ([]model.NodeList, error) {
-	endpoint := fmt.Sprintf("%s/nodes", r.pveConf.APIURL)
-
-	formData := url.Values{}
-
-	req, err := http.NewRequest("GET", endpoint, bytes.NewBufferString(formData.Encode()))
-	if err != nil {
-		return nil, xerrors.Errorf("can't create http request: %w", err)
+	if conf.TaskTimeout == 0 {
+		conf.TaskTimeout = defaultTaskTimeout
 	}
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return nil, xerrors.Errorf("fail http request: %w", err)
+	if conf.TaskPollInterval == 0 {
+		conf.TaskPollInterval = defaultTaskPollInterval
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
+	if conf.LockRetries == 0 {
+		conf.LockRetries = defaultLockRetries
 	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[[]model.NodeList]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return nil, xerrors.Errorf("can't unmarshal response body: %w", err)
+	if conf.LockBackoff == 0 {
+		conf.LockBackoff = defaultLockBackoff
 	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return nil, xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	return &pveRepository{
+		pveConf:    conf,
+		HTTPClient: client,
+		guest:      model.GuestQEMU,
 	}
-
-	return pveresp.Data, nil
 }
 
-func (r *pveRepository) GetVMList(nodes *model.NodeList) ([]model.VMList, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu", r.pveConf.APIURL, strings.Split(nodes.ID, "/")[1])
-	formData := url.Values{}
-	req, err := http.NewRequest("GET", endpoint, bytes.NewBufferString(formData.Encode()))
-	if err != nil {
-		return nil, xerrors.Errorf("can't create http request: %w", err)
-	}
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return nil, xerrors.Errorf("fail http request: %w", err)
+func (r *pveRepository) ForGuest(kind string) PVERepository {
+	if kind == "" {
+		kind = model.GuestQEMU
 	}
-	defer resp.Body.Close()
+	g := *r
+	g.guest = kind
+	return &g
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
+func (r *pveRepository) lxc() bool {
+	return r.guest == model.GuestLXC
+}
+
+// guestPath は /nodes/{node}/{qemu|lxc}/{vmid} 以下のパスを作ります
+func (r *pveRepository) guestPath(node string, vmid int, path string) string {
+	return fmt.Sprintf("/nodes/%s/%s/%d%s", node, r.guest, vmid, path)
+}
 
-	var pveresp model.ResponsePVE[[]model.VMList]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return nil, xerrors.Errorf("can't unmarshal response body: %w", err)
+func (r *pveRepository) GetNodeList(ctx context.Context) ([]model.NodeList, error) {
+	nodes := []model.NodeList{}
+	if err := r.request(ctx, http.MethodGet, "/nodes", url.Values{}, &nodes); err != nil {
+		return nil, xerrors.Errorf("can't get nodes: %w", err)
 	}
+	return nodes, nil
+}
 
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return nil, xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+func (r *pveRepository) GetVMList(ctx context.Context, nodes *model.NodeList) ([]model.VMList, error) {
+	vms := []model.VMList{}
+	path := fmt.Sprintf("/nodes/%s/%s", strings.Split(nodes.ID, "/")[1], r.guest)
+	if err := r.request(ctx, http.MethodGet, path, url.Values{}, &vms); err != nil {
+		return nil, xerrors.Errorf("can't get vms: %w", err)
 	}
-	return pveresp.Data, nil
+	return vms, nil
 }
 
-func (r *pveRepository) EditVM(vmedit model.VMEdit) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/config", r.pveConf.APIURL, vmedit.Node, vmedit.Vmid)
+func (r *pveRepository) EditVM(ctx context.Context, vmedit model.VMEdit) error {
 	// フォームデータの作成
 	formData := url.Values{}
 	if vmedit.Memory != 0 {
 		formData.Set("memory", strconv.Itoa(vmedit.Memory))
 	}
+	if vmedit.Name != "" {
+		if r.lxc() {
+			formData.Set("hostname", vmedit.Name)
+		} else {
+			formData.Set("name", vmedit.Name)
+		}
+	}
 	if vmedit.Cores != 0 {
 		formData.Set("cores", strconv.Itoa(vmedit.Cores))
 
 	}
 
+	for i, v := range vmedit.Net {
+		formData.Set(fmt.Sprintf("net%d", i), v)
+	}
+	if vmedit.Tags != "" {
+		formData.Set("tags", vmedit.Tags)
+	}
+	if len(vmedit.Delete) > 0 {
+		formData.Set("delete", strings.Join(vmedit.Delete, ","))
+	}
+	// LXC のコンテナは cloud-init とディスクの設定を持たない (IP アドレスは net0 に書く)
+	if r.lxc() {
+		if err := r.task(ctx, http.MethodPut, r.guestPath(vmedit.Node, vmedit.Vmid, "/config"), formData); err != nil {
+			return xerrors.Errorf("can't edit container: %w", err)
+		}
+		return nil
+	}
 	for i, v := range vmedit.Ipconfig {
 		formData.Set(fmt.Sprintf("ipconfig%d", i), v)
 	}
@@ -142,527 +187,210 @@ func (r *pveRepository) EditVM(vmedit model.VMEdit) error {
 	}
 
 	if vmedit.Cicustom != "" {
-		formData.Set("cicustom", fmt.Sprintf("user=cephfs:snippets/%s", vmedit.Cicustom))
-		fmt.Printf("user=cephfs:snippets/%s", vmedit.Cicustom)
-	}
-
-	fmt.Println("Request Body:", formData.Encode())
-
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("POST", endpoint, strings.NewReader(formData.Encode()))
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
-	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
+		cicustom := []string{fmt.Sprintf("user=%s:snippets/%s", r.pveConf.Snippet.StorageID, vmedit.Cicustom)}
+		if vmedit.CicustomNetwork != "" {
+			cicustom = append(cicustom, fmt.Sprintf("network=%s:snippets/%s", r.pveConf.Snippet.StorageID, vmedit.CicustomNetwork))
+		}
+		if vmedit.CicustomMeta != "" {
+			cicustom = append(cicustom, fmt.Sprintf("meta=%s:snippets/%s", r.pveConf.Snippet.StorageID, vmedit.CicustomMeta))
+		}
+		if vmedit.CicustomVendor != "" {
+			cicustom = append(cicustom, fmt.Sprintf("vendor=%s:snippets/%s", r.pveConf.Snippet.StorageID, vmedit.CicustomVendor))
+		}
+		formData.Set("cicustom", strings.Join(cicustom, ","))
+	}
+
+	if err := r.task(ctx, http.MethodPost, r.guestPath(vmedit.Node, vmedit.Vmid, "/config"), formData); err != nil {
+		return xerrors.Errorf("can't edit vm: %w", err)
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return errors.Newf("API Error: status code %d, response: %s, body: %s", resp.StatusCode, pveresp.Errors["errors"])
-	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("VM クローンの作成が開始されました。UPID: %s\n", pveresp.Data)
-
 	return nil
 }
 
-func (r *pveRepository) DeleteStorageContest(node, storage, content string) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/nodes/%s/storage/%s/content/%s", r.pveConf.APIURL, node, storage, content)
-	// フォームデータの作成
-	formData := url.Values{}
-
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("DELETE", endpoint, strings.NewReader(formData.Encode()))
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
+func (r *pveRepository) DeleteStorageContest(ctx context.Context, node, storage, content string) error {
+	path := fmt.Sprintf("/nodes/%s/storage/%s/content/%s", node, storage, content)
+	if err := r.task(ctx, http.MethodDelete, path, url.Values{}); err != nil {
+		return xerrors.Errorf("can't delete storage content: %w", err)
 	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return errors.Newf("API Error: status code %d, response: %s, body: %s", resp.StatusCode, pveresp.Errors["errors"])
-	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("VM クローンの作成が開始されました。UPID: %s\n", pveresp.Data)
-
 	return nil
 }
 
-// この関数は使用していない
-func (r *pveRepository) GetVM(id string) (*model.VMConfig, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%s/config", r.pveConf.APIURL, "pve02", id)
-	formData := url.Values{}
-
-	req, err := http.NewRequest("GET", endpoint, bytes.NewBufferString(formData.Encode()))
-	if err != nil {
-		return nil, xerrors.Errorf("can't create http request: %w", err)
-	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return nil, xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return nil, xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
-	}
-
-	var getVMconfig model.ResponsePVE[model.VMConfig]
-
-	err = json.Unmarshal([]byte(body), &getVMconfig)
-	if err != nil {
-		return nil, xerrors.Errorf("json Unmarshal error: %w", err)
+func (r *pveRepository) GetVM(ctx context.Context, node string, vmid int) (*model.VMConfig, error) {
+	conf := &model.VMConfig{}
+	if err := r.request(ctx, http.MethodGet, r.guestPath(node, vmid, "/config"), url.Values{}, conf); err != nil {
+		return nil, xerrors.Errorf("can't get vm config: %w", err)
 	}
-	fmt.Println(getVMconfig)
-
-	return &getVMconfig.Data, nil
+	return conf, nil
 }
 
-func (r *pveRepository) CloneVM(name string, id int, cnode string, cloneid int, tnode string) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/clone", r.pveConf.APIURL, cnode, cloneid)
-	fmt.Printf("%s/nodes/%s/qemu/%b/clone\n", r.pveConf.APIURL, cnode, cloneid)
+func (r *pveRepository) CloneVM(ctx context.Context, clone *model.VMClone) error {
 	// フォームデータの作成
 	formData := url.Values{}
-	formData.Set("name", name)
-	formData.Set("newid", strconv.Itoa(id))
-	formData.Set("target", tnode)
-	formData.Set("full", "0")
-
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBufferString(formData.Encode()))
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
-	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// レスポンスの読み取り
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	if r.lxc() {
+		formData.Set("hostname", clone.Name)
+	} else {
+		formData.Set("name", clone.Name)
+	}
+	formData.Set("newid", strconv.Itoa(clone.Newid))
+	formData.Set("target", clone.Target)
+	if clone.Mode == model.CloneModeFull {
+		formData.Set("full", "1")
+		// storage はフルクローンの場合のみ指定できる
+		if clone.Storage != "" {
+			formData.Set("storage", clone.Storage)
+		}
+	} else {
+		formData.Set("full", "0")
+	}
+	if clone.Pool != "" {
+		formData.Set("pool", clone.Pool)
+	}
+
+	// クローンが終わるまで待つ (終わる前は VM がロックされていて編集できない)
+	if err := r.task(ctx, http.MethodPost, r.guestPath(clone.Node, clone.Cloneid, "/clone"), formData); err != nil {
+		return xerrors.Errorf("can't clone vm: %w", err)
 	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("VM クローンの作成が開始されました。UPID: %s\n", pveresp.Data)
-
 	return nil
 }
 
-func (r *pveRepository) DeleteVM(vmdelete *model.VMDelete) error {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/", r.pveConf.APIURL, vmdelete.Node, vmdelete.Vmid)
-	req, err := http.NewRequest("DELETE", endpoint, nil)
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
-	}
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// レスポンスの読み取り
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+func (r *pveRepository) DeleteVM(ctx context.Context, vmdelete *model.VMDelete) error {
+	if err := r.task(ctx, http.MethodDelete, r.guestPath(vmdelete.Node, vmdelete.Vmid, ""), url.Values{}); err != nil {
+		return xerrors.Errorf("can't delete vm: %w", err)
 	}
 	return nil
 }
 
-func (r *pveRepository) NextVMID() (string, error) {
-	endpoint := fmt.Sprintf("%s/cluster/nextid", r.pveConf.APIURL)
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		return "", xerrors.Errorf("can't create http request: %w", err)
-	}
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return "", xerrors.Errorf("fail http request: %w", err)
+func (r *pveRepository) NextVMID(ctx context.Context) (string, error) {
+	var vmid string
+	if err := r.request(ctx, http.MethodGet, "/cluster/nextid", url.Values{}, &vmid); err != nil {
+		return "", xerrors.Errorf("can't get next vmid: %w", err)
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return "", xerrors.Errorf("can't unmarshal response body: %w", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return "", xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
-	}
-	// クローン作成のUPIDを表示
-	log.Printf("VM クローンの作成が開始されました。UPID: %s\n", pveresp.Data)
-	return pveresp.Data, nil
+	return vmid, nil
 }
 
-func (r *pveRepository) GetClusterResourcesList() ([]model.ClusterResources, error) {
-	endpoint := fmt.Sprintf("%s/cluster/resources", r.pveConf.APIURL)
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		return nil, xerrors.Errorf("can't create http request: %w", err)
+func (r *pveRepository) GetClusterResourcesList(ctx context.Context) ([]model.ClusterResources, error) {
+	res := []model.ClusterResources{}
+	if err := r.request(ctx, http.MethodGet, "/cluster/resources", url.Values{}, &res); err != nil {
+		return nil, xerrors.Errorf("can't get cluster resources: %w", err)
 	}
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return res, nil
+}
 
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
+func (r *pveRepository) LookupVMNode(ctx context.Context, vmid int) (string, error) {
+	g, err := r.LookupGuest(ctx, vmid)
 	if err != nil {
-		return nil, xerrors.Errorf("fail http request: %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
+	return g.Node, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+func (r *pveRepository) LookupGuest(ctx context.Context, vmid int) (*model.Guest, error) {
+	res, err := r.GetClusterResourcesList(ctx)
 	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[[]model.ClusterResources]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return nil, xerrors.Errorf("can't unmarshal response body: %w", err)
+		return nil, err
 	}
+	return findGuest(res, vmid)
+}
 
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return nil, xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+func findGuest(res []model.ClusterResources, vmid int) (*model.Guest, error) {
+	for _, v := range res {
+		// ノードやストレージは vmid を持たないので VM とコンテナだけを見る
+		if model.IsGuestType(v.Type) && vmid == v.Vmid {
+			return &model.Guest{Node: v.Node, Type: v.Type}, nil
+		}
 	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("VM クローンの作成が開始されました。UPID: %s\n", pveresp.Data)
-
-	fmt.Println("fiewajfioejwaofjipoeawjfpojewaio;fj")
-	fmt.Printf("%+v", pveresp.Data)
-	return pveresp.Data, nil
+	return nil, xerrors.Errorf("not found vmid %d in cluster: %w", vmid, model.ErrPVENotFound)
 }
 
-func (r *pveRepository) ResizeDisk(node string, disk string, size int, vmid int) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/resize", r.pveConf.APIURL, node, vmid)
-	fmt.Printf("%s/nodes/%s/qemu/%b/clone\n", r.pveConf.APIURL, node, vmid)
+func (r *pveRepository) ResizeDisk(ctx context.Context, node string, disk string, size int, vmid int) error {
 	// フォームデータの作成
 	formData := url.Values{}
 	formData.Set("disk", disk)
 	formData.Set("size", fmt.Sprintf("%dG", size))
 
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("PUT", endpoint, bytes.NewBufferString(formData.Encode()))
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
-	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// レスポンスの読み取り
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	if err := r.task(ctx, http.MethodPut, r.guestPath(node, vmid, "/resize"), formData); err != nil {
+		return xerrors.Errorf("can't resize vm disk: %w", err)
 	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("resize  vm disk %s\n", pveresp.Data)
-
 	return nil
 }
 
-func (r *pveRepository) Boot(node string, vmid int) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/status/start", r.pveConf.APIURL, node, vmid)
-	// フォームデータの作成
-
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("POST", endpoint, nil)
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
+func (r *pveRepository) Boot(ctx context.Context, node string, vmid int) error {
+	path := r.guestPath(node, vmid, "/status/start")
+	if err := r.task(ctx, http.MethodPost, path, url.Values{}); err != nil {
+		return xerrors.Errorf("can't start vm: %w", err)
 	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// レスポンスの読み取り
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
-	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("start vm%s\n", pveresp.Data)
-
 	return nil
 }
 
-func (r *pveRepository) Shutdown(node string, vmid int) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/status/stop", r.pveConf.APIURL, node, vmid)
-	// フォームデータの作成
-
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("POST", endpoint, nil)
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
+// Suspend は VM を一時停止します (toDisk の場合はハイバネートする)
+func (r *pveRepository) Suspend(ctx context.Context, node string, vmid int, toDisk bool) error {
+	// コンテナの suspend は CRIU が必要な実験的な機能なので使わない
+	if r.lxc() {
+		return xerrors.Errorf("can't suspend container: %w", model.ErrGuestUnsupported)
 	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// レスポンスの読み取り
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
+	path := r.guestPath(node, vmid, "/status/suspend")
+	formData := url.Values{}
+	if toDisk {
+		formData.Set("todisk", "1")
 	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+	if err := r.task(ctx, http.MethodPost, path, formData); err != nil {
+		return xerrors.Errorf("can't suspend vm: %w", err)
 	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("shutdown vm%s\n", pveresp.Data)
-
 	return nil
-
 }
 
-func (r *pveRepository) Template(node string, vmid int) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/template", r.pveConf.APIURL, node, vmid)
-	// フォームデータの作成
-
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("POST", endpoint, nil)
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
+// Resume は一時停止した VM を再開します (ハイバネートした VM は Boot で再開する)
+func (r *pveRepository) Resume(ctx context.Context, node string, vmid int) error {
+	path := r.guestPath(node, vmid, "/status/resume")
+	if err := r.task(ctx, http.MethodPost, path, url.Values{}); err != nil {
+		return xerrors.Errorf("can't resume vm: %w", err)
 	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// レスポンスの読み取り
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
-	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
-	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("template vm%s\n", pveresp.Data)
-
 	return nil
 }
 
-func (r *pveRepository) GetNetIntFormQumeAgent(node string, vmid int) ([]model.NetworkIntQumeAgent, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/agent/network-get-interfaces", r.pveConf.APIURL, node, vmid)
-	// formData := url.Values{}
-	fmt.Println(endpoint)
-
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		return nil, xerrors.Errorf("can't create http request: %w", err)
+func (r *pveRepository) Shutdown(ctx context.Context, node string, vmid int) error {
+	path := r.guestPath(node, vmid, "/status/stop")
+	if err := r.task(ctx, http.MethodPost, path, url.Values{}); err != nil {
+		return xerrors.Errorf("can't stop vm: %w", err)
 	}
+	return nil
+}
 
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return nil, xerrors.Errorf("fail http request: %w", err)
+func (r *pveRepository) Template(ctx context.Context, node string, vmid int) error {
+	path := r.guestPath(node, vmid, "/template")
+	if err := r.task(ctx, http.MethodPost, path, url.Values{}); err != nil {
+		return xerrors.Errorf("can't convert vm to template: %w", err)
 	}
-	defer resp.Body.Close()
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
+func (r *pveRepository) GetVMStatus(ctx context.Context, node string, vmid int) (*model.VMStatus, error) {
+	status := &model.VMStatus{}
+	path := r.guestPath(node, vmid, "/status/current")
+	if err := r.request(ctx, http.MethodGet, path, url.Values{}, status); err != nil {
+		return nil, xerrors.Errorf("can't get vm status: %w", err)
 	}
+	return status, nil
+}
 
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return nil, xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+// GetNetIntFormQumeAgent は VM の中のインターフェースとアドレスを返します
+// LXC のコンテナは guest agent がないので /interfaces から同じ形に変換する
+func (r *pveRepository) GetNetIntFormQumeAgent(ctx context.Context, node string, vmid int) ([]model.NetworkIntQumeAgent, error) {
+	if r.lxc() {
+		return r.lxcInterfaces(ctx, node, vmid)
 	}
-
-	var getVMconfig model.ResponsePVE[struct {
+	var res struct {
 		Result []model.NetworkIntQumeAgent `json:"result"`
-	}]
-
-	err = json.Unmarshal([]byte(body), &getVMconfig)
-	if err != nil {
-		return nil, xerrors.Errorf("json Unmarshal error: %w", err)
 	}
-	return getVMconfig.Data.Result, nil
+	path := fmt.Sprintf("/nodes/%s/qemu/%d/agent/network-get-interfaces", node, vmid)
+	if err := r.request(ctx, http.MethodGet, path, url.Values{}, &res); err != nil {
+		return nil, xerrors.Errorf("can't get network interfaces: %w", err)
+	}
+	return res.Result, nil
 }
 
-func (r *pveRepository) EditVMACL(vmid int) error {
-	// フォームデータの作成
-	endpoint := fmt.Sprintf("%s/access/acl", r.pveConf.APIURL)
+func (r *pveRepository) EditVMACL(ctx context.Context, vmid int) error {
 	// '!' で分割してユーザー部分を取得
-	parts := strings.Split(r.pveConf.Authorization, "!")
-	// if len(parts) < 2 {
-	// 	("エラー: トークンの形式が無効です。'!' が含まれていません。")
-	// }
-
-	userPart := parts[0]
-	fmt.Println("抽出されたユーザー部分:", userPart)
+	userPart := strings.Split(r.pveConf.Authorization, "!")[0]
 
 	// フォームデータの作成
 	formData := url.Values{}
@@ -670,41 +398,8 @@ func (r *pveRepository) EditVMACL(vmid int) error {
 	formData.Set("users", userPart)
 	formData.Set("roles", "ctf_dev_vm")
 
-	// 新しいPOSTリクエストの作成
-	req, err := http.NewRequest("PUT", endpoint, bytes.NewBufferString(formData.Encode()))
-	if err != nil {
-		return xerrors.Errorf("can't create http request: %w", err)
-	}
-
-	// ヘッダーの設定
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// リクエストの送信
-	resp, err := r.HTTPClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("fail http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// レスポンスの読み取り
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading clone response body: %v", err)
-	}
-
-	// json.Unmarshalでデコード
-	var pveresp model.ResponsePVE[string]
-	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return xerrors.Errorf("can't unmarshal response body: %w", err)
+	if err := r.request(ctx, http.MethodPut, "/access/acl", formData, nil); err != nil {
+		return xerrors.Errorf("can't edit vm acl: %w", err)
 	}
-
-	// エラーチェック
-	if resp.StatusCode >= 400 {
-		return xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
-	}
-
-	// クローン作成のUPIDを表示
-	log.Printf("VM クローンの作成が開始されました。UPID: %s\n", pveresp.Data)
-
 	return nil
 }
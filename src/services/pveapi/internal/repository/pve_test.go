@@ -1,164 +1,120 @@
 package repository
 
 import (
-	"bytes"
-	"crypto/tls"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"os"
+	"context"
 	"testing"
 	"time"
 
 	"github.com/LainInTheWired/ctf-backend/pveapi/model"
-	"github.com/joho/godotenv"
-	echoLog "github.com/labstack/gommon/log" // エイリアスを付ける
-
+	"github.com/LainInTheWired/ctf-backend/pveapi/pvefake"
 	"golang.org/x/xerrors"
 )
 
-// 認証ヘッダーを自動的に付与するカスタムクライアントを作成
-type MiddlewareTransport struct {
-	Transport http.RoundTripper
-	Token     string
-}
-
-type httpClientRequestLog struct {
-	method  string
-	url     string
-	headers map[string][]string
-	body    string
-}
-type httpClinetResponseLog struct {
-	status string
-	header http.Header
-	body   string
+func newFakeRepository(t *testing.T, nodes ...pvefake.Node) (*pvefake.Server, PVERepository) {
+	fake := pvefake.NewServer(nodes...)
+	t.Cleanup(fake.Close)
+	conf := &model.PVEConfig{
+		APIURL:           fake.URL,
+		Authorization:    "ctf@pve!token=secret",
+		TaskPollInterval: time.Millisecond,
+		LockBackoff:      time.Millisecond,
+	}
+	return fake, NewPVERepository(conf, fake.Client())
 }
 
-// リクエストのたびに Authorization ヘッダーを自動で追加
-func (a *MiddlewareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Authorization", fmt.Sprintf("PVEAPIToken=%s", a.Token))
-	var reqbody []byte
-	if req.Body != nil {
-		reqbody, err := io.ReadAll(req.Body)
-		if err != nil {
-			xerrors.Errorf("can't read reqest body : %w", err)
-		}
-		req.Body = io.NopCloser(bytes.NewBuffer(reqbody))
-
+func TestGetNodeList(t *testing.T) {
+	_, r := newFakeRepository(t, pvefake.Node{Name: "pve01", Maxcpu: 8}, pvefake.Node{Name: "pve02", Status: "offline"})
+	nodes, err := r.GetNodeList(context.Background())
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	reqlog := httpClientRequestLog{
-		method:  req.Method,
-		url:     req.URL.String(),
-		headers: req.Header,
-		body:    string(reqbody),
+	if len(nodes) != 2 || nodes[0].Node != "pve01" || nodes[0].Status != "online" || nodes[1].Status != "offline" {
+		t.Errorf("GetNodeList() = %+v", nodes)
 	}
+}
 
-	echoLog.Debug(reqlog)
-	res, err := a.Transport.RoundTrip(req)
-	if err != nil {
-		xerrors.Errorf("http clinet send error : %w", err)
+func TestEditVMACL(t *testing.T) {
+	fake, r := newFakeRepository(t, pvefake.Node{Name: "pve01"})
+	if err := r.EditVMACL(context.Background(), 137); err != nil {
+		t.Fatal(err)
 	}
-
-	if res != nil && res.Body != nil {
-
-		resbody, err := io.ReadAll(res.Body)
-		if err != nil {
-			xerrors.Errorf("can't read response body : %w", err)
-		}
-		res.Body = io.NopCloser(bytes.NewBuffer(resbody))
-		reslog := httpClinetResponseLog{
-			status: res.Status,
-			header: res.Header,
-			body:   string(resbody),
-		}
-		echoLog.Debug(reslog)
-	}
-	return res, err
-}
-func TestGetNodeList(t *testing.T) {
-	// .envファイルを読み込む
-	err := godotenv.Load("../.env")
-	if err != nil {
-		log.Fatalf("Error loading .env file")
+	acls := fake.ACLs()
+	if len(acls) != 1 || acls[0].Get("path") != "vms/137" || acls[0].Get("users") != "ctf@pve" {
+		t.Errorf("ACLs() = %v", acls)
 	}
+}
+
+func TestCloneLifecycle(t *testing.T) {
+	ctx := context.Background()
+	fake, r := newFakeRepository(t, pvefake.Node{Name: "pve01"})
+	fake.AddVM(pvefake.VM{Vmid: 9000, Node: "pve01", Template: true, Config: map[string]string{"scsi0": "vmdisk:base-9000-disk-0,size=16G"}})
 
-	// proxmoxapi初期化処理
-	config := &model.PVEConfig{
-		APIURL:        os.Getenv("PROXMOX_API_URL"),
-		Authorization: os.Getenv("PROXMOX_API_TOKEN"),
+	clone := &model.VMClone{Name: "q1", Cloneid: 9000, Newid: 100, Node: "pve01", Target: "pve01", Mode: model.CloneModeLinked}
+	if err := r.CloneVM(ctx, clone); err != nil {
+		t.Fatal(err)
 	}
-	// httpclinet auth middleware
-	// カスタムトランスポートを作成
-	// カスタム Transport を設定（InsecureSkipVerify は本番環境では false に）
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // 本番では false にする
+	// CloneVM はタスクの終了を待つのでロックは解除されている
+	if err := r.ResizeDisk(ctx, "pve01", "scsi0", 32, 100); err != nil {
+		t.Fatal(err)
 	}
-
-	// カスタム AuthTransport を作成
-	authTransport := &MiddlewareTransport{
-		Transport: tr,
-		Token:     config.Authorization,
+	conf, err := r.GetVM(ctx, "pve01", 100)
+	if err != nil {
+		t.Fatal(err)
 	}
-	// カスタム HTTP クライアントの作成
-	client := &http.Client{
-		Transport: authTransport,
-		Timeout:   60 * time.Second,
+	if conf.Scsi0 != "vmdisk:base-9000-disk-0/vm-100-disk-0,size=32G" {
+		t.Errorf("scsi0 = %q", conf.Scsi0)
 	}
-
-	// 設定のバリデーション
-	if config.APIURL == "" || config.Authorization == "" {
-		log.Fatal("必要な環境変数が設定されていません。PROXMOX_API_URL および PROXMOX_AUTHORIZATION を設定してください。")
+	// フルクローンはテンプレートのディスクを参照しない
+	full := &model.VMClone{Name: "q2", Cloneid: 9000, Newid: 101, Node: "pve01", Target: "pve01", Mode: model.CloneModeFull, Storage: "ceph"}
+	if err := r.CloneVM(ctx, full); err != nil {
+		t.Fatal(err)
 	}
-
-	r := NewPVERepository(config, client)
-	a, err := r.GetNodeList()
-	if err != nil {
-		log.Fatal(err)
+	if conf, err := r.GetVM(ctx, "pve01", 101); err != nil || conf.Scsi0 != "ceph:vm-101-disk-0,size=16G" {
+		t.Errorf("full clone scsi0 = %+v, %v", conf, err)
 	}
-	t.Log(a)
-}
-func TestEditVMACL(t *testing.T) {
-	// .envファイルを読み込む
-	err := godotenv.Load("../.env")
-	if err != nil {
-		log.Fatalf("Error loading .env file")
+	if err := r.Boot(ctx, "pve01", 100); err != nil {
+		t.Fatal(err)
 	}
-
-	// proxmoxapi初期化処理
-	config := &model.PVEConfig{
-		APIURL:        os.Getenv("PROXMOX_API_URL"),
-		Authorization: os.Getenv("PROXMOX_API_TOKEN"),
+	// 起動中の VM は削除できない
+	if err := r.DeleteVM(ctx, &model.VMDelete{Vmid: 100, Node: "pve01"}); err == nil {
+		t.Error("DeleteVM() on running vm should fail")
 	}
-	// httpclinet auth middleware
-	// カスタムトランスポートを作成
-	// カスタム Transport を設定（InsecureSkipVerify は本番環境では false に）
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // 本番では false にする
+	if err := r.Shutdown(ctx, "pve01", 100); err != nil {
+		t.Fatal(err)
 	}
-
-	// カスタム AuthTransport を作成
-	authTransport := &MiddlewareTransport{
-		Transport: tr,
-		Token:     config.Authorization,
+	if err := r.DeleteVM(ctx, &model.VMDelete{Vmid: 100, Node: "pve01"}); err != nil {
+		t.Fatal(err)
 	}
-	// カスタム HTTP クライアントの作成
-	client := &http.Client{
-		Transport: authTransport,
-		Timeout:   60 * time.Second,
+	if _, err := r.GetVM(ctx, "pve01", 100); !xerrors.Is(err, model.ErrPVENotFound) {
+		t.Errorf("GetVM() after delete = %v, want not found", err)
 	}
+}
 
-	// 設定のバリデーション
-	if config.APIURL == "" || config.Authorization == "" {
-		log.Fatal("必要な環境変数が設定されていません。PROXMOX_API_URL および PROXMOX_AUTHORIZATION を設定してください。")
+func TestLockedGivesUp(t *testing.T) {
+	fake, r := newFakeRepository(t, pvefake.Node{Name: "pve01"})
+	fake.AddVM(pvefake.VM{Vmid: 100, Node: "pve01"})
+	fake.LockVM(100, 100)
+	err := r.Boot(context.Background(), "pve01", 100)
+	if !xerrors.Is(err, model.ErrPVELocked) {
+		t.Fatalf("Boot() = %v, want locked", err)
 	}
+}
 
-	r := NewPVERepository(config, client)
-	err = r.EditVMACL(137)
-	if err != nil {
-		log.Fatal(err)
+func TestCanceledContext(t *testing.T) {
+	fake, r := newFakeRepository(t, pvefake.Node{Name: "pve01"})
+	fake.AddVM(pvefake.VM{Vmid: 100, Node: "pve01"})
+	fake.LockVM(100, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Boot(ctx, "pve01", 100); !xerrors.Is(err, context.Canceled) {
+		t.Fatalf("Boot() = %v, want canceled", err)
 	}
+}
 
+func TestAuthError(t *testing.T) {
+	fake, r := newFakeRepository(t, pvefake.Node{Name: "pve01"})
+	fake.Token = "ctf@pve!token=secret"
+	if _, err := r.GetNodeList(context.Background()); !xerrors.Is(err, model.ErrPVEAuth) {
+		t.Fatalf("GetNodeList() = %v, want auth", err)
+	}
 }
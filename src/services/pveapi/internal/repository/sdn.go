@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"golang.org/x/xerrors"
+)
+
+func (r *pveRepository) ListSDNZones(ctx context.Context) ([]model.SDNZone, error) {
+	zones := []model.SDNZone{}
+	if err := r.request(ctx, http.MethodGet, "/cluster/sdn/zones", url.Values{}, &zones); err != nil {
+		return nil, xerrors.Errorf("can't list sdn zones: %w", err)
+	}
+	return zones, nil
+}
+
+// CreateSDNZone は VLAN タグで分離する SDN ゾーンを作成します
+func (r *pveRepository) CreateSDNZone(ctx context.Context, zone *model.SDNZone) error {
+	formData := url.Values{}
+	formData.Set("zone", zone.Zone)
+	formData.Set("type", zone.Type)
+	if zone.Bridge != "" {
+		formData.Set("bridge", zone.Bridge)
+	}
+	if err := r.request(ctx, http.MethodPost, "/cluster/sdn/zones", formData, nil); err != nil {
+		return xerrors.Errorf("can't create sdn zone: %w", err)
+	}
+	return nil
+}
+
+func (r *pveRepository) CreateVNet(ctx context.Context, vnet *model.VNet) error {
+	formData := url.Values{}
+	formData.Set("vnet", vnet.Name)
+	formData.Set("zone", vnet.Zone)
+	formData.Set("tag", strconv.Itoa(vnet.Tag))
+	if vnet.Alias != "" {
+		formData.Set("alias", vnet.Alias)
+	}
+	if err := r.request(ctx, http.MethodPost, "/cluster/sdn/vnets", formData, nil); err != nil {
+		return xerrors.Errorf("can't create vnet: %w", err)
+	}
+	return nil
+}
+
+func (r *pveRepository) DeleteVNet(ctx context.Context, name string) error {
+	if err := r.request(ctx, http.MethodDelete, "/cluster/sdn/vnets/"+url.PathEscape(name), url.Values{}, nil); err != nil {
+		return xerrors.Errorf("can't delete vnet: %w", err)
+	}
+	return nil
+}
+
+func (r *pveRepository) CreateSubnet(ctx context.Context, vnet *model.VNet) error {
+	formData := url.Values{}
+	formData.Set("type", "subnet")
+	formData.Set("subnet", vnet.Subnet)
+	if vnet.Gateway != "" {
+		formData.Set("gateway", vnet.Gateway)
+	}
+	if err := r.request(ctx, http.MethodPost, fmt.Sprintf("/cluster/sdn/vnets/%s/subnets", url.PathEscape(vnet.Name)), formData, nil); err != nil {
+		return xerrors.Errorf("can't create subnet: %w", err)
+	}
+	return nil
+}
+
+func (r *pveRepository) ListSubnets(ctx context.Context, name string) ([]model.SDNSubnet, error) {
+	subnets := []model.SDNSubnet{}
+	if err := r.request(ctx, http.MethodGet, fmt.Sprintf("/cluster/sdn/vnets/%s/subnets", url.PathEscape(name)), url.Values{}, &subnets); err != nil {
+		return nil, xerrors.Errorf("can't list subnets: %w", err)
+	}
+	return subnets, nil
+}
+
+func (r *pveRepository) DeleteSubnet(ctx context.Context, name string, subnet string) error {
+	if err := r.request(ctx, http.MethodDelete, fmt.Sprintf("/cluster/sdn/vnets/%s/subnets/%s", url.PathEscape(name), url.PathEscape(subnet)), url.Values{}, nil); err != nil {
+		return xerrors.Errorf("can't delete subnet: %w", err)
+	}
+	return nil
+}
+
+// ApplySDN は保留中の SDN の設定を全ノードに反映します
+func (r *pveRepository) ApplySDN(ctx context.Context) error {
+	if err := r.request(ctx, http.MethodPut, "/cluster/sdn", url.Values{}, nil); err != nil {
+		return xerrors.Errorf("can't apply sdn: %w", err)
+	}
+	return nil
+}
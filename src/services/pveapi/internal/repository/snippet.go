@@ -0,0 +1,278 @@
+package repository
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	SnippetBackendSFTP = "sftp"
+	SnippetBackendNFS  = "nfs"
+)
+
+// sftpDialTimeout はノードに SSH で接続するまでの上限です (届かないノードでリクエストが止まらないようにする)
+const sftpDialTimeout = 10 * time.Second
+
+// スニペットのファイル名として許可する形式
+var snippetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,127}\.ya?ml$`)
+
+// SnippetStore は cloud-init のスニペットを Proxmox から参照できるストレージに保存します
+type SnippetStore interface {
+	Put(name string, data []byte) error
+	Delete(name string) error
+	List() ([]string, error)
+	// Exists は names のうち保存されているスニペットを返します (ディレクトリ全体は読まない)
+	Exists(names ...string) (map[string]bool, error)
+}
+
+// ValidateSnippetName はスニペットのファイル名がパスとして安全か確認します
+func ValidateSnippetName(name string) error {
+	if !snippetNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return errors.Newf("invalid snippet name: %q", name)
+	}
+	return nil
+}
+
+func NewSnippetStore(conf *model.SnippetConfig) (SnippetStore, error) {
+	if conf.Dir == "" {
+		return nil, errors.New("snippet directory is not configured")
+	}
+	switch conf.Backend {
+	case SnippetBackendSFTP:
+		return newSFTPSnippetStore(conf)
+	case SnippetBackendNFS:
+		return &nfsSnippetStore{dir: conf.Dir}, nil
+	}
+	return nil, errors.Newf("unknown snippet backend: %q", conf.Backend)
+}
+
+// sftpSnippetStore は Proxmox ノードに SFTP で接続してスニペットを保存します
+type sftpSnippetStore struct {
+	dir       string
+	addr      string
+	sshConfig *ssh.ClientConfig
+}
+
+func newSFTPSnippetStore(conf *model.SnippetConfig) (*sftpSnippetStore, error) {
+	key, err := os.ReadFile(conf.SFTPKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read ssh private key")
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse ssh private key")
+	}
+	// 接続先のホスト鍵は known_hosts で検証する
+	hostKeyCallback, err := knownhosts.New(conf.KnownHostsPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't load known_hosts")
+	}
+	return &sftpSnippetStore{
+		dir:  conf.Dir,
+		addr: conf.SFTPHost,
+		sshConfig: &ssh.ClientConfig{
+			User:            conf.SFTPUser,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sftpDialTimeout,
+		},
+	}, nil
+}
+
+func (s *sftpSnippetStore) connect() (*ssh.Client, *sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", s.addr, s.sshConfig)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "can't connect ssh")
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "can't start sftp session")
+	}
+	return conn, client, nil
+}
+
+func (s *sftpSnippetStore) Put(name string, data []byte) error {
+	if err := ValidateSnippetName(name); err != nil {
+		return err
+	}
+	conn, client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	// 書き込み途中のファイルを Proxmox が読まないように一時ファイルからリネームする
+	tmp := path.Join(s.dir, "."+name+".tmp")
+	f, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return errors.Wrap(err, "can't create remote file")
+	}
+	// 失敗した場合は一時ファイルを残さない
+	renamed := false
+	defer func() {
+		if !renamed {
+			client.Remove(tmp)
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "can't write remote file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "can't close remote file")
+	}
+	if err := client.PosixRename(tmp, path.Join(s.dir, name)); err != nil {
+		return errors.Wrap(err, "can't rename remote file")
+	}
+	renamed = true
+	return nil
+}
+
+func (s *sftpSnippetStore) Delete(name string) error {
+	if err := ValidateSnippetName(name); err != nil {
+		return err
+	}
+	conn, client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	if err := client.Remove(path.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrap(err, "can't delete remote file")
+	}
+	return nil
+}
+
+func (s *sftpSnippetStore) List() ([]string, error) {
+	conn, client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	entries, err := client.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read remote directory")
+	}
+	names := []string{}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && ValidateSnippetName(e.Name()) == nil {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *sftpSnippetStore) Exists(names ...string) (map[string]bool, error) {
+	for _, name := range names {
+		if err := ValidateSnippetName(name); err != nil {
+			return nil, err
+		}
+	}
+	conn, client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	found := map[string]bool{}
+	for _, name := range names {
+		st, err := client.Stat(path.Join(s.dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "can't stat remote file")
+		}
+		found[name] = st.Mode().IsRegular()
+	}
+	return found, nil
+}
+
+// nfsSnippetStore は Proxmox と共有している NFS のマウント先にスニペットを保存します
+type nfsSnippetStore struct {
+	dir string
+}
+
+func (s *nfsSnippetStore) Put(name string, data []byte) error {
+	if err := ValidateSnippetName(name); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, "."+name+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "can't create file")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "can't write file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "can't close file")
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return errors.Wrap(err, "can't chmod file")
+	}
+	if err := os.Rename(f.Name(), filepath.Join(s.dir, name)); err != nil {
+		return errors.Wrap(err, "can't rename file")
+	}
+	return nil
+}
+
+func (s *nfsSnippetStore) Delete(name string) error {
+	if err := ValidateSnippetName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrap(err, "can't delete file")
+	}
+	return nil
+}
+
+func (s *nfsSnippetStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read directory")
+	}
+	names := []string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() && ValidateSnippetName(e.Name()) == nil {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *nfsSnippetStore) Exists(names ...string) (map[string]bool, error) {
+	found := map[string]bool{}
+	for _, name := range names {
+		if err := ValidateSnippetName(name); err != nil {
+			return nil, err
+		}
+		st, err := os.Stat(filepath.Join(s.dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "can't stat file")
+		}
+		found[name] = st.Mode().IsRegular()
+	}
+	return found, nil
+}
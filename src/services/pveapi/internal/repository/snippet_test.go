@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+)
+
+func TestValidateSnippetName(t *testing.T) {
+	valid := []string{"1-2-3.yaml", "ctf-1-2.yml", "user.data.yaml"}
+	invalid := []string{"", "../etc/passwd.yaml", "a/b.yaml", ".hidden.yaml", "a..b.yaml", "run.sh", "a b.yaml"}
+	for _, name := range valid {
+		if err := ValidateSnippetName(name); err != nil {
+			t.Errorf("ValidateSnippetName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range invalid {
+		if err := ValidateSnippetName(name); err == nil {
+			t.Errorf("ValidateSnippetName(%q) should fail", name)
+		}
+	}
+}
+
+func TestNFSSnippetStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSnippetStore(&model.SnippetConfig{Backend: SnippetBackendNFS, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("1-2-3.yaml", []byte("#cloud-config\n")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "1-2-3.yaml"))
+	if err != nil || string(b) != "#cloud-config\n" {
+		t.Fatalf("unexpected content %q: %v", b, err)
+	}
+	names, err := s.List()
+	if err != nil || len(names) != 1 || names[0] != "1-2-3.yaml" {
+		t.Fatalf("unexpected list %v: %v", names, err)
+	}
+	found, err := s.Exists("1-2-3.yaml", "1-2-3-network.yaml")
+	if err != nil || !found["1-2-3.yaml"] || found["1-2-3-network.yaml"] {
+		t.Fatalf("unexpected exists %v: %v", found, err)
+	}
+	if err := s.Delete("1-2-3.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	// 存在しないファイルの削除はエラーにしない
+	if err := s.Delete("1-2-3.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("../x.yaml", nil); err == nil {
+		t.Fatal("path traversal should be rejected")
+	}
+}
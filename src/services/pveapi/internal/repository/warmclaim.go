@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/xerrors"
+)
+
+// 払い出しの途中でプロセスが落ちた場合に VM がずっと使えなくならないようにする
+const warmClaimTTL = 10 * time.Minute
+
+// WarmClaimStore は払い出し中のウォームプールの VM を記録します
+// Redis に保存すると pveapi の複数のプロセスで同じ VM を二重に払い出さない
+type WarmClaimStore interface {
+	// Claim は vmid を払い出し中にします (他で払い出し中の場合は false)
+	Claim(ctx context.Context, vmid int) (bool, error)
+	Claimed(ctx context.Context, vmid int) (bool, error)
+	Release(ctx context.Context, vmid int) error
+}
+
+type redisWarmClaimStore struct {
+	client  *redis.Client
+	cluster string
+}
+
+// NewRedisWarmClaimStore はクラスタ cluster の払い出しを Redis の SETNX で記録します
+func NewRedisWarmClaimStore(client *redis.Client, cluster string) WarmClaimStore {
+	return &redisWarmClaimStore{client: client, cluster: cluster}
+}
+
+func (r *redisWarmClaimStore) key(vmid int) string {
+	return fmt.Sprintf(model.WarmClaimKey, r.cluster, vmid)
+}
+
+func (r *redisWarmClaimStore) Claim(ctx context.Context, vmid int) (bool, error) {
+	ok, err := r.client.SetNX(ctx, r.key(vmid), 1, warmClaimTTL).Result()
+	if err != nil {
+		return false, xerrors.Errorf("can't claim warm vm: %w", err)
+	}
+	return ok, nil
+}
+
+func (r *redisWarmClaimStore) Claimed(ctx context.Context, vmid int) (bool, error) {
+	n, err := r.client.Exists(ctx, r.key(vmid)).Result()
+	if err != nil {
+		return false, xerrors.Errorf("can't get warm vm claim: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (r *redisWarmClaimStore) Release(ctx context.Context, vmid int) error {
+	if err := r.client.Del(ctx, r.key(vmid)).Err(); err != nil {
+		return xerrors.Errorf("can't release warm vm: %w", err)
+	}
+	return nil
+}
+
+// memoryWarmClaimStore はプロセス内だけで払い出しを記録します (Redis がない場合とテスト用)
+type memoryWarmClaimStore struct {
+	mu      sync.Mutex
+	claimed map[int]bool
+}
+
+func NewMemoryWarmClaimStore() WarmClaimStore {
+	return &memoryWarmClaimStore{claimed: map[int]bool{}}
+}
+
+func (m *memoryWarmClaimStore) Claim(ctx context.Context, vmid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.claimed[vmid] {
+		return false, nil
+	}
+	m.claimed[vmid] = true
+	return true, nil
+}
+
+func (m *memoryWarmClaimStore) Claimed(ctx context.Context, vmid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.claimed[vmid], nil
+}
+
+func (m *memoryWarmClaimStore) Release(ctx context.Context, vmid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.claimed, vmid)
+	return nil
+}
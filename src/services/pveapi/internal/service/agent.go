@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/LainInTheWired/ctf-backend/pveapi/repository"
+	"github.com/cockroachdb/errors"
+)
+
+// 1 回の AgentRun で待つ上限
+const maxAgentRunTimeout = 5 * time.Minute
+
+func (p *pveService) AgentExec(ctx context.Context, vmid int, command []string, input string) (int, error) {
+	if len(command) == 0 || command[0] == "" {
+		return 0, errors.New("command is empty")
+	}
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't search node")
+	}
+	pid, err := repo.AgentExec(ctx, node, vmid, command, input)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't exec command")
+	}
+	return pid, nil
+}
+
+func (p *pveService) AgentExecStatus(ctx context.Context, vmid int, pid int) (*model.AgentExecStatus, error) {
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't search node")
+	}
+	status, err := repo.AgentExecStatus(ctx, node, vmid, pid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get exec status")
+	}
+	return status, nil
+}
+
+func (p *pveService) AgentRun(ctx context.Context, vmid int, command []string, input string, timeout time.Duration) (*model.AgentExecStatus, error) {
+	if len(command) == 0 || command[0] == "" {
+		return nil, errors.New("command is empty")
+	}
+	if timeout <= 0 || timeout > maxAgentRunTimeout {
+		timeout = maxAgentRunTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't search node")
+	}
+	return p.agentRun(ctx, repo, node, vmid, command, input)
+}
+
+// agentRun はコマンドを実行して終了を ctx が終わるまで待ちます
+func (p *pveService) agentRun(ctx context.Context, repo repository.PVERepository, node string, vmid int, command []string, input string) (*model.AgentExecStatus, error) {
+	pid, err := repo.AgentExec(ctx, node, vmid, command, input)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't exec command")
+	}
+	interval := p.conf.TaskPollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, err := repo.AgentExecStatus(ctx, node, vmid, pid)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't get exec status")
+		}
+		if status.Exited == 1 {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "command (pid %d) did not exit", pid)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *pveService) AgentFileRead(ctx context.Context, vmid int, file string) (*model.AgentFile, error) {
+	if !path.IsAbs(file) {
+		return nil, errors.Newf("path must be absolute: %s", file)
+	}
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't search node")
+	}
+	f, err := repo.AgentFileRead(ctx, node, vmid, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read file")
+	}
+	return f, nil
+}
+
+func (p *pveService) AgentFileWrite(ctx context.Context, vmid int, file *model.AgentFileWrite) error {
+	if !path.IsAbs(file.Path) {
+		return errors.Newf("path must be absolute: %s", file.Path)
+	}
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return errors.Wrap(err, "can't search node")
+	}
+	if err := repo.AgentFileWrite(ctx, node, vmid, file); err != nil {
+		return errors.Wrap(err, "can't write file")
+	}
+	return nil
+}
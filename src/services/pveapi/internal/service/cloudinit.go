@@ -0,0 +1,287 @@
+package service
+
+import (
+	"encoding/base64"
+	"net"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+)
+
+var (
+	hostnameLabelPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+	usernamePattern      = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	permissionsPattern   = regexp.MustCompile(`^0?[0-7]{3}$`)
+)
+
+// write_files で cloud-init が解釈できるエンコーディング
+var writeFileEncodings = map[string]bool{
+	"": true, "text/plain": true,
+	"b64": true, "base64": true,
+	"gz": true, "gzip": true,
+	"gz+b64": true, "gz+base64": true, "gzip+b64": true, "gzip+base64": true,
+}
+
+// defaultCloudinit はすべての VM に入れる設定です (以前の CloudinitGenerator と同じパッケージ)
+// GetIps が qemu-guest-agent を使うので必ずインストールする
+var defaultCloudinit = model.CloudinitConfig{
+	Packages: []string{"git", "curl", "qemu-guest-agent"},
+	RunCmd:   []string{"systemctl enable --now qemu-guest-agent"},
+}
+
+// SnippetFilename は user-data のファイル名から他の種類のスニペットのファイル名を作ります
+// 例: 1-2-3.yaml → 1-2-3-network.yaml
+func SnippetFilename(filename string, kind string) string {
+	if kind == model.SnippetUser {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + kind + ext
+}
+
+// MergeCloudinit は問題ごとのベースの設定にチームごとの上書きを重ねます
+// スカラー値は上書き側が優先され、users/write_files はキー (name/path) ごとに置き換え、
+// packages は重複を除いて追加、bootcmd/runcmd はベースの後ろに追加します
+func MergeCloudinit(base, override *model.CloudinitConfig) *model.CloudinitConfig {
+	merged := &model.CloudinitConfig{}
+	for _, c := range []*model.CloudinitConfig{base, override} {
+		if c == nil {
+			continue
+		}
+		if c.Hostname != "" {
+			merged.Hostname = c.Hostname
+		}
+		if c.FQDN != "" {
+			merged.FQDN = c.FQDN
+		}
+		if c.SshPwauth != 0 {
+			merged.SshPwauth = c.SshPwauth
+		}
+		if c.PackageUpdate != nil {
+			merged.PackageUpdate = c.PackageUpdate
+		}
+		if c.PackageUpgrade != nil {
+			merged.PackageUpgrade = c.PackageUpgrade
+		}
+		merged.Users = mergeUsers(merged.Users, c.Users)
+		merged.Chpasswd = mergeChpasswd(merged.Chpasswd, c.Chpasswd)
+		merged.Packages = mergePackages(merged.Packages, c.Packages)
+		merged.WriteFiles = mergeWriteFiles(merged.WriteFiles, c.WriteFiles)
+		merged.BootCmd = append(merged.BootCmd, c.BootCmd...)
+		merged.RunCmd = append(merged.RunCmd, c.RunCmd...)
+	}
+	return merged
+}
+
+func mergeUsers(base, override []model.User) []model.User {
+	users := append([]model.User{}, base...)
+	for _, o := range override {
+		replaced := false
+		for i := range users {
+			if users[i].Name == o.Name {
+				users[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			users = append(users, o)
+		}
+	}
+	return users
+}
+
+func mergeChpasswd(base, override *model.Chpasswd) *model.Chpasswd {
+	if override == nil {
+		return base
+	}
+	if base == nil {
+		base = &model.Chpasswd{}
+	}
+	merged := &model.Chpasswd{Expire: base.Expire, Users: append([]model.ChpasswdUser{}, base.Users...)}
+	if override.Expire != nil {
+		merged.Expire = override.Expire
+	}
+	for _, o := range override.Users {
+		replaced := false
+		for i := range merged.Users {
+			if merged.Users[i].Name == o.Name {
+				merged.Users[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged.Users = append(merged.Users, o)
+		}
+	}
+	return merged
+}
+
+func mergePackages(base, override []string) []string {
+	packages := append([]string{}, base...)
+	for _, o := range override {
+		found := false
+		for _, p := range packages {
+			if p == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			packages = append(packages, o)
+		}
+	}
+	return packages
+}
+
+func mergeWriteFiles(base, override []model.WriteFile) []model.WriteFile {
+	files := append([]model.WriteFile{}, base...)
+	for _, o := range override {
+		replaced := false
+		for i := range files {
+			if files[i].Path == o.Path {
+				files[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			files = append(files, o)
+		}
+	}
+	return files
+}
+
+// ValidateCloudinit は user-data / vendor-data の内容を検証します
+func ValidateCloudinit(conf *model.CloudinitConfig) error {
+	if conf.Hostname != "" && !hostnameLabelPattern.MatchString(conf.Hostname) {
+		return errors.Newf("invalid hostname: %q", conf.Hostname)
+	}
+	if conf.FQDN != "" {
+		for _, label := range strings.Split(conf.FQDN, ".") {
+			if !hostnameLabelPattern.MatchString(label) {
+				return errors.Newf("invalid fqdn: %q", conf.FQDN)
+			}
+		}
+	}
+	if conf.SshPwauth != 0 && conf.SshPwauth != 1 {
+		return errors.Newf("ssh_pwauth must be 0 or 1: %d", conf.SshPwauth)
+	}
+
+	names := map[string]bool{}
+	for _, u := range conf.Users {
+		if !usernamePattern.MatchString(u.Name) {
+			return errors.Newf("invalid user name: %q", u.Name)
+		}
+		if names[u.Name] {
+			return errors.Newf("duplicate user: %q", u.Name)
+		}
+		names[u.Name] = true
+		if u.Shell != "" && !path.IsAbs(u.Shell) {
+			return errors.Newf("shell must be an absolute path: %q", u.Shell)
+		}
+	}
+
+	if conf.Chpasswd != nil {
+		for _, u := range conf.Chpasswd.Users {
+			if !usernamePattern.MatchString(u.Name) {
+				return errors.Newf("invalid chpasswd user name: %q", u.Name)
+			}
+			switch u.Type {
+			case "RANDOM":
+			case "", "text", "hash":
+				if u.Password == "" {
+					return errors.Newf("chpasswd password is required: %q", u.Name)
+				}
+			default:
+				return errors.Newf("invalid chpasswd type: %q", u.Type)
+			}
+		}
+	}
+
+	for _, p := range conf.Packages {
+		if p == "" || strings.ContainsAny(p, " \t\n") {
+			return errors.Newf("invalid package: %q", p)
+		}
+	}
+
+	paths := map[string]bool{}
+	for _, f := range conf.WriteFiles {
+		if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path {
+			return errors.Newf("write_files path must be a clean absolute path: %q", f.Path)
+		}
+		if paths[f.Path] {
+			return errors.Newf("duplicate write_files path: %q", f.Path)
+		}
+		paths[f.Path] = true
+		if f.Permissions != "" && !permissionsPattern.MatchString(f.Permissions) {
+			return errors.Newf("invalid write_files permissions: %q", f.Permissions)
+		}
+		if !writeFileEncodings[f.Encoding] {
+			return errors.Newf("invalid write_files encoding: %q", f.Encoding)
+		}
+		if strings.Contains(f.Encoding, "b64") || strings.Contains(f.Encoding, "base64") {
+			if _, err := base64.StdEncoding.DecodeString(f.Content); err != nil {
+				return errors.Wrapf(err, "write_files content is not base64: %q", f.Path)
+			}
+		}
+	}
+
+	for _, c := range append(append([]string{}, conf.BootCmd...), conf.RunCmd...) {
+		if strings.TrimSpace(c) == "" {
+			return errors.New("empty command in bootcmd/runcmd")
+		}
+	}
+	return nil
+}
+
+// ValidateNetworkConfig は network-config の内容を検証します
+func ValidateNetworkConfig(conf *model.NetworkConfig) error {
+	if conf.Version != 2 {
+		return errors.Newf("network-config version must be 2: %d", conf.Version)
+	}
+	for name, eth := range conf.Ethernets {
+		for _, a := range eth.Addresses {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return errors.Wrapf(err, "invalid address on %s", name)
+			}
+		}
+		if eth.Gateway4 != "" && net.ParseIP(eth.Gateway4).To4() == nil {
+			return errors.Newf("invalid gateway4 on %s: %q", name, eth.Gateway4)
+		}
+		if eth.Nameservers != nil {
+			for _, ns := range eth.Nameservers.Addresses {
+				if net.ParseIP(ns) == nil {
+					return errors.Newf("invalid nameserver on %s: %q", name, ns)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateCloudinitDocument はスニペット一式を検証します
+func ValidateCloudinitDocument(doc *model.CloudinitDocument) error {
+	if doc.User == nil {
+		return errors.New("user-data is required")
+	}
+	if err := ValidateCloudinit(doc.User); err != nil {
+		return errors.Wrap(err, "invalid user-data")
+	}
+	if doc.Vendor != nil {
+		if err := ValidateCloudinit(doc.Vendor); err != nil {
+			return errors.Wrap(err, "invalid vendor-data")
+		}
+	}
+	if doc.Network != nil {
+		if err := ValidateNetworkConfig(doc.Network); err != nil {
+			return errors.Wrap(err, "invalid network-config")
+		}
+	}
+	if doc.Meta != nil && doc.Meta.LocalHostname != "" && !hostnameLabelPattern.MatchString(doc.Meta.LocalHostname) {
+		return errors.Newf("invalid meta-data local-hostname: %q", doc.Meta.LocalHostname)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+)
+
+// DefaultClusterID はクラスタを 1 つだけ登録する場合の ID です
+const DefaultClusterID = "default"
+
+// Clusters は ID を付けて登録した Proxmox クラスタごとの PVEService です
+// VM の操作はクラスタの ID を指定して Get で取り出した PVEService に対して行う
+type Clusters interface {
+	// Get は id のクラスタを返します (空の場合は最初に登録したクラスタ)
+	Get(id string) (PVEService, error)
+	// IDs は登録した順にクラスタの ID を返します
+	IDs() []string
+	// Place は id のクラスタ (空の場合はすべてのクラスタ) から VM を置くクラスタとノードを選びます
+	// source が 0 でない場合はクローン元の VM があるクラスタだけから選ぶ
+	Place(ctx context.Context, id string, source int, cores int, memory int, disk int) (*model.Placement, error)
+	// GetClusterResource は id のクラスタ (空の場合はすべてのクラスタ) のリソースを返します
+	GetClusterResource(ctx context.Context, id string, filter model.InstanceTags) ([]model.ClusterResources, error)
+}
+
+type clusters struct {
+	ids      []string
+	services map[string]PVEService
+}
+
+// NewClusters は confs の順に services を登録します (confs[i] が services[i] の設定)
+func NewClusters(confs []*model.PVEConfig, services []PVEService) (Clusters, error) {
+	if len(confs) == 0 || len(confs) != len(services) {
+		return nil, errors.New("no proxmox cluster")
+	}
+	c := &clusters{services: map[string]PVEService{}}
+	for i, conf := range confs {
+		if conf.ID == "" {
+			return nil, errors.New("cluster id is required")
+		}
+		if _, ok := c.services[conf.ID]; ok {
+			return nil, errors.Newf("duplicate cluster id %q", conf.ID)
+		}
+		c.ids = append(c.ids, conf.ID)
+		c.services[conf.ID] = services[i]
+	}
+	return c, nil
+}
+
+func (c *clusters) Get(id string) (PVEService, error) {
+	if id == "" {
+		id = c.ids[0]
+	}
+	s, ok := c.services[id]
+	if !ok {
+		return nil, errors.Wrapf(model.ErrPVENotFound, "unknown cluster %q", id)
+	}
+	return s, nil
+}
+
+func (c *clusters) IDs() []string {
+	return append([]string{}, c.ids...)
+}
+
+// targets は id のクラスタ (空の場合はすべてのクラスタ) の ID を返します
+func (c *clusters) targets(id string) ([]string, error) {
+	if id == "" {
+		return c.ids, nil
+	}
+	if _, err := c.Get(id); err != nil {
+		return nil, err
+	}
+	return []string{id}, nil
+}
+
+func (c *clusters) Place(ctx context.Context, id string, source int, cores int, memory int, disk int) (*model.Placement, error) {
+	ids, err := c.targets(id)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		best    *model.Placement
+		lastErr error
+	)
+	// 各クラスタで最も負荷の低いノードを比べる (空きのないクラスタは飛ばす)
+	for _, cid := range ids {
+		if source != 0 {
+			if _, err := c.services[cid].SearchNodeByVmid(ctx, source); err != nil {
+				lastErr = errors.Wrapf(err, "cluster %s", cid)
+				continue
+			}
+		}
+		p, err := c.services[cid].Place(ctx, cores, memory, disk)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "cluster %s", cid)
+			continue
+		}
+		p.Cluster = cid
+		if best == nil || p.CPU < best.CPU {
+			best = p
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+func (c *clusters) GetClusterResource(ctx context.Context, id string, filter model.InstanceTags) ([]model.ClusterResources, error) {
+	ids, err := c.targets(id)
+	if err != nil {
+		return nil, err
+	}
+	all := []model.ClusterResources{}
+	for _, cid := range ids {
+		res, err := c.services[cid].GetClusterResource(ctx, filter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cluster %s", cid)
+		}
+		for _, r := range res {
+			r.Cluster = cid
+			all = append(all, r)
+		}
+	}
+	return all, nil
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+)
+
+// base-9000-disk-0 や vm-100-disk-1 などのボリューム名
+var volumePattern = regexp.MustCompile(`^(?:.*/)?(?:base|vm)-\d+-disk-(\d+)$`)
+
+// ParseDisk は "vmdisk:base-9000-disk-0,size=16G" のようなディスク設定を分解します
+func ParseDisk(spec string) (*model.Disk, error) {
+	if spec == "" {
+		return nil, errors.New("disk spec is empty")
+	}
+	parts := strings.Split(spec, ",")
+	storage, volume, ok := strings.Cut(parts[0], ":")
+	if !ok || storage == "" || volume == "" {
+		return nil, errors.Newf("invalid disk spec: %s", spec)
+	}
+	if !volumePattern.MatchString(volume) {
+		return nil, errors.Newf("unsupported volume name: %s", volume)
+	}
+	return &model.Disk{
+		Storage: storage,
+		Volume:  volume,
+		Options: parts[1:],
+	}, nil
+}
+
+// CloneDisk はテンプレートのディスク設定からクローン後のディスク設定を作ります
+// リンククローンの場合はベースイメージを参照するボリューム名になります
+func CloneDisk(tdisk *model.Disk, vmid int, clone *model.VMClone) *model.Disk {
+	index := volumePattern.FindStringSubmatch(tdisk.Volume)[1]
+	volume := fmt.Sprintf("vm-%d-disk-%s", vmid, index)
+	storage := tdisk.Storage
+	if clone.Mode == model.CloneModeFull {
+		if clone.Storage != "" {
+			storage = clone.Storage
+		}
+	} else {
+		volume = fmt.Sprintf("%s/%s", tdisk.Volume, volume)
+	}
+	return &model.Disk{
+		Storage: storage,
+		Volume:  volume,
+		Options: tdisk.Options,
+	}
+}
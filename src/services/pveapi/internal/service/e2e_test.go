@@ -0,0 +1,524 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/LainInTheWired/ctf-backend/pveapi/pvefake"
+	"github.com/LainInTheWired/ctf-backend/pveapi/repository"
+)
+
+// newFakeService は偽の Proxmox とローカルディレクトリのスニペットで PVEService を作ります
+func newFakeService(t *testing.T, nodes ...pvefake.Node) (*pvefake.Server, PVEService) {
+	return newFakeServiceWithConfig(t, func(*model.PVEConfig) {}, nodes...)
+}
+
+// newFakeServiceWithConfig は edit で設定を変えてから PVEService を作ります
+func newFakeServiceWithConfig(t *testing.T, edit func(conf *model.PVEConfig), nodes ...pvefake.Node) (*pvefake.Server, PVEService) {
+	return newFakeServiceWithClaims(t, edit, repository.NewMemoryWarmClaimStore(), nodes...)
+}
+
+// newFakeServiceWithClaims はウォームプールの払い出しを claims に記録する PVEService を作ります
+func newFakeServiceWithClaims(t *testing.T, edit func(conf *model.PVEConfig), claims repository.WarmClaimStore, nodes ...pvefake.Node) (*pvefake.Server, PVEService) {
+	fake := pvefake.NewServer(nodes...)
+	t.Cleanup(fake.Close)
+	conf := &model.PVEConfig{
+		APIURL:           fake.URL,
+		Authorization:    "ctf@pve!token=secret",
+		CloneMode:        model.CloneModeLinked,
+		Snippet:          model.SnippetConfig{Backend: repository.SnippetBackendNFS, StorageID: "cephfs", Dir: t.TempDir()},
+		TaskPollInterval: time.Millisecond,
+		LockBackoff:      time.Millisecond,
+	}
+	edit(conf)
+	snippets, err := repository.NewSnippetStore(&conf.Snippet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.AddVM(pvefake.VM{Vmid: 9000, Node: "pve01", Template: true, Config: map[string]string{
+		"scsi0": "vmdisk:base-9000-disk-0,size=16G",
+		"net0":  "virtio=BC:24:11:00:00:01,bridge=vmbr0",
+	}})
+	return fake, NewPVEService(repository.NewPVERepository(conf, fake.Client()), snippets, claims, conf)
+}
+
+func TestE2EProvisionAndTeardown(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeService(t,
+		pvefake.Node{Name: "pve01", CPU: 0.5, Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30},
+		pvefake.Node{Name: "pve02", CPU: 0.1, Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30},
+	)
+
+	if err := s.GenerateCloudinit("1-2-3.yaml", &model.CloudinitDocument{
+		User:    &model.CloudinitConfig{Hostname: "q1"},
+		Network: &model.NetworkConfig{Version: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	node, err := s.SelectNode(ctx, 2, 2048, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != "pve02" {
+		t.Errorf("SelectNode() = %q, want least loaded pve02", node)
+	}
+
+	// クローン直後の VM がロックされていても設定の変更はリトライされる
+	fake.LockVM(100, 2)
+	vmconf := &model.VMEdit{Node: node, Cores: 2, Memory: 2048, Cicustom: "1-2-3.yaml"}
+	vmid, err := s.CreateCloudinitVM(ctx, 20, vmconf, &model.VMClone{Name: "q1", Cloneid: 9000}, "ctf100")
+	if err != nil {
+		t.Fatalf("CreateCloudinitVM() error = %+v", err)
+	}
+	vm, ok := fake.VM(vmid)
+	if !ok {
+		t.Fatalf("vm %d was not created", vmid)
+	}
+	if vm.Node != "pve02" || vm.Status != "running" {
+		t.Errorf("vm = %+v", vm)
+	}
+	if want := "user=cephfs:snippets/1-2-3.yaml,network=cephfs:snippets/1-2-3-network.yaml"; vm.Config["cicustom"] != want {
+		t.Errorf("cicustom = %q, want %q", vm.Config["cicustom"], want)
+	}
+	if !strings.Contains(vm.Config["net0"], "bridge=ctf100") || !strings.HasSuffix(vm.Config["scsi0"], "size=20G") {
+		t.Errorf("config = %v", vm.Config)
+	}
+
+	fake.SetAgentIPs(vmid, map[string][]string{"eth0": {"10.0.100.10"}})
+	ips, err := s.GetIps(ctx, vmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips["eth0"]) != 1 || ips["eth0"][0] != "10.0.100.10" {
+		t.Errorf("GetIps() = %v", ips)
+	}
+
+	if err := s.DeleteVMByVmid(ctx, vmid); err != nil {
+		t.Fatalf("DeleteVMByVmid() error = %+v", err)
+	}
+	if _, ok := fake.VM(vmid); ok {
+		t.Errorf("vm %d was not deleted", vmid)
+	}
+}
+
+func TestE2ESelectNodeNoCapacity(t *testing.T) {
+	_, s := newFakeService(t,
+		pvefake.Node{Name: "pve01", CPU: 0.1, Maxcpu: 2, Maxmem: 4 << 30, Maxdisk: 100 << 30},
+		pvefake.Node{Name: "pve02", Status: "offline", Maxcpu: 32, Maxmem: 64 << 30, Maxdisk: 100 << 30},
+	)
+	if node, err := s.SelectNode(context.Background(), 4, 2048, 20); err == nil {
+		t.Errorf("SelectNode() = %q, want error", node)
+	}
+}
+
+func TestE2ECleanupOnFailure(t *testing.T) {
+	fake, s := newFakeService(t, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	if err := s.GenerateCloudinit("1-2-4.yaml", &model.CloudinitDocument{User: &model.CloudinitConfig{}}); err != nil {
+		t.Fatal(err)
+	}
+	// 起動に失敗した VM は削除される
+	fake.FailTasks("qmstart", "start failed: QEMU exited with code 1")
+	vmconf := &model.VMEdit{Node: "pve01", Cicustom: "1-2-4.yaml"}
+	if _, err := s.CreateCloudinitVM(context.Background(), 0, vmconf, &model.VMClone{Name: "q1", Cloneid: 9000}, ""); err == nil {
+		t.Fatal("CreateCloudinitVM() should fail")
+	}
+	if ids := fake.VMs(); len(ids) != 1 || ids[0] != 9000 {
+		t.Errorf("VMs() = %v, want only the template", ids)
+	}
+}
+
+func TestE2ETagsAndPool(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeService(t, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	if err := s.GenerateCloudinit("1-2-3.yaml", &model.CloudinitDocument{User: &model.CloudinitConfig{Hostname: "q1"}}); err != nil {
+		t.Fatal(err)
+	}
+	fake.AddVM(pvefake.VM{Vmid: 200, Node: "pve01", Name: "1-9-9"})
+
+	tags := model.InstanceTags{ContestID: 1, TeamID: 2, QuestionID: 3, CreatedBy: "Contest"}
+	vmconf := &model.VMEdit{Node: "pve01", Cicustom: "1-2-3.yaml", Tags: tags.String()}
+	vmid, err := s.CreateCloudinitVM(ctx, 0, vmconf, &model.VMClone{Name: "1-2-3", Cloneid: 9000, Pool: "ctf-contest-1"}, "")
+	if err != nil {
+		t.Fatalf("CreateCloudinitVM() error = %+v", err)
+	}
+	vm, _ := fake.VM(vmid)
+	if want := "ctf-contest-1;ctf-team-2;ctf-question-3;ctf-by-contest"; vm.Config["tags"] != want {
+		t.Errorf("tags = %q, want %q", vm.Config["tags"], want)
+	}
+	if pools := fake.Pools(); vm.Pool != "ctf-contest-1" || len(pools) != 1 {
+		t.Errorf("pool = %q, pools = %v", vm.Pool, pools)
+	}
+
+	// 名前がコンテストの形式でもタグのない VM は含まない
+	res, err := s.GetClusterResource(ctx, model.InstanceTags{ContestID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Vmid != vmid || res[0].Instance == nil || res[0].Instance.TeamID != 2 || res[0].Instance.CreatedBy != "contest" {
+		t.Errorf("GetClusterResource(contest 1) = %+v", res)
+	}
+	if res, _ := s.GetClusterResource(ctx, model.InstanceTags{ContestID: 2}); len(res) != 0 {
+		t.Errorf("GetClusterResource(contest 2) = %+v", res)
+	}
+}
+
+func TestE2EAgent(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeService(t, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	fake.TaskPolls = 2
+	fake.Exec = func(vmid int, command []string, input string) (int, string, string) {
+		if command[0] == "false" {
+			return 1, "", "failed\n"
+		}
+		return 0, strings.Join(command, " ") + input, ""
+	}
+	fake.AddVM(pvefake.VM{Vmid: 300, Node: "pve01", Status: "running", AgentIPs: map[string][]string{"eth0": {"10.0.100.10"}}})
+	fake.AddVM(pvefake.VM{Vmid: 301, Node: "pve01", Status: "running"})
+
+	status, err := s.AgentRun(ctx, 300, []string{"echo", "ok"}, "", time.Second)
+	if err != nil {
+		t.Fatalf("AgentRun() error = %+v", err)
+	}
+	if status.Exited != 1 || status.ExitCode != 0 || status.OutData != "echo ok" {
+		t.Errorf("AgentRun() = %+v", status)
+	}
+	if status, err := s.AgentRun(ctx, 300, []string{"false"}, "", time.Second); err != nil || status.ExitCode != 1 {
+		t.Errorf("AgentRun(false) = %+v, %v", status, err)
+	}
+	if _, err := s.AgentRun(ctx, 301, []string{"true"}, "", time.Second); err == nil {
+		t.Error("AgentRun() without guest agent should fail")
+	}
+
+	// base64 の内容はデコードして書き込まれる
+	if err := s.AgentFileWrite(ctx, 300, &model.AgentFileWrite{Path: "/root/flag.txt", Content: "ZmxhZ3t4fQ==", Base64: true}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.AgentFileRead(ctx, 300, "/root/flag.txt")
+	if err != nil || f.Content != "flag{x}" {
+		t.Errorf("AgentFileRead() = %+v, %v", f, err)
+	}
+	if _, err := s.AgentFileRead(ctx, 300, "flag.txt"); err == nil {
+		t.Error("relative path should be rejected")
+	}
+}
+
+func TestE2EReadiness(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeService(t, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	cloudinit := "status: running\n"
+	fake.Exec = func(vmid int, command []string, input string) (int, string, string) {
+		return 0, cloudinit, ""
+	}
+	fake.AddVM(pvefake.VM{Vmid: 300, Node: "pve01", Status: "stopped"})
+
+	stages := func() (*model.VMReadiness, []bool) {
+		t.Helper()
+		res, err := s.VMReadiness(ctx, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		passed := []bool{}
+		for _, st := range res.Stages {
+			passed = append(passed, st.Passed)
+		}
+		return res, passed
+	}
+
+	if res, passed := stages(); res.Ready || len(passed) != 4 || passed[0] {
+		t.Errorf("stopped vm: %+v", res)
+	}
+	// 起動しただけでは guest agent が応答しない
+	if err := s.(*pveService).pveRepo.Boot(ctx, "pve01", 300); err != nil {
+		t.Fatal(err)
+	}
+	if res, passed := stages(); res.Ready || !passed[0] || passed[1] {
+		t.Errorf("booted vm: %+v", res)
+	}
+	fake.SetAgentIPs(300, map[string][]string{"lo": {"127.0.0.1"}, "eth0": {"10.0.100.10", "fe80::1"}})
+	if res, passed := stages(); res.Ready || !passed[1] || passed[2] || res.Stages[2].Message != "cloud-init is running" {
+		t.Errorf("cloud-init running: %+v", res)
+	}
+	cloudinit = "\nstatus: done\n"
+	res, _ := stages()
+	if !res.Ready || len(res.IPs) != 1 || len(res.IPs["eth0"]) != 1 || res.IPs["eth0"][0] != "10.0.100.10" {
+		t.Errorf("ready vm: %+v", res)
+	}
+}
+
+func TestE2EMetrics(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeService(t, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30,
+		RRD: []model.RRDData{{Time: 60, CPU: 0.1, MemUsed: 4 << 30, MemTotal: 16 << 30}},
+	})
+	fake.AddVM(pvefake.VM{Vmid: 300, Node: "pve01", Status: "running", RRD: []model.RRDData{
+		{Time: 60, CPU: 0.98, MaxCPU: 2, Mem: 1 << 30, MaxMem: 2 << 30, NetOut: 1e6},
+		{Time: 120},
+	}})
+
+	m, err := s.VMMetrics(ctx, 300, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Timeframe != model.TimeframeHour || m.Node != "pve01" || len(m.Data) != 2 || m.Data[0].CPU != 0.98 || m.Data[1].CPU != 0 {
+		t.Errorf("vm metrics = %+v", m)
+	}
+	if _, err := s.VMMetrics(ctx, 300, "minute"); err == nil {
+		t.Errorf("invalid timeframe was accepted")
+	}
+	n, err := s.NodeMetrics(ctx, "pve01", model.TimeframeDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.Data) != 1 || n.Data[0].MemTotal != 16<<30 {
+		t.Errorf("node metrics = %+v", n)
+	}
+}
+
+func TestE2EIdleSuspend(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeService(t, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	rrd := func(netout ...float64) []model.RRDData {
+		data := []model.RRDData{}
+		for i, n := range netout {
+			data = append(data, model.RRDData{Time: int64(i * 60), MaxCPU: 2, NetOut: n})
+		}
+		return data
+	}
+	fake.AddVM(pvefake.VM{Vmid: 300, Node: "pve01", Status: "running", RRD: rrd(5000, 10, 10, 10)})
+	fake.AddVM(pvefake.VM{Vmid: 301, Node: "pve01", Status: "running", RRD: rrd(10, 10, 10, 5000)})
+	fake.AddVM(pvefake.VM{Vmid: 302, Node: "pve01", Status: "running", RRD: rrd(10)})
+	policy := &model.IdlePolicy{Mode: model.IdleModeHibernate, IdleMinutes: 3, Threshold: 1024}
+
+	// 直近 3 分の送受信が閾値以下の VM だけを止める
+	for vmid, idle := range map[int]bool{300: true, 301: false, 302: false} {
+		res, err := s.SuspendIdle(ctx, vmid, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Idle != idle || res.Changed != idle {
+			t.Errorf("vm %d: %+v", vmid, res)
+		}
+	}
+	if vm, _ := fake.VM(300); !vm.Hibernated || vm.Status != "stopped" {
+		t.Fatalf("vm 300 = %+v", vm)
+	}
+	// 止めた VM は何もしない
+	if res, err := s.SuspendIdle(ctx, 300, policy); err != nil || res.Changed || res.State != model.PowerHibernated {
+		t.Errorf("hibernated vm: %+v %v", res, err)
+	}
+	res, err := s.Resume(ctx, 300)
+	if err != nil || !res.Changed {
+		t.Fatalf("resume: %+v %v", res, err)
+	}
+	if vm, _ := fake.VM(300); vm.Hibernated || vm.Status != "running" {
+		t.Errorf("resumed vm 300 = %+v", vm)
+	}
+
+	// suspend はメモリに残したまま一時停止する
+	fake.AddVM(pvefake.VM{Vmid: 303, Node: "pve01", Status: "running", RRD: rrd(0, 0, 0)})
+	if res, err := s.SuspendIdle(ctx, 303, &model.IdlePolicy{Mode: model.IdleModeSuspend, IdleMinutes: 3}); err != nil || res.State != model.PowerPaused {
+		t.Fatalf("suspend: %+v %v", res, err)
+	}
+	if res, err := s.Resume(ctx, 303); err != nil || !res.Changed {
+		t.Fatalf("resume: %+v %v", res, err)
+	}
+	if vm, _ := fake.VM(303); vm.Paused {
+		t.Errorf("resumed vm 303 = %+v", vm)
+	}
+	if res, err := s.Resume(ctx, 303); err != nil || res.Changed {
+		t.Errorf("resume running vm: %+v %v", res, err)
+	}
+}
+
+func TestE2EWarmPool(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeServiceWithConfig(t, func(conf *model.PVEConfig) {
+		conf.WarmPool.Sizes = map[int]int{9000: 2}
+	}, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+
+	// 補充した VM は停止したままタグで見分ける
+	st := s.RefillWarmPool(ctx)
+	if len(st) != 1 || st[0].Ready != 2 || len(st[0].Created) != 2 || st[0].Error != "" {
+		t.Fatalf("RefillWarmPool() = %+v", st)
+	}
+	warm := st[0].Created[0]
+	if vm, _ := fake.VM(warm); vm.Status != "stopped" || vm.Config["tags"] != "ctf-warm-9000;ctf-by-warmpool" {
+		t.Fatalf("warm vm = %+v", vm)
+	}
+	if st := s.RefillWarmPool(ctx); st[0].Ready != 2 || len(st[0].Created) != 0 {
+		t.Errorf("refill of full pool = %+v", st)
+	}
+
+	if err := s.GenerateCloudinit("1-2-3.yaml", &model.CloudinitDocument{User: &model.CloudinitConfig{Hostname: "q1"}}); err != nil {
+		t.Fatal(err)
+	}
+	clones := fake.Hits("POST", "/nodes/pve01/qemu/9000/clone")
+	tags := model.InstanceTags{ContestID: 1, TeamID: 2, QuestionID: 3, CreatedBy: "contest"}
+	vmconf := &model.VMEdit{Node: "pve01", Cores: 2, Cicustom: "1-2-3.yaml", Tags: tags.String()}
+	vmid, err := s.CreateCloudinitVM(ctx, 20, vmconf, &model.VMClone{Name: "1-2-3", Cloneid: 9000, Pool: "ctf-contest-1"}, "ctf100")
+	if err != nil {
+		t.Fatalf("CreateCloudinitVM() error = %+v", err)
+	}
+	// クローンせずにウォームプールの VM を払い出して、チームの設定で起動する
+	if vmid != warm || fake.Hits("POST", "/nodes/pve01/qemu/9000/clone") != clones {
+		t.Fatalf("vmid = %d, want warm vm %d without cloning", vmid, warm)
+	}
+	vm, _ := fake.VM(vmid)
+	if vm.Status != "running" || vm.Name != "1-2-3" || vm.Pool != "ctf-contest-1" || vm.Config["tags"] != tags.String() {
+		t.Errorf("claimed vm = %+v", vm)
+	}
+	if !strings.HasPrefix(vm.Config["cicustom"], "user=cephfs:snippets/1-2-3.yaml") || !strings.Contains(vm.Config["net0"], "bridge=ctf100") || !strings.HasSuffix(vm.Config["scsi0"], "size=20G") {
+		t.Errorf("config = %v", vm.Config)
+	}
+	if st := s.WarmPool(ctx); st[0].Ready != 1 {
+		t.Errorf("WarmPool() = %+v", st)
+	}
+
+	// 空になったテンプレートは通常どおりクローンする
+	if _, err := s.CreateCloudinitVM(ctx, 0, &model.VMEdit{Node: "pve01", Cicustom: "1-2-3.yaml"}, &model.VMClone{Name: "a", Cloneid: 9000}, ""); err != nil {
+		t.Fatal(err)
+	}
+	vmid, err = s.CreateCloudinitVM(ctx, 0, &model.VMEdit{Node: "pve01", Cicustom: "1-2-3.yaml"}, &model.VMClone{Name: "b", Cloneid: 9000}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.Hits("POST", "/nodes/pve01/qemu/9000/clone") != clones+1 {
+		t.Errorf("vm %d: expected a clone after the pool is empty", vmid)
+	}
+}
+
+func TestE2ETemplateClearsCicustom(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeService(t, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	fake.AddVM(pvefake.VM{Vmid: 300, Node: "pve01", Status: "running", Config: map[string]string{
+		"scsi0":    "vmdisk:vm-300-disk-0,size=16G",
+		"cicustom": "user=cephfs:snippets/template-build-1.yaml",
+	}})
+	if err := s.Template(ctx, 300); err != nil {
+		t.Fatalf("Template() error = %+v", err)
+	}
+	// 消されるスニペットをクローンに引き継がない
+	vm, _ := fake.VM(300)
+	if !vm.Template || vm.Status != "stopped" || vm.Config["cicustom"] != "" {
+		t.Errorf("template = %+v", vm)
+	}
+}
+
+func TestE2EWarmPoolClaims(t *testing.T) {
+	ctx := context.Background()
+	claims := repository.NewMemoryWarmClaimStore()
+	fake, s := newFakeServiceWithClaims(t, func(conf *model.PVEConfig) {
+		conf.WarmPool.Sizes = map[int]int{9000: 2}
+	}, claims, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	st := s.RefillWarmPool(ctx)
+	if len(st) != 1 || len(st[0].Created) != 2 {
+		t.Fatalf("RefillWarmPool() = %+v", st)
+	}
+	if err := s.GenerateCloudinit("1-2-3.yaml", &model.CloudinitDocument{User: &model.CloudinitConfig{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 他のプロセスが払い出し中の VM は使わない
+	if ok, err := claims.Claim(ctx, st[0].Created[0]); !ok || err != nil {
+		t.Fatalf("Claim() = %v, %v", ok, err)
+	}
+	vmid, err := s.CreateCloudinitVM(ctx, 0, &model.VMEdit{Node: "pve01", Cicustom: "1-2-3.yaml"}, &model.VMClone{Name: "a", Cloneid: 9000}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmid != st[0].Created[1] {
+		t.Errorf("vmid = %d, want unclaimed warm vm %d", vmid, st[0].Created[1])
+	}
+	if st := s.WarmPool(ctx); st[0].Ready != 0 {
+		t.Errorf("WarmPool() = %+v", st)
+	}
+
+	// ウォームプールと違うモードのクローンはウォームプールを使わない
+	if err := claims.Release(ctx, st[0].Created[0]); err != nil {
+		t.Fatal(err)
+	}
+	clones := fake.Hits("POST", "/nodes/pve01/qemu/9000/clone")
+	vmid, err = s.CreateCloudinitVM(ctx, 0, &model.VMEdit{Node: "pve01", Cicustom: "1-2-3.yaml"}, &model.VMClone{Name: "b", Cloneid: 9000, Mode: model.CloneModeFull, Storage: "ceph"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmid == st[0].Created[0] || fake.Hits("POST", "/nodes/pve01/qemu/9000/clone") != clones+1 {
+		t.Errorf("vmid = %d, want a full clone instead of the warm vm", vmid)
+	}
+	if vm, _ := fake.VM(vmid); !strings.HasPrefix(vm.Config["scsi0"], "ceph:vm-") {
+		t.Errorf("scsi0 = %q", vm.Config["scsi0"])
+	}
+}
+
+func TestE2ELXC(t *testing.T) {
+	ctx := context.Background()
+	fake, s := newFakeService(t, pvefake.Node{Name: "pve01", Maxcpu: 8, Maxmem: 16 << 30, Maxdisk: 100 << 30})
+	fake.AddVM(pvefake.VM{Vmid: 9100, Node: "pve01", Type: model.GuestLXC, Template: true, Config: map[string]string{
+		"rootfs": "vmdisk:base-9100-disk-0,size=8G",
+		"net0":   "name=eth0,bridge=vmbr0,hwaddr=BC:24:11:00:00:02,ip=dhcp,type=veth",
+	}})
+	if err := s.GenerateCloudinit("1-2-5.yaml", &model.CloudinitDocument{User: &model.CloudinitConfig{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 種類が違うテンプレートは指定できない
+	vmconf := &model.VMEdit{Node: "pve01", Cicustom: "1-2-5.yaml"}
+	if _, err := s.CreateCloudinitVM(ctx, 0, vmconf, &model.VMClone{Name: "q5", Cloneid: 9000, Type: model.GuestLXC}, ""); !errors.Is(err, model.ErrGuestUnsupported) {
+		t.Fatalf("CreateCloudinitVM() with qemu template error = %v", err)
+	}
+
+	vmconf = &model.VMEdit{Node: "pve01", Cores: 1, Memory: 512, Cicustom: "1-2-5.yaml", Ipconfig: []string{"ip=10.0.100.10/24,gw=10.0.100.1"}}
+	vmid, err := s.CreateCloudinitVM(ctx, 10, vmconf, &model.VMClone{Name: "q5", Cloneid: 9100}, "ctf100")
+	if err != nil {
+		t.Fatalf("CreateCloudinitVM() error = %+v", err)
+	}
+	vm, ok := fake.VM(vmid)
+	if !ok || vm.Type != model.GuestLXC || vm.Name != "q5" || vm.Status != "running" {
+		t.Fatalf("container = %+v", vm)
+	}
+	if want := "name=eth0,type=veth,bridge=ctf100,ip=10.0.100.10/24,gw=10.0.100.1"; vm.Config["net0"] != want {
+		t.Errorf("net0 = %q, want %q", vm.Config["net0"], want)
+	}
+	if _, ok := vm.Config["cicustom"]; ok || !strings.HasSuffix(vm.Config["rootfs"], "size=10G") {
+		t.Errorf("config = %v", vm.Config)
+	}
+
+	// コンテナには guest agent がないので IP アドレスは /interfaces から取る
+	res, err := s.VMReadiness(ctx, vmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Ready || len(res.IPs["eth0"]) != 1 || res.IPs["eth0"][0] != "10.0.100.10" {
+		t.Errorf("VMReadiness() = %+v", res)
+	}
+	if _, err := s.AgentExec(ctx, vmid, []string{"id"}, ""); !errors.Is(err, model.ErrGuestUnsupported) {
+		t.Errorf("AgentExec() error = %v", err)
+	}
+
+	// コンテナは一時停止できないので、アイドルの場合は停止して次のアクセスで起動し直す
+	fake.AddVM(pvefake.VM{Vmid: 310, Node: "pve01", Type: model.GuestLXC, Status: "running", RRD: []model.RRDData{{MaxCPU: 1}, {MaxCPU: 1}}})
+	st, err := s.SuspendIdle(ctx, 310, &model.IdlePolicy{Mode: model.IdleModeHibernate, IdleMinutes: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Changed || st.State != model.PowerStopped {
+		t.Errorf("SuspendIdle() = %+v", st)
+	}
+	if st, err := s.Resume(ctx, 310); err != nil || !st.Changed {
+		t.Errorf("Resume() = %+v, %v", st, err)
+	}
+	if ct, _ := fake.VM(310); ct.Status != "running" {
+		t.Errorf("resumed container = %+v", ct)
+	}
+
+	if err := s.DeleteVMByVmid(ctx, vmid); err != nil {
+		t.Fatalf("DeleteVMByVmid() error = %+v", err)
+	}
+	if _, ok := fake.VM(vmid); ok {
+		t.Errorf("container %d was not deleted", vmid)
+	}
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/LainInTheWired/ctf-backend/pveapi/repository"
+	"github.com/cockroachdb/errors"
+)
+
+var (
+	dportPattern         = regexp.MustCompile(`^\d{1,5}(:\d{1,5})?(,\d{1,5}(:\d{1,5})?)*$`)
+	securityGroupPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{1,17}$`)
+)
+
+var firewallPolicies = map[string]bool{"": true, "ACCEPT": true, "DROP": true, "REJECT": true}
+
+// ValidateFirewall は VM に適用するファイアウォールの設定を検証します
+func ValidateFirewall(fw *model.VMFirewall) error {
+	if !firewallPolicies[fw.Options.PolicyIn] || !firewallPolicies[fw.Options.PolicyOut] {
+		return errors.Newf("invalid policy: in=%q out=%q", fw.Options.PolicyIn, fw.Options.PolicyOut)
+	}
+	for _, g := range fw.Groups {
+		if !securityGroupPattern.MatchString(g) {
+			return errors.Newf("invalid security group: %q", g)
+		}
+	}
+	for _, r := range fw.Rules {
+		if r.Type != "in" && r.Type != "out" {
+			return errors.Newf("invalid rule type: %q", r.Type)
+		}
+		if r.Action == "" || !firewallPolicies[r.Action] {
+			return errors.Newf("invalid rule action: %q", r.Action)
+		}
+		switch r.Proto {
+		case "", "tcp", "udp", "icmp", "ipv6-icmp":
+		default:
+			return errors.Newf("invalid rule proto: %q", r.Proto)
+		}
+		if r.Dport != "" {
+			if r.Proto != "tcp" && r.Proto != "udp" {
+				return errors.Newf("dport requires tcp or udp: %q", r.Dport)
+			}
+			if !dportPattern.MatchString(r.Dport) {
+				return errors.Newf("invalid rule dport: %q", r.Dport)
+			}
+		}
+		for _, addr := range []string{r.Source, r.Dest} {
+			if err := validateFirewallAddress(addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateFirewallAddress は IP アドレスか CIDR をカンマ区切りで受け付けます
+func validateFirewallAddress(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	for _, a := range strings.Split(addr, ",") {
+		if net.ParseIP(a) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(a); err != nil {
+			return errors.Newf("invalid address: %q", a)
+		}
+	}
+	return nil
+}
+
+// ensureNetFirewall は net0 の firewall を有効にします (無効だと VM のルールが適用されない)
+func (p *pveService) ensureNetFirewall(ctx context.Context, repo repository.PVERepository, node string, vmid int) error {
+	conf, err := repo.GetVM(ctx, node, vmid)
+	if err != nil {
+		return errors.Wrap(err, "can't get vm config")
+	}
+	if strings.Contains(conf.Net0, "firewall=1") {
+		return nil
+	}
+	opts := []string{}
+	for _, o := range strings.Split(conf.Net0, ",") {
+		if o != "" && !strings.HasPrefix(o, "firewall=") {
+			opts = append(opts, o)
+		}
+	}
+	opts = append(opts, "firewall=1")
+	vmedit := model.VMEdit{
+		Vmid: vmid,
+		Node: node,
+		Net:  []string{strings.Join(opts, ",")},
+	}
+	if err := repo.EditVM(ctx, vmedit); err != nil {
+		return errors.Wrap(err, "can't enable firewall on net0")
+	}
+	return nil
+}
+
+// SetVMFirewall は VM のファイアウォールのルールを fw の内容で置き換えます
+func (p *pveService) SetVMFirewall(ctx context.Context, vmid int, fw *model.VMFirewall) error {
+	if err := ValidateFirewall(fw); err != nil {
+		return errors.Wrap(err, "invalid firewall")
+	}
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return errors.Wrap(err, "can't search node")
+	}
+	if fw.Options.Enable {
+		if err := p.ensureNetFirewall(ctx, repo, node, vmid); err != nil {
+			return err
+		}
+	}
+
+	// 既存のルールは位置がずれないように後ろから削除する
+	rules, err := repo.ListFirewallRules(ctx, node, vmid)
+	if err != nil {
+		return errors.Wrap(err, "can't list firewall rules")
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Pos > rules[j].Pos })
+	for _, r := range rules {
+		if err := repo.DeleteFirewallRule(ctx, node, vmid, r.Pos); err != nil {
+			return errors.Wrap(err, "can't delete firewall rule")
+		}
+	}
+
+	// セキュリティグループ、ルールの順に上から並べる
+	pos := 0
+	for _, g := range fw.Groups {
+		rule := &model.FirewallRule{Pos: pos, Type: "group", Action: g, Enable: 1}
+		if err := repo.CreateFirewallRule(ctx, node, vmid, rule); err != nil {
+			return errors.Wrap(err, "can't apply security group")
+		}
+		pos++
+	}
+	for _, r := range fw.Rules {
+		rule := r
+		rule.Pos = pos
+		rule.Enable = 1
+		if err := repo.CreateFirewallRule(ctx, node, vmid, &rule); err != nil {
+			return errors.Wrap(err, "can't create firewall rule")
+		}
+		pos++
+	}
+
+	if err := repo.EditFirewallOptions(ctx, node, vmid, &fw.Options); err != nil {
+		return errors.Wrap(err, "can't edit firewall options")
+	}
+	return nil
+}
+
+func (p *pveService) GetVMFirewallRules(ctx context.Context, vmid int) ([]model.FirewallRule, error) {
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't search node")
+	}
+	rules, err := repo.ListFirewallRules(ctx, node, vmid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list firewall rules")
+	}
+	return rules, nil
+}
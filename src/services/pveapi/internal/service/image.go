@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/LainInTheWired/ctf-backend/pveapi/repository"
+	"github.com/cockroachdb/errors"
+)
+
+// defaultImageBridge はイメージから作る VM の net0 のブリッジです (指定がない場合)
+const defaultImageBridge = "vmbr0"
+
+// ValidateImageFilename はクラウドイメージのファイル名を確認します
+// Proxmox は拡張子でイメージの形式を判定するので qcow2 と raw だけを受け付ける
+func ValidateImageFilename(filename string) error {
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return errors.Newf("invalid image filename %q", filename)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".qcow2", ".raw":
+		return nil
+	}
+	return errors.Wrapf(model.ErrImageFormat, "image %q", filename)
+}
+
+func (p *pveService) ImportImage(ctx context.Context, img *model.ImageImport, file io.Reader) (*model.ImportedImage, error) {
+	if err := ValidateImageFilename(img.Filename); err != nil {
+		return nil, err
+	}
+	if img.Node == "" {
+		node, err := p.SelectNode(ctx, 0, 0, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't select node")
+		}
+		img.Node = node
+	}
+	if img.URL != "" {
+		if err := p.pveRepo.DownloadImage(ctx, img); err != nil {
+			return nil, errors.Wrap(err, "can't download image")
+		}
+	} else {
+		if file == nil {
+			return nil, errors.New("image url or file is required")
+		}
+		if err := p.pveRepo.UploadImage(ctx, img, file); err != nil {
+			return nil, errors.Wrap(err, "can't upload image")
+		}
+	}
+	return &model.ImportedImage{
+		Node:  img.Node,
+		Volid: img.Storage + ":" + model.ImageContent + "/" + img.Filename,
+	}, nil
+}
+
+func (p *pveService) CreateImageVM(ctx context.Context, vm *model.VMCreate) (int, error) {
+	if vm.Cicustom != "" {
+		if err := repository.ValidateSnippetName(vm.Cicustom); err != nil {
+			return 0, errors.Wrap(err, "invalid cicustom")
+		}
+	}
+	if vm.Node == "" {
+		node, err := p.SelectNode(ctx, vm.Cores, vm.Memory, vm.Disk)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't select node")
+		}
+		vm.Node = node
+	}
+	if vm.Bridge == "" {
+		vm.Bridge = defaultImageBridge
+	}
+	if vm.Vmid == 0 {
+		svmid, err := p.pveRepo.NextVMID(ctx)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't get next vmid")
+		}
+		vmid, err := strconv.Atoi(svmid)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't Atoi vmid")
+		}
+		vm.Vmid = vmid
+	}
+	if err := p.pveRepo.CreateVM(ctx, vm); err != nil {
+		return 0, errors.Wrap(err, "can't create vm")
+	}
+	// クラウドイメージのディスクは小さいので指定のサイズまで広げる
+	if vm.Disk > 0 {
+		if err := p.pveRepo.ResizeDisk(ctx, vm.Node, "scsi0", vm.Disk, vm.Vmid); err != nil {
+			p.cleanupVM(ctx, model.GuestQEMU, vm.Node, vm.Vmid)
+			return 0, errors.Wrap(err, "can't resize disk")
+		}
+	}
+	return vm.Vmid, nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+)
+
+// timeframe は空の場合に hour を返します
+func timeframe(tf string) string {
+	if tf == "" {
+		return model.TimeframeHour
+	}
+	return tf
+}
+
+// VMMetrics は vmid の VM の CPU・メモリ・ネットワーク・ディスク I/O の推移を返します
+func (p *pveService) VMMetrics(ctx context.Context, vmid int, tf string) (*model.Metrics, error) {
+	tf = timeframe(tf)
+	if !model.ValidTimeframe(tf) {
+		return nil, errors.Newf("invalid timeframe %q", tf)
+	}
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't search node")
+	}
+	data, err := repo.GetVMRRDData(ctx, node, vmid, tf)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get vm metrics")
+	}
+	return &model.Metrics{Cluster: p.conf.ID, Node: node, Vmid: vmid, Timeframe: tf, Data: data}, nil
+}
+
+// NodeMetrics はノードの CPU・メモリ・ネットワークの推移を返します
+func (p *pveService) NodeMetrics(ctx context.Context, node string, tf string) (*model.Metrics, error) {
+	tf = timeframe(tf)
+	if !model.ValidTimeframe(tf) {
+		return nil, errors.Newf("invalid timeframe %q", tf)
+	}
+	data, err := p.pveRepo.GetNodeRRDData(ctx, node, tf)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get node metrics")
+	}
+	return &model.Metrics{Cluster: p.conf.ID, Node: node, Timeframe: tf, Data: data}, nil
+}
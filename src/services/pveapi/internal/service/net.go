@@ -0,0 +1,72 @@
+package service
+
+import (
+	"strings"
+)
+
+// RewriteNet はテンプレートの netX の設定を bridge に付け替えます
+// MAC アドレスと VLAN タグは引き継がない (VNet 側でタグを付ける)
+// 例: "virtio=BC:24:11:00:00:01,bridge=vmbr0,firewall=1" → "virtio,bridge=ctf100,firewall=1"
+func RewriteNet(spec string, bridge string) string {
+	if spec == "" {
+		return "virtio,bridge=" + bridge
+	}
+	parts := strings.Split(spec, ",")
+	out := []string{}
+	for i, p := range parts {
+		key, _, _ := strings.Cut(p, "=")
+		if i == 0 {
+			// 先頭はモデル名 (virtio=MAC の形式)
+			out = append(out, key)
+			continue
+		}
+		switch key {
+		case "bridge", "tag", "macaddr", "trunks":
+			continue
+		}
+		out = append(out, p)
+	}
+	out = append(out[:1], append([]string{"bridge=" + bridge}, out[1:]...)...)
+	return strings.Join(out, ",")
+}
+
+// RewriteLXCNet はコンテナの netX の設定を bridge と ipconfig (ip=...,gw=...) に付け替えます
+// コンテナは cloud-init を使わないので IP アドレスは netX に書く
+// bridge が空の場合はテンプレートのブリッジをそのまま使う
+// 例: "name=eth0,bridge=vmbr0,hwaddr=BC:24:11:00:00:01,ip=dhcp,type=veth" → "name=eth0,type=veth,bridge=ctf100,ip=10.0.100.10/24,gw=10.0.100.1"
+func RewriteLXCNet(spec string, bridge string, ipconfig string) string {
+	out := []string{}
+	hasName := false
+	for _, p := range strings.Split(spec, ",") {
+		key, _, _ := strings.Cut(p, "=")
+		switch key {
+		case "":
+			continue
+		case "hwaddr", "tag", "trunks":
+			continue
+		case "bridge":
+			if bridge != "" {
+				continue
+			}
+		case "ip", "gw":
+			if ipconfig != "" {
+				continue
+			}
+		case "name":
+			hasName = true
+		}
+		out = append(out, p)
+	}
+	if !hasName {
+		out = append([]string{"name=eth0"}, out...)
+	}
+	if bridge != "" {
+		out = append(out, "bridge="+bridge)
+	}
+	for _, p := range strings.Split(ipconfig, ",") {
+		if key, _, _ := strings.Cut(p, "="); key == "ip" || key == "gw" {
+			out = append(out, p)
+		}
+	}
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/LainInTheWired/ctf-backend/pveapi/repository"
+	"github.com/cockroachdb/errors"
+)
+
+// powerState は VM を操作するリポジトリとノード、電源の状態を返します
+func (p *pveService) powerState(ctx context.Context, vmid int) (repository.PVERepository, string, string, error) {
+	repo, node, err := p.guestRepo(ctx, vmid)
+	if err != nil {
+		return nil, "", "", errors.Wrap(err, "can't search node")
+	}
+	status, err := repo.GetVMStatus(ctx, node, vmid)
+	if err != nil {
+		return nil, "", "", errors.Wrap(err, "can't get vm status")
+	}
+	return repo, node, model.PowerStateOf(status), nil
+}
+
+// isIdle は rrddata (hour は 1 点が 1 分) の直近 minutes 点の送受信がすべて threshold 以下かを返します
+// 起動してから minutes 分経っていない (値のある点が足りない) 場合はアイドルとみなさない
+func isIdle(data []model.RRDData, minutes int, threshold float64) bool {
+	if minutes <= 0 || len(data) < minutes {
+		return false
+	}
+	for _, d := range data[len(data)-minutes:] {
+		if d.MaxCPU == 0 || d.NetIn+d.NetOut > threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// SuspendIdle は実行中の VM が policy の条件でアイドルであれば一時停止またはハイバネートします
+func (p *pveService) SuspendIdle(ctx context.Context, vmid int, policy *model.IdlePolicy) (*model.PowerState, error) {
+	if policy.Mode != model.IdleModeSuspend && policy.Mode != model.IdleModeHibernate {
+		return nil, errors.Newf("invalid idle mode %q", policy.Mode)
+	}
+	repo, node, state, err := p.powerState(ctx, vmid)
+	if err != nil {
+		return nil, err
+	}
+	res := &model.PowerState{Vmid: vmid, State: state}
+	if state != model.PowerRunning {
+		return res, nil
+	}
+	data, err := repo.GetVMRRDData(ctx, node, vmid, model.TimeframeHour)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get vm metrics")
+	}
+	res.Idle = isIdle(data, policy.IdleMinutes, policy.Threshold)
+	if !res.Idle {
+		return res, nil
+	}
+	hibernate := policy.Mode == model.IdleModeHibernate
+	if err := repo.Suspend(ctx, node, vmid, hibernate); errors.Is(err, model.ErrGuestUnsupported) {
+		// コンテナはハイバネートできないので停止する (起動し直すとプロセスは最初からになる)
+		if err := repo.Shutdown(ctx, node, vmid); err != nil {
+			return nil, errors.Wrap(err, "can't stop container")
+		}
+		res.State = model.PowerStopped
+		res.Changed = true
+		return res, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "can't suspend vm")
+	}
+	res.State = model.PowerPaused
+	if hibernate {
+		res.State = model.PowerHibernated
+	}
+	res.Changed = true
+	return res, nil
+}
+
+// Resume は一時停止・ハイバネート・停止している VM を起動します (実行中の場合は何もしない)
+func (p *pveService) Resume(ctx context.Context, vmid int) (*model.PowerState, error) {
+	repo, node, state, err := p.powerState(ctx, vmid)
+	if err != nil {
+		return nil, err
+	}
+	res := &model.PowerState{Vmid: vmid, State: model.PowerRunning, Changed: true}
+	switch state {
+	case model.PowerRunning:
+		res.Changed = false
+	case model.PowerPaused:
+		err = repo.Resume(ctx, node, vmid)
+	default:
+		// ハイバネートした VM は起動するとメモリの内容から再開する
+		err = repo.Boot(ctx, node, vmid)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't resume vm")
+	}
+	return res, nil
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+)
+
+// cloud-init status の終了を待つ上限 (--wait は付けないのですぐに終わる)
+const cloudinitStatusTimeout = 15 * time.Second
+
+// parseCloudinitStatus は `cloud-init status` の出力から status を取り出します
+// 例: "status: done"
+func parseCloudinitStatus(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "status:"); ok {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// guestIPs はループバックとリンクローカル以外のアドレスをインターフェースごとに返します
+func guestIPs(ifs []model.NetworkIntQumeAgent) map[string][]string {
+	ips := map[string][]string{}
+	for _, i := range ifs {
+		for _, a := range i.IPAddresses {
+			ip := net.ParseIP(a.IPAddress)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			ips[i.Name] = append(ips[i.Name], a.IPAddress)
+		}
+	}
+	return ips
+}
+
+// VMReadiness は VM の起動から IP アドレスの割り当てまでを順に確認します
+// ある段階を通過できなかった場合、それ以降の段階は確認しない
+func (p *pveService) VMReadiness(ctx context.Context, vmid int) (*model.VMReadiness, error) {
+	g, err := p.pveRepo.LookupGuest(ctx, vmid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't search node")
+	}
+	repo, node := p.pveRepo.ForGuest(g.Type), g.Node
+	// コンテナには guest agent も cloud-init もないので、その段階は通過させる
+	lxc := g.Type == model.GuestLXC
+	res := &model.VMReadiness{Vmid: vmid, Stages: []model.ReadinessStage{}}
+	// check は段階を確認し、通過した場合のみ次に進む
+	failed := ""
+	check := func(name string, fn func() (bool, string)) {
+		if failed != "" {
+			res.Stages = append(res.Stages, model.ReadinessStage{Name: name, Message: fmt.Sprintf("waiting for %s", failed)})
+			return
+		}
+		passed, msg := fn()
+		if !passed {
+			failed = name
+		}
+		res.Stages = append(res.Stages, model.ReadinessStage{Name: name, Passed: passed, Message: msg})
+	}
+
+	check(model.StageRunning, func() (bool, string) {
+		status, err := repo.GetVMStatus(ctx, node, vmid)
+		if err != nil {
+			return false, err.Error()
+		}
+		if status.Status != "running" || (status.QMPStatus != "" && status.QMPStatus != "running") {
+			return false, fmt.Sprintf("vm is %s", status.Status)
+		}
+		return true, ""
+	})
+	check(model.StageAgent, func() (bool, string) {
+		if lxc {
+			return true, "not used by lxc"
+		}
+		if err := repo.AgentPing(ctx, node, vmid); err != nil {
+			return false, "guest agent is not responding"
+		}
+		return true, ""
+	})
+	check(model.StageCloudinit, func() (bool, string) {
+		if lxc {
+			return true, "not used by lxc"
+		}
+		ctx, cancel := context.WithTimeout(ctx, cloudinitStatusTimeout)
+		defer cancel()
+		out, err := p.agentRun(ctx, repo, node, vmid, []string{"cloud-init", "status"}, "")
+		if err != nil {
+			return false, err.Error()
+		}
+		// 新しい cloud-init は回復可能なエラーがあると done でも終了コード 2 を返す
+		switch status := parseCloudinitStatus(out.OutData); status {
+		case "done":
+			return true, ""
+		case "":
+			return false, fmt.Sprintf("unknown cloud-init status (exit %d)", out.ExitCode)
+		default:
+			return false, fmt.Sprintf("cloud-init is %s", status)
+		}
+	})
+	check(model.StageIP, func() (bool, string) {
+		ifs, err := repo.GetNetIntFormQumeAgent(ctx, node, vmid)
+		if err != nil {
+			return false, err.Error()
+		}
+		res.IPs = guestIPs(ifs)
+		if len(res.IPs) == 0 {
+			return false, "no ip address assigned"
+		}
+		return true, ""
+	})
+	res.Ready = failed == ""
+	return res, nil
+}
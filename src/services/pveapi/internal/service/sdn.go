@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/gommon/log"
+)
+
+// ensureSDNZone は設定された SDN ゾーンがなければ作成します
+func (p *pveService) ensureSDNZone(ctx context.Context) error {
+	zones, err := p.pveRepo.ListSDNZones(ctx)
+	if err != nil {
+		return errors.Wrap(err, "can't list sdn zones")
+	}
+	for _, z := range zones {
+		if z.Zone == p.conf.SDNZone {
+			return nil
+		}
+	}
+	zone := &model.SDNZone{
+		Zone:   p.conf.SDNZone,
+		Type:   p.conf.SDNZoneType,
+		Bridge: p.conf.SDNBridge,
+	}
+	if err := p.pveRepo.CreateSDNZone(ctx, zone); err != nil {
+		return errors.Wrap(err, "can't create sdn zone")
+	}
+	return nil
+}
+
+// CreateVNet は VNet とサブネットを作成して SDN の設定を反映します
+func (p *pveService) CreateVNet(ctx context.Context, vnet *model.VNet) error {
+	if p.conf.SDNZone == "" {
+		return errors.New("sdn zone is not configured")
+	}
+	vnet.Zone = p.conf.SDNZone
+	if err := p.ensureSDNZone(ctx); err != nil {
+		return err
+	}
+	if err := p.pveRepo.CreateVNet(ctx, vnet); err != nil {
+		return errors.Wrap(err, "can't create vnet")
+	}
+	if vnet.Subnet != "" {
+		if err := p.pveRepo.CreateSubnet(ctx, vnet); err != nil {
+			// 戻せなかった VNet は残るのでログに出す
+			if derr := p.pveRepo.DeleteVNet(ctx, vnet.Name); derr != nil {
+				log.Errorf("can't delete vnet %s after failed subnet create: %+v", vnet.Name, derr)
+			}
+			return errors.Wrap(err, "can't create subnet")
+		}
+	}
+	if err := p.pveRepo.ApplySDN(ctx); err != nil {
+		return errors.Wrap(err, "can't apply sdn")
+	}
+	return nil
+}
+
+// DeleteVNet はサブネットと VNet を削除して SDN の設定を反映します
+func (p *pveService) DeleteVNet(ctx context.Context, name string) error {
+	subnets, err := p.pveRepo.ListSubnets(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "can't list subnets")
+	}
+	for _, s := range subnets {
+		if err := p.pveRepo.DeleteSubnet(ctx, name, s.Subnet); err != nil {
+			return errors.Wrap(err, "can't delete subnet")
+		}
+	}
+	if err := p.pveRepo.DeleteVNet(ctx, name); err != nil {
+		return errors.Wrap(err, "can't delete vnet")
+	}
+	if err := p.pveRepo.ApplySDN(ctx); err != nil {
+		return errors.Wrap(err, "can't apply sdn")
+	}
+	return nil
+}
@@ -1,41 +1,88 @@
 package service
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/LainInTheWired/ctf-backend/pveapi/model"
 	"github.com/LainInTheWired/ctf-backend/pveapi/repository"
 	"github.com/cockroachdb/errors"
+	"github.com/labstack/gommon/log"
 )
 
 type pveService struct {
-	pveRepo repository.PVERepository
+	pveRepo  repository.PVERepository
+	snippets repository.SnippetStore
+	conf     *model.PVEConfig
+
+	// ウォームプールの VM を払い出している間は claims に記録して二重に払い出さない
+	claims   repository.WarmClaimStore
+	refillMu sync.Mutex
 }
 
 type PVEService interface {
-	CreateCloudinitVM(name string, size int, vmconf *model.VMEdit, cloneid int) (int, error)
-	DeleteVMByVmid(vmid int) error
-	SelectNode(cores int, memory int, disk int) (string, error)
-	GenerateCloudinit(hostname string, conf []model.User, filename string, sshPwauth int) error
-	TransferFileViaSCP(fname string) error
-	Template(vmid int) error
+	CreateCloudinitVM(ctx context.Context, size int, vmconf *model.VMEdit, clone *model.VMClone, bridge string) (int, error)
+	DeleteVMByVmid(ctx context.Context, vmid int) error
+	// SearchNodeByVmid は vmid の VM があるノードを返します
+	SearchNodeByVmid(ctx context.Context, vmid int) (string, error)
+	SelectNode(ctx context.Context, cores int, memory int, disk int) (string, error)
+	// Place は VM を置けるノードのうち最も負荷の低いものを返します
+	Place(ctx context.Context, cores int, memory int, disk int) (*model.Placement, error)
+	GenerateCloudinit(filename string, doc *model.CloudinitDocument) error
+	Template(ctx context.Context, vmid int) error
 	DeleteCloudinitFile(fname string) error
-	GetIps(vmid int) (map[string][]string, error)
-	GetClusterResource() ([]model.ClusterResources, error)
-	EditVMACL() error
+	ListCloudinitFiles() ([]string, error)
+	GetIps(ctx context.Context, vmid int) (map[string][]string, error)
+	// VMReadiness は起動・guest agent・cloud-init・IP の順に VM が使えるかを確認します
+	VMReadiness(ctx context.Context, vmid int) (*model.VMReadiness, error)
+	// VMMetrics と NodeMetrics は timeframe (空の場合は hour) の rrddata を返します
+	VMMetrics(ctx context.Context, vmid int, timeframe string) (*model.Metrics, error)
+	NodeMetrics(ctx context.Context, node string, timeframe string) (*model.Metrics, error)
+	// SuspendIdle は VM が policy の条件でアイドルであれば止めます
+	SuspendIdle(ctx context.Context, vmid int, policy *model.IdlePolicy) (*model.PowerState, error)
+	Resume(ctx context.Context, vmid int) (*model.PowerState, error)
+	AgentExec(ctx context.Context, vmid int, command []string, input string) (int, error)
+	AgentExecStatus(ctx context.Context, vmid int, pid int) (*model.AgentExecStatus, error)
+	// AgentRun はコマンドを実行して終了まで (最大 timeout) 待ちます
+	AgentRun(ctx context.Context, vmid int, command []string, input string, timeout time.Duration) (*model.AgentExecStatus, error)
+	AgentFileRead(ctx context.Context, vmid int, path string) (*model.AgentFile, error)
+	AgentFileWrite(ctx context.Context, vmid int, file *model.AgentFileWrite) error
+	// filter の 0 でない項目とタグが一致する VM だけを返す (空の場合はすべて)
+	GetClusterResource(ctx context.Context, filter model.InstanceTags) ([]model.ClusterResources, error)
+	EditVMACL(ctx context.Context) error
+	CreateVNet(ctx context.Context, vnet *model.VNet) error
+	DeleteVNet(ctx context.Context, name string) error
+	SetVMFirewall(ctx context.Context, vmid int, fw *model.VMFirewall) error
+	GetVMFirewallRules(ctx context.Context, vmid int) ([]model.FirewallRule, error)
+	// WarmPool はテンプレートごとのウォームプールの状態を返します
+	WarmPool(ctx context.Context) []model.WarmPoolStatus
+	// RefillWarmPool は足りない数だけテンプレートをクローンします
+	RefillWarmPool(ctx context.Context) []model.WarmPoolStatus
+	// RunWarmPool は ctx が終わるまで設定の間隔で RefillWarmPool を実行します
+	RunWarmPool(ctx context.Context)
+	// ImportImage はクラウドイメージを URL からダウンロードするか file をアップロードしてストレージに置きます
+	ImportImage(ctx context.Context, img *model.ImageImport, file io.Reader) (*model.ImportedImage, error)
+	// CreateImageVM はクラウドイメージから cloud-init と guest agent を有効にした VM を作ります
+	CreateImageVM(ctx context.Context, vm *model.VMCreate) (int, error)
 }
 
-func NewPVEService(r repository.PVERepository) PVEService {
+func NewPVEService(r repository.PVERepository, snippets repository.SnippetStore, claims repository.WarmClaimStore, conf *model.PVEConfig) PVEService {
 	return &pveService{
-		pveRepo: r,
+		pveRepo:  r,
+		snippets: snippets,
+		conf:     conf,
+		claims:   claims,
 	}
 }
 
 // SelectLeastLoadedNode は最も負荷が低いノードを選択します
-func (p *pveService) SelectNodeByCPU() (string, error) {
-	nodes, err := p.pveRepo.GetNodeList()
+func (p *pveService) SelectNodeByCPU(ctx context.Context) (string, error) {
+	nodes, err := p.pveRepo.GetNodeList(ctx)
 	if err != nil {
 		return "", errors.Wrap(err, "can't get nodes")
 	}
@@ -60,10 +107,18 @@ func (p *pveService) SelectNodeByCPU() (string, error) {
 	return selectedNode, nil
 }
 
-func (p *pveService) SelectNode(cores int, memory int, disk int) (string, error) {
-	nodes, err := p.pveRepo.GetNodeList()
+func (p *pveService) SelectNode(ctx context.Context, cores int, memory int, disk int) (string, error) {
+	placement, err := p.Place(ctx, cores, memory, disk)
 	if err != nil {
-		return "", errors.Wrap(err, "can't get nodes")
+		return "", err
+	}
+	return placement.Node, nil
+}
+
+func (p *pveService) Place(ctx context.Context, cores int, memory int, disk int) (*model.Placement, error) {
+	nodes, err := p.pveRepo.GetNodeList(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get nodes")
 	}
 	minLoad := 1.0 // CPU負荷は通常0.0〜1.0の範囲
 	var selectedNode string
@@ -91,14 +146,82 @@ func (p *pveService) SelectNode(cores int, memory int, disk int) (string, error)
 	}
 
 	if selectedNode == "" {
-		return "", errors.New("not found online node")
+		return nil, errors.New("not found online node")
 	}
-	return selectedNode, nil
+	return &model.Placement{Cluster: p.conf.ID, Node: selectedNode, CPU: minLoad}, nil
 
 }
 
-func (p *pveService) CreateCloudinitVM(name string, size int, vmconf *model.VMEdit, cloneid int) (int, error) {
-	svmid, err := p.pveRepo.NextVMID()
+func (p *pveService) CreateCloudinitVM(ctx context.Context, size int, vmconf *model.VMEdit, clone *model.VMClone, bridge string) (int, error) {
+	if err := repository.ValidateSnippetName(vmconf.Cicustom); err != nil {
+		return 0, errors.Wrap(err, "invalid cicustom")
+	}
+	// user-data と一緒に生成されたスニペットがあれば cicustom に追加する
+	network := SnippetFilename(vmconf.Cicustom, model.SnippetNetwork)
+	meta := SnippetFilename(vmconf.Cicustom, model.SnippetMeta)
+	vendor := SnippetFilename(vmconf.Cicustom, model.SnippetVendor)
+	found, err := p.snippets.Exists(network, meta, vendor)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't stat snippets")
+	}
+	if found[network] {
+		vmconf.CicustomNetwork = network
+	}
+	if found[meta] {
+		vmconf.CicustomMeta = meta
+	}
+	if found[vendor] {
+		vmconf.CicustomVendor = vendor
+	}
+	if _, err := p.templateGuest(ctx, clone); err != nil {
+		return 0, err
+	}
+	repo := p.pveRepo.ForGuest(clone.Type)
+	// ウォームプールに停止した VM があればクローンせずに払い出す
+	vmid, ok := p.claimWarmVM(ctx, vmconf, clone, bridge)
+	if !ok {
+		if vmid, err = p.cloneTemplate(ctx, vmconf, clone, bridge); err != nil {
+			return 0, err
+		}
+	}
+
+	if size != 0 {
+		disk := "scsi0"
+		if clone.Type == model.GuestLXC {
+			disk = "rootfs"
+		}
+		err = repo.ResizeDisk(ctx, vmconf.Node, disk, size, vmid)
+		if err != nil {
+			p.cleanupVM(ctx, clone.Type, vmconf.Node, vmid)
+			return 0, errors.Wrap(err, "can't resize vm disk")
+		}
+	}
+
+	err = repo.Boot(ctx, vmconf.Node, vmid)
+	if err != nil {
+		p.cleanupVM(ctx, clone.Type, vmconf.Node, vmid)
+		return 0, errors.Wrap(err, "can't boot")
+	}
+	return vmid, nil
+}
+
+// templateGuest はテンプレートがあるノードを返し、clone.Type にテンプレートの種類を入れます
+// clone.Type が指定されている場合はテンプレートの種類と一致するかを確認する
+func (p *pveService) templateGuest(ctx context.Context, clone *model.VMClone) (string, error) {
+	g, err := p.pveRepo.LookupGuest(ctx, clone.Cloneid)
+	if err != nil {
+		return "", errors.Wrap(err, "can't search vm")
+	}
+	if clone.Type != "" && clone.Type != g.Type {
+		return "", errors.Wrapf(model.ErrGuestUnsupported, "template %d is %s, not %s", clone.Cloneid, g.Type, clone.Type)
+	}
+	clone.Type = g.Type
+	return g.Node, nil
+}
+
+// cloneTemplate はテンプレートを vmconf.Node にクローンして vmconf の設定を適用します
+func (p *pveService) cloneTemplate(ctx context.Context, vmconf *model.VMEdit, clone *model.VMClone, bridge string) (int, error) {
+	svmid, err := p.pveRepo.NextVMID(ctx)
 	if err != nil {
 		return 0, errors.Wrap(err, "can't get next VID")
 	}
@@ -106,90 +229,120 @@ func (p *pveService) CreateCloudinitVM(name string, size int, vmconf *model.VMEd
 	if err != nil {
 		return 0, errors.Wrap(err, "can't cast vmid")
 	}
-	vmconf.Scsi = []string{fmt.Sprintf("vmdisk:vm-%d-disk-0,size=16G", vmid)}
 
 	vmconf.Vmid = vmid
-	cnode, err := p.SearchNodeByVmid(cloneid)
+	cnode, err := p.templateGuest(ctx, clone)
 	if err != nil {
-		return 0, errors.Wrap(err, "can't search vm")
+		return 0, err
 	}
+	repo := p.pveRepo.ForGuest(clone.Type)
 
-	err = p.pveRepo.CloneVM(name, vmid, cnode, cloneid, vmconf.Node)
+	// テンプレートの scsi0 から新しいVMのディスク設定を作る
+	tconf, err := repo.GetVM(ctx, cnode, clone.Cloneid)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get template config")
+	}
+	if clone.Mode == "" {
+		clone.Mode = p.conf.CloneMode
+	}
+	if clone.Storage == "" {
+		clone.Storage = p.conf.CloneStorage
+	}
+	if clone.Pool == "" {
+		clone.Pool = p.conf.Pool
+	}
+	if clone.Pool != "" {
+		if err := p.ensurePool(ctx, clone.Pool); err != nil {
+			return 0, errors.Wrap(err, "can't ensure pool")
+		}
+	}
+	if clone.Mode == model.CloneModeLinked && tconf.Template != 1 {
+		return 0, errors.Newf("linked clone requires a template: vmid %d is not a template", clone.Cloneid)
+	}
+	if clone.Type == model.GuestLXC {
+		// コンテナはディスクをクローンの storage に作るので rootfs は書き換えない
+		// cloud-init がないので IP アドレスは net0 に書く
+		if bridge != "" || len(vmconf.Ipconfig) > 0 {
+			vmconf.Net = []string{RewriteLXCNet(tconf.Net0, bridge, strings.Join(vmconf.Ipconfig, ","))}
+		}
+	} else {
+		disk, err := ParseDisk(tconf.Scsi0)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't parse template disk")
+		}
+		vmconf.Scsi = []string{CloneDisk(disk, vmid, clone).String()}
+		// bridge の指定があれば net0 をその VNet に付け替える
+		if bridge != "" {
+			vmconf.Net = []string{RewriteNet(tconf.Net0, bridge)}
+		}
+	}
+
+	clone.Newid = vmid
+	clone.Node = cnode
+	clone.Target = vmconf.Node
+	err = repo.CloneVM(ctx, clone)
 	if err != nil {
 		return 0, errors.Wrap(err, "can't clone vm")
 	}
 
 	// 追加 ACL
-	if err := p.pveRepo.EditVMACL(vmid); err != nil {
+	if err := repo.EditVMACL(ctx, vmid); err != nil {
 		return 0, errors.Wrap(err, "can't edit acl")
 	}
 
-	// err = p.EditVM(*vmconf)
-	err = p.fiveEditVM(vmconf)
-	if err != nil {
-		p.fiveDeleteVM(&model.VMDelete{Vmid: vmid, Node: vmconf.Node})
+	// クローンの完了は CloneVM が待つので、ロック中の場合のみリポジトリがリトライする
+	if err := repo.EditVM(ctx, *vmconf); err != nil {
+		p.cleanupVM(ctx, clone.Type, vmconf.Node, vmid)
 		return 0, errors.Wrap(err, "can't edit vm")
 	}
+	return vmid, nil
+}
 
-	if size != 0 {
-		err = p.pveRepo.ResizeDisk(vmconf.Node, "scsi0", size, vmid)
-		if err != nil {
-			p.fiveDeleteVM(&model.VMDelete{Vmid: vmid, Node: vmconf.Node})
-			return 0, errors.Wrap(err, "can't resize vm disk")
-		}
+// cleanupVM は作成に失敗した kind (qemu / lxc) のゲストを削除します
+// 呼び出し元のリクエストがキャンセルされていても削除は最後まで行う
+func (p *pveService) cleanupVM(ctx context.Context, kind string, node string, vmid int) {
+	ctx = context.WithoutCancel(ctx)
+	if err := p.pveRepo.ForGuest(kind).DeleteVM(ctx, &model.VMDelete{Vmid: vmid, Node: node}); err != nil {
+		log.Errorf("can't cleanup vm %d: %+v", vmid, err)
 	}
+}
 
-	err = p.pveRepo.Boot(vmconf.Node, vmid)
+// ensurePool はリソースプールがなければ作成します
+// 一覧を取ってから作成するまでに別のリクエストが作成した場合も成功にする
+func (p *pveService) ensurePool(ctx context.Context, poolid string) error {
+	pools, err := p.pveRepo.ListPools(ctx)
 	if err != nil {
-		p.fiveDeleteVM(&model.VMDelete{Vmid: vmid, Node: vmconf.Node})
-		return 0, errors.Wrap(err, "can't boot")
+		return errors.Wrap(err, "can't list pools")
 	}
-	return vmid, nil
-}
-
-func (p *pveService) fiveEditVM(conf *model.VMEdit) error {
-	for i := 0; i < 5; i++ {
-		time.Sleep(5 * time.Second)
-		if err := p.pveRepo.EditVM(*conf); err != nil {
-			fmt.Println(i)
-			if i > 3 {
-				return errors.Wrap(err, "can't error")
-			}
-		} else {
-			break
+	for _, pool := range pools {
+		if pool.PoolID == poolid {
+			return nil
 		}
 	}
+	if err := p.pveRepo.CreatePool(ctx, &model.Pool{PoolID: poolid, Comment: "ctf"}); err != nil && !errors.Is(err, model.ErrPVEExists) {
+		return err
+	}
 	return nil
 }
 
-func (p *pveService) fiveDeleteVM(conf *model.VMDelete) error {
-	for i := 0; i < 5; i++ {
-		time.Sleep(5 * time.Second)
-		if err := p.pveRepo.DeleteVM(conf); err != nil {
-			if i > 3 {
-				return errors.Wrap(err, "can't error")
-			}
-		} else {
-			break
-		}
+func (p *pveService) SearchNodeByVmid(ctx context.Context, vmid int) (string, error) {
+	node, err := p.pveRepo.LookupVMNode(ctx, vmid)
+	if err != nil {
+		return "", errors.Wrap(err, "can't search node")
 	}
-	return nil
+	return node, nil
 }
 
-func (p *pveService) SearchNodeByVmid(vmid int) (string, error) {
-	res, err := p.pveRepo.GetClusterResourcesList()
+// guestRepo は vmid のゲストがあるノードと、その種類 (qemu / lxc) を操作するリポジトリを返します
+func (p *pveService) guestRepo(ctx context.Context, vmid int) (repository.PVERepository, string, error) {
+	g, err := p.pveRepo.LookupGuest(ctx, vmid)
 	if err != nil {
-		return "", err
-	}
-	for _, v := range res {
-		if vmid == v.Vmid {
-			return v.Node, nil
-		}
+		return nil, "", errors.Wrap(err, "can't lookup guest")
 	}
-	return "", errors.New("not found this vmid in cluster")
+	return p.pveRepo.ForGuest(g.Type), g.Node, nil
 }
-func (p *pveService) DeleteVMByVmid(vmid int) error {
-	n, err := p.SearchNodeByVmid(vmid)
+func (p *pveService) DeleteVMByVmid(ctx context.Context, vmid int) error {
+	repo, n, err := p.guestRepo(ctx, vmid)
 	fmt.Println("search error", err)
 	if err != nil {
 		return errors.Wrap(err, "can't search node")
@@ -199,61 +352,111 @@ func (p *pveService) DeleteVMByVmid(vmid int) error {
 		Node: n,
 	}
 
-	if err := p.pveRepo.Shutdown(n, vmid); err != nil {
-		return err
+	// 停止タスクの完了を待ってから削除する
+	if err := repo.Shutdown(ctx, n, vmid); err != nil {
+		return errors.Wrap(err, "can't stop vm")
 	}
-
-	time.Sleep(30 * time.Second)
-
-	if err := p.fiveDeleteVM(conf); err != nil {
-		return err
+	if err := repo.DeleteVM(ctx, conf); err != nil {
+		return errors.Wrap(err, "can't delete vm")
 	}
 	return nil
 
 }
 
-func (p *pveService) GenerateCloudinit(hostname string, conf []model.User, filename string, sshPwauth int) error {
-	if err := p.pveRepo.CloudinitGenerator(filename, hostname, hostname, sshPwauth, conf); err != nil {
+func (p *pveService) GenerateCloudinit(filename string, doc *model.CloudinitDocument) error {
+	if err := repository.ValidateSnippetName(filename); err != nil {
+		return errors.Wrap(err, "invalid filename")
+	}
+	doc.User = MergeCloudinit(&defaultCloudinit, doc.User)
+	if err := ValidateCloudinitDocument(doc); err != nil {
+		return errors.Wrap(err, "invalid cloudinit")
+	}
+
+	snippets := map[string][]byte{}
+	data, err := p.pveRepo.CloudinitGenerator(doc.User)
+	if err != nil {
 		return errors.Wrap(err, "can't create cloudinit")
 	}
-	return nil
-}
+	snippets[model.SnippetUser] = data
+	if doc.Network != nil {
+		if snippets[model.SnippetNetwork], err = p.pveRepo.NetworkConfigGenerator(doc.Network); err != nil {
+			return errors.Wrap(err, "can't create network-config")
+		}
+	}
+	if doc.Meta != nil {
+		if snippets[model.SnippetMeta], err = p.pveRepo.MetaDataGenerator(doc.Meta); err != nil {
+			return errors.Wrap(err, "can't create meta-data")
+		}
+	}
+	if doc.Vendor != nil {
+		if snippets[model.SnippetVendor], err = p.pveRepo.CloudinitGenerator(doc.Vendor); err != nil {
+			return errors.Wrap(err, "can't create vendor-data")
+		}
+	}
 
-func (p *pveService) TransferFileViaSCP(fname string) error {
-	if err := p.pveRepo.TransferFileViaSCP(fname); err != nil {
-		return errors.Wrap(err, "can't send file")
+	for _, kind := range []string{model.SnippetUser, model.SnippetNetwork, model.SnippetMeta, model.SnippetVendor} {
+		name := SnippetFilename(filename, kind)
+		data, ok := snippets[kind]
+		if !ok {
+			// 以前の生成で残ったスニペットを参照しないように消しておく
+			if err := p.snippets.Delete(name); err != nil {
+				return errors.Wrapf(err, "can't delete old %s snippet", kind)
+			}
+			continue
+		}
+		if err := p.snippets.Put(name, data); err != nil {
+			return errors.Wrapf(err, "can't upload %s snippet", kind)
+		}
 	}
 	return nil
 }
 
 func (p *pveService) DeleteCloudinitFile(fname string) error {
-	if err := p.pveRepo.DeleteFile(fname); err != nil {
-		return errors.Wrap(err, "can't to template")
+	for _, kind := range []string{model.SnippetUser, model.SnippetNetwork, model.SnippetMeta, model.SnippetVendor} {
+		if err := p.snippets.Delete(SnippetFilename(fname, kind)); err != nil {
+			return errors.Wrap(err, "can't delete cloudinit")
+		}
 	}
 	return nil
 }
 
-func (p *pveService) Template(vmid int) error {
-	node, err := p.SearchNodeByVmid(vmid)
+// ListCloudinitFiles はスニペットの保存先にあるファイル名を返します
+func (p *pveService) ListCloudinitFiles() ([]string, error) {
+	names, err := p.snippets.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list snippets")
+	}
+	return names, nil
+}
+
+func (p *pveService) Template(ctx context.Context, vmid int) error {
+	g, err := p.pveRepo.LookupGuest(ctx, vmid)
 	if err != nil {
 		return errors.Wrap(err, "can't found err")
 	}
-	if err := p.pveRepo.Shutdown(node, vmid); err != nil {
+	repo, node := p.pveRepo.ForGuest(g.Type), g.Node
+	if err := repo.Shutdown(ctx, node, vmid); err != nil {
 		return errors.Wrap(err, "can't stop vm")
 	}
-	if err := p.pveRepo.Template(node, vmid); err != nil {
+	// 作成時のスニペットはテンプレートにした後に消されるので、クローンに引き継がないように外しておく
+	if g.Type == model.GuestQEMU {
+		if err := repo.EditVM(ctx, model.VMEdit{Vmid: vmid, Node: node, Delete: []string{"cicustom"}}); err != nil {
+			return errors.Wrap(err, "can't clear cicustom")
+		}
+	}
+	if err := repo.Template(ctx, node, vmid); err != nil {
 		return errors.Wrap(err, "can't to template")
 	}
 	return nil
 }
 
-func (p *pveService) GetIps(vmid int) (map[string][]string, error) {
+func (p *pveService) GetIps(ctx context.Context, vmid int) (map[string][]string, error) {
 	ips := map[string][]string{}
-	node, err := p.SearchNodeByVmid(vmid)
+	repo, node, err := p.guestRepo(ctx, vmid)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't found err")
 	}
-	GetNetIntFormQumeAgent, err := p.pveRepo.GetNetIntFormQumeAgent(node, vmid)
+	GetNetIntFormQumeAgent, err := repo.GetNetIntFormQumeAgent(ctx, node, vmid)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't get int")
 	}
@@ -266,16 +469,40 @@ func (p *pveService) GetIps(vmid int) (map[string][]string, error) {
 	return ips, nil
 }
 
-func (p *pveService) GetClusterResource() ([]model.ClusterResources, error) {
-	res, err := p.pveRepo.GetClusterResourcesList()
+func (p *pveService) GetClusterResource(ctx context.Context, filter model.InstanceTags) ([]model.ClusterResources, error) {
+	res, err := p.pveRepo.GetClusterResourcesList(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return res, nil
+	filtered := []model.ClusterResources{}
+	for _, r := range res {
+		if model.IsGuestType(r.Type) {
+			if tags := model.ParseInstanceTags(r.Tags); !tags.IsZero() {
+				r.Instance = &tags
+			}
+		}
+		if !filter.IsZero() && !matchInstance(r.Instance, filter) {
+			continue
+		}
+		filtered = append(filtered, r)
+	}
+	return filtered, nil
+}
+
+// matchInstance は filter の 0 でない項目がすべて一致するかを返します
+func matchInstance(tags *model.InstanceTags, filter model.InstanceTags) bool {
+	if tags == nil {
+		return false
+	}
+	return (filter.ContestID == 0 || tags.ContestID == filter.ContestID) &&
+		(filter.TeamID == 0 || tags.TeamID == filter.TeamID) &&
+		(filter.QuestionID == 0 || tags.QuestionID == filter.QuestionID) &&
+		(filter.Warm == 0 || tags.Warm == filter.Warm) &&
+		(filter.CreatedBy == "" || tags.CreatedBy == filter.CreatedBy)
 }
 
-func (p *pveService) EditVMACL() error {
-	err := p.pveRepo.EditVMACL(137)
+func (p *pveService) EditVMACL(ctx context.Context) error {
+	err := p.pveRepo.EditVMACL(ctx, 137)
 	if err != nil {
 		return err
 	}
@@ -1,7 +1,10 @@
 package service
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
 )
 
 func TestSCP(t *testing.T) {
@@ -12,3 +15,178 @@ func TestSCP(t *testing.T) {
 func TestSelectNode(t *testing.T) {
 
 }
+
+func TestCloneDisk(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		clone model.VMClone
+		want  string
+	}{
+		{
+			name:  "full clone keeps storage",
+			spec:  "vmdisk:base-9000-disk-0,size=16G",
+			clone: model.VMClone{Mode: model.CloneModeFull},
+			want:  "vmdisk:vm-120-disk-0,size=16G",
+		},
+		{
+			name:  "full clone to other storage",
+			spec:  "vmdisk:base-9000-disk-0,discard=on,size=32G",
+			clone: model.VMClone{Mode: model.CloneModeFull, Storage: "ceph"},
+			want:  "ceph:vm-120-disk-0,discard=on,size=32G",
+		},
+		{
+			name:  "linked clone references base image",
+			spec:  "ceph:base-9000-disk-1,size=16G",
+			clone: model.VMClone{Mode: model.CloneModeLinked, Storage: "ignored"},
+			want:  "ceph:base-9000-disk-1/vm-120-disk-1,size=16G",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := ParseDisk(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseDisk(%q): %v", tt.spec, err)
+			}
+			if got := CloneDisk(d, 120, &tt.clone).String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDiskInvalid(t *testing.T) {
+	for _, spec := range []string{"", "size=16G", "vmdisk:", "local:iso/alma.iso,media=cdrom"} {
+		if _, err := ParseDisk(spec); err == nil {
+			t.Errorf("ParseDisk(%q) should fail", spec)
+		}
+	}
+}
+
+func TestMergeCloudinit(t *testing.T) {
+	update := true
+	base := &model.CloudinitConfig{
+		Hostname:      "question",
+		PackageUpdate: &update,
+		Users:         []model.User{{Name: "ctf", Shell: "/bin/sh"}},
+		Packages:      []string{"git", "curl"},
+		WriteFiles:    []model.WriteFile{{Path: "/opt/flag.txt", Content: "base"}},
+		RunCmd:        []string{"echo base"},
+	}
+	override := &model.CloudinitConfig{
+		Hostname:   "1-2-3",
+		Users:      []model.User{{Name: "ctf", Shell: "/bin/bash"}, {Name: "team"}},
+		Packages:   []string{"curl", "nmap"},
+		WriteFiles: []model.WriteFile{{Path: "/opt/flag.txt", Content: "team"}},
+		RunCmd:     []string{"echo team"},
+	}
+	m := MergeCloudinit(base, override)
+	if m.Hostname != "1-2-3" || m.PackageUpdate == nil || !*m.PackageUpdate {
+		t.Errorf("unexpected scalars: %+v", m)
+	}
+	if len(m.Users) != 2 || m.Users[0].Shell != "/bin/bash" {
+		t.Errorf("unexpected users: %+v", m.Users)
+	}
+	if strings.Join(m.Packages, ",") != "git,curl,nmap" {
+		t.Errorf("unexpected packages: %v", m.Packages)
+	}
+	if len(m.WriteFiles) != 1 || m.WriteFiles[0].Content != "team" {
+		t.Errorf("unexpected write_files: %+v", m.WriteFiles)
+	}
+	if strings.Join(m.RunCmd, ";") != "echo base;echo team" {
+		t.Errorf("unexpected runcmd: %v", m.RunCmd)
+	}
+	// ベースは変更しない
+	if base.Users[0].Shell != "/bin/sh" || len(base.Packages) != 2 {
+		t.Errorf("base was modified: %+v", base)
+	}
+}
+
+func TestValidateCloudinit(t *testing.T) {
+	tests := []struct {
+		name string
+		conf model.CloudinitConfig
+		ok   bool
+	}{
+		{"valid", model.CloudinitConfig{Hostname: "1-2-3", WriteFiles: []model.WriteFile{{Path: "/etc/motd", Permissions: "0644"}}}, true},
+		{"bad hostname", model.CloudinitConfig{Hostname: "a_b"}, false},
+		{"duplicate user", model.CloudinitConfig{Users: []model.User{{Name: "ctf"}, {Name: "ctf"}}}, false},
+		{"relative path", model.CloudinitConfig{WriteFiles: []model.WriteFile{{Path: "etc/motd"}}}, false},
+		{"path traversal", model.CloudinitConfig{WriteFiles: []model.WriteFile{{Path: "/etc/../root/x"}}}, false},
+		{"bad base64", model.CloudinitConfig{WriteFiles: []model.WriteFile{{Path: "/x", Encoding: "b64", Content: "%%"}}}, false},
+		{"chpasswd without password", model.CloudinitConfig{Chpasswd: &model.Chpasswd{Users: []model.ChpasswdUser{{Name: "root", Type: "text"}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCloudinit(&tt.conf); (err == nil) != tt.ok {
+				t.Errorf("ValidateCloudinit() = %v, ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSnippetFilename(t *testing.T) {
+	if got := SnippetFilename("1-2-3.yaml", model.SnippetNetwork); got != "1-2-3-network.yaml" {
+		t.Errorf("SnippetFilename() = %q", got)
+	}
+	if got := SnippetFilename("1-2-3.yaml", model.SnippetUser); got != "1-2-3.yaml" {
+		t.Errorf("SnippetFilename() = %q", got)
+	}
+}
+
+func TestRewriteNet(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"virtio=BC:24:11:00:00:01,bridge=vmbr0,firewall=1", "virtio,bridge=ctf100,firewall=1"},
+		{"e1000=BC:24:11:00:00:01,bridge=vmbr1,tag=20", "e1000,bridge=ctf100"},
+		{"", "virtio,bridge=ctf100"},
+	}
+	for _, tt := range tests {
+		if got := RewriteNet(tt.spec, "ctf100"); got != tt.want {
+			t.Errorf("RewriteNet(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteLXCNet(t *testing.T) {
+	tests := []struct {
+		spec     string
+		bridge   string
+		ipconfig string
+		want     string
+	}{
+		{"name=eth0,bridge=vmbr0,hwaddr=BC:24:11:00:00:01,ip=dhcp,type=veth", "ctf100", "ip=10.0.100.10/24,gw=10.0.100.1",
+			"name=eth0,type=veth,bridge=ctf100,ip=10.0.100.10/24,gw=10.0.100.1"},
+		{"name=eth0,bridge=vmbr0,ip=dhcp,firewall=1", "", "", "name=eth0,bridge=vmbr0,ip=dhcp,firewall=1"},
+		{"", "ctf100", "ip=dhcp", "name=eth0,bridge=ctf100,ip=dhcp"},
+	}
+	for _, tt := range tests {
+		if got := RewriteLXCNet(tt.spec, tt.bridge, tt.ipconfig); got != tt.want {
+			t.Errorf("RewriteLXCNet(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFirewall(t *testing.T) {
+	tests := []struct {
+		name string
+		rule model.FirewallRule
+		ok   bool
+	}{
+		{"tcp port from subnet", model.FirewallRule{Type: "in", Action: "ACCEPT", Proto: "tcp", Dport: "22", Source: "10.0.100.0/24,10.255.0.100"}, true},
+		{"port range", model.FirewallRule{Type: "in", Action: "ACCEPT", Proto: "udp", Dport: "60000:61000"}, true},
+		{"dport without proto", model.FirewallRule{Type: "in", Action: "ACCEPT", Dport: "22"}, false},
+		{"bad action", model.FirewallRule{Type: "in", Action: "ALLOW"}, false},
+		{"bad source", model.FirewallRule{Type: "in", Action: "ACCEPT", Source: "10.0.0.0/33"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fw := &model.VMFirewall{Rules: []model.FirewallRule{tt.rule}}
+			if err := ValidateFirewall(fw); (err == nil) != tt.ok {
+				t.Errorf("ValidateFirewall() = %v, ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf-backend/pveapi/model"
+	"github.com/cockroachdb/errors"
+)
+
+// ParseWarmPoolSizes は "9000=2,9001=1" のような テンプレート=数 の一覧を読みます
+func ParseWarmPoolSizes(spec string) (map[int]int, error) {
+	sizes := map[int]int{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, errors.Newf("invalid warm pool entry: %s", item)
+		}
+		template, err := strconv.Atoi(strings.TrimSpace(k))
+		if err != nil || template <= 0 {
+			return nil, errors.Newf("invalid warm pool template: %s", item)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || size < 0 {
+			return nil, errors.Newf("invalid warm pool size: %s", item)
+		}
+		sizes[template] = size
+	}
+	return sizes, nil
+}
+
+// warmVMs は template のウォームプールの停止している VM のうち払い出し中でないものを返します
+func (p *pveService) warmVMs(ctx context.Context, template int) ([]model.ClusterResources, error) {
+	res, err := p.GetClusterResource(ctx, model.InstanceTags{Warm: template, CreatedBy: model.WarmPoolCreatedBy})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cluster resources")
+	}
+	vms := []model.ClusterResources{}
+	for _, r := range res {
+		if !model.IsGuestType(r.Type) || r.Template == 1 || r.Status != model.PowerStopped {
+			continue
+		}
+		claimed, err := p.claims.Claimed(ctx, r.Vmid)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't get warm vm claim")
+		}
+		if claimed {
+			continue
+		}
+		vms = append(vms, r)
+	}
+	return vms, nil
+}
+
+// warmClonable はウォームプールの VM が clone の指定どおりにクローンしたものと同じかを返します
+// ウォームプールの VM はクラスタのデフォルトのモードとストレージでクローンしている
+func (p *pveService) warmClonable(clone *model.VMClone) bool {
+	mode := clone.Mode
+	if mode == "" {
+		mode = p.conf.CloneMode
+	}
+	if mode != p.conf.CloneMode {
+		return false
+	}
+	// リンククローンは元のディスクと同じストレージに作られる
+	return mode != model.CloneModeFull || clone.Storage == "" || clone.Storage == p.conf.CloneStorage
+}
+
+// claimWarmVM はウォームプールの VM に vmconf の設定を適用して払い出します
+// 払い出せる VM がない場合や設定に失敗した場合は false を返し、呼び出し元がクローンする
+// cloud-init はスニペットを作り直した cicustom で起動するときに適用される
+func (p *pveService) claimWarmVM(ctx context.Context, vmconf *model.VMEdit, clone *model.VMClone, bridge string) (int, bool) {
+	if p.conf.WarmPool.Sizes[clone.Cloneid] == 0 || !p.warmClonable(clone) {
+		return 0, false
+	}
+	vms, err := p.warmVMs(ctx, clone.Cloneid)
+	if err != nil {
+		log.Printf("warm pool: can't list vms: %+v", err)
+		return 0, false
+	}
+	// 他のプロセスと同時に同じ VM を選んでも、先に Claim できた方だけが払い出す
+	var warm model.ClusterResources
+	found := false
+	for _, vm := range vms {
+		ok, err := p.claims.Claim(ctx, vm.Vmid)
+		if err != nil {
+			log.Printf("warm pool: can't claim vm %d: %+v", vm.Vmid, err)
+			return 0, false
+		}
+		if ok {
+			warm, found = vm, true
+			break
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	// タグを書き換えた後はウォームプールの VM として数えられない
+	defer func() {
+		if err := p.claims.Release(ctx, warm.Vmid); err != nil {
+			log.Printf("warm pool: can't release vm %d: %+v", warm.Vmid, err)
+		}
+	}()
+
+	// 失敗した場合は vmconf を変えずにクローンに戻す
+	conf := *vmconf
+	if err := p.applyWarmVM(ctx, warm, &conf, clone, bridge); err != nil {
+		log.Printf("warm pool: can't use vm %d: %+v", warm.Vmid, err)
+		p.cleanupVM(ctx, warm.Type, warm.Node, warm.Vmid)
+		return 0, false
+	}
+	*vmconf = conf
+	return warm.Vmid, true
+}
+
+func (p *pveService) applyWarmVM(ctx context.Context, warm model.ClusterResources, vmconf *model.VMEdit, clone *model.VMClone, bridge string) error {
+	repo := p.pveRepo.ForGuest(warm.Type)
+	vmconf.Vmid = warm.Vmid
+	vmconf.Node = warm.Node
+	vmconf.Name = clone.Name
+	lxc := warm.Type == model.GuestLXC
+	// bridge の指定があれば net0 をその VNet に付け替える (コンテナは IP アドレスも net0 に書く)
+	if bridge != "" || (lxc && len(vmconf.Ipconfig) > 0) {
+		conf, err := repo.GetVM(ctx, warm.Node, warm.Vmid)
+		if err != nil {
+			return errors.Wrap(err, "can't get vm config")
+		}
+		if lxc {
+			vmconf.Net = []string{RewriteLXCNet(conf.Net0, bridge, strings.Join(vmconf.Ipconfig, ","))}
+		} else {
+			vmconf.Net = []string{RewriteNet(conf.Net0, bridge)}
+		}
+	}
+	pool := clone.Pool
+	if pool == "" {
+		pool = p.conf.Pool
+	}
+	if pool != "" && pool != warm.Pool {
+		if err := p.ensurePool(ctx, pool); err != nil {
+			return errors.Wrap(err, "can't ensure pool")
+		}
+		if err := p.pveRepo.AddPoolVM(ctx, pool, warm.Vmid); err != nil {
+			return errors.Wrap(err, "can't move vm to pool")
+		}
+	}
+	if err := repo.EditVM(ctx, *vmconf); err != nil {
+		return errors.Wrap(err, "can't edit vm")
+	}
+	return nil
+}
+
+// createWarmVM は最も負荷の低いノードにテンプレートをクローンして停止したままにします
+func (p *pveService) createWarmVM(ctx context.Context, template int) (int, error) {
+	placement, err := p.Place(ctx, 0, 0, 0)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't select node")
+	}
+	vmconf := &model.VMEdit{
+		Node: placement.Node,
+		Tags: model.InstanceTags{Warm: template, CreatedBy: model.WarmPoolCreatedBy}.String(),
+	}
+	clone := &model.VMClone{Name: fmt.Sprintf("warm-%d", template), Cloneid: template}
+	vmid, err := p.cloneTemplate(ctx, vmconf, clone, "")
+	if err != nil {
+		return 0, errors.Wrap(err, "can't clone template")
+	}
+	return vmid, nil
+}
+
+func (p *pveService) warmPoolTemplates() []int {
+	templates := []int{}
+	for t := range p.conf.WarmPool.Sizes {
+		templates = append(templates, t)
+	}
+	sort.Ints(templates)
+	return templates
+}
+
+func (p *pveService) WarmPool(ctx context.Context) []model.WarmPoolStatus {
+	statuses := []model.WarmPoolStatus{}
+	for _, t := range p.warmPoolTemplates() {
+		st := model.WarmPoolStatus{Cluster: p.conf.ID, Template: t, Size: p.conf.WarmPool.Sizes[t]}
+		vms, err := p.warmVMs(ctx, t)
+		if err != nil {
+			st.Error = err.Error()
+		}
+		st.Ready = len(vms)
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+func (p *pveService) RefillWarmPool(ctx context.Context) []model.WarmPoolStatus {
+	// クローンには時間がかかるので、払い出しとは別のロックで補充が重ならないようにする
+	p.refillMu.Lock()
+	defer p.refillMu.Unlock()
+
+	statuses := p.WarmPool(ctx)
+	for i := range statuses {
+		st := &statuses[i]
+		if st.Error != "" {
+			continue
+		}
+		for st.Ready < st.Size {
+			vmid, err := p.createWarmVM(ctx, st.Template)
+			if err != nil {
+				st.Error = err.Error()
+				break
+			}
+			st.Created = append(st.Created, vmid)
+			st.Ready++
+		}
+	}
+	return statuses
+}
+
+func (p *pveService) RunWarmPool(ctx context.Context) {
+	if p.conf.WarmPool.Interval <= 0 || len(p.conf.WarmPool.Sizes) == 0 {
+		return
+	}
+	ticker := time.NewTicker(p.conf.WarmPool.Interval)
+	defer ticker.Stop()
+	for {
+		for _, st := range p.RefillWarmPool(ctx) {
+			if st.Error != "" {
+				log.Printf("warm pool: cluster %s template %d: %s", st.Cluster, st.Template, st.Error)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// challenge は challenge.yml の問題のパッケージを確認してバックエンドに同期するコマンドです
+//
+//	challenge lint DIR...
+//	challenge sync [-url URL] [-session SESSION] [-dry-run] DIR...
+//
+// DIR の下の challenge.yml をすべて探す。sync はすべてのパッケージが lint を通った場合のみ
+// POST /question/import に送り、同じ名前の問題があれば更新する。files は問題の添付ファイルとして
+// アップロードする (中身が同じファイルは送らない)
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/LainInTheWired/ctf_backend/question/service"
+	myvalidator "github.com/LainInTheWired/ctf_backend/shared/pkg/validator"
+)
+
+// challengePackage は読み込んだ問題のパッケージです
+type challengePackage struct {
+	path      string // challenge.yml のパス
+	data      []byte
+	challenge *model.Challenge
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: challenge lint DIR...")
+	fmt.Fprintln(os.Stderr, "       challenge sync [-url URL] [-session SESSION] [-dry-run] DIR...")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "lint":
+		flags := flag.NewFlagSet("lint", flag.ExitOnError)
+		flags.Parse(os.Args[2:])
+		if _, ok := lintAll(flags.Args()); !ok {
+			os.Exit(1)
+		}
+	case "sync":
+		flags := flag.NewFlagSet("sync", flag.ExitOnError)
+		url := flags.String("url", envOr("CTF_API_URL", "http://localhost"), "backend URL (CTF_API_URL)")
+		session := flags.String("session", os.Getenv("CTF_SESSION"), "session cookie of an admin user (CTF_SESSION)")
+		dryRun := flags.Bool("dry-run", false, "validate on the backend without creating or updating questions")
+		flags.Parse(os.Args[2:])
+		pkgs, ok := lintAll(flags.Args())
+		if !ok {
+			os.Exit(1)
+		}
+		if !syncAll(pkgs, strings.TrimRight(*url, "/"), *session, *dryRun) {
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
+
+func envOr(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// findChallenges は dir の下の challenge.yml のパスを返します
+func findChallenges(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == model.ChallengeFilename {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// lintAll は dirs の下のすべてのパッケージを確認し、問題があれば表示します
+func lintAll(dirs []string) ([]challengePackage, bool) {
+	if len(dirs) == 0 {
+		usage()
+	}
+	v := myvalidator.NewValidator()
+	ok := true
+	var pkgs []challengePackage
+	names := map[string]string{}
+	for _, dir := range dirs {
+		paths, err := findChallenges(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", dir, err)
+			ok = false
+			continue
+		}
+		if len(paths) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: no %s found\n", dir, model.ChallengeFilename)
+			ok = false
+		}
+		for _, path := range paths {
+			pkg, errs := lintPackage(v.Validate, path)
+			if pkg != nil {
+				// 問題は名前で特定するので同じ名前のパッケージは同期できない
+				if prev, dup := names[pkg.challenge.Name]; dup {
+					errs = append(errs, fmt.Errorf("name %q is also used by %s", pkg.challenge.Name, prev))
+				}
+				names[pkg.challenge.Name] = path
+			}
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			}
+			if len(errs) > 0 {
+				ok = false
+				continue
+			}
+			pkgs = append(pkgs, *pkg)
+			fmt.Printf("%s: ok\n", path)
+		}
+	}
+	return pkgs, ok
+}
+
+// lintPackage は challenge.yml と配布するファイルを確認します
+func lintPackage(validate func(i interface{}) error, path string) (*challengePackage, []error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+	c, err := service.ParseChallenge(data)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var errs []error
+	if err := validate(c); err != nil {
+		errs = append(errs, err)
+	}
+	if err := service.LintChallenge(c); err != nil {
+		errs = append(errs, err)
+	}
+	dir := filepath.Dir(path)
+	for _, f := range c.Files {
+		st, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f)))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("file %s: %w", f, err))
+		} else if st.IsDir() {
+			errs = append(errs, fmt.Errorf("file %s is a directory", f))
+		}
+	}
+	return &challengePackage{path: path, data: data, challenge: c}, errs
+}
+
+// syncAll はパッケージを順に POST /question/import に送ります
+func syncAll(pkgs []challengePackage, url string, session string, dryRun bool) bool {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	endpoint := url + "/question/import"
+	if dryRun {
+		endpoint += "?dry_run=1"
+	}
+	ok := true
+	for _, pkg := range pkgs {
+		req, err := http.NewRequest("POST", endpoint, bytes.NewReader(pkg.data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", pkg.path, err)
+			return false
+		}
+		req.Header.Set("Content-Type", "application/yaml")
+		body, err := send(client, req, session)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", pkg.path, err)
+			ok = false
+			continue
+		}
+		fmt.Printf("%s: %s\n", pkg.challenge.Name, strings.TrimSpace(string(body)))
+		if dryRun || len(pkg.challenge.Files) == 0 {
+			continue
+		}
+		var res model.ChallengeImport
+		if err := json.Unmarshal(body, &res); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", pkg.path, err)
+			ok = false
+			continue
+		}
+		if err := syncFiles(client, url, session, pkg, res.QuestionID); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", pkg.path, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// send はセッションのクッキーを付けてリクエストを送り、エラーのステータスをエラーにします
+func send(client *http.Client, req *http.Request, session string) ([]byte, error) {
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// syncFiles はパッケージの files を問題の添付ファイルとしてアップロードします
+func syncFiles(client *http.Client, url string, session string, pkg challengePackage, qid int) error {
+	endpoint := fmt.Sprintf("%s/question/%d/attachments", url, qid)
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	body, err := send(client, req, session)
+	if err != nil {
+		return err
+	}
+	var current []model.Attachment
+	if err := json.Unmarshal(body, &current); err != nil {
+		return err
+	}
+	sums := map[string]string{}
+	for _, a := range current {
+		sums[a.Name] = a.SHA256
+	}
+	dir := filepath.Dir(pkg.path)
+	for _, f := range pkg.challenge.Files {
+		name := path.Base(f)
+		file := filepath.Join(dir, filepath.FromSlash(f))
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return err
+		}
+		if sums[name] == sum {
+			fmt.Printf("%s: %s: unchanged\n", pkg.challenge.Name, name)
+			continue
+		}
+		if err := uploadFile(client, endpoint, session, name, file); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s: uploaded\n", pkg.challenge.Name, name)
+	}
+	return nil
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadFile はファイルを読み込まずに multipart で送ります
+func uploadFile(client *http.Client, endpoint string, session string, name string, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequest("POST", endpoint+"?name="+neturl.QueryEscape(name), pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	_, err = send(client, req, session)
+	return err
+}
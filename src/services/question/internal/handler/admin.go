@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+// AdminChecker はユーザーが管理者か確認します (AttachmentService が満たす)
+type AdminChecker interface {
+	IsAdmin(uid int) (bool, error)
+}
+
+// AdminOnly は X-User-ID のユーザーが管理者の場合だけ next を呼ぶミドルウェアです
+func AdminOnly(a AdminChecker) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			uid, err := strconv.Atoi(c.Request().Header.Get("X-User-ID"))
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "User ID not found"})
+			}
+			admin, err := a.IsAdmin(uid)
+			if err != nil {
+				wrappedErr := xerrors.Errorf(": %w", err)
+				log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+			}
+			if !admin {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "admin only"})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/LainInTheWired/ctf_backend/question/service"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type AttachmentHander interface {
+	UploadAttachment(c echo.Context) error
+	GetAttachments(c echo.Context) error
+	DeleteAttachment(c echo.Context) error
+	AttachmentLink(c echo.Context) error
+	DownloadAttachment(c echo.Context) error
+}
+
+type attachmentHander struct {
+	serv service.AttachmentService
+}
+
+func NewAttachmentHander(s service.AttachmentService) AttachmentHander {
+	return &attachmentHander{
+		serv: s,
+	}
+}
+
+// attachmentErrorStatus は添付ファイルのエラーのステータスコードを返します
+func attachmentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, model.ErrAttachmentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, model.ErrAttachmentTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, model.ErrAttachmentForbidden), errors.Is(err, model.ErrAttachmentLinkInvalid):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func attachmentError(c echo.Context, err error) error {
+	wrappedErr := xerrors.Errorf(": %w", err)
+	log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+	return c.JSON(attachmentErrorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+}
+
+// user は X-User-ID のユーザーを返します (admin の場合は管理者でなければレスポンスを書き込んで ok=false を返す)
+func (h *attachmentHander) user(c echo.Context, admin bool) (uid int, ok bool, err error) {
+	uid, cerr := strconv.Atoi(c.Request().Header.Get("X-User-ID"))
+	if cerr != nil {
+		return 0, false, c.JSON(http.StatusUnauthorized, map[string]string{"error": "User ID not found"})
+	}
+	if !admin {
+		return uid, true, nil
+	}
+	isAdmin, aerr := h.serv.IsAdmin(uid)
+	if aerr != nil {
+		return 0, false, attachmentError(c, aerr)
+	}
+	if !isAdmin {
+		return 0, false, c.JSON(http.StatusForbidden, map[string]string{"error": "admin only"})
+	}
+	return uid, true, nil
+}
+
+// attachmentParams は questionID と attachmentID (names で指定したもの) を返します
+func attachmentParams(c echo.Context, names ...string) ([]int, bool) {
+	ids := []int{}
+	for _, p := range names {
+		id, err := strconv.Atoi(c.Param(p))
+		if err != nil {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// UploadAttachment は multipart の file を問題の添付ファイルにします (管理者のみ)
+// 名前は name クエリ、省略時はアップロードしたファイル名。大きなファイルを読み込まないようにパートを順に読む
+func (h *attachmentHander) UploadAttachment(c echo.Context) error {
+	if _, ok, err := h.user(c, true); !ok {
+		return err
+	}
+	ids, ok := attachmentParams(c, "questionID")
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+	}
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return attachmentError(c, err)
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "error: file is required"})
+		}
+		if err != nil {
+			return attachmentError(c, err)
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		name := c.QueryParam("name")
+		if name == "" {
+			name = part.FileName()
+		}
+		a, err := h.serv.UploadAttachment(ids[0], name, part.Header.Get(echo.HeaderContentType), part)
+		part.Close()
+		if err != nil {
+			return attachmentError(c, err)
+		}
+		return c.JSON(http.StatusCreated, a)
+	}
+}
+
+// GetAttachments は問題の添付ファイルの一覧を返します (管理者か問題を含むコンテストのチームのみ)
+func (h *attachmentHander) GetAttachments(c echo.Context) error {
+	uid, ok, err := h.user(c, false)
+	if !ok {
+		return err
+	}
+	ids, ok := attachmentParams(c, "questionID")
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+	}
+	as, err := h.serv.GetAttachments(uid, ids[0])
+	if err != nil {
+		return attachmentError(c, err)
+	}
+	return c.JSON(http.StatusOK, as)
+}
+
+func (h *attachmentHander) DeleteAttachment(c echo.Context) error {
+	if _, ok, err := h.user(c, true); !ok {
+		return err
+	}
+	ids, ok := attachmentParams(c, "questionID", "attachmentID")
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+	}
+	if err := h.serv.DeleteAttachment(ids[0], ids[1]); err != nil {
+		return attachmentError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "success delete attachment"})
+}
+
+// AttachmentLink は期限付きのダウンロードのリンクを返します
+func (h *attachmentHander) AttachmentLink(c echo.Context) error {
+	uid, ok, err := h.user(c, false)
+	if !ok {
+		return err
+	}
+	ids, ok := attachmentParams(c, "questionID", "attachmentID")
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error: param")})
+	}
+	link, err := h.serv.AttachmentLink(uid, ids[0], ids[1])
+	if err != nil {
+		return attachmentError(c, err)
+	}
+	return c.JSON(http.StatusOK, link)
+}
+
+// DownloadAttachment はリンクの token の添付ファイルを返します (リンクを発行したユーザーのみ)
+func (h *attachmentHander) DownloadAttachment(c echo.Context) error {
+	uid, ok, err := h.user(c, false)
+	if !ok {
+		return err
+	}
+	a, body, err := h.serv.OpenAttachment(uid, c.QueryParam("token"))
+	if err != nil {
+		return attachmentError(c, err)
+	}
+	defer body.Close()
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", a.Name))
+	res.Header().Set(echo.HeaderContentLength, strconv.FormatInt(a.Size, 10))
+	res.Header().Set("ETag", fmt.Sprintf("%q", a.SHA256))
+	res.Header().Set("X-Content-SHA256", a.SHA256)
+	res.Header().Set("Cache-Control", "private, no-store")
+	return c.Stream(http.StatusOK, a.ContentType, body)
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/LainInTheWired/ctf_backend/question/service"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+// maxChallengeSize は challenge.yml の大きさの上限です
+const maxChallengeSize = 1 << 20
+
+// ImportChallenge は challenge.yml (リクエストのボディ) の問題を作成または更新します (管理者の確認は AdminOnly で行う)
+// dry_run=1 の場合は確認だけして、作成・更新した場合の結果を返す
+func (h *quesionHander) ImportChallenge(c echo.Context) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxChallengeSize+1))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if len(body) > maxChallengeSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "error: challenge is too large"})
+	}
+	ch, err := service.ParseChallenge(body)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(ch); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+
+	res, err := h.serv.ImportChallenge(ch, c.QueryParam("dry_run") == "1")
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, model.ErrChallengeConflict) {
+			status = http.StatusConflict
+		}
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(status, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if res.Action == model.ChallengeCreated && !res.DryRun {
+		return c.JSON(http.StatusCreated, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
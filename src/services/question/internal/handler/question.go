@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -21,6 +22,9 @@ type QuesionHander interface {
 	DeleteVM(c echo.Context) error
 	GetQuesionIp(c echo.Context) error
 	UpdateQuestion(c echo.Context) error
+	GetQuestionVMs(c echo.Context) error
+	SetQuestionVMs(c echo.Context) error
+	ImportChallenge(c echo.Context) error
 }
 
 type quesionHander struct {
@@ -41,12 +45,30 @@ type quesionRequest struct {
 	IP          string   `json:"ip,omitempty" validate:"omitempty,cidr"`
 	Gateway     string   `json:"gateway,omitempty" validate:"omitempty,ip"`
 	Filename    string   `json:"filename"`
+	Bridge      string   `json:"bridge,omitempty" validate:"omitempty,alphanum,max=8"`
+	Ports       []string `json:"ports,omitempty" validate:"omitempty,dive,port"`
+	// qemu (VM) または lxc (コンテナ)
+	Backend string `json:"backend,omitempty" validate:"omitempty,oneof=qemu lxc"`
+	// クローン元のテンプレート (template サービスの ID、問題の作成のみ)
+	TemplateID int `json:"template_id,omitempty"`
+	// コンテストのインスタンスとしてクローンする場合に VM のタグとプールに使う
+	ContestID  int    `json:"contest_id,omitempty"`
+	TeamID     int    `json:"team_id,omitempty"`
+	QuestionID int    `json:"question_id,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Pool       string `json:"pool,omitempty"`
+	// 複数の VM の問題で VM ごとに渡す cloud-init の設定
+	Cloudinit json.RawMessage `json:"cloudinit,omitempty"`
 }
 
 type updateQuestion struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	Answer      string `json:"answer"`
+	// 正解のフラグ (省略した場合は answer だけを正解にする)
+	Flags []string `json:"flags" validate:"omitempty,dive,required"`
+	// 省略した場合は公開しているポートを変えない (空の配列で消す)
+	Ports *[]string `json:"ports" validate:"omitempty,dive,port"`
 }
 type QuestionsInContestRequest struct {
 	ContestID int `json:"contest_id"`
@@ -93,6 +115,9 @@ func (h *quesionHander) CreateQuestion(c echo.Context) error {
 		Gateway:     req.Gateway,
 		Username:    req.Username,
 		Password:    req.Password,
+		Ports:       req.Ports,
+		Backend:     req.Backend,
+		TemplateID:  req.TemplateID,
 	}
 
 	if err := h.serv.CreateQuestion(m); err != nil {
@@ -207,14 +232,22 @@ func (h *quesionHander) CloneQuestion(c echo.Context) error {
 		IP:          req.IP,
 		Password:    req.Password,
 		Gateway:     req.Gateway,
+		Bridge:      req.Bridge,
+		ContestID:   req.ContestID,
+		TeamID:      req.TeamID,
+		QuestionID:  req.QuestionID,
+		CreatedBy:   req.CreatedBy,
+		Pool:        req.Pool,
+		Backend:     req.Backend,
+		Cloudinit:   req.Cloudinit,
 	}
-	vmid, err := h.serv.CloneQuestion(m)
+	vm, err := h.serv.CloneQuestion(m)
 	if err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
-	return c.JSON(http.StatusAccepted, map[string]int{"data": vmid})
+	return c.JSON(http.StatusAccepted, vm)
 }
 
 func (h *quesionHander) GetQuesionByID(c echo.Context) error {
@@ -256,7 +289,8 @@ func (h *quesionHander) DeleteVM(c echo.Context) error {
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
 	}
-	if err := h.serv.DeleteVM(id); err != nil {
+	// ?cluster= は VM があるクラスタ (省略時は pveapi のデフォルト)
+	if err := h.serv.DeleteVM(c.QueryParam("cluster"), id); err != nil {
 		wrappedErr := xerrors.Errorf(": %w", err)
 		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
@@ -307,6 +341,10 @@ func (h *quesionHander) UpdateQuestion(c echo.Context) error {
 		Name:        req.Name,
 		Description: req.Description,
 		Answer:      req.Answer,
+		Flags:       req.Flags,
+	}
+	if req.Ports != nil {
+		q.Ports = append([]string{}, *req.Ports...)
 	}
 
 	if err := h.serv.UpdateQuestion(q); err != nil {
@@ -316,3 +354,42 @@ func (h *quesionHander) UpdateQuestion(c echo.Context) error {
 	}
 	return c.JSON(http.StatusAccepted, map[string]string{"message": "success update question"})
 }
+
+func (h *quesionHander) GetQuestionVMs(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("questionID"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	vms, err := h.serv.GetQuestionVMs(id)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, vms)
+}
+
+// SetQuestionVMs は問題を構成する VM の一覧を置き換えます
+// 空の一覧を送ると questions.vmid の VM 1 台の問題に戻る
+func (h *quesionHander) SetQuestionVMs(c echo.Context) error {
+	var req []model.QuestionVM
+	id, err := strconv.Atoi(c.Param("questionID"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if err := h.serv.SetQuestionVMs(id, req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "success update question vms"})
+}
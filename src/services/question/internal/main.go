@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"database/sql"
 	"fmt"
@@ -10,11 +11,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/LainInTheWired/ctf_backend/question/handler"
+	"github.com/LainInTheWired/ctf_backend/question/model"
 	"github.com/LainInTheWired/ctf_backend/question/repository"
 	"github.com/LainInTheWired/ctf_backend/question/service"
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
 	myvalidator "github.com/LainInTheWired/ctf_backend/shared/pkg/validator"
 	"github.com/joho/godotenv"
 	"golang.org/x/xerrors"
@@ -95,6 +100,10 @@ func (a *MiddlewareTransport) RoundTrip(req *http.Request) (*http.Response, erro
 // logBody はリクエストボディをログに出力するミドルウェアです
 func logBody(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		// 添付ファイルのアップロードはボディが大きいので出力しない
+		if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+			return next(c)
+		}
 		buf, _ := io.ReadAll(c.Request().Body)
 		c.Logger().Info(string(buf))
 		c.Request().Body = io.NopCloser(bytes.NewBuffer(buf))
@@ -102,7 +111,7 @@ func logBody(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 func NewDBClient() (*sql.DB, error) {
-	db, err := sql.Open("mysql", fmt.Sprintf("user:user@tcp(%s:3306)/ctf", os.Getenv("MYSQL_URL")))
+	db, err := sql.Open("mysql", fmt.Sprintf("user:user@tcp(%s:3306)/ctf?parseTime=true", os.Getenv("MYSQL_URL")))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -113,6 +122,51 @@ func NewDBClient() (*sql.DB, error) {
 	return db, nil
 }
 
+// NewAttachmentStore は ATTACHMENT_STORE (local または s3) の添付ファイルのストレージを作ります
+func NewAttachmentStore() (repository.AttachmentStore, error) {
+	switch os.Getenv("ATTACHMENT_STORE") {
+	case "", "local":
+		dir := os.Getenv("ATTACHMENT_DIR")
+		if dir == "" {
+			dir = "/attachments"
+		}
+		return repository.NewLocalAttachmentStore(dir), nil
+	case "s3":
+		return repository.NewS3AttachmentStore(&http.Client{}, repository.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+	}
+	return nil, xerrors.Errorf("unknown ATTACHMENT_STORE %q", os.Getenv("ATTACHMENT_STORE"))
+}
+
+// NewAttachmentConfig は添付ファイルの大きさの上限とリンクの設定を環境変数から読みます
+func NewAttachmentConfig() *model.AttachmentConfig {
+	conf := &model.AttachmentConfig{
+		MaxSize: 100 << 20,
+		LinkTTL: 5 * time.Minute,
+		Secret:  []byte(os.Getenv("ATTACHMENT_SECRET")),
+	}
+	if mb, err := strconv.ParseInt(os.Getenv("ATTACHMENT_MAX_SIZE"), 10, 64); err == nil && mb > 0 {
+		conf.MaxSize = mb << 20
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("ATTACHMENT_LINK_TTL")); err == nil && ttl > 0 {
+		conf.LinkTTL = ttl
+	}
+	// 鍵がない場合は起動ごとに作る (再起動すると発行済みのリンクは使えなくなる)
+	if len(conf.Secret) == 0 {
+		conf.Secret = make([]byte, 32)
+		if _, err := rand.Read(conf.Secret); err != nil {
+			log.Fatal(err)
+		}
+		echoLog.Warn("ATTACHMENT_SECRET is not set; download links are invalidated on restart")
+	}
+	return conf
+}
+
 func NewRedisClient() (*redis.Client, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr:     "redis:6379",
@@ -196,16 +250,35 @@ func main() {
 	mr := repository.NewMysqlRepository(db)
 	pr := repository.NewPVEAPIRepository(client, os.Getenv("PVEAPI_URL"))
 	ter := repository.NewTeamRepository(client, os.Getenv("TEAM_URL"))
+	tpr := repository.NewTemplateRepository(client, os.Getenv("TEMPLATE_URL"))
+
+	store, err := NewAttachmentStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	as := service.NewAttachmentService(mr, store, role.NewRoleRepository(reddb), NewAttachmentConfig())
+	ah := handler.NewAttachmentHander(as)
 
-	s := service.NewQuestionService(mr, pr, ter)
+	s := service.NewQuestionService(mr, pr, ter, tpr, as)
 	h := handler.NewQuestionHander(s)
 
 	fmt.Println(client)
 	e.GET("/swagger/*", echoSwagger.WrapHandler)
 
 	e.POST("/question", h.CreateQuestion)
+	// challenge.yml のインポート (cmd/challenge の sync が使う、管理者のみ)
+	e.POST("/question/import", h.ImportChallenge, handler.AdminOnly(as))
 	e.DELETE("/question/:questionID", h.DeleteQuestion)
 	e.PUT("/question/:questionID", h.UpdateQuestion)
+	e.GET("/question/:questionID/vms", h.GetQuestionVMs)
+	e.PUT("/question/:questionID/vms", h.SetQuestionVMs)
+
+	// 問題の添付ファイル (アップロードと削除は管理者のみ、ダウンロードは期限付きのリンクで行う)
+	e.POST("/question/:questionID/attachments", ah.UploadAttachment)
+	e.GET("/question/:questionID/attachments", ah.GetAttachments)
+	e.DELETE("/question/:questionID/attachments/:attachmentID", ah.DeleteAttachment)
+	e.POST("/question/:questionID/attachments/:attachmentID/link", ah.AttachmentLink)
+	e.GET("/question/attachments/download", ah.DownloadAttachment)
 
 	e.GET("/question/:id", h.GetQuestionsInContest)
 	e.GET("/question", h.GetQuestions)
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+var (
+	// ErrAttachmentNotFound は添付ファイルがない場合のエラーです
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	// ErrAttachmentTooLarge は添付ファイルが AttachmentConfig.MaxSize を超えた場合のエラーです
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	// ErrAttachmentForbidden は問題を含むコンテストに参加していないユーザーが添付ファイルを求めた場合のエラーです
+	ErrAttachmentForbidden = errors.New("attachment is not available to the user")
+	// ErrAttachmentLinkInvalid はダウンロードのリンクの署名が合わないか期限が切れた場合のエラーです
+	ErrAttachmentLinkInvalid = errors.New("attachment link is invalid or expired")
+)
+
+// AttachmentConfig は添付ファイルの設定です
+type AttachmentConfig struct {
+	// 1 ファイルの大きさの上限 (byte)
+	MaxSize int64
+	// ダウンロードのリンクの有効期間
+	LinkTTL time.Duration
+	// ダウンロードのリンクに署名する鍵
+	Secret []byte
+}
+
+// Attachment は問題の添付ファイル (pcap やバイナリなど) です
+type Attachment struct {
+	ID         int    `json:"id"`
+	QuestionID int    `json:"question_id"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	// 中身の SHA-256 (hex)
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type"`
+	// ストレージ (ローカルのディレクトリまたは S3 のバケット) でのキー
+	StorageKey string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// AttachmentLink は添付ファイルの期限付きのダウンロードのリンクです
+type AttachmentLink struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,76 @@
+package model
+
+import "github.com/cockroachdb/errors"
+
+// ChallengeFilename は問題のパッケージのディレクトリに置く定義のファイル名です
+const ChallengeFilename = "challenge.yml"
+
+// ChallengeVersion は challenge.yml の形式のバージョンです
+const ChallengeVersion = 1
+
+// インポートの結果
+const (
+	ChallengeCreated = "created"
+	ChallengeUpdated = "updated"
+)
+
+// ErrChallengeConflict はインポートでは変えられない項目が既存の問題と違う場合のエラーです
+var ErrChallengeConflict = errors.New("challenge conflicts with existing question")
+
+// Challenge は challenge.yml の問題の定義です (形式は docs/challenge.md)
+type Challenge struct {
+	Version     int    `yaml:"version" json:"version" validate:"required"`
+	Name        string `yaml:"name" json:"name" validate:"required,max=255"`
+	Category    string `yaml:"category" json:"category" validate:"required,max=255"`
+	Description string `yaml:"description" json:"description"`
+	// コンテストに追加するときのデフォルトの点数
+	Points int      `yaml:"points" json:"points" validate:"min=0"`
+	Flags  []string `yaml:"flags" json:"flags" validate:"required,min=1,dive,required"`
+	Hints  []Hint   `yaml:"hints,omitempty" json:"hints,omitempty" validate:"dive"`
+	// 配布するファイル (パッケージのディレクトリからの相対パス)
+	Files []string `yaml:"files,omitempty" json:"files,omitempty" validate:"dive,required"`
+	// クローン元のテンプレートの名前 (name@version で version を固定する、省略時は最新)
+	Template  string             `yaml:"template" json:"template" validate:"required"`
+	Resources ChallengeResources `yaml:"resources,omitempty" json:"resources,omitempty"`
+	// 問題の VM の cloud-init の設定 (pveapi の CloudinitConfig、問題を作るときのみ使う)
+	Cloudinit map[string]any `yaml:"cloudinit,omitempty" json:"cloudinit,omitempty"`
+	// 公開するポート (例: 22/tcp, 80, icmp)
+	Ports       []string     `yaml:"ports,omitempty" json:"ports,omitempty" validate:"dive,port"`
+	Healthcheck *Healthcheck `yaml:"healthcheck,omitempty" json:"healthcheck,omitempty"`
+}
+
+// Hint は問題のヒントです (cost はヒントを見たときに引く点数)
+type Hint struct {
+	Text string `yaml:"text" json:"text" validate:"required"`
+	Cost int    `yaml:"cost,omitempty" json:"cost,omitempty" validate:"min=0"`
+}
+
+// ChallengeResources は問題の VM のリソースです (0 の場合はテンプレートのまま)
+type ChallengeResources struct {
+	CPUs   int `yaml:"cpu,omitempty" json:"cpu,omitempty" validate:"min=0"`
+	Memory int `yaml:"memory,omitempty" json:"memory,omitempty" validate:"min=0"` // MB
+	Disk   int `yaml:"disk,omitempty" json:"disk,omitempty" validate:"min=0"`     // GB
+}
+
+// Healthcheck は問題の VM が動いているかを確認する方法です
+type Healthcheck struct {
+	// ports のどれか (例: 80/tcp)
+	Port string `yaml:"port" json:"port" validate:"required,port"`
+	// tcp は接続できるか、http は path が 2xx / 3xx を返すかを確認する
+	Type     string `yaml:"type,omitempty" json:"type,omitempty" validate:"omitempty,oneof=tcp http"`
+	Path     string `yaml:"path,omitempty" json:"path,omitempty"`
+	Interval int    `yaml:"interval,omitempty" json:"interval,omitempty" validate:"min=0"` // 秒
+	Timeout  int    `yaml:"timeout,omitempty" json:"timeout,omitempty" validate:"min=0"`   // 秒
+}
+
+// ChallengeImport は POST /question/import の結果です
+type ChallengeImport struct {
+	QuestionID int    `json:"question_id,omitempty"`
+	Name       string `json:"name"`
+	// created または updated (dry_run の場合はインポートした場合の結果)
+	Action     string `json:"action"`
+	TemplateID int    `json:"template_id"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+	// 更新では反映されない challenge.yml の項目 (VM は作り直さないため)
+	Ignored []string `json:"ignored,omitempty"`
+}
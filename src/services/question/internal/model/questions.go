@@ -1,8 +1,24 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type PveapiResponse[T any] struct {
 	Data  string `json:"data"`
 	Error string `json:"error"`
+	// VM を作成したクラスタとゲストの種類 (POST /vm のみ)
+	Cluster string `json:"cluster,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+// ClonedVM は CloneQuestion でクローンした VM です
+type ClonedVM struct {
+	VMID    int    `json:"data"`
+	Cluster string `json:"cluster"`
+	// qemu / lxc。コンテナには cloud-init のパスワードが設定されない
+	Type string `json:"type"`
 }
 
 type Question struct {
@@ -11,16 +27,54 @@ type Question struct {
 	CategoryId   int    `json:"category_id"`
 	Description  string `json:"description"`
 	VMID         int    `json:"vmid"`
+	ClusterID    string `json:"cluster_id"` // VM がある Proxmox のクラスタ
+	Backend      string `json:"backend"`    // qemu または lxc
 	Env          string `json:"env"`
 	Answer       string `json:"answer"`
 	CategoryName string `json:"category_name"`
 	Point        int    `json:"point"`
+	// 公開するポート (例: 22/tcp, 80/tcp)
+	Ports []string `json:"ports"`
+	// 問題を作ったテンプレート (template サービスの ID、テンプレートを使わない問題は 0)
+	TemplateID int `json:"template_id,omitempty"`
+	// 正解のフラグ (Answer は最初のフラグ)
+	Flags       []string     `json:"flags,omitempty"`
+	Hints       []Hint       `json:"hints,omitempty"`
+	Files       []string     `json:"files,omitempty"`
+	Healthcheck *Healthcheck `json:"healthcheck,omitempty"`
 }
+
+// QuestionVM は複数の VM で構成する問題の VM 1 台分の設定です
+type QuestionVM struct {
+	QuestionID int    `json:"question_id"`
+	Role       string `json:"role"`
+	// クローン元のテンプレート (VMID はテンプレートの VM から決める)
+	TemplateID int `json:"template_id"`
+	VMID       int `json:"vmid"`
+	CPUs       int `json:"cpu,omitempty"`
+	Memory     int `json:"memory,omitempty"`
+	Disk       int `json:"disk,omitempty"`
+	// VM ごとの cloud-init の設定 (pveapi の CloudinitConfig の JSON)
+	Cloudinit json.RawMessage `json:"cloudinit,omitempty"`
+}
+
 type Category struct {
 	ID   int
 	Name string
 }
+
+// Template は template サービスのテンプレートのうち問題の作成に使う項目です
 type Template struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Version   int        `json:"version"`
+	VMID      int        `json:"vmid"`
+	ClusterID string     `json:"cluster_id"`
+	Backend   string     `json:"backend"`
+	CPUs      int        `json:"cpu"`
+	Memory    int        `json:"memory"`
+	Disk      int        `json:"disk"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
 }
 type CreateQuestion struct {
 	ID          int      `json:"id"`
@@ -37,6 +91,20 @@ type CreateQuestion struct {
 	CategoryId  int      `json:"category_id"`
 	Username    string   `json:"username"`
 	Password    string   `json:"password"`
+	Bridge      string   `json:"bridge"`
+	Ports       []string `json:"ports"`
+	// コンテストのインスタンスの場合のみ
+	ContestID  int    `json:"contest_id"`
+	TeamID     int    `json:"team_id"`
+	QuestionID int    `json:"question_id"`
+	CreatedBy  string `json:"created_by"`
+	Pool       string `json:"pool"`
+	// qemu または lxc (省略時は qemu)
+	Backend string `json:"backend"`
+	// クローン元のテンプレート (template サービスの ID)
+	TemplateID int `json:"template_id"`
+	// VM ごとの cloud-init の設定 (複数の VM の問題のみ)
+	Cloudinit json.RawMessage `json:"cloudinit,omitempty"`
 }
 
 type CreateVM struct {
@@ -48,6 +116,17 @@ type CreateVM struct {
 	Disk     int    `json:"disk"`
 	Cicustom string `json:"cicustom"`
 	CPU      int    `json:"cpu"`
+	Bridge   string `json:"bridge,omitempty"`
+	// VM のタグ (pveapi が ctf-contest-1 などに変換する)
+	ContestID  int    `json:"contest_id,omitempty"`
+	TeamID     int    `json:"team_id,omitempty"`
+	QuestionID int    `json:"question_id,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Pool       string `json:"pool,omitempty"`
+	// テンプレートの種類 qemu または lxc (省略時は pveapi がテンプレートに合わせる)
+	Backend string `json:"backend,omitempty"`
+	// クローン元のテンプレートがあるクラスタ (クエリで渡す、空の場合は pveapi が選ぶ)
+	Cluster string `json:"-"`
 }
 
 type CloudinitResponse struct {
@@ -57,6 +136,8 @@ type CloudinitResponse struct {
 	Username  string   `json:"username"`
 	Password  string   `json:"passwd"`
 	SshPwauth string   `json:"ssh_pwauth"`
+	// 問題ごとのベースの設定 (hostname やユーザーはこれを上書きする)
+	Base json.RawMessage `json:"base,omitempty"`
 }
 
 type Point struct {
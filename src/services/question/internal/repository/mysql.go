@@ -2,7 +2,8 @@ package repository
 
 import (
 	"database/sql"
-	"fmt"
+	"encoding/json"
+	"strings"
 
 	"github.com/cockroachdb/errors"
 
@@ -13,12 +14,34 @@ type mysqlRepository struct {
 	DB *sql.DB
 }
 type MysqlRepository interface {
-	InsertQuestion(q model.Question) error
+	// InsertQuestion は問題を登録して ID を返します
+	InsertQuestion(q model.Question) (int, error)
 	DeleteQuestion(qid int) error
 	SelectContestQuestionsByContestID(contestID int) ([]model.Question, error)
 	SelectContestQuestions() ([]model.Question, error)
 	SelectQuesionByQuestionID(qid int) (model.Question, error)
+	// UpdateQuestion は q.Ports が nil の場合は ports を変えません (flags は常に q.Flags にする)
 	UpdateQuestion(q model.Question) error
+	SelectQuestionVMs(qid int) ([]model.QuestionVM, error)
+	// ReplaceQuestionVMs は問題の VM の設定を vms で置き換えます (空の場合は VM 1 台の問題に戻す)
+	ReplaceQuestionVMs(qid int, vms []model.QuestionVM) error
+	// SelectQuestionIDByName は name の問題の ID を返します (ない場合は 0)
+	SelectQuestionIDByName(name string) (int, error)
+	// SelectCategoryIDByName は name のカテゴリの ID を返します (ない場合は 0)
+	SelectCategoryIDByName(name string) (int, error)
+	InsertCategory(name string) (int, error)
+	// UpdateQuestionChallenge は challenge.yml でインポートした項目を更新します
+	UpdateQuestionChallenge(q model.Question) error
+	SelectAttachments(qid int) ([]model.Attachment, error)
+	// SelectAttachment は添付ファイルを返します (ない場合は model.ErrAttachmentNotFound)
+	SelectAttachment(id int) (*model.Attachment, error)
+	// UpsertAttachment は添付ファイルを登録して ID を返します (問題に同じ名前のファイルがある場合は置き換える)
+	UpsertAttachment(a model.Attachment) (int, error)
+	DeleteAttachment(id int) error
+	// CountAttachmentsByKey は storage_key を使っている添付ファイルの数を返します
+	CountAttachmentsByKey(key string) (int, error)
+	// UserHasQuestion は uid のチームが qid を含む始まったコンテストに参加しているかを返します
+	UserHasQuestion(uid, qid int) (bool, error)
 }
 
 func NewMysqlRepository(db *sql.DB) MysqlRepository {
@@ -27,21 +50,54 @@ func NewMysqlRepository(db *sql.DB) MysqlRepository {
 	}
 }
 
-func (m *mysqlRepository) InsertQuestion(q model.Question) error {
-	// emailが登録されているかチェック
-	ins, err := m.DB.Prepare("INSERT INTO questions (name,env,category_id,description,vmid) VALUES(?,?,?,?,?)")
+// jsonColumn は v を JSON の列の値にします (空の場合は NULL)
+func jsonColumn(v any, empty bool) (sql.NullString, error) {
+	if empty {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(v)
 	if err != nil {
-		return errors.Wrap(err, "question insert error")
+		return sql.NullString{}, errors.Wrap(err, "can't change json")
 	}
-	defer ins.Close()
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
 
-	fmt.Printf("INSERT INTO questions (name,env,category_id,describe,vmid) VALUES(%s,%s,%d,%s,%d)", q.Name, q.Env, q.CategoryId, q.Description, q.VMID)
+// challengeColumns は flags・hints・files・healthcheck の列の値を返します
+func challengeColumns(q model.Question) ([]any, error) {
+	flags, err := jsonColumn(q.Flags, len(q.Flags) == 0)
+	if err != nil {
+		return nil, err
+	}
+	hints, err := jsonColumn(q.Hints, len(q.Hints) == 0)
+	if err != nil {
+		return nil, err
+	}
+	files, err := jsonColumn(q.Files, len(q.Files) == 0)
+	if err != nil {
+		return nil, err
+	}
+	healthcheck, err := jsonColumn(q.Healthcheck, q.Healthcheck == nil)
+	if err != nil {
+		return nil, err
+	}
+	return []any{flags, hints, files, healthcheck}, nil
+}
 
-	_, err = ins.Exec(q.Name, q.Env, q.CategoryId, q.Description, q.VMID)
+func (m *mysqlRepository) InsertQuestion(q model.Question) (int, error) {
+	cols, err := challengeColumns(q)
 	if err != nil {
-		return errors.Wrap(err, "can't insert question")
+		return 0, err
 	}
-	return nil
+	args := append([]any{q.Name, q.Env, q.CategoryId, q.Description, q.VMID, q.ClusterID, q.Backend, strings.Join(q.Ports, ","), q.TemplateID, q.Answer, q.Point}, cols...)
+	res, err := m.DB.Exec("INSERT INTO questions (name,env,category_id,description,vmid,cluster_id,backend,ports,template_id,answer,point,flags,hints,files,healthcheck) VALUES(?,?,?,?,?,?,?,?,NULLIF(?,0),?,?,?,?,?,?)", args...)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't insert question")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get question id")
+	}
+	return int(id), nil
 }
 
 func (m *mysqlRepository) DeleteQuestion(qid int) error {
@@ -60,13 +116,24 @@ func (m *mysqlRepository) DeleteQuestion(qid int) error {
 }
 func (m *mysqlRepository) UpdateQuestion(q model.Question) error {
 	// emailが登録されているかチェック
-	ins, err := m.DB.Prepare("UPDATE questions SET name = ?, answer = ? , description = ? WHERE id =?")
+	// flags は毎回書き換える (空の場合は消して answer だけを正解にする)
+	flags, err := jsonColumn(q.Flags, len(q.Flags) == 0)
+	if err != nil {
+		return err
+	}
+	query := "UPDATE questions SET name = ?, answer = ? , description = ?, flags = ? WHERE id =?"
+	args := []any{q.Name, q.Answer, q.Description, flags, q.ID}
+	if q.Ports != nil {
+		query = "UPDATE questions SET name = ?, answer = ? , description = ?, flags = ?, ports = ? WHERE id =?"
+		args = []any{q.Name, q.Answer, q.Description, flags, strings.Join(q.Ports, ","), q.ID}
+	}
+	ins, err := m.DB.Prepare(query)
 	if err != nil {
 		return errors.Wrap(err, "contest_teams insert error")
 	}
 	defer ins.Close()
 
-	_, err = ins.Exec(q.Name, q.Answer, q.Description, q.ID)
+	_, err = ins.Exec(args...)
 	if err != nil {
 		return errors.Wrap(err, "can't insert contest_questions")
 	}
@@ -142,8 +209,8 @@ func (m *mysqlRepository) SelectPointsByConteastID(categoryID int) ([]model.Ques
 
 func (m *mysqlRepository) SelectQuesionByQuestionID(qid int) (model.Question, error) {
 	var quesion model.Question
-	var Ans sql.NullString
-	if err := m.DB.QueryRow("SELECT q.id,q.name,c.name,q.description,q.vmid,q.answer FROM questions as q JOIN category AS c ON c.id = q.category_id WHERE q.id = ?", qid).Scan(&quesion.ID, &quesion.Name, &quesion.CategoryName, &quesion.Description, &quesion.VMID, &Ans); err != nil {
+	var Ans, Ports, Flags, Hints, Files, Healthcheck sql.NullString
+	if err := m.DB.QueryRow("SELECT q.id,q.name,c.name,q.description,q.vmid,q.cluster_id,q.backend,q.answer,q.ports,COALESCE(q.template_id,0),q.point,q.flags,q.hints,q.files,q.healthcheck FROM questions as q JOIN category AS c ON c.id = q.category_id WHERE q.id = ?", qid).Scan(&quesion.ID, &quesion.Name, &quesion.CategoryName, &quesion.Description, &quesion.VMID, &quesion.ClusterID, &quesion.Backend, &Ans, &Ports, &quesion.TemplateID, &quesion.Point, &Flags, &Hints, &Files, &Healthcheck); err != nil {
 		if err == sql.ErrNoRows {
 			return model.Question{}, errors.Wrap(err, "not exist this id")
 		}
@@ -152,6 +219,19 @@ func (m *mysqlRepository) SelectQuesionByQuestionID(qid int) (model.Question, er
 	if Ans.Valid {
 		quesion.Answer = Ans.String
 	}
+	if Ports.Valid && Ports.String != "" {
+		quesion.Ports = strings.Split(Ports.String, ",")
+	}
+	for _, col := range []struct {
+		v   sql.NullString
+		out any
+	}{{Flags, &quesion.Flags}, {Hints, &quesion.Hints}, {Files, &quesion.Files}, {Healthcheck, &quesion.Healthcheck}} {
+		if col.v.Valid && col.v.String != "" {
+			if err := json.Unmarshal([]byte(col.v.String), col.out); err != nil {
+				return model.Question{}, errors.Wrap(err, "can't unmarshal question column")
+			}
+		}
+	}
 	return quesion, nil
 }
 
@@ -181,3 +261,189 @@ func (m *mysqlRepository) SelectContestQuestions() ([]model.Question, error) {
 
 	return questions, nil
 }
+
+func (m *mysqlRepository) SelectQuestionVMs(qid int) ([]model.QuestionVM, error) {
+	vms := []model.QuestionVM{}
+	rows, err := m.DB.Query("SELECT question_id,role,vmid,COALESCE(template_id,0),cpu,memory,disk,cloudinit FROM question_vms WHERE question_id = ? ORDER BY position, role", qid)
+	if err != nil {
+		return nil, errors.Wrap(err, "error select question_vms")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			vm        model.QuestionVM
+			Cloudinit sql.NullString
+		)
+		if err := rows.Scan(&vm.QuestionID, &vm.Role, &vm.VMID, &vm.TemplateID, &vm.CPUs, &vm.Memory, &vm.Disk, &Cloudinit); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		if Cloudinit.Valid && Cloudinit.String != "" {
+			vm.Cloudinit = json.RawMessage(Cloudinit.String)
+		}
+		vms = append(vms, vm)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return vms, nil
+}
+
+func (m *mysqlRepository) ReplaceQuestionVMs(qid int, vms []model.QuestionVM) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can't begin transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM question_vms WHERE question_id = ?", qid); err != nil {
+		return errors.Wrap(err, "can't delete question_vms")
+	}
+	for i, vm := range vms {
+		var cloudinit sql.NullString
+		if len(vm.Cloudinit) > 0 {
+			cloudinit = sql.NullString{String: string(vm.Cloudinit), Valid: true}
+		}
+		if _, err := tx.Exec("INSERT INTO question_vms (question_id,role,vmid,template_id,cpu,memory,disk,cloudinit,position) VALUES(?,?,?,NULLIF(?,0),?,?,?,?,?)", qid, vm.Role, vm.VMID, vm.TemplateID, vm.CPUs, vm.Memory, vm.Disk, cloudinit, i); err != nil {
+			return errors.Wrap(err, "can't insert question_vms")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "can't commit question_vms")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) SelectQuestionIDByName(name string) (int, error) {
+	rows, err := m.DB.Query("SELECT id FROM questions WHERE name = ?", name)
+	if err != nil {
+		return 0, errors.Wrap(err, "error select question")
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, errors.Wrap(err, "failed to scan row")
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "select errors")
+	}
+	// 名前で問題を特定するので同じ名前の問題があると更新できない
+	if len(ids) > 1 {
+		return 0, errors.Wrapf(model.ErrChallengeConflict, "%d questions are named %q", len(ids), name)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return ids[0], nil
+}
+
+func (m *mysqlRepository) SelectCategoryIDByName(name string) (int, error) {
+	var id int
+	if err := m.DB.QueryRow("SELECT id FROM category WHERE name = ?", name).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "can't select category")
+	}
+	return id, nil
+}
+
+func (m *mysqlRepository) InsertCategory(name string) (int, error) {
+	// 同時に作られた場合は既存のカテゴリの ID を返す
+	res, err := m.DB.Exec("INSERT INTO category (name) VALUES(?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)", name)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't insert category")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get category id")
+	}
+	return int(id), nil
+}
+
+func (m *mysqlRepository) UpdateQuestionChallenge(q model.Question) error {
+	cols, err := challengeColumns(q)
+	if err != nil {
+		return err
+	}
+	args := append([]any{q.CategoryId, q.Description, strings.Join(q.Ports, ","), q.Answer, q.Point}, cols...)
+	args = append(args, q.ID)
+	if _, err := m.DB.Exec("UPDATE questions SET category_id = ?, description = ?, ports = ?, answer = ?, point = ?, flags = ?, hints = ?, files = ?, healthcheck = ? WHERE id = ?", args...); err != nil {
+		return errors.Wrap(err, "can't update question")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) SelectAttachments(qid int) ([]model.Attachment, error) {
+	as := []model.Attachment{}
+	rows, err := m.DB.Query("SELECT id,question_id,name,size,sha256,content_type,storage_key,create_date FROM question_attachments WHERE question_id = ? ORDER BY name", qid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select question_attachments")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a model.Attachment
+		if err := rows.Scan(&a.ID, &a.QuestionID, &a.Name, &a.Size, &a.SHA256, &a.ContentType, &a.StorageKey, &a.CreatedAt); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		as = append(as, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return as, nil
+}
+
+func (m *mysqlRepository) SelectAttachment(id int) (*model.Attachment, error) {
+	var a model.Attachment
+	if err := m.DB.QueryRow("SELECT id,question_id,name,size,sha256,content_type,storage_key,create_date FROM question_attachments WHERE id = ?", id).Scan(&a.ID, &a.QuestionID, &a.Name, &a.Size, &a.SHA256, &a.ContentType, &a.StorageKey, &a.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Wrapf(model.ErrAttachmentNotFound, "attachment %d", id)
+		}
+		return nil, errors.Wrap(err, "can't select question_attachments")
+	}
+	return &a, nil
+}
+
+func (m *mysqlRepository) UpsertAttachment(a model.Attachment) (int, error) {
+	res, err := m.DB.Exec("INSERT INTO question_attachments (question_id,name,size,sha256,content_type,storage_key) VALUES(?,?,?,?,?,?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), size = VALUES(size), sha256 = VALUES(sha256), content_type = VALUES(content_type), storage_key = VALUES(storage_key)", a.QuestionID, a.Name, a.Size, a.SHA256, a.ContentType, a.StorageKey)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't insert question_attachments")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get attachment id")
+	}
+	return int(id), nil
+}
+
+func (m *mysqlRepository) DeleteAttachment(id int) error {
+	if _, err := m.DB.Exec("DELETE FROM question_attachments WHERE id = ?", id); err != nil {
+		return errors.Wrap(err, "can't delete question_attachments")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) CountAttachmentsByKey(key string) (int, error) {
+	var n int
+	if err := m.DB.QueryRow("SELECT COUNT(*) FROM question_attachments WHERE storage_key = ?", key).Scan(&n); err != nil {
+		return 0, errors.Wrap(err, "can't count question_attachments")
+	}
+	return n, nil
+}
+
+func (m *mysqlRepository) UserHasQuestion(uid, qid int) (bool, error) {
+	var n int
+	// 始まる前のコンテストの問題のファイルは配らない
+	if err := m.DB.QueryRow(`SELECT COUNT(*) FROM team_users AS tu
+		JOIN contest_teams AS ct ON ct.team_id = tu.team_id
+		JOIN contest_questions AS cq ON cq.contest_id = ct.contest_id
+		JOIN contests AS c ON c.id = ct.contest_id
+		WHERE tu.user_id = ? AND cq.question_id = ? AND c.start <= NOW()`, uid, qid).Scan(&n); err != nil {
+		return false, errors.Wrap(err, "can't select contest of question")
+	}
+	return n > 0, nil
+}
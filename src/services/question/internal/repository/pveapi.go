@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 
 	"github.com/LainInTheWired/ctf_backend/question/model"
 	"github.com/cockroachdb/errors"
@@ -19,8 +20,11 @@ type pveapiRepository struct {
 }
 type PVEAPIRepository interface {
 	Cloudinit(conf *model.CloudinitResponse) error
-	CreateVM(conf *model.CreateVM) (string, error)
-	DeleteVM(vmid int) error
+	// CreateVM は作成した VM の vmid と pveapi が選んだクラスタを返します
+	// CreateVM は VM をクローンして、vmid と置いたクラスタ、ゲストの種類を返します
+	CreateVM(conf *model.CreateVM) (*model.PveapiResponse[string], error)
+	// cluster が空の場合は pveapi のデフォルトのクラスタ
+	DeleteVM(cluster string, vmid int) error
 	GetIPByVMID(vmid int) (*model.ResponseIPs, error)
 }
 
@@ -76,20 +80,23 @@ func (r *pveapiRepository) Cloudinit(conf *model.CloudinitResponse) error {
 	return nil
 }
 
-func (r *pveapiRepository) CreateVM(conf *model.CreateVM) (string, error) {
+func (r *pveapiRepository) CreateVM(conf *model.CreateVM) (*model.PveapiResponse[string], error) {
 	// フォームデータの作成
 	endpoint := fmt.Sprintf("http://%s:8000/vm", r.URL)
+	if conf.Cluster != "" {
+		endpoint += "?cluster=" + url.QueryEscape(conf.Cluster)
+	}
 	// フォームデータの作成
 
 	jsend, err := json.Marshal(conf)
 	if err != nil {
-		return "", errors.Wrap(err, "can't change json")
+		return nil, errors.Wrap(err, "can't change json")
 	}
 
 	// 新しいPOSTリクエストの作成
 	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsend))
 	if err != nil {
-		return "", xerrors.Errorf("can't create http request: %w", err)
+		return nil, xerrors.Errorf("can't create http request: %w", err)
 	}
 
 	// ヘッダーの設定
@@ -98,7 +105,7 @@ func (r *pveapiRepository) CreateVM(conf *model.CreateVM) (string, error) {
 	// リクエストの送信
 	resp, err := r.HTTPClient.Do(req)
 	if err != nil {
-		return "", xerrors.Errorf("fail http request: %w", err)
+		return nil, xerrors.Errorf("fail http request: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -111,19 +118,22 @@ func (r *pveapiRepository) CreateVM(conf *model.CreateVM) (string, error) {
 	// json.Unmarshalでデコード
 	var pveresp model.PveapiResponse[string]
 	if err := json.Unmarshal(body, &pveresp); err != nil {
-		return "", xerrors.Errorf("can't unmarshal response body: %w", err)
+		return nil, xerrors.Errorf("can't unmarshal response body: %w", err)
 	}
 
 	// エラーチェック
 	if resp.StatusCode >= 400 {
-		return "", xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
+		return nil, xerrors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, resp.Status)
 	}
-	return pveresp.Data, nil
+	return &pveresp, nil
 }
 
-func (r *pveapiRepository) DeleteVM(vmid int) error {
+func (r *pveapiRepository) DeleteVM(cluster string, vmid int) error {
 	// フォームデータの作成
 	endpoint := fmt.Sprintf("http://%s:8000/vm", r.URL)
+	if cluster != "" {
+		endpoint += "?cluster=" + url.QueryEscape(cluster)
+	}
 	// フォームデータの作成
 
 	conf := struct {
@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/cockroachdb/errors"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// AttachmentStore は添付ファイルの中身を置くストレージです
+// キーは英数字と / - _ . のみを使う (service が questions/<qid>/<sha256> の形で決める)
+type AttachmentStore interface {
+	// Put は r から size byte を読んで key に保存します (sum は中身の SHA-256 の hex)
+	Put(key string, r io.Reader, size int64, sum string, contentType string) error
+	// Get は key の中身を返します (ない場合は model.ErrAttachmentNotFound)
+	Get(key string) (io.ReadCloser, error)
+	// Delete は key を削除します (ない場合も成功にする)
+	Delete(key string) error
+}
+
+type localAttachmentStore struct {
+	dir string
+}
+
+// NewLocalAttachmentStore は dir (NFS のボリュームなど) にファイルとして保存するストレージを作ります
+func NewLocalAttachmentStore(dir string) AttachmentStore {
+	return &localAttachmentStore{
+		dir: dir,
+	}
+}
+
+func (l *localAttachmentStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", errors.Newf("invalid attachment key %q", key)
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(key)), nil
+}
+
+func (l *localAttachmentStore) Put(key string, r io.Reader, size int64, sum string, contentType string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return errors.Wrap(err, "can't create attachment directory")
+	}
+	// 書き込み中のファイルを読まれないように、一時ファイルに書いてから置き換える
+	f, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return errors.Wrap(err, "can't create attachment file")
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "can't write attachment file")
+	}
+	if n != size {
+		return errors.Newf("attachment size mismatch: wrote %d, want %d", n, size)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return errors.Wrap(err, "can't rename attachment file")
+	}
+	return nil
+}
+
+func (l *localAttachmentStore) Get(key string) (io.ReadCloser, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.Wrapf(model.ErrAttachmentNotFound, "attachment file %s", key)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open attachment file")
+	}
+	return f, nil
+}
+
+func (l *localAttachmentStore) Delete(key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.Wrap(err, "can't remove attachment file")
+	}
+	return nil
+}
+
+// S3Config は S3 互換のストレージ (MinIO など) の接続先です
+type S3Config struct {
+	// 例: http://minio:9000 (バケットはパスで指定する)
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+type s3AttachmentStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3AttachmentStore は S3 互換のストレージのバケットに保存するストレージを作ります
+// 署名などのプロトコルは minio-go に任せる (client の Transport を使う)
+func NewS3AttachmentStore(client *http.Client, conf S3Config) (AttachmentStore, error) {
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, errors.Newf("invalid S3 endpoint %q", conf.Endpoint)
+	}
+	cli, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, ""),
+		Secure:       u.Scheme == "https",
+		Region:       conf.Region,
+		BucketLookup: minio.BucketLookupPath,
+		Transport:    client.Transport,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create S3 client")
+	}
+	return &s3AttachmentStore{
+		client: cli,
+		bucket: conf.Bucket,
+	}, nil
+}
+
+func (s *s3AttachmentStore) Put(key string, r io.Reader, size int64, sum string, contentType string) error {
+	if _, err := s.client.PutObject(context.Background(), s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType}); err != nil {
+		return errors.Wrapf(err, "can't put object %s", key)
+	}
+	return nil
+}
+
+func (s *s3AttachmentStore) Get(key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't get object %s", key)
+	}
+	// GetObject はリクエストを遅らせるので、ない場合のエラーは Stat で確かめる
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, errors.Wrapf(model.ErrAttachmentNotFound, "object %s", key)
+		}
+		return nil, errors.Wrapf(err, "can't get object %s", key)
+	}
+	return obj, nil
+}
+
+func (s *s3AttachmentStore) Delete(key string) error {
+	// S3 はないオブジェクトの削除も成功にする
+	if err := s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{}); err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return errors.Wrapf(err, "can't delete object %s", key)
+	}
+	return nil
+}
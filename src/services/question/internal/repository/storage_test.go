@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/cockroachdb/errors"
+)
+
+// decodeAWSChunked は <大きさ (hex)>;chunk-signature=<署名>\r\n<データ>\r\n が続くボディからデータを取り出します
+func decodeAWSChunked(b []byte) []byte {
+	data := []byte{}
+	for {
+		line, rest, ok := bytes.Cut(b, []byte("\r\n"))
+		if !ok {
+			return data
+		}
+		size, _, _ := bytes.Cut(line, []byte(";"))
+		n, err := strconv.ParseInt(string(size), 16, 64)
+		if err != nil || n == 0 || int64(len(rest)) < n {
+			return data
+		}
+		data = append(data, rest[:n]...)
+		b = bytes.TrimPrefix(rest[n:], []byte("\r\n"))
+	}
+}
+
+func TestS3AttachmentStore(t *testing.T) {
+	objects := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") || r.Header.Get("X-Amz-Date") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/bucket/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch r.Method {
+		case http.MethodPut:
+			b, _ := io.ReadAll(r.Body)
+			if r.Header.Get("Content-Type") != "text/plain" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// http の場合 minio-go は aws-chunked で署名しながら送る
+			if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+				b = decodeAWSChunked(b)
+			}
+			objects[key] = string(b)
+		case http.MethodGet, http.MethodHead:
+			b, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			io.WriteString(w, b)
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewS3AttachmentStore(srv.Client(), S3Config{Endpoint: srv.URL + "/", Bucket: "bucket", AccessKey: "access", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("questions/1/abc", strings.NewReader("data"), 4, "sum", "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get("questions/1/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "data" {
+		t.Fatalf("got %q", b)
+	}
+	if err := s.Delete("questions/1/abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("questions/1/abc"); !errors.Is(err, model.ErrAttachmentNotFound) {
+		t.Fatalf("deleted object: got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/cockroachdb/errors"
+)
+
+type TemplateRepository interface {
+	GetTemplate(id int) (*model.Template, error)
+	// GetTemplates は name のテンプレートを新しい version から返します (退役したものも含める)
+	GetTemplates(name string) ([]model.Template, error)
+}
+
+type templateRepository struct {
+	HTTPClient *http.Client
+	URL        string
+}
+
+func NewTemplateRepository(h *http.Client, url string) TemplateRepository {
+	return &templateRepository{
+		HTTPClient: h,
+		URL:        url,
+	}
+}
+
+func (r *templateRepository) GetTemplate(id int) (*model.Template, error) {
+	var t model.Template
+	if err := r.get(fmt.Sprintf("http://%s:8000/template/%d", r.URL, id), &t); err != nil {
+		return nil, errors.Wrapf(err, "can't get template %d", id)
+	}
+	return &t, nil
+}
+
+func (r *templateRepository) GetTemplates(name string) ([]model.Template, error) {
+	var ts []model.Template
+	if err := r.get(fmt.Sprintf("http://%s:8000/template?all=1&name=%s", r.URL, url.QueryEscape(name)), &ts); err != nil {
+		return nil, errors.Wrapf(err, "can't get templates %s", name)
+	}
+	return ts, nil
+}
+
+func (r *templateRepository) get(endpoint string, out any) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return errors.Wrap(err, "can't create http request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "can't read response body")
+	}
+
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, string(body))
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return errors.Wrap(err, "can't unmarshal response body")
+	}
+	return nil
+}
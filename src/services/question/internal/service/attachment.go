@@ -0,0 +1,294 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/LainInTheWired/ctf_backend/question/repository"
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/gommon/log"
+)
+
+// attachmentNamePattern は添付ファイルの名前です (Content-Disposition にそのまま使える文字のみ)
+var attachmentNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,254}$`)
+
+// attachmentDownloadPath は期限付きのリンクでダウンロードするパスです
+const attachmentDownloadPath = "/question/attachments/download"
+
+// AttachmentService は問題の添付ファイルを管理し、コンテストに参加しているチームにだけ配ります
+// ダウンロードは期限付きで署名したリンクで行い、リンクは発行したユーザーのみ使える
+type AttachmentService interface {
+	IsAdmin(uid int) (bool, error)
+	// UploadAttachment は r の中身を qid の添付ファイル name として保存します (同じ名前のファイルは置き換える)
+	UploadAttachment(qid int, name string, contentType string, r io.Reader) (*model.Attachment, error)
+	GetAttachments(uid, qid int) ([]model.Attachment, error)
+	DeleteAttachment(qid, id int) error
+	// DeleteAttachments は qid の添付ファイルとそのオブジェクトをすべて消します (問題を消す前に呼ぶ)
+	DeleteAttachments(qid int) error
+	// AttachmentLink は uid が使えるダウンロードのリンクを発行します
+	AttachmentLink(uid, qid, id int) (*model.AttachmentLink, error)
+	// OpenAttachment はリンクの token を確かめて添付ファイルの中身を返します
+	OpenAttachment(uid int, token string) (*model.Attachment, io.ReadCloser, error)
+}
+
+type attachmentService struct {
+	myrepo   repository.MysqlRepository
+	store    repository.AttachmentStore
+	roleRepo role.RoleRepository
+	conf     *model.AttachmentConfig
+	now      func() time.Time
+}
+
+func NewAttachmentService(r repository.MysqlRepository, store repository.AttachmentStore, roleRepo role.RoleRepository, conf *model.AttachmentConfig) AttachmentService {
+	return &attachmentService{
+		myrepo:   r,
+		store:    store,
+		roleRepo: roleRepo,
+		conf:     conf,
+		now:      time.Now,
+	}
+}
+
+func (s *attachmentService) IsAdmin(uid int) (bool, error) {
+	return role.IsAdmin(s.roleRepo, uid)
+}
+
+// canRead は uid が qid の添付ファイルを見られるか (管理者か、問題を含むコンテストのチーム) を返します
+func (s *attachmentService) canRead(uid, qid int) error {
+	admin, err := s.IsAdmin(uid)
+	if err != nil {
+		return err
+	}
+	if admin {
+		return nil
+	}
+	ok, err := s.myrepo.UserHasQuestion(uid, qid)
+	if err != nil {
+		return errors.Wrap(err, "can't check contest of question")
+	}
+	if !ok {
+		return errors.Wrapf(model.ErrAttachmentForbidden, "user %d, question %d", uid, qid)
+	}
+	return nil
+}
+
+func (s *attachmentService) UploadAttachment(qid int, name string, contentType string, r io.Reader) (*model.Attachment, error) {
+	if !attachmentNamePattern.MatchString(name) {
+		return nil, errors.Newf("invalid attachment name %q: use letters, digits, '.', '-' and '_'", name)
+	}
+	if _, err := s.myrepo.SelectQuesionByQuestionID(qid); err != nil {
+		return nil, errors.Wrap(err, "can't select question")
+	}
+
+	// 大きさとハッシュを確かめてからストレージに置くため、いったん一時ファイルに書く
+	f, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create temp file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, s.conf.MaxSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read attachment")
+	}
+	if size > s.conf.MaxSize {
+		return nil, errors.Wrapf(model.ErrAttachmentTooLarge, "limit is %d bytes", s.conf.MaxSize)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "can't seek temp file")
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// 同じ中身のファイルは問題の中で 1 つのオブジェクトを共有する
+	a := model.Attachment{
+		QuestionID:  qid,
+		Name:        name,
+		Size:        size,
+		SHA256:      sum,
+		ContentType: contentType,
+		StorageKey:  fmt.Sprintf("questions/%d/%s", qid, sum),
+	}
+	if err := s.store.Put(a.StorageKey, f, size, sum, contentType); err != nil {
+		return nil, errors.Wrap(err, "can't put attachment")
+	}
+	as, err := s.myrepo.SelectAttachments(qid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select attachments")
+	}
+	old := ""
+	for _, cur := range as {
+		if cur.Name == name {
+			old = cur.StorageKey
+		}
+	}
+	id, err := s.myrepo.UpsertAttachment(a)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't insert attachment")
+	}
+	if old != "" && old != a.StorageKey {
+		s.deleteObject(old)
+	}
+	return s.myrepo.SelectAttachment(id)
+}
+
+func (s *attachmentService) GetAttachments(uid, qid int) ([]model.Attachment, error) {
+	if err := s.canRead(uid, qid); err != nil {
+		return nil, err
+	}
+	as, err := s.myrepo.SelectAttachments(qid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select attachments")
+	}
+	return as, nil
+}
+
+// attachment は qid の添付ファイル id を返します (別の問題のファイルの場合は model.ErrAttachmentNotFound)
+func (s *attachmentService) attachment(qid, id int) (*model.Attachment, error) {
+	a, err := s.myrepo.SelectAttachment(id)
+	if err != nil {
+		return nil, err
+	}
+	if a.QuestionID != qid {
+		return nil, errors.Wrapf(model.ErrAttachmentNotFound, "attachment %d of question %d", id, qid)
+	}
+	return a, nil
+}
+
+func (s *attachmentService) DeleteAttachment(qid, id int) error {
+	a, err := s.attachment(qid, id)
+	if err != nil {
+		return err
+	}
+	if err := s.myrepo.DeleteAttachment(id); err != nil {
+		return errors.Wrap(err, "can't delete attachment")
+	}
+	s.deleteObject(a.StorageKey)
+	return nil
+}
+
+func (s *attachmentService) DeleteAttachments(qid int) error {
+	as, err := s.myrepo.SelectAttachments(qid)
+	if err != nil {
+		return errors.Wrap(err, "can't get attachments")
+	}
+	// 同じオブジェクトを使う添付ファイルがあるので、行をすべて消してからオブジェクトを消す
+	keys := []string{}
+	for _, a := range as {
+		if err := s.myrepo.DeleteAttachment(a.ID); err != nil {
+			return errors.Wrap(err, "can't delete attachment")
+		}
+		if !slices.Contains(keys, a.StorageKey) {
+			keys = append(keys, a.StorageKey)
+		}
+	}
+	for _, key := range keys {
+		s.deleteObject(key)
+	}
+	return nil
+}
+
+// deleteObject はどの添付ファイルも使っていないオブジェクトを消します
+// 消せなくても添付ファイルの操作は成功しているので、ログに残すだけにする
+func (s *attachmentService) deleteObject(key string) {
+	n, err := s.myrepo.CountAttachmentsByKey(key)
+	if err != nil {
+		log.Warnf("can't count attachments of %s: %+v", key, err)
+		return
+	}
+	if n > 0 {
+		return
+	}
+	if err := s.store.Delete(key); err != nil {
+		log.Warnf("can't delete attachment object %s: %+v", key, err)
+	}
+}
+
+func (s *attachmentService) AttachmentLink(uid, qid, id int) (*model.AttachmentLink, error) {
+	if err := s.canRead(uid, qid); err != nil {
+		return nil, err
+	}
+	if _, err := s.attachment(qid, id); err != nil {
+		return nil, err
+	}
+	expires := s.now().Add(s.conf.LinkTTL).Truncate(time.Second)
+	payload := fmt.Sprintf("%d.%d.%d", id, uid, expires.Unix())
+	token := payload + "." + s.signature(payload)
+	return &model.AttachmentLink{
+		URL:       attachmentDownloadPath + "?token=" + url.QueryEscape(token),
+		ExpiresAt: expires,
+	}, nil
+}
+
+func (s *attachmentService) signature(payload string) string {
+	m := hmac.New(sha256.New, s.conf.Secret)
+	m.Write([]byte(payload))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// parseToken は <添付ファイルの ID>.<ユーザー ID>.<期限 (unix)>.<署名> の token を確かめます
+func (s *attachmentService) parseToken(uid int, token string) (int, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return 0, errors.Wrap(model.ErrAttachmentLinkInvalid, "malformed token")
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.signature(payload))) {
+		return 0, errors.Wrap(model.ErrAttachmentLinkInvalid, "bad signature")
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return 0, errors.Wrap(model.ErrAttachmentLinkInvalid, "malformed token")
+	}
+	nums := make([]int64, len(parts))
+	for j, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return 0, errors.Wrap(model.ErrAttachmentLinkInvalid, "malformed token")
+		}
+		nums[j] = n
+	}
+	if int(nums[1]) != uid {
+		return 0, errors.Wrapf(model.ErrAttachmentLinkInvalid, "link was issued to another user")
+	}
+	if !s.now().Before(time.Unix(nums[2], 0)) {
+		return 0, errors.Wrap(model.ErrAttachmentLinkInvalid, "link expired")
+	}
+	return int(nums[0]), nil
+}
+
+func (s *attachmentService) OpenAttachment(uid int, token string) (*model.Attachment, io.ReadCloser, error) {
+	id, err := s.parseToken(uid, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := s.myrepo.SelectAttachment(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := s.store.Get(a.StorageKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "can't get attachment")
+	}
+	return a, body, nil
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/LainInTheWired/ctf_backend/question/repository"
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
+	"github.com/cockroachdb/errors"
+)
+
+type fakeAttachmentMysql struct {
+	repository.MysqlRepository
+	attachments map[int]model.Attachment
+	// uid ごとに参加しているコンテストの問題
+	members map[int][]int
+}
+
+func (f *fakeAttachmentMysql) SelectQuesionByQuestionID(qid int) (model.Question, error) {
+	return model.Question{ID: qid}, nil
+}
+func (f *fakeAttachmentMysql) SelectAttachments(qid int) ([]model.Attachment, error) {
+	as := []model.Attachment{}
+	for _, a := range f.attachments {
+		if a.QuestionID == qid {
+			as = append(as, a)
+		}
+	}
+	return as, nil
+}
+func (f *fakeAttachmentMysql) SelectAttachment(id int) (*model.Attachment, error) {
+	a, ok := f.attachments[id]
+	if !ok {
+		return nil, model.ErrAttachmentNotFound
+	}
+	return &a, nil
+}
+func (f *fakeAttachmentMysql) UpsertAttachment(a model.Attachment) (int, error) {
+	for id, cur := range f.attachments {
+		if cur.QuestionID == a.QuestionID && cur.Name == a.Name {
+			a.ID = id
+			f.attachments[id] = a
+			return id, nil
+		}
+	}
+	a.ID = len(f.attachments) + 1
+	f.attachments[a.ID] = a
+	return a.ID, nil
+}
+func (f *fakeAttachmentMysql) DeleteAttachment(id int) error {
+	delete(f.attachments, id)
+	return nil
+}
+func (f *fakeAttachmentMysql) CountAttachmentsByKey(key string) (int, error) {
+	n := 0
+	for _, a := range f.attachments {
+		if a.StorageKey == key {
+			n++
+		}
+	}
+	return n, nil
+}
+func (f *fakeAttachmentMysql) UserHasQuestion(uid, qid int) (bool, error) {
+	for _, q := range f.members[uid] {
+		if q == qid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type fakeRoles map[int][]role.Role
+
+func (f fakeRoles) GetRoles(uid int) ([]role.Role, error) {
+	return f[uid], nil
+}
+
+func TestAttachment(t *testing.T) {
+	dir := t.TempDir()
+	db := &fakeAttachmentMysql{attachments: map[int]model.Attachment{}, members: map[int][]int{2: {1}}}
+	conf := &model.AttachmentConfig{MaxSize: 16, LinkTTL: time.Minute, Secret: []byte("secret")}
+	s := NewAttachmentService(db, repository.NewLocalAttachmentStore(dir), fakeRoles{1: {{ID: role.AdminRoleID}}}, conf).(*attachmentService)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	if _, err := s.UploadAttachment(1, "big.bin", "", strings.NewReader(strings.Repeat("x", 17))); !errors.Is(err, model.ErrAttachmentTooLarge) {
+		t.Fatalf("upload over the limit: got %v", err)
+	}
+	if _, err := s.UploadAttachment(1, "../evil", "", strings.NewReader("x")); err == nil {
+		t.Fatal("upload with a path in the name should fail")
+	}
+	a, err := s.UploadAttachment(1, "capture.pcap", "", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256("hello")
+	if a.Size != 5 || a.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected attachment: %+v", a)
+	}
+
+	// コンテストに参加していないユーザーにはリンクを出さない
+	if _, err := s.AttachmentLink(3, 1, a.ID); !errors.Is(err, model.ErrAttachmentForbidden) {
+		t.Fatalf("link for outsider: got %v", err)
+	}
+	if _, err := s.AttachmentLink(2, 2, a.ID); !errors.Is(err, model.ErrAttachmentForbidden) {
+		t.Fatalf("link for another question: got %v", err)
+	}
+	link, err := s.AttachmentLink(2, 1, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := u.Query().Get("token")
+
+	got, body, err := s.OpenAttachment(2, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(body)
+	body.Close()
+	if got.Name != "capture.pcap" || string(b) != "hello" {
+		t.Fatalf("unexpected download: %+v %q", got, b)
+	}
+
+	// 別のユーザー・書き換えた token・期限切れのリンクは使えない
+	if _, _, err := s.OpenAttachment(3, token); !errors.Is(err, model.ErrAttachmentLinkInvalid) {
+		t.Fatalf("link for another user: got %v", err)
+	}
+	if _, _, err := s.OpenAttachment(2, strings.Replace(token, "1.", "2.", 1)); !errors.Is(err, model.ErrAttachmentLinkInvalid) {
+		t.Fatalf("tampered link: got %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, _, err := s.OpenAttachment(2, token); !errors.Is(err, model.ErrAttachmentLinkInvalid) {
+		t.Fatalf("expired link: got %v", err)
+	}
+
+	// 同じ名前で置き換えると古いオブジェクトは消す
+	if _, err := s.UploadAttachment(1, "capture.pcap", "", strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	store := repository.NewLocalAttachmentStore(dir)
+	if _, err := store.Get(a.StorageKey); !errors.Is(err, model.ErrAttachmentNotFound) {
+		t.Fatalf("old object should be deleted: got %v", err)
+	}
+	if len(db.attachments) != 1 {
+		t.Fatalf("attachment should be replaced: %+v", db.attachments)
+	}
+}
+
+func TestDeleteAttachments(t *testing.T) {
+	dir := t.TempDir()
+	db := &fakeAttachmentMysql{attachments: map[int]model.Attachment{}}
+	conf := &model.AttachmentConfig{MaxSize: 16, LinkTTL: time.Minute, Secret: []byte("secret")}
+	s := NewAttachmentService(db, repository.NewLocalAttachmentStore(dir), fakeRoles{}, conf)
+
+	keys := []string{}
+	// 同じ中身のファイルは同じオブジェクトを使う
+	for _, up := range []struct {
+		qid        int
+		name, body string
+	}{{1, "a.txt", "hello"}, {1, "b.txt", "hello"}, {1, "c.txt", "world"}, {2, "a.txt", "hello"}} {
+		a, err := s.UploadAttachment(up.qid, up.name, "", strings.NewReader(up.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, a.StorageKey)
+	}
+	if err := s.DeleteAttachments(1); err != nil {
+		t.Fatal(err)
+	}
+	store := repository.NewLocalAttachmentStore(dir)
+	for _, key := range keys[:3] {
+		if _, err := store.Get(key); !errors.Is(err, model.ErrAttachmentNotFound) {
+			t.Errorf("object %s should be deleted: got %v", key, err)
+		}
+	}
+	// 別の問題の添付ファイルは残す
+	r, err := store.Get(keys[3])
+	if err != nil {
+		t.Fatalf("object of another question was deleted: %v", err)
+	}
+	r.Close()
+	if len(db.attachments) != 1 {
+		t.Errorf("attachments = %+v", db.attachments)
+	}
+}
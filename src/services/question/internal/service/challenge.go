@@ -0,0 +1,223 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/cockroachdb/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// challengeNamePattern は問題の名前です (VM のホスト名とスニペットのファイル名に使う)
+var challengeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// templateRefPattern はテンプレートの指定です (例: ubuntu-24.04, ubuntu-24.04@2)
+var templateRefPattern = regexp.MustCompile(`^([a-z0-9][a-z0-9._-]{0,63})(?:@([1-9][0-9]*))?$`)
+
+// ParseChallenge は challenge.yml を読み込みます
+// 書き間違いに気づけるように知らない項目はエラーにする
+func ParseChallenge(data []byte) (*model.Challenge, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var c model.Challenge
+	if err := dec.Decode(&c); err != nil {
+		return nil, errors.Wrap(err, "can't parse challenge")
+	}
+	return &c, nil
+}
+
+// LintChallenge は validate のタグで確認できない challenge.yml の項目を確認し、すべての問題をまとめて返します
+func LintChallenge(c *model.Challenge) error {
+	var errs []error
+	if c.Version != model.ChallengeVersion {
+		errs = append(errs, errors.Newf("unsupported version %d (want %d)", c.Version, model.ChallengeVersion))
+	}
+	if !challengeNamePattern.MatchString(c.Name) {
+		errs = append(errs, errors.Newf("invalid name %q: use lowercase letters, digits and hyphens", c.Name))
+	}
+	if !templateRefPattern.MatchString(c.Template) {
+		errs = append(errs, errors.Newf("invalid template %q: use name or name@version", c.Template))
+	}
+	flags := map[string]bool{}
+	for _, f := range c.Flags {
+		if flags[f] {
+			errs = append(errs, errors.Newf("duplicate flag %q", f))
+		}
+		flags[f] = true
+	}
+	for i, h := range c.Hints {
+		if h.Cost > c.Points {
+			errs = append(errs, errors.Newf("hint %d costs %d, more than points %d", i+1, h.Cost, c.Points))
+		}
+	}
+	files := map[string]bool{}
+	for _, f := range c.Files {
+		// パッケージの外のファイルは配布しない
+		if !filepath.IsLocal(filepath.FromSlash(f)) {
+			errs = append(errs, errors.Newf("file %q must be a relative path inside the package", f))
+		}
+		// 添付ファイルはファイル名 (ディレクトリを除いた部分) で登録する
+		name := path.Base(f)
+		if !attachmentNamePattern.MatchString(name) {
+			errs = append(errs, errors.Newf("file %q: name %q can't be an attachment name", f, name))
+		}
+		if files[name] {
+			errs = append(errs, errors.Newf("duplicate file name %q", name))
+		}
+		files[name] = true
+	}
+	if hc := c.Healthcheck; hc != nil {
+		found := false
+		for _, p := range c.Ports {
+			found = found || p == hc.Port
+		}
+		if !found {
+			errs = append(errs, errors.Newf("healthcheck port %s is not in ports", hc.Port))
+		}
+		if hc.Type == "http" && !strings.HasPrefix(hc.Path, "/") {
+			errs = append(errs, errors.New("http healthcheck needs a path starting with /"))
+		}
+		if hc.Type != "http" && hc.Path != "" {
+			errs = append(errs, errors.New("healthcheck path is only for http"))
+		}
+	}
+	if len(c.Cloudinit) > 0 {
+		if _, err := json.Marshal(c.Cloudinit); err != nil {
+			errs = append(errs, errors.Wrap(err, "cloudinit must be a mapping with string keys"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// splitTemplateRef はテンプレートの指定を名前と version に分けます (version の指定がない場合は 0)
+func splitTemplateRef(ref string) (string, int) {
+	m := templateRefPattern.FindStringSubmatch(ref)
+	if m == nil {
+		return ref, 0
+	}
+	version, _ := strconv.Atoi(m[2])
+	return m[1], version
+}
+
+// pickTemplate は新しい問題に使うテンプレートを選びます (version の指定がない場合は退役していない最新)
+func pickTemplate(ts []model.Template, name string, version int) (*model.Template, error) {
+	for i, t := range ts {
+		if version != 0 && t.Version == version {
+			return &ts[i], nil
+		}
+		if version == 0 && t.RetiredAt == nil {
+			return &ts[i], nil
+		}
+	}
+	if version != 0 {
+		return nil, errors.Newf("template %s@%d is not found", name, version)
+	}
+	return nil, errors.Newf("template %s has no active version", name)
+}
+
+func (s *quesionService) ImportChallenge(c *model.Challenge, dryRun bool) (*model.ChallengeImport, error) {
+	if err := LintChallenge(c); err != nil {
+		return nil, errors.Wrap(err, "invalid challenge")
+	}
+	name, version := splitTemplateRef(c.Template)
+	// GET /template は新しい version から返す
+	ts, err := s.temprepo.GetTemplates(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get templates")
+	}
+	qid, err := s.myrepo.SelectQuestionIDByName(c.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select question")
+	}
+
+	res := &model.ChallengeImport{QuestionID: qid, Name: c.Name, DryRun: dryRun}
+	var t *model.Template
+	if qid != 0 {
+		cur, err := s.myrepo.SelectQuesionByQuestionID(qid)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't select question")
+		}
+		// 作成済みの VM は作り直さないので、テンプレートは作成したときのものと同じでなければならない
+		for i := range ts {
+			if ts[i].ID == cur.TemplateID {
+				t = &ts[i]
+			}
+		}
+		if t == nil || (version != 0 && t.Version != version) {
+			return nil, errors.Wrapf(model.ErrChallengeConflict, "question %s was created from another template; delete it to change the template", c.Name)
+		}
+		res.Action = model.ChallengeUpdated
+		// VM の設定は問題を作るときにしか使わないので、指定されていれば反映されないことを返す
+		if c.Resources != (model.ChallengeResources{}) {
+			res.Ignored = append(res.Ignored, "resources")
+		}
+		if len(c.Cloudinit) > 0 {
+			res.Ignored = append(res.Ignored, "cloudinit")
+		}
+	} else {
+		if t, err = pickTemplate(ts, name, version); err != nil {
+			return nil, err
+		}
+		res.Action = model.ChallengeCreated
+	}
+	res.TemplateID = t.ID
+	if dryRun {
+		return res, nil
+	}
+
+	categoryID, err := s.myrepo.SelectCategoryIDByName(c.Category)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select category")
+	}
+	if categoryID == 0 {
+		if categoryID, err = s.myrepo.InsertCategory(c.Category); err != nil {
+			return nil, errors.Wrap(err, "can't create category")
+		}
+	}
+	ques := model.Question{
+		ID:          qid,
+		CategoryId:  categoryID,
+		Description: c.Description,
+		Ports:       c.Ports,
+		Answer:      c.Flags[0],
+		Flags:       c.Flags,
+		Point:       c.Points,
+		Hints:       c.Hints,
+		Files:       c.Files,
+		Healthcheck: c.Healthcheck,
+	}
+	if qid != 0 {
+		if err := s.myrepo.UpdateQuestionChallenge(ques); err != nil {
+			return nil, errors.Wrap(err, "can't update question")
+		}
+		return res, nil
+	}
+
+	var cloudinit json.RawMessage
+	if len(c.Cloudinit) > 0 {
+		if cloudinit, err = json.Marshal(c.Cloudinit); err != nil {
+			return nil, errors.Wrap(err, "can't change json")
+		}
+	}
+	cq := model.CreateQuestion{
+		Name:        c.Name,
+		Description: c.Description,
+		CategoryID:  categoryID,
+		CPUs:        c.Resources.CPUs,
+		Memory:      c.Resources.Memory,
+		Disk:        c.Resources.Disk,
+		Ports:       c.Ports,
+		TemplateID:  t.ID,
+		Cloudinit:   cloudinit,
+	}
+	if res.QuestionID, err = s.createQuestion(cq, ques); err != nil {
+		return nil, errors.Wrap(err, "can't create question")
+	}
+	return res, nil
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/LainInTheWired/ctf_backend/question/repository"
+	"github.com/cockroachdb/errors"
+)
+
+type fakeMysql struct {
+	repository.MysqlRepository
+	questions  []model.Question
+	categories []string
+	vms        map[int][]model.QuestionVM
+	insertErr  error
+}
+
+func (f *fakeMysql) InsertQuestion(q model.Question) (int, error) {
+	if f.insertErr != nil {
+		return 0, f.insertErr
+	}
+	q.ID = len(f.questions) + 1
+	f.questions = append(f.questions, q)
+	return q.ID, nil
+}
+func (f *fakeMysql) SelectQuesionByQuestionID(qid int) (model.Question, error) {
+	return f.questions[qid-1], nil
+}
+func (f *fakeMysql) SelectQuestionIDByName(name string) (int, error) {
+	for _, q := range f.questions {
+		if q.Name == name {
+			return q.ID, nil
+		}
+	}
+	return 0, nil
+}
+func (f *fakeMysql) SelectCategoryIDByName(name string) (int, error) {
+	for i, c := range f.categories {
+		if c == name {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+func (f *fakeMysql) InsertCategory(name string) (int, error) {
+	f.categories = append(f.categories, name)
+	return len(f.categories), nil
+}
+func (f *fakeMysql) ReplaceQuestionVMs(qid int, vms []model.QuestionVM) error {
+	if f.vms == nil {
+		f.vms = map[int][]model.QuestionVM{}
+	}
+	f.vms[qid] = vms
+	return nil
+}
+func (f *fakeMysql) UpdateQuestionChallenge(q model.Question) error {
+	cur := &f.questions[q.ID-1]
+	cur.CategoryId, cur.Description, cur.Ports = q.CategoryId, q.Description, q.Ports
+	cur.Answer, cur.Flags, cur.Point, cur.Hints, cur.Files, cur.Healthcheck = q.Answer, q.Flags, q.Point, q.Hints, q.Files, q.Healthcheck
+	return nil
+}
+func (f *fakeMysql) UpdateQuestion(q model.Question) error {
+	cur := &f.questions[q.ID-1]
+	cur.Name, cur.Description, cur.Answer, cur.Flags = q.Name, q.Description, q.Answer, q.Flags
+	return nil
+}
+
+type fakePVEAPI struct {
+	repository.PVEAPIRepository
+	cloudinits []*model.CloudinitResponse
+	vms        []*model.CreateVM
+	deleted    []int
+}
+
+func (f *fakePVEAPI) Cloudinit(conf *model.CloudinitResponse) error {
+	f.cloudinits = append(f.cloudinits, conf)
+	return nil
+}
+func (f *fakePVEAPI) CreateVM(conf *model.CreateVM) (*model.PveapiResponse[string], error) {
+	f.vms = append(f.vms, conf)
+	return &model.PveapiResponse[string]{Data: "200", Cluster: "cluster-a", Type: "qemu"}, nil
+}
+func (f *fakePVEAPI) DeleteVM(cluster string, vmid int) error {
+	f.deleted = append(f.deleted, vmid)
+	return nil
+}
+
+type fakeTemplates []model.Template
+
+func (f fakeTemplates) GetTemplate(id int) (*model.Template, error) {
+	for i := range f {
+		if f[i].ID == id {
+			return &f[i], nil
+		}
+	}
+	return nil, errors.Newf("template %d is not found", id)
+}
+func (f fakeTemplates) GetTemplates(name string) ([]model.Template, error) {
+	ts := []model.Template{}
+	for i := len(f) - 1; i >= 0; i-- {
+		if f[i].Name == name {
+			ts = append(ts, f[i])
+		}
+	}
+	return ts, nil
+}
+
+const webChallenge = `
+version: 1
+name: web-login
+category: web
+description: ログインを突破してください
+points: 100
+flags:
+  - flag{first}
+  - flag{second}
+hints:
+  - text: SQL
+    cost: 10
+files:
+  - dist/app.zip
+template: ubuntu-24.04
+resources:
+  cpu: 2
+cloudinit:
+  packages: [nginx]
+ports: [22/tcp, 80/tcp]
+healthcheck:
+  port: 80/tcp
+  type: http
+  path: /
+`
+
+func TestLintChallenge(t *testing.T) {
+	if _, err := ParseChallenge([]byte("version: 1\nnmae: typo\n")); err == nil {
+		t.Error("expected error for unknown field")
+	}
+	c, err := ParseChallenge([]byte(webChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LintChallenge(c); err != nil {
+		t.Fatalf("LintChallenge() = %v", err)
+	}
+
+	c.Name = "Web Login"
+	c.Flags = append(c.Flags, "flag{first}")
+	c.Files = []string{"../secret"}
+	c.Healthcheck.Port = "8080/tcp"
+	err = LintChallenge(c)
+	for _, want := range []string{"invalid name", "duplicate flag", "inside the package", "not in ports"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LintChallenge() = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestImportChallenge(t *testing.T) {
+	retired := time.Now()
+	mysql := &fakeMysql{}
+	pve := &fakePVEAPI{}
+	temps := fakeTemplates{
+		{ID: 1, Name: "ubuntu-24.04", Version: 1, VMID: 9000, Backend: "qemu", CPUs: 1, Memory: 1024},
+		{ID: 2, Name: "ubuntu-24.04", Version: 2, VMID: 9001, Backend: "qemu", CPUs: 1, Memory: 2048},
+		{ID: 3, Name: "ubuntu-24.04", Version: 3, VMID: 9002, Backend: "qemu", RetiredAt: &retired},
+	}
+	s := NewQuestionService(mysql, pve, nil, temps, nil)
+
+	c, _ := ParseChallenge([]byte(webChallenge))
+	dry, err := s.ImportChallenge(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dry.Action != model.ChallengeCreated || dry.TemplateID != 2 || len(pve.vms) != 0 || len(mysql.questions) != 0 {
+		t.Fatalf("dry run = %+v vms=%d", dry, len(pve.vms))
+	}
+
+	// 退役していない最新のテンプレートから作る
+	res, err := s.ImportChallenge(c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := mysql.questions[0]
+	if res.Action != model.ChallengeCreated || res.QuestionID != 1 || q.TemplateID != 2 || q.Answer != "flag{first}" || len(q.Flags) != 2 || q.Point != 100 {
+		t.Fatalf("created = %+v question = %+v", res, q)
+	}
+	if vm := pve.vms[0]; vm.Cloneid != 9001 || vm.CPU != 2 || vm.Memory != 2048 || string(pve.cloudinits[0].Base) != `{"packages":["nginx"]}` {
+		t.Errorf("vm = %+v base = %s", vm, pve.cloudinits[0].Base)
+	}
+
+	// 2 回目は VM を作らずに更新する
+	c.Description = "updated"
+	c.Points = 200
+	res, err = s.ImportChallenge(c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != model.ChallengeUpdated || len(pve.vms) != 1 || mysql.questions[0].Description != "updated" || mysql.questions[0].Point != 200 {
+		t.Fatalf("updated = %+v question = %+v", res, mysql.questions[0])
+	}
+	if len(res.Ignored) != 2 || res.Ignored[0] != "resources" || res.Ignored[1] != "cloudinit" {
+		t.Errorf("ignored = %v", res.Ignored)
+	}
+
+	// 作成したときと違うテンプレートには変えられない
+	c.Template = "ubuntu-24.04@1"
+	if _, err := s.ImportChallenge(c, false); !errors.Is(err, model.ErrChallengeConflict) {
+		t.Errorf("ImportChallenge() = %v, want ErrChallengeConflict", err)
+	}
+}
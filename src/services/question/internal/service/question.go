@@ -1,41 +1,87 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"slices"
 	"strconv"
 
 	"github.com/LainInTheWired/ctf_backend/question/model"
 	"github.com/LainInTheWired/ctf_backend/question/repository"
 	"github.com/cockroachdb/errors"
+	"github.com/labstack/gommon/log"
 )
 
 type quesionService struct {
 	myrepo     repository.MysqlRepository
 	pveapirepo repository.PVEAPIRepository
 	teamrepo   repository.TeamRepository
+	temprepo   repository.TemplateRepository
+	// attachments は問題を消すときに添付ファイルのオブジェクトを消すのに使う
+	attachments AttachmentService
 }
 
 type QuesionService interface {
 	CreateQuestion(q model.CreateQuestion) error
 	DeleteQuestion(qid int) error
-	CloneQuestion(q model.CreateQuestion) (int, error)
+	// CloneQuestion は作成した VM の vmid と VM を置いたクラスタを返します
+	CloneQuestion(q model.CreateQuestion) (*model.ClonedVM, error)
 	GetQuestionsInContest(contestID int) ([]model.Question, error)
 	GetQuestions() ([]model.Question, error)
 	GetQuesionByID(qid int) (model.Question, error)
-	DeleteVM(vmid int) error
+	DeleteVM(cluster string, vmid int) error
 	GetQuesionIp(vmid int) (*model.ResponseIPs, error)
 	UpdateQuestion(q model.Question) error
+	GetQuestionVMs(qid int) ([]model.QuestionVM, error)
+	// SetQuestionVMs は問題を複数の VM で構成します (空の場合は questions.vmid の VM 1 台)
+	SetQuestionVMs(qid int, vms []model.QuestionVM) error
+	// ImportChallenge は challenge.yml の問題を名前で探して作成または更新します (dryRun の場合は確認のみ)
+	ImportChallenge(c *model.Challenge, dryRun bool) (*model.ChallengeImport, error)
 }
 
-func NewQuestionService(r repository.MysqlRepository, p repository.PVEAPIRepository, t repository.TeamRepository) QuesionService {
+func NewQuestionService(r repository.MysqlRepository, p repository.PVEAPIRepository, t repository.TeamRepository, tr repository.TemplateRepository, as AttachmentService) QuesionService {
 	return &quesionService{
-		myrepo:     r,
-		pveapirepo: p,
-		teamrepo:   t,
+		myrepo:      r,
+		pveapirepo:  p,
+		teamrepo:    t,
+		temprepo:    tr,
+		attachments: as,
 	}
 }
 
 func (s *quesionService) CreateQuestion(q model.CreateQuestion) error {
+	_, err := s.createQuestion(q, model.Question{})
+	return err
+}
+
+// createQuestion はテンプレートから問題の VM を作り、ques に VM の情報を入れて登録します
+func (s *quesionService) createQuestion(q model.CreateQuestion, ques model.Question) (int, error) {
+	// クローン元のテンプレートは template サービスに登録されているものを使う
+	if q.TemplateID == 0 {
+		return 0, errors.New("template_id is required")
+	}
+	t, err := s.temprepo.GetTemplate(q.TemplateID)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get template")
+	}
+	if t.RetiredAt != nil {
+		return 0, errors.Newf("template %s v%d is retired", t.Name, t.Version)
+	}
+	if q.Backend != "" && q.Backend != t.Backend {
+		return 0, errors.Newf("template %s v%d is %s, not %s", t.Name, t.Version, t.Backend, q.Backend)
+	}
+	// 指定がなければテンプレートのリソースを使う
+	if q.CPUs == 0 {
+		q.CPUs = t.CPUs
+	}
+	if q.Memory == 0 {
+		q.Memory = t.Memory
+	}
+	if q.Disk == 0 {
+		q.Disk = t.Disk
+	}
+
 	// モデルの構造体に移し替えてから、repositoryに渡す
 	clconf := &model.CloudinitResponse{
 		Filename:  q.Name + ".yaml",
@@ -44,10 +90,11 @@ func (s *quesionService) CreateQuestion(q model.CreateQuestion) error {
 		SshPwauth: "1",
 		Username:  q.Username,
 		Password:  q.Password,
+		Base:      q.Cloudinit,
 	}
 
 	vmconfig := &model.CreateVM{
-		Cloneid:  9000,
+		Cloneid:  t.VMID,
 		Name:     q.Name,
 		Memory:   q.Memory,
 		IP:       q.IP,
@@ -55,36 +102,45 @@ func (s *quesionService) CreateQuestion(q model.CreateQuestion) error {
 		Disk:     q.Disk,
 		Cicustom: q.Name + ".yaml",
 		CPU:      q.CPUs,
+		Backend:  t.Backend,
+		Cluster:  t.ClusterID,
 	}
 	fmt.Printf("%+v", vmconfig)
 
 	if err := s.pveapirepo.Cloudinit(clconf); err != nil {
-		return errors.Wrap(err, "can't create contest")
+		return 0, errors.Wrap(err, "can't create contest")
 	}
-	svmid, err := s.pveapirepo.CreateVM(vmconfig)
+	created, err := s.pveapirepo.CreateVM(vmconfig)
 
 	if err != nil {
-		return errors.Wrap(err, "can't create contest")
+		return 0, errors.Wrap(err, "can't create contest")
 	}
 
-	vmid, err := strconv.Atoi(svmid)
+	vmid, err := strconv.Atoi(created.Data)
 	if err != nil {
-		return errors.Wrap(err, "can't Atoi vmid")
+		return 0, errors.Wrap(err, "can't Atoi vmid")
 	}
 
-	ques := &model.Question{
-		Name:        q.Name,
-		CategoryId:  q.CategoryID,
-		Description: q.Description,
-		Env:         q.Env,
-		VMID:        vmid,
-	}
+	ques.Name = q.Name
+	ques.CategoryId = q.CategoryID
+	ques.Description = q.Description
+	ques.Env = q.Env
+	ques.VMID = vmid
+	ques.ClusterID = created.Cluster
+	ques.Backend = t.Backend
+	ques.Ports = q.Ports
+	ques.TemplateID = t.ID
 
-	if err := s.myrepo.InsertQuestion(*ques); err != nil {
-		return errors.Wrap(err, "can't create contest")
+	id, err := s.myrepo.InsertQuestion(ques)
+	if err != nil {
+		// 登録できなかった VM は残さない
+		if derr := s.pveapirepo.DeleteVM(created.Cluster, vmid); derr != nil {
+			log.Errorf("can't delete vm %d: %v", vmid, derr)
+		}
+		return 0, errors.Wrap(err, "can't create contest")
 	}
 
-	return nil
+	return id, nil
 }
 
 func (s *quesionService) Template(vmid int) {
@@ -97,17 +153,21 @@ func (s *quesionService) DeleteQuestion(qid int) error {
 	if err != nil {
 		return errors.Wrap(err, "can't Select Questinos")
 	}
-	if err := s.pveapirepo.DeleteVM(ques.VMID); err != nil {
+	if err := s.pveapirepo.DeleteVM(ques.ClusterID, ques.VMID); err != nil {
 		return errors.Wrap(err, "can't Delete vm")
 	}
+	// 添付ファイルの行は問題と一緒に消えるので、先にオブジェクトを消しておく
+	if err := s.attachments.DeleteAttachments(qid); err != nil {
+		return errors.Wrap(err, "can't Delete attachments")
+	}
 	if err := s.myrepo.DeleteQuestion(qid); err != nil {
 		return errors.Wrap(err, "can't Delete Question")
 	}
 	return nil
 }
 
-func (s *quesionService) DeleteVM(vmid int) error {
-	if err := s.pveapirepo.DeleteVM(vmid); err != nil {
+func (s *quesionService) DeleteVM(cluster string, vmid int) error {
+	if err := s.pveapirepo.DeleteVM(cluster, vmid); err != nil {
 		return errors.Wrap(err, "can't Delete vm")
 	}
 	return nil
@@ -131,7 +191,7 @@ func (s *quesionService) GetQuestionsInContest(contestID int) ([]model.Question,
 	return q, nil
 }
 
-func (s *quesionService) CloneQuestion(q model.CreateQuestion) (int, error) {
+func (s *quesionService) CloneQuestion(q model.CreateQuestion) (*model.ClonedVM, error) {
 	// モデルの構造体に移し替えてから、repositoryに渡す
 	clconf := &model.CloudinitResponse{
 		Filename:  q.Name + ".yaml",
@@ -140,6 +200,7 @@ func (s *quesionService) CloneQuestion(q model.CreateQuestion) (int, error) {
 		SshPwauth: "1",
 		Username:  "user",
 		Password:  q.Password,
+		Base:      q.Cloudinit,
 	}
 
 	vmconfig := &model.CreateVM{
@@ -151,19 +212,28 @@ func (s *quesionService) CloneQuestion(q model.CreateQuestion) (int, error) {
 		Disk:     q.Disk,
 		Cicustom: q.Name + ".yaml",
 		CPU:      q.CPUs,
+		Bridge:   q.Bridge,
+
+		ContestID:  q.ContestID,
+		TeamID:     q.TeamID,
+		QuestionID: q.QuestionID,
+		CreatedBy:  q.CreatedBy,
+		Pool:       q.Pool,
+		Backend:    q.Backend,
 	}
 
+	// LXC のコンテナは cloud-init を使わないが、同じ名前で作っておけば削除の手順が変わらない
 	if err := s.pveapirepo.Cloudinit(clconf); err != nil {
-		return 0, errors.Wrap(err, "can't create contest")
+		return nil, errors.Wrap(err, "can't create contest")
 	}
-	svmid, err := s.pveapirepo.CreateVM(vmconfig)
+	created, err := s.pveapirepo.CreateVM(vmconfig)
 	if err != nil {
-		return 0, errors.Wrap(err, "can't create contest")
+		return nil, errors.Wrap(err, "can't create contest")
 	}
 
-	vmid, err := strconv.Atoi(svmid)
+	vmid, err := strconv.Atoi(created.Data)
 	if err != nil {
-		return 0, errors.Wrap(err, "can't Atoi vmid")
+		return nil, errors.Wrap(err, "can't Atoi vmid")
 	}
 
 	// ques := &model.Question{
@@ -178,7 +248,7 @@ func (s *quesionService) CloneQuestion(q model.CreateQuestion) (int, error) {
 	// 	return errors.Wrap(err, "can't create contest")
 	// }
 
-	return vmid, nil
+	return &model.ClonedVM{VMID: vmid, Cluster: created.Cluster, Type: created.Type}, nil
 }
 
 func (s *quesionService) GetQuesionByID(qid int) (model.Question, error) {
@@ -197,10 +267,94 @@ func (s *quesionService) GetQuesionIp(vmid int) (*model.ResponseIPs, error) {
 	return ips, nil
 }
 
+// UpdateQuestion は問題を更新します。古いフラグが正解のまま残らないように flags も書き換え、
+// flags を省略した場合は消して answer だけを正解にする (answer を省略した場合は最初のフラグ)
 func (s *quesionService) UpdateQuestion(q model.Question) error {
+	q.Answer, q.Flags = updateFlags(q.Answer, q.Flags)
 	if err := s.myrepo.UpdateQuestion(q); err != nil {
 		return errors.Wrap(err, "errors")
 
 	}
 	return nil
 }
+
+// updateFlags は answer を先頭にして重複を除いたフラグを返します
+func updateFlags(answer string, flags []string) (string, []string) {
+	if len(flags) == 0 {
+		return answer, nil
+	}
+	if answer == "" {
+		answer = flags[0]
+	}
+	fs := []string{answer}
+	for _, f := range flags {
+		if !slices.Contains(fs, f) {
+			fs = append(fs, f)
+		}
+	}
+	return answer, fs
+}
+
+// roleNamePattern は VM 名とスニペットのファイル名に入れるロールの名前です
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,15}$`)
+
+// スニペットの種類と同じ名前はファイル名が区別できないので使えない
+var reservedRoles = map[string]bool{"network": true, "meta": true, "vendor": true}
+
+func (s *quesionService) GetQuestionVMs(qid int) ([]model.QuestionVM, error) {
+	vms, err := s.myrepo.SelectQuestionVMs(qid)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get question vms")
+	}
+	return vms, nil
+}
+
+func (s *quesionService) SetQuestionVMs(qid int, vms []model.QuestionVM) error {
+	if err := ValidateQuestionVMs(vms); err != nil {
+		return errors.Wrap(err, "invalid question vms")
+	}
+	// createQuestion と同じく template サービスに登録された退役していないテンプレートだけを使う
+	for i := range vms {
+		t, err := s.temprepo.GetTemplate(vms[i].TemplateID)
+		if err != nil {
+			return errors.Wrapf(err, "role %s: can't get template", vms[i].Role)
+		}
+		if t.RetiredAt != nil {
+			return errors.Newf("role %s: template %s v%d is retired", vms[i].Role, t.Name, t.Version)
+		}
+		vms[i].QuestionID = qid
+		vms[i].VMID = t.VMID
+	}
+	if err := s.myrepo.ReplaceQuestionVMs(qid, vms); err != nil {
+		return errors.Wrap(err, "can't set question vms")
+	}
+	return nil
+}
+
+// ValidateQuestionVMs は問題の VM の一覧を確認します
+// 先頭の VM がチームに案内する接続先になる
+func ValidateQuestionVMs(vms []model.QuestionVM) error {
+	roles := map[string]bool{}
+	for _, vm := range vms {
+		if !roleNamePattern.MatchString(vm.Role) || reservedRoles[vm.Role] {
+			return errors.Newf("invalid role: %q", vm.Role)
+		}
+		if roles[vm.Role] {
+			return errors.Newf("duplicate role: %s", vm.Role)
+		}
+		roles[vm.Role] = true
+		if vm.TemplateID <= 0 {
+			return errors.Newf("role %s: template_id is required", vm.Role)
+		}
+		if vm.CPUs < 0 || vm.Memory < 0 || vm.Disk < 0 {
+			return errors.Newf("role %s: resources must not be negative", vm.Role)
+		}
+		if len(vm.Cloudinit) > 0 {
+			var conf map[string]json.RawMessage
+			if err := json.Unmarshal(vm.Cloudinit, &conf); err != nil {
+				return errors.Wrapf(err, "role %s: cloudinit must be a json object", vm.Role)
+			}
+		}
+	}
+	return nil
+}
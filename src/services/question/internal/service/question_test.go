@@ -0,0 +1,89 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/question/model"
+	"github.com/cockroachdb/errors"
+)
+
+func TestCreateQuestionDeletesVMOnInsertError(t *testing.T) {
+	mysql := &fakeMysql{insertErr: errors.New("data too long for column description")}
+	pve := &fakePVEAPI{}
+	s := NewQuestionService(mysql, pve, nil, fakeTemplates{{ID: 1, Name: "kali", Version: 1, VMID: 9100}}, nil)
+
+	if err := s.CreateQuestion(model.CreateQuestion{Name: "web", TemplateID: 1}); err == nil {
+		t.Fatal("CreateQuestion succeeded")
+	}
+	// 登録できなかった問題の VM は残さない
+	if len(pve.vms) != 1 || !slices.Equal(pve.deleted, []int{200}) {
+		t.Errorf("created = %d, deleted = %v", len(pve.vms), pve.deleted)
+	}
+}
+
+func TestUpdateQuestionFlags(t *testing.T) {
+	mysql := &fakeMysql{questions: []model.Question{{ID: 1, Answer: "flag{old}", Flags: []string{"flag{old}", "flag{alt}"}}}}
+	s := NewQuestionService(mysql, nil, nil, nil, nil)
+
+	// answer を変えると古いフラグは消える
+	if err := s.UpdateQuestion(model.Question{ID: 1, Answer: "flag{new}"}); err != nil {
+		t.Fatal(err)
+	}
+	if q := mysql.questions[0]; q.Answer != "flag{new}" || len(q.Flags) != 0 {
+		t.Errorf("question = %+v", q)
+	}
+
+	// flags を指定した場合は answer を先頭にする (answer を省略した場合は最初のフラグ)
+	for _, tt := range []struct {
+		answer string
+		flags  []string
+		want   []string
+	}{
+		{"", []string{"flag{a}", "flag{b}"}, []string{"flag{a}", "flag{b}"}},
+		{"flag{b}", []string{"flag{a}", "flag{b}"}, []string{"flag{b}", "flag{a}"}},
+		{"flag{c}", []string{"flag{a}"}, []string{"flag{c}", "flag{a}"}},
+	} {
+		if err := s.UpdateQuestion(model.Question{ID: 1, Answer: tt.answer, Flags: tt.flags}); err != nil {
+			t.Fatal(err)
+		}
+		if q := mysql.questions[0]; q.Answer != tt.want[0] || !slices.Equal(q.Flags, tt.want) {
+			t.Errorf("answer = %q, flags = %v: question = %+v", tt.answer, tt.flags, q)
+		}
+	}
+}
+
+func TestSetQuestionVMs(t *testing.T) {
+	retired := time.Now()
+	temps := fakeTemplates{
+		{ID: 1, Name: "kali", Version: 1, VMID: 9100},
+		{ID: 2, Name: "ubuntu", Version: 1, VMID: 9101, RetiredAt: &retired},
+	}
+	mysql := &fakeMysql{}
+	s := NewQuestionService(mysql, nil, nil, temps, nil)
+
+	// テンプレートの VM をクローン元にする
+	if err := s.SetQuestionVMs(3, []model.QuestionVM{{Role: "attacker", TemplateID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if vms := mysql.vms[3]; len(vms) != 1 || vms[0].VMID != 9100 || vms[0].TemplateID != 1 || vms[0].QuestionID != 3 {
+		t.Fatalf("vms = %+v", vms)
+	}
+
+	for _, vms := range [][]model.QuestionVM{
+		// テンプレートの指定がない
+		{{Role: "attacker", VMID: 9100}},
+		// 退役したテンプレート
+		{{Role: "attacker", TemplateID: 1}, {Role: "target", TemplateID: 2}},
+		// 登録されていないテンプレート
+		{{Role: "target", TemplateID: 9}},
+	} {
+		if err := s.SetQuestionVMs(4, vms); err == nil {
+			t.Errorf("invalid vms were accepted: %+v", vms)
+		}
+	}
+	if _, ok := mysql.vms[4]; ok {
+		t.Errorf("invalid vms were saved: %+v", mysql.vms[4])
+	}
+}
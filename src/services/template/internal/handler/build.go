@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/LainInTheWired/ctf_backend/template/model"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type imageSourceRequest struct {
+	URL               string `json:"url,omitempty" validate:"omitempty,url"`
+	Path              string `json:"path,omitempty"`
+	Filename          string `json:"filename,omitempty"`
+	Checksum          string `json:"checksum,omitempty" validate:"omitempty,hexadecimal"`
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty" validate:"required_with=Checksum,omitempty,oneof=md5 sha1 sha224 sha256 sha384 sha512"`
+}
+
+type buildTemplateRequest struct {
+	Name         string             `json:"name" validate:"required"`
+	OS           string             `json:"os"`
+	ClusterID    string             `json:"cluster_id"`
+	Node         string             `json:"node,omitempty"`
+	Storage      string             `json:"storage" validate:"required"`
+	ImageStorage string             `json:"image_storage" validate:"required"`
+	Source       imageSourceRequest `json:"source"`
+	CPUs         int                `json:"cpu" validate:"min=0"`
+	Memory       int                `json:"memory" validate:"omitempty,min=256"`
+	Disk         int                `json:"disk" validate:"min=0"`
+	Bridge       string             `json:"bridge,omitempty" validate:"omitempty,alphanum,max=8"`
+	Cloudinit    []string           `json:"cloudinit" validate:"omitempty,dive,oneof=user network meta vendor"`
+	// 変換の前に一度起動して実行する cloud-init (pveapi の CloudinitConfig)
+	Provision json.RawMessage `json:"provision,omitempty"`
+}
+
+// spoolImage はアップロードされたイメージを一時ファイルに保存し、そのパスを返します
+// ビルドはリクエストが終わった後も続くので、リクエストのファイルはそのまま使えない
+func spoolImage(c echo.Context) (string, string, error) {
+	fh, err := c.FormFile("image")
+	if err != nil {
+		return "", "", xerrors.Errorf("image file is required: %w", err)
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return "", "", xerrors.Errorf("can't open image: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp("", "template-image-*")
+	if err != nil {
+		return "", "", xerrors.Errorf("can't create temp file: %w", err)
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		os.Remove(dst.Name())
+		return "", "", xerrors.Errorf("can't save image: %w", err)
+	}
+	return dst.Name(), fh.Filename, nil
+}
+
+// BuildTemplate はクラウドイメージからテンプレートを作るジョブを始めます
+// JSON の場合は source の url か path を使い、multipart の場合は build フィールドの JSON と image ファイルを使う
+func (h *templateHander) BuildTemplate(c echo.Context) error {
+	var req buildTemplateRequest
+	upload := ""
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		if err := json.Unmarshal([]byte(c.FormValue("build")), &req); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		if err := c.Validate(req); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		name, filename, err := spoolImage(c)
+		if err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		upload = name
+		if req.Source.Filename == "" {
+			req.Source.Filename = filename
+		}
+	} else {
+		if err := c.Bind(&req); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+		// データをバリデーションにかける
+		if err := c.Validate(req); err != nil {
+			wrappedErr := xerrors.Errorf(": %w", err)
+			log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+		}
+	}
+
+	b := model.TemplateBuild{
+		Name:         req.Name,
+		OS:           req.OS,
+		ClusterID:    req.ClusterID,
+		Node:         req.Node,
+		Storage:      req.Storage,
+		ImageStorage: req.ImageStorage,
+		Source: model.ImageSource{
+			URL:               req.Source.URL,
+			Path:              req.Source.Path,
+			Filename:          req.Source.Filename,
+			Checksum:          req.Source.Checksum,
+			ChecksumAlgorithm: req.Source.ChecksumAlgorithm,
+			Upload:            upload,
+		},
+		CPUs:      req.CPUs,
+		Memory:    req.Memory,
+		Disk:      req.Disk,
+		Bridge:    req.Bridge,
+		Cloudinit: req.Cloudinit,
+		Provision: req.Provision,
+	}
+	job, err := h.serv.BuildTemplate(b)
+	if err != nil {
+		// ジョブが始まらなかった場合は一時ファイルを消す (始まった場合はジョブが消す)
+		if upload != "" {
+			os.Remove(upload)
+		}
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(errorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+func (h *templateHander) GetTemplateJobs(c echo.Context) error {
+	js, err := h.serv.GetTemplateJobs()
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, js)
+}
+
+func (h *templateHander) GetTemplateJob(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	j, err := h.serv.GetTemplateJob(id)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(errorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, j)
+}
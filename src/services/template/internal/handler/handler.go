@@ -1,7 +1,195 @@
 package handler
 
-type TeamHander interface {
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/LainInTheWired/ctf_backend/template/model"
+	"github.com/LainInTheWired/ctf_backend/template/service"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type TemplateHander interface {
+	CreateTemplate(c echo.Context) error
+	GetTemplates(c echo.Context) error
+	GetTemplate(c echo.Context) error
+	UpdateTemplate(c echo.Context) error
+	RetireTemplate(c echo.Context) error
+	DeleteTemplate(c echo.Context) error
+	BuildTemplate(c echo.Context) error
+	GetTemplateJobs(c echo.Context) error
+	GetTemplateJob(c echo.Context) error
+}
+
+type templateHander struct {
+	serv service.TemplateService
+}
+
+type templateRequest struct {
+	Name      string   `json:"name" validate:"required"`
+	VMID      int      `json:"vmid" validate:"required,min=100"`
+	ClusterID string   `json:"cluster_id"`
+	Backend   string   `json:"backend,omitempty" validate:"omitempty,oneof=qemu lxc"`
+	OS        string   `json:"os"`
+	CPUs      int      `json:"cpu" validate:"min=0"`
+	Memory    int      `json:"memory" validate:"min=0"`
+	Disk      int      `json:"disk" validate:"min=0"`
+	Cloudinit []string `json:"cloudinit" validate:"omitempty,dive,oneof=user network meta vendor"`
+	// テンプレートでない VM をテンプレートに変換してから登録する
+	Convert bool `json:"convert"`
+}
+
+type updateTemplateRequest struct {
+	OS        string   `json:"os"`
+	CPUs      int      `json:"cpu" validate:"min=0"`
+	Memory    int      `json:"memory" validate:"min=0"`
+	Disk      int      `json:"disk" validate:"min=0"`
+	Cloudinit []string `json:"cloudinit" validate:"omitempty,dive,oneof=user network meta vendor"`
+}
+
+func NewTemplateHander(s service.TemplateService) TemplateHander {
+	return &templateHander{
+		serv: s,
+	}
+}
+
+// errorStatus はサービスのエラーに対応するステータスコードを返します
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, model.ErrTemplateNotFound), errors.Is(err, model.ErrTemplateJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, model.ErrTemplateInUse), errors.Is(err, model.ErrTemplateRetired):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func (h *templateHander) CreateTemplate(c echo.Context) error {
+	var req templateRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	// データをバリデーションにかける
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+
+	m := model.Template{
+		Name:      req.Name,
+		VMID:      req.VMID,
+		ClusterID: req.ClusterID,
+		Backend:   req.Backend,
+		OS:        req.OS,
+		CPUs:      req.CPUs,
+		Memory:    req.Memory,
+		Disk:      req.Disk,
+		Cloudinit: req.Cloudinit,
+	}
+	t, err := h.serv.RegisterTemplate(m, req.Convert)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(errorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusCreated, t)
+}
+
+func (h *templateHander) GetTemplates(c echo.Context) error {
+	// all=1 の場合は退役したテンプレートも返す
+	ts, err := h.serv.GetTemplates(c.QueryParam("name"), c.QueryParam("all") == "1")
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, ts)
+}
+
+func (h *templateHander) GetTemplate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	t, err := h.serv.GetTemplate(id)
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(errorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+func (h *templateHander) UpdateTemplate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	var req updateTemplateRequest
+	if err := c.Bind(&req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if err := c.Validate(req); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	m := model.Template{
+		ID:        id,
+		OS:        req.OS,
+		CPUs:      req.CPUs,
+		Memory:    req.Memory,
+		Disk:      req.Disk,
+		Cloudinit: req.Cloudinit,
+	}
+	if err := h.serv.UpdateTemplate(m); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(errorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "update template"})
+}
+
+func (h *templateHander) RetireTemplate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if err := h.serv.RetireTemplate(id); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(errorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "retire template"})
 }
 
-type teamHander struct {
+func (h *templateHander) DeleteTemplate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	if err := h.serv.DeleteTemplate(id); err != nil {
+		wrappedErr := xerrors.Errorf(": %w", err)
+		log.Errorf("\n%+v\n", wrappedErr) // スタックトレース付きでログに出力
+		return c.JSON(errorStatus(err), map[string]string{"error": fmt.Sprintf("error:", wrappedErr)})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "delete template"})
 }
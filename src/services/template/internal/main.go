@@ -12,7 +12,13 @@ import (
 	"os"
 	"time"
 
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
 	myvalidator "github.com/LainInTheWired/ctf_backend/shared/pkg/validator"
+	"github.com/LainInTheWired/ctf_backend/template/handler"
+	"github.com/LainInTheWired/ctf_backend/template/model"
+	"github.com/LainInTheWired/ctf_backend/template/repository"
+	"github.com/LainInTheWired/ctf_backend/template/service"
+	"github.com/joho/godotenv"
 	"golang.org/x/xerrors"
 
 	_ "github.com/go-sql-driver/mysql" // 空のインポートを追加
@@ -87,7 +93,7 @@ func (a *MiddlewareTransport) RoundTrip(req *http.Request) (*http.Response, erro
 }
 
 func NewDBClient() (*sql.DB, error) {
-	db, err := sql.Open("mysql", "user:user@tcp(db:3306)/ctf")
+	db, err := sql.Open("mysql", fmt.Sprintf("user:user@tcp(%s:3306)/ctf?parseTime=true", os.Getenv("MYSQL_URL")))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -114,6 +120,11 @@ func NewRedisClient() (*redis.Client, error) {
 }
 
 func main() {
+	// .envファイルを読み込む
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatalf("Error loading .env file")
+	}
 	// mysql初期化処理
 	db, err := NewDBClient()
 	if err != nil {
@@ -165,17 +176,48 @@ func main() {
 		Timeout:   60 * time.Second,
 	}
 
-	// mr := repository.NewMysqlRepository(db)
-	// pr := repository.NewPVEAPIRepository(client)
+	// イメージの取り込みは 1 回のリクエストが長く、大きなファイルを送るので
+	// タイムアウトとログを付けないクライアントを使う (pveapi のタスクのタイムアウトで止まる)
+	buildClient := &http.Client{
+		Transport: tr,
+	}
+
+	mr := repository.NewMysqlRepository(db)
+	pr := repository.NewPVEAPIRepository(client, os.Getenv("PVEAPI_URL"))
+	br := repository.NewPVEAPIRepository(buildClient, os.Getenv("PVEAPI_URL"))
 
-	// s := service.NewContestService(pr, mr)
-	// h := hander.NewContestHander(s)
+	buildConf := &model.BuildConfig{
+		ImageDir:         os.Getenv("IMAGE_DIR"),
+		ProvisionTimeout: 30 * time.Minute,
+		PollInterval:     10 * time.Second,
+	}
+	if v := os.Getenv("PROVISION_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid PROVISION_TIMEOUT: %v", err)
+		}
+		buildConf.ProvisionTimeout = d
+	}
 
-	fmt.Println(client)
-	// e.POST("/contest", h.CreateContest)
-	// e.DELETE("/contest", h.DeleteContest)
-	// e.POST("/team_contests", h.JoinTeamsinContest)
-	// e.DELETE("/team_contests", h.DeleteTeamContest)
+	s := service.NewTemplateService(mr, pr, br, role.NewRoleRepository(reddb), buildConf)
+	// 再起動で中断したビルドは続けられないので失敗にする
+	if err := s.RecoverTemplateJobs(); err != nil {
+		echoLog.Errorf("%+v", err)
+	}
+	h := handler.NewTemplateHander(s)
+	// テンプレートの変更は管理者だけ
+	admin := handler.AdminOnly(s)
+
+	e.POST("/template", h.CreateTemplate, admin)
+	e.GET("/template", h.GetTemplates)
+	e.GET("/template/:id", h.GetTemplate)
+	e.PUT("/template/:id", h.UpdateTemplate, admin)
+	e.POST("/template/:id/retire", h.RetireTemplate, admin)
+	e.DELETE("/template/:id", h.DeleteTemplate, admin)
+	// クラウドイメージからのビルド (ジョブの確認も管理者だけ)
+	e.POST("/template/build", h.BuildTemplate, admin)
+	e.GET("/template/build", h.GetTemplateJobs, admin)
+	e.GET("/template/build/:id", h.GetTemplateJob, admin)
 
 	e.Start(":8000")
 }
@@ -0,0 +1,114 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ErrTemplateJobNotFound はビルドのジョブがない場合のエラーです
+var ErrTemplateJobNotFound = errors.New("template job not found")
+
+// ビルドのジョブの状態
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// ビルドの段階 (この順に進む。provision は Provision がある場合のみ)
+const (
+	StepImport    = "import"    // イメージをストレージに取り込む
+	StepCreate    = "create"    // イメージから VM を作る
+	StepProvision = "provision" // VM を起動して cloud-init を実行する
+	StepConvert   = "convert"   // VM をテンプレートに変換する
+	StepRegister  = "register"  // テンプレートとして登録する
+)
+
+// BuildConfig はテンプレートのビルドの設定です
+type BuildConfig struct {
+	// path で指定できるイメージを置くディレクトリ (空の場合は path を使えない)
+	ImageDir string
+	// provision の cloud-init が終わるのを待つ上限と確認の間隔
+	ProvisionTimeout time.Duration
+	PollInterval     time.Duration
+}
+
+// ImageSource はテンプレートにするクラウドイメージ (qcow2 / raw) の取得元です
+// URL・Path・アップロードのいずれか 1 つを指定する
+type ImageSource struct {
+	URL  string `json:"url,omitempty"`
+	Path string `json:"path,omitempty"` // BuildConfig.ImageDir からの相対パス
+	// ストレージに置くファイル名 (省略時は URL やパスのファイル名、拡張子は .qcow2 か .raw)
+	Filename string `json:"filename,omitempty"`
+	// ダウンロードしたファイルを確認するハッシュ (URL の場合のみ)
+	Checksum          string `json:"checksum,omitempty"`
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty"`
+	// アップロードされたファイルを保存した一時ファイル (ビルドが終わると削除する)
+	Upload string `json:"-"`
+}
+
+// TemplateBuild はクラウドイメージからテンプレートを作る設定です
+type TemplateBuild struct {
+	Name      string `json:"name"`
+	OS        string `json:"os"`
+	ClusterID string `json:"cluster_id"`
+	Node      string `json:"node,omitempty"` // 空の場合は pveapi が選ぶ
+	// VM のディスクを置くストレージとイメージを取り込むストレージ (import の content が必要)
+	Storage      string      `json:"storage"`
+	ImageStorage string      `json:"image_storage"`
+	Source       ImageSource `json:"source"`
+	CPUs         int         `json:"cpu"`
+	Memory       int         `json:"memory"` // MB
+	Disk         int         `json:"disk"`   // GB (0 の場合はイメージのまま)
+	Bridge       string      `json:"bridge,omitempty"`
+	// 登録するテンプレートが対応している cloud-init の設定
+	Cloudinit []string `json:"cloudinit"`
+	// テンプレートに変換する前に一度起動して実行する cloud-init (pveapi の CloudinitConfig)
+	Provision json.RawMessage `json:"provision,omitempty"`
+}
+
+// TemplateJob はテンプレートのビルドの進み具合です
+type TemplateJob struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	ClusterID string `json:"cluster_id"`
+	Status    string `json:"status"`
+	Step      string `json:"step"`
+	Progress  int    `json:"progress"` // 0-100
+	VMID      int    `json:"vmid,omitempty"`
+	// 登録したテンプレート (成功した場合のみ)
+	TemplateID int       `json:"template_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ImportedImage は pveapi の POST /image のレスポンスです
+type ImportedImage struct {
+	Node  string `json:"node"`
+	Volid string `json:"volid"`
+}
+
+// ReadinessStage と VMReadiness は pveapi の GET /vm/:vmid/status のレスポンスです
+type ReadinessStage struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+type VMReadiness struct {
+	Vmid   int              `json:"vmid"`
+	Ready  bool             `json:"ready"`
+	Stages []ReadinessStage `json:"stages"`
+}
+
+// AgentExecStatus は pveapi の POST /vm/:vmid/agent/exec (wait) のレスポンスです
+type AgentExecStatus struct {
+	Exited   int    `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	OutData  string `json:"out-data,omitempty"`
+	ErrData  string `json:"err-data,omitempty"`
+}
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ErrTemplateInUse は問題が使っているテンプレートを削除しようとした場合のエラーです
+var ErrTemplateInUse = errors.New("template is used by questions")
+
+// ErrTemplateRetired は退役したテンプレートを新しく使おうとした場合のエラーです
+var ErrTemplateRetired = errors.New("template is retired")
+
+// ErrTemplateNotFound はテンプレートが登録されていない場合のエラーです
+var ErrTemplateNotFound = errors.New("template not found")
+
+// cloud-init で使える設定 (pveapi のスニペットの種類)
+const (
+	CloudinitUser    = "user"
+	CloudinitNetwork = "network"
+	CloudinitMeta    = "meta"
+	CloudinitVendor  = "vendor"
+)
+
+// Template は template サービスが管理する Proxmox のテンプレート (ベースイメージ) です
+// 同じ名前のテンプレートは登録するたびに version が 1 つずつ増える
+type Template struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"` // 例: ubuntu-24.04
+	Version   int    `json:"version"`
+	VMID      int    `json:"vmid"`
+	ClusterID string `json:"cluster_id"` // テンプレートがある Proxmox のクラスタ (空の場合はデフォルト)
+	Backend   string `json:"backend"`    // qemu または lxc
+	OS        string `json:"os"`
+	// 問題を作るときに指定がなければ使うリソース (0 の場合はテンプレートのまま)
+	CPUs   int `json:"cpu"`
+	Memory int `json:"memory"` // MB
+	Disk   int `json:"disk"`   // GB
+	// テンプレートが対応している cloud-init の設定 (user / network / meta / vendor)
+	Cloudinit []string   `json:"cloudinit"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// テンプレートを使っている問題 (GET /template/:id のみ)
+	Questions []TemplateQuestion `json:"questions,omitempty"`
+}
+
+// Retired は退役したテンプレートであれば true を返します
+func (t Template) Retired() bool {
+	return t.RetiredAt != nil
+}
+
+// TemplateQuestion はテンプレートから作った問題です
+type TemplateQuestion struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// ClusterResources は pveapi の GET /cluster のリソースのうち使う項目です
+type ClusterResources struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Node     string `json:"node"`
+	Status   string `json:"status"`
+	Type     string `json:"type"` // qemu / lxc / node / storage など
+	Template int    `json:"template"`
+	Vmid     int    `json:"vmid"`
+	Cluster  string `json:"cluster,omitempty"`
+}
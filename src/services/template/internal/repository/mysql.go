@@ -1,3 +1,280 @@
 package repository
 
-type   struct
\ No newline at end of file
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/LainInTheWired/ctf_backend/template/model"
+)
+
+type mysqlRepository struct {
+	DB *sql.DB
+}
+type MysqlRepository interface {
+	// InsertTemplate は同じ名前の最新の version の次の version で登録し、ID と version を返します
+	InsertTemplate(t model.Template) (int, int, error)
+	// SelectTemplates は name のテンプレートを新しい順に返します (name が空の場合はすべて)
+	SelectTemplates(name string, retired bool) ([]model.Template, error)
+	SelectTemplate(id int) (*model.Template, error)
+	UpdateTemplate(t model.Template) error
+	RetireTemplate(id int, at time.Time) error
+	// DeleteTemplate は問題に使われていないテンプレートを削除し、削除したテンプレートを返します
+	// 使われているかはトランザクションの中で確かめ直す
+	DeleteTemplate(id int) (*model.Template, error)
+	// SelectTemplateQuestions はテンプレートから作った問題を返します (複数の VM の問題の VM に使ったものを含む)
+	SelectTemplateQuestions(id int) ([]model.TemplateQuestion, error)
+
+	InsertTemplateJob(j model.TemplateJob) (int, error)
+	// UpdateTemplateJob はジョブの状態・段階・進み具合・vmid・テンプレート・エラーを更新します
+	UpdateTemplateJob(j model.TemplateJob) error
+	SelectTemplateJob(id int) (*model.TemplateJob, error)
+	// SelectTemplateJobs は新しい順に limit 件のジョブを返します
+	SelectTemplateJobs(limit int) ([]model.TemplateJob, error)
+	// SelectUnfinishedTemplateJobs は終わっていない (pending / running の) ジョブを返します
+	SelectUnfinishedTemplateJobs() ([]model.TemplateJob, error)
+	// FailTemplateJobs は終わっていないジョブを失敗にして件数を返します (起動時に中断したジョブを片付ける)
+	FailTemplateJobs(reason string) (int64, error)
+}
+
+func NewMysqlRepository(db *sql.DB) MysqlRepository {
+	return &mysqlRepository{
+		DB: db,
+	}
+}
+
+const templateColumns = "id,name,version,vmid,cluster_id,backend,os,cpu,memory,disk,cloudinit,retired_at,create_date"
+
+func scanTemplate(row interface{ Scan(...any) error }) (*model.Template, error) {
+	var (
+		t         model.Template
+		Cloudinit string
+		RetiredAt sql.NullTime
+	)
+	if err := row.Scan(&t.ID, &t.Name, &t.Version, &t.VMID, &t.ClusterID, &t.Backend, &t.OS, &t.CPUs, &t.Memory, &t.Disk, &Cloudinit, &RetiredAt, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	t.Cloudinit = []string{}
+	if Cloudinit != "" {
+		t.Cloudinit = strings.Split(Cloudinit, ",")
+	}
+	if RetiredAt.Valid {
+		t.RetiredAt = &RetiredAt.Time
+	}
+	return &t, nil
+}
+
+func (m *mysqlRepository) InsertTemplate(t model.Template) (int, int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "can't begin transaction")
+	}
+	defer tx.Rollback()
+
+	// 同じ名前の登録が重なっても同じ version にならないように行をロックする
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version),0)+1 FROM templates WHERE name = ? FOR UPDATE", t.Name).Scan(&version); err != nil {
+		return 0, 0, errors.Wrap(err, "can't select template version")
+	}
+	res, err := tx.Exec("INSERT INTO templates (name,version,vmid,cluster_id,backend,os,cpu,memory,disk,cloudinit) VALUES(?,?,?,?,?,?,?,?,?,?)",
+		t.Name, version, t.VMID, t.ClusterID, t.Backend, t.OS, t.CPUs, t.Memory, t.Disk, strings.Join(t.Cloudinit, ","))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "can't insert template")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "can't get template id")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, errors.Wrap(err, "can't commit template")
+	}
+	return int(id), version, nil
+}
+
+func (m *mysqlRepository) SelectTemplates(name string, retired bool) ([]model.Template, error) {
+	query := "SELECT " + templateColumns + " FROM templates WHERE (? = '' OR name = ?)"
+	if !retired {
+		query += " AND retired_at IS NULL"
+	}
+	rows, err := m.DB.Query(query+" ORDER BY name, version DESC", name, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "error select templates")
+	}
+	defer rows.Close()
+	templates := []model.Template{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		templates = append(templates, *t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return templates, nil
+}
+
+func (m *mysqlRepository) SelectTemplate(id int) (*model.Template, error) {
+	t, err := scanTemplate(m.DB.QueryRow("SELECT "+templateColumns+" FROM templates WHERE id = ?", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Wrapf(model.ErrTemplateNotFound, "template %d", id)
+		}
+		return nil, errors.Wrap(err, "can't select template")
+	}
+	return t, nil
+}
+
+func (m *mysqlRepository) UpdateTemplate(t model.Template) error {
+	_, err := m.DB.Exec("UPDATE templates SET os = ?, cpu = ?, memory = ?, disk = ?, cloudinit = ? WHERE id = ?",
+		t.OS, t.CPUs, t.Memory, t.Disk, strings.Join(t.Cloudinit, ","), t.ID)
+	if err != nil {
+		return errors.Wrap(err, "can't update template")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) RetireTemplate(id int, at time.Time) error {
+	// 退役した日時は最初のものを残す
+	if _, err := m.DB.Exec("UPDATE templates SET retired_at = COALESCE(retired_at, ?) WHERE id = ?", at, id); err != nil {
+		return errors.Wrap(err, "can't retire template")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) DeleteTemplate(id int) (*model.Template, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't begin transaction")
+	}
+	defer tx.Rollback()
+
+	// 問題の登録と重ならないようにテンプレートの行をロックしてから使われているか確かめる
+	t, err := scanTemplate(tx.QueryRow("SELECT "+templateColumns+" FROM templates WHERE id = ? FOR UPDATE", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Wrapf(model.ErrTemplateNotFound, "template %d", id)
+		}
+		return nil, errors.Wrap(err, "can't select template")
+	}
+	var used int
+	if err := tx.QueryRow("SELECT (SELECT COUNT(*) FROM questions WHERE template_id = ?) + (SELECT COUNT(*) FROM question_vms WHERE template_id = ?)", id, id).Scan(&used); err != nil {
+		return nil, errors.Wrap(err, "can't count template questions")
+	}
+	if used > 0 {
+		return nil, errors.Wrapf(model.ErrTemplateInUse, "template %d", id)
+	}
+	if _, err := tx.Exec("DELETE FROM templates WHERE id = ?", id); err != nil {
+		return nil, errors.Wrap(err, "can't delete template")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "can't commit template")
+	}
+	return t, nil
+}
+
+func (m *mysqlRepository) SelectTemplateQuestions(id int) ([]model.TemplateQuestion, error) {
+	// 複数の VM の問題の VM に使われている場合も含める
+	rows, err := m.DB.Query("SELECT id,name FROM questions WHERE template_id = ? OR id IN (SELECT question_id FROM question_vms WHERE template_id = ?) ORDER BY id", id, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "error select questions")
+	}
+	defer rows.Close()
+	questions := []model.TemplateQuestion{}
+	for rows.Next() {
+		var q model.TemplateQuestion
+		if err := rows.Scan(&q.ID, &q.Name); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		questions = append(questions, q)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return questions, nil
+}
+
+const templateJobColumns = "id,name,cluster_id,status,step,progress,vmid,COALESCE(template_id,0),COALESCE(error,''),create_date,update_date"
+
+func scanTemplateJob(row interface{ Scan(...any) error }) (*model.TemplateJob, error) {
+	var j model.TemplateJob
+	if err := row.Scan(&j.ID, &j.Name, &j.ClusterID, &j.Status, &j.Step, &j.Progress, &j.VMID, &j.TemplateID, &j.Error, &j.CreatedAt, &j.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (m *mysqlRepository) InsertTemplateJob(j model.TemplateJob) (int, error) {
+	res, err := m.DB.Exec("INSERT INTO template_jobs (name,cluster_id,status,step) VALUES(?,?,?,?)", j.Name, j.ClusterID, j.Status, j.Step)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't insert template job")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get template job id")
+	}
+	return int(id), nil
+}
+
+func (m *mysqlRepository) UpdateTemplateJob(j model.TemplateJob) error {
+	_, err := m.DB.Exec("UPDATE template_jobs SET status = ?, step = ?, progress = ?, vmid = ?, template_id = NULLIF(?,0), error = NULLIF(?,'') WHERE id = ?",
+		j.Status, j.Step, j.Progress, j.VMID, j.TemplateID, j.Error, j.ID)
+	if err != nil {
+		return errors.Wrap(err, "can't update template job")
+	}
+	return nil
+}
+
+func (m *mysqlRepository) SelectTemplateJob(id int) (*model.TemplateJob, error) {
+	j, err := scanTemplateJob(m.DB.QueryRow("SELECT "+templateJobColumns+" FROM template_jobs WHERE id = ?", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Wrapf(model.ErrTemplateJobNotFound, "template job %d", id)
+		}
+		return nil, errors.Wrap(err, "can't select template job")
+	}
+	return j, nil
+}
+
+func (m *mysqlRepository) SelectTemplateJobs(limit int) ([]model.TemplateJob, error) {
+	return m.selectTemplateJobs("SELECT "+templateJobColumns+" FROM template_jobs ORDER BY id DESC LIMIT ?", limit)
+}
+
+func (m *mysqlRepository) SelectUnfinishedTemplateJobs() ([]model.TemplateJob, error) {
+	return m.selectTemplateJobs("SELECT " + templateJobColumns + " FROM template_jobs WHERE status IN ('pending','running') ORDER BY id")
+}
+
+func (m *mysqlRepository) selectTemplateJobs(query string, args ...any) ([]model.TemplateJob, error) {
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error select template jobs")
+	}
+	defer rows.Close()
+	jobs := []model.TemplateJob{}
+	for rows.Next() {
+		j, err := scanTemplateJob(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		jobs = append(jobs, *j)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select errors")
+	}
+	return jobs, nil
+}
+
+func (m *mysqlRepository) FailTemplateJobs(reason string) (int64, error) {
+	res, err := m.DB.Exec("UPDATE template_jobs SET status = 'failed', error = ? WHERE status IN ('pending','running')", reason)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't fail template jobs")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get affected rows")
+	}
+	return n, nil
+}
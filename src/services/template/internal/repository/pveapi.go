@@ -0,0 +1,249 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/LainInTheWired/ctf_backend/template/model"
+	"github.com/cockroachdb/errors"
+)
+
+type pveapiRepository struct {
+	HTTPClient *http.Client
+	URL        string
+}
+
+// PVEAPIRepository は pveapi サービスを呼び出します
+// cluster が空の場合は pveapi のデフォルトのクラスタ
+type PVEAPIRepository interface {
+	GetClusterResources(cluster string) ([]model.ClusterResources, error)
+	// ToTemplate は VM を停止してテンプレートに変換します
+	ToTemplate(cluster string, vmid int) error
+	DeleteVM(cluster string, vmid int) error
+
+	// ImportImage は Proxmox に url のクラウドイメージをダウンロードさせます
+	ImportImage(cluster string, src model.ImageSource, node string, storage string) (*model.ImportedImage, error)
+	// UploadImage はクラウドイメージのファイルをアップロードします
+	UploadImage(cluster string, file io.Reader, filename string, node string, storage string) (*model.ImportedImage, error)
+	// CreateImageVM は取り込んだイメージから VM を作り、vmid を返します
+	CreateImageVM(cluster string, b model.TemplateBuild, image model.ImportedImage, cicustom string) (int, error)
+	// Cloudinit と DeleteCloudinit は最初の起動で使う cloud-init のファイルを置いて消します
+	Cloudinit(cluster string, filename string, hostname string, base json.RawMessage) error
+	DeleteCloudinit(cluster string, filename string) error
+	// StartVM は停止している VM を起動します
+	StartVM(cluster string, vmid int) error
+	VMStatus(cluster string, vmid int) (*model.VMReadiness, error)
+	// AgentRun は guest agent でコマンドを実行し、終わるまで待ちます
+	AgentRun(cluster string, vmid int, command []string, timeout int) (*model.AgentExecStatus, error)
+}
+
+// agentActor は guest agent の操作を監査ログに残すときのユーザーです
+const agentActor = "template"
+
+func NewPVEAPIRepository(h *http.Client, url string) PVEAPIRepository {
+	return &pveapiRepository{
+		HTTPClient: h,
+		URL:        url,
+	}
+}
+
+// endpoint は path に cluster のクエリを付けた URL を返します
+func (r *pveapiRepository) endpoint(path string, cluster string) string {
+	endpoint := r.URL + path
+	if cluster != "" {
+		endpoint += "?cluster=" + url.QueryEscape(cluster)
+	}
+	return endpoint
+}
+
+// do は body を JSON で送り、エラーでなければレスポンスを out にデコードします
+func (r *pveapiRepository) do(method, endpoint string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		jsend, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "can't change json")
+		}
+		reqBody = bytes.NewBuffer(jsend)
+	}
+	req, err := http.NewRequest(method, endpoint, reqBody)
+	if err != nil {
+		return errors.Wrap(err, "can't create http request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", agentActor)
+	return r.send(req, out)
+}
+
+// send はリクエストを送り、エラーでなければレスポンスを out にデコードします
+func (r *pveapiRepository) send(req *http.Request, out any) error {
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fail http request")
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "can't read response body")
+	}
+	// エラーチェック
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("API Error: status code %d, response: %s", resp.StatusCode, string(b))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return errors.Wrap(err, "can't unmarshal response body")
+	}
+	return nil
+}
+
+func (r *pveapiRepository) GetClusterResources(cluster string) ([]model.ClusterResources, error) {
+	var res []model.ClusterResources
+	if err := r.do("GET", r.endpoint("/cluster", cluster), nil, &res); err != nil {
+		return nil, errors.Wrap(err, "can't get cluster resources")
+	}
+	return res, nil
+}
+
+func (r *pveapiRepository) ToTemplate(cluster string, vmid int) error {
+	if err := r.do("POST", r.endpoint("/template", cluster), map[string]int{"id": vmid}, nil); err != nil {
+		return errors.Wrapf(err, "can't convert vm %d to template", vmid)
+	}
+	return nil
+}
+
+func (r *pveapiRepository) DeleteVM(cluster string, vmid int) error {
+	if err := r.do("DELETE", r.endpoint("/vm", cluster), map[string]int{"id": vmid}, nil); err != nil {
+		return errors.Wrapf(err, "can't delete vm %d", vmid)
+	}
+	return nil
+}
+
+func (r *pveapiRepository) ImportImage(cluster string, src model.ImageSource, node string, storage string) (*model.ImportedImage, error) {
+	body := map[string]string{
+		"node":               node,
+		"storage":            storage,
+		"filename":           src.Filename,
+		"url":                src.URL,
+		"checksum":           src.Checksum,
+		"checksum_algorithm": src.ChecksumAlgorithm,
+	}
+	var res model.ImportedImage
+	if err := r.do("POST", r.endpoint("/image", cluster), body, &res); err != nil {
+		return nil, errors.Wrapf(err, "can't import image %s", src.URL)
+	}
+	return &res, nil
+}
+
+func (r *pveapiRepository) UploadImage(cluster string, file io.Reader, filename string, node string, storage string) (*model.ImportedImage, error) {
+	// イメージは大きいのでメモリに読み込まずにそのまま送る
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		var err error
+		for _, f := range [][2]string{{"node", node}, {"storage", storage}, {"filename", filename}} {
+			if err = mw.WriteField(f[0], f[1]); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			var part io.Writer
+			if part, err = mw.CreateFormFile("file", filename); err == nil {
+				_, err = io.Copy(part, file)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest("POST", r.endpoint("/image", cluster), pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return nil, errors.Wrap(err, "can't create http request")
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var res model.ImportedImage
+	if err := r.send(req, &res); err != nil {
+		pr.CloseWithError(err)
+		return nil, errors.Wrapf(err, "can't upload image %s", filename)
+	}
+	return &res, nil
+}
+
+func (r *pveapiRepository) CreateImageVM(cluster string, b model.TemplateBuild, image model.ImportedImage, cicustom string) (int, error) {
+	body := map[string]any{
+		"name":     b.Name,
+		"node":     image.Node,
+		"storage":  b.Storage,
+		"image":    image.Volid,
+		"cpu":      b.CPUs,
+		"memory":   b.Memory,
+		"disk":     b.Disk,
+		"bridge":   b.Bridge,
+		"cicustom": cicustom,
+	}
+	var res struct {
+		Vmid int `json:"vmid"`
+	}
+	if err := r.do("POST", r.endpoint("/vm/image", cluster), body, &res); err != nil {
+		return 0, errors.Wrapf(err, "can't create vm from image %s", image.Volid)
+	}
+	return res.Vmid, nil
+}
+
+func (r *pveapiRepository) Cloudinit(cluster string, filename string, hostname string, base json.RawMessage) error {
+	body := map[string]any{
+		"filename": filename,
+		"hostname": hostname,
+		"base":     base,
+	}
+	if err := r.do("POST", r.endpoint("/cloudinit", cluster), body, nil); err != nil {
+		return errors.Wrapf(err, "can't create cloudinit %s", filename)
+	}
+	return nil
+}
+
+func (r *pveapiRepository) DeleteCloudinit(cluster string, filename string) error {
+	if err := r.do("DELETE", r.endpoint("/cloudinit", cluster), map[string]string{"filename": filename}, nil); err != nil {
+		return errors.Wrapf(err, "can't delete cloudinit %s", filename)
+	}
+	return nil
+}
+
+func (r *pveapiRepository) StartVM(cluster string, vmid int) error {
+	if err := r.do("POST", r.endpoint(fmt.Sprintf("/vm/%d/resume", vmid), cluster), nil, nil); err != nil {
+		return errors.Wrapf(err, "can't start vm %d", vmid)
+	}
+	return nil
+}
+
+func (r *pveapiRepository) VMStatus(cluster string, vmid int) (*model.VMReadiness, error) {
+	var res model.VMReadiness
+	if err := r.do("GET", r.endpoint(fmt.Sprintf("/vm/%d/status", vmid), cluster), nil, &res); err != nil {
+		return nil, errors.Wrapf(err, "can't get vm %d status", vmid)
+	}
+	return &res, nil
+}
+
+func (r *pveapiRepository) AgentRun(cluster string, vmid int, command []string, timeout int) (*model.AgentExecStatus, error) {
+	body := map[string]any{
+		"command": command,
+		"wait":    true,
+		"timeout": timeout,
+	}
+	var res model.AgentExecStatus
+	if err := r.do("POST", r.endpoint(fmt.Sprintf("/vm/%d/agent/exec", vmid), cluster), body, &res); err != nil {
+		return nil, errors.Wrapf(err, "can't exec on vm %d", vmid)
+	}
+	return &res, nil
+}
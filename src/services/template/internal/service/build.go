@@ -0,0 +1,290 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/template/model"
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/gommon/log"
+)
+
+// ビルドする VM の設定のデフォルト
+const (
+	defaultBuildCPUs   = 1
+	defaultBuildMemory = 1024
+)
+
+// templateJobLimit は GET /template/build で返すジョブの数です
+const templateJobLimit = 100
+
+// provisionCleanup はテンプレートにする前に VM の固有の情報を消すコマンドです
+// クローンした VM でもう一度 cloud-init が動き、machine-id が作り直されるようにする
+var provisionCleanup = []string{"sh", "-c", "cloud-init clean --logs && truncate -s 0 /etc/machine-id && sync"}
+
+// buildSteps は b のビルドで進む段階を返します
+func buildSteps(b model.TemplateBuild) []string {
+	if len(b.Provision) > 0 {
+		return []string{model.StepImport, model.StepCreate, model.StepProvision, model.StepConvert, model.StepRegister}
+	}
+	return []string{model.StepImport, model.StepCreate, model.StepConvert, model.StepRegister}
+}
+
+// imageFilename はイメージをストレージに置くファイル名を返します
+func imageFilename(src model.ImageSource) string {
+	if src.Filename != "" {
+		return src.Filename
+	}
+	if src.URL != "" {
+		if u, err := url.Parse(src.URL); err == nil {
+			return path.Base(u.Path)
+		}
+	}
+	return filepath.Base(src.Path)
+}
+
+// validateTemplateBuild はビルドを始める前に設定を確認し、デフォルトを埋めます
+func (s *templateService) validateTemplateBuild(b *model.TemplateBuild) error {
+	if !templateNamePattern.MatchString(b.Name) {
+		return errors.Newf("invalid template name %q", b.Name)
+	}
+	if b.Storage == "" || b.ImageStorage == "" {
+		return errors.New("storage and image_storage are required")
+	}
+	sources := 0
+	for _, v := range []string{b.Source.URL, b.Source.Path, b.Source.Upload} {
+		if v != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("exactly one of image url, path or upload is required")
+	}
+	if b.Source.Path != "" {
+		if s.buildConf.ImageDir == "" {
+			return errors.New("image path is not allowed")
+		}
+		// IMAGE_DIR の外のファイルは読ませない
+		if !filepath.IsLocal(b.Source.Path) {
+			return errors.Newf("invalid image path %q", b.Source.Path)
+		}
+	}
+	b.Source.Filename = imageFilename(b.Source)
+	switch strings.ToLower(filepath.Ext(b.Source.Filename)) {
+	case ".qcow2", ".raw":
+	default:
+		return errors.Newf("image filename %q must be .qcow2 or .raw", b.Source.Filename)
+	}
+	if b.CPUs == 0 {
+		b.CPUs = defaultBuildCPUs
+	}
+	if b.Memory == 0 {
+		b.Memory = defaultBuildMemory
+	}
+	t := model.Template{Backend: "qemu", CPUs: b.CPUs, Memory: b.Memory, Disk: b.Disk, Cloudinit: b.Cloudinit}
+	if err := ValidateTemplate(t); err != nil {
+		return errors.Wrap(err, "invalid template")
+	}
+	return nil
+}
+
+func (s *templateService) BuildTemplate(b model.TemplateBuild) (*model.TemplateJob, error) {
+	if err := s.validateTemplateBuild(&b); err != nil {
+		return nil, err
+	}
+	job := model.TemplateJob{Name: b.Name, ClusterID: b.ClusterID, Status: model.JobPending, Step: model.StepImport}
+	id, err := s.myrepo.InsertTemplateJob(job)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't insert template job")
+	}
+	// イメージの取り込みやプロビジョニングは時間がかかるので、ジョブを返して裏で進める
+	go s.runBuild(id, b)
+	return s.myrepo.SelectTemplateJob(id)
+}
+
+func (s *templateService) GetTemplateJob(id int) (*model.TemplateJob, error) {
+	j, err := s.myrepo.SelectTemplateJob(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select template job")
+	}
+	return j, nil
+}
+
+func (s *templateService) GetTemplateJobs() ([]model.TemplateJob, error) {
+	js, err := s.myrepo.SelectTemplateJobs(templateJobLimit)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select template jobs")
+	}
+	return js, nil
+}
+
+func (s *templateService) RecoverTemplateJobs() error {
+	jobs, err := s.myrepo.SelectUnfinishedTemplateJobs()
+	if err != nil {
+		return errors.Wrap(err, "can't select interrupted template jobs")
+	}
+	templates, err := s.myrepo.SelectTemplates("", true)
+	if err != nil {
+		return errors.Wrap(err, "can't select templates")
+	}
+	// runBuild が失敗したときと同じく作りかけの VM を消す (登録まで終わった VM は残す)
+	for _, job := range jobs {
+		if job.VMID == 0 || slices.ContainsFunc(templates, func(t model.Template) bool {
+			return t.VMID == job.VMID && t.ClusterID == job.ClusterID
+		}) {
+			continue
+		}
+		if err := s.buildrepo.DeleteVM(job.ClusterID, job.VMID); err != nil {
+			log.Errorf("can't delete vm %d of template job %d: %+v", job.VMID, job.ID, err)
+		}
+	}
+	n, err := s.myrepo.FailTemplateJobs("interrupted by template service restart")
+	if err != nil {
+		return errors.Wrap(err, "can't fail interrupted template jobs")
+	}
+	if n > 0 {
+		log.Warnf("marked %d interrupted template jobs as failed", n)
+	}
+	return nil
+}
+
+// runBuild はジョブの段階を順に進め、失敗した場合は作りかけの VM を消します
+func (s *templateService) runBuild(id int, b model.TemplateBuild) {
+	job := model.TemplateJob{ID: id, Name: b.Name, ClusterID: b.ClusterID, Status: model.JobRunning}
+	steps := buildSteps(b)
+	snippet := ""
+	if len(b.Provision) > 0 {
+		snippet = fmt.Sprintf("template-build-%d.yaml", id)
+	}
+	defer func() {
+		if b.Source.Upload != "" {
+			os.Remove(b.Source.Upload)
+		}
+	}()
+
+	var image *model.ImportedImage
+	var err error
+	for i, step := range steps {
+		job.Step = step
+		job.Progress = i * 100 / len(steps)
+		if uerr := s.myrepo.UpdateTemplateJob(job); uerr != nil {
+			log.Errorf("can't update template job %d: %+v", id, uerr)
+		}
+		switch step {
+		case model.StepImport:
+			image, err = s.importImage(b)
+		case model.StepCreate:
+			if snippet != "" {
+				err = s.buildrepo.Cloudinit(b.ClusterID, snippet, b.Name, b.Provision)
+			}
+			if err == nil {
+				job.VMID, err = s.buildrepo.CreateImageVM(b.ClusterID, b, *image, snippet)
+			}
+		case model.StepProvision:
+			err = s.provision(b.ClusterID, job.VMID)
+		case model.StepConvert:
+			err = s.buildrepo.ToTemplate(b.ClusterID, job.VMID)
+		case model.StepRegister:
+			var t *model.Template
+			t, err = s.RegisterTemplate(model.Template{
+				Name:      b.Name,
+				VMID:      job.VMID,
+				ClusterID: b.ClusterID,
+				Backend:   "qemu",
+				OS:        b.OS,
+				CPUs:      b.CPUs,
+				Memory:    b.Memory,
+				Disk:      b.Disk,
+				Cloudinit: b.Cloudinit,
+			}, false)
+			if err == nil {
+				job.TemplateID = t.ID
+			}
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "template job %d failed at %s", id, step)
+			break
+		}
+	}
+
+	// 最初の起動が終われば cloud-init のファイルは使わない
+	if snippet != "" {
+		if derr := s.buildrepo.DeleteCloudinit(b.ClusterID, snippet); derr != nil {
+			log.Warnf("can't delete cloudinit %s: %+v", snippet, derr)
+		}
+	}
+	if err != nil {
+		log.Errorf("%+v", err)
+		if job.VMID != 0 {
+			if derr := s.buildrepo.DeleteVM(b.ClusterID, job.VMID); derr != nil {
+				log.Errorf("can't delete vm %d of template job %d: %+v", job.VMID, id, derr)
+			}
+		}
+		job.Status = model.JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = model.JobSucceeded
+		job.Progress = 100
+	}
+	if uerr := s.myrepo.UpdateTemplateJob(job); uerr != nil {
+		log.Errorf("can't update template job %d: %+v", id, uerr)
+	}
+}
+
+// importImage は URL・IMAGE_DIR のファイル・アップロードされたファイルのいずれかを取り込みます
+func (s *templateService) importImage(b model.TemplateBuild) (*model.ImportedImage, error) {
+	if b.Source.URL != "" {
+		return s.buildrepo.ImportImage(b.ClusterID, b.Source, b.Node, b.ImageStorage)
+	}
+	name := b.Source.Upload
+	if name == "" {
+		name = filepath.Join(s.buildConf.ImageDir, b.Source.Path)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open image")
+	}
+	defer f.Close()
+	return s.buildrepo.UploadImage(b.ClusterID, f, b.Source.Filename, b.Node, b.ImageStorage)
+}
+
+// provision は VM を起動して cloud-init が終わるのを待ち、クローンできるように後片付けします
+func (s *templateService) provision(cluster string, vmid int) error {
+	if err := s.buildrepo.StartVM(cluster, vmid); err != nil {
+		return err
+	}
+	deadline := s.now().Add(s.buildConf.ProvisionTimeout)
+	for {
+		st, err := s.buildrepo.VMStatus(cluster, vmid)
+		if err != nil {
+			return err
+		}
+		if st.Ready {
+			break
+		}
+		for _, stage := range st.Stages {
+			// エラーで終わった cloud-init は待っても終わらない
+			if stage.Name == "cloud-init" && stage.Message == "cloud-init is error" {
+				return errors.Newf("provision of vm %d failed: %s", vmid, stage.Message)
+			}
+		}
+		if !s.now().Before(deadline) {
+			return errors.Newf("vm %d is not ready after %s", vmid, s.buildConf.ProvisionTimeout)
+		}
+		time.Sleep(s.buildConf.PollInterval)
+	}
+	out, err := s.buildrepo.AgentRun(cluster, vmid, provisionCleanup, 60)
+	if err != nil {
+		return err
+	}
+	if out.ExitCode != 0 {
+		return errors.Newf("cleanup of vm %d exited with %d: %s", vmid, out.ExitCode, out.ErrData)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/template/model"
+	"github.com/cockroachdb/errors"
+)
+
+func (f *fakeMysql) InsertTemplateJob(j model.TemplateJob) (int, error) {
+	j.ID = len(f.jobs) + 1
+	f.jobs = append(f.jobs, j)
+	return j.ID, nil
+}
+func (f *fakeMysql) UpdateTemplateJob(j model.TemplateJob) error {
+	f.jobs[j.ID-1] = j
+	return nil
+}
+func (f *fakeMysql) SelectUnfinishedTemplateJobs() ([]model.TemplateJob, error) {
+	jobs := []model.TemplateJob{}
+	for _, j := range f.jobs {
+		if j.Status == model.JobPending || j.Status == model.JobRunning {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+func (f *fakeMysql) FailTemplateJobs(reason string) (int64, error) {
+	n := int64(0)
+	for i, j := range f.jobs {
+		if j.Status == model.JobPending || j.Status == model.JobRunning {
+			f.jobs[i].Status, f.jobs[i].Error = model.JobFailed, reason
+			n++
+		}
+	}
+	return n, nil
+}
+func (f *fakeMysql) SelectTemplates(name string, retired bool) ([]model.Template, error) {
+	ts := []model.Template{}
+	for _, t := range f.templates {
+		if (name == "" || t.Name == name) && (retired || t.RetiredAt == nil) {
+			ts = append(ts, t)
+		}
+	}
+	return ts, nil
+}
+func (f *fakeMysql) SelectTemplateJob(id int) (*model.TemplateJob, error) {
+	if id < 1 || id > len(f.jobs) {
+		return nil, errors.Wrapf(model.ErrTemplateJobNotFound, "template job %d", id)
+	}
+	j := f.jobs[id-1]
+	return &j, nil
+}
+
+// fakeBuildPVEAPI はビルドで呼ばれる pveapi を記録します
+type fakeBuildPVEAPI struct {
+	*fakePVEAPI
+	uploaded  map[string]string
+	snippets  map[string]string
+	statuses  []model.VMReadiness
+	commands  [][]string
+	nextVMID  int
+	createdBy string
+}
+
+func (f *fakeBuildPVEAPI) ImportImage(cluster string, src model.ImageSource, node string, storage string) (*model.ImportedImage, error) {
+	return &model.ImportedImage{Node: "pve-a", Volid: storage + ":import/" + src.Filename}, nil
+}
+func (f *fakeBuildPVEAPI) UploadImage(cluster string, file io.Reader, filename string, node string, storage string) (*model.ImportedImage, error) {
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	f.uploaded[filename] = string(b)
+	return &model.ImportedImage{Node: "pve-a", Volid: storage + ":import/" + filename}, nil
+}
+func (f *fakeBuildPVEAPI) CreateImageVM(cluster string, b model.TemplateBuild, image model.ImportedImage, cicustom string) (int, error) {
+	f.createdBy = image.Volid
+	f.resources = append(f.resources, model.ClusterResources{Type: "qemu", Vmid: f.nextVMID})
+	return f.nextVMID, nil
+}
+func (f *fakeBuildPVEAPI) Cloudinit(cluster string, filename string, hostname string, base json.RawMessage) error {
+	f.snippets[filename] = string(base)
+	return nil
+}
+func (f *fakeBuildPVEAPI) DeleteCloudinit(cluster string, filename string) error {
+	delete(f.snippets, filename)
+	return nil
+}
+func (f *fakeBuildPVEAPI) StartVM(cluster string, vmid int) error {
+	return nil
+}
+func (f *fakeBuildPVEAPI) VMStatus(cluster string, vmid int) (*model.VMReadiness, error) {
+	st := f.statuses[0]
+	if len(f.statuses) > 1 {
+		f.statuses = f.statuses[1:]
+	}
+	return &st, nil
+}
+func (f *fakeBuildPVEAPI) AgentRun(cluster string, vmid int, command []string, timeout int) (*model.AgentExecStatus, error) {
+	f.commands = append(f.commands, command)
+	return &model.AgentExecStatus{Exited: 1}, nil
+}
+func (f *fakeBuildPVEAPI) ToTemplate(cluster string, vmid int) error {
+	f.converted = append(f.converted, vmid)
+	for i := range f.resources {
+		if f.resources[i].Vmid == vmid {
+			f.resources[i].Template = 1
+		}
+	}
+	return nil
+}
+
+func newFakeBuildPVEAPI(statuses ...model.VMReadiness) *fakeBuildPVEAPI {
+	return &fakeBuildPVEAPI{
+		fakePVEAPI: &fakePVEAPI{},
+		uploaded:   map[string]string{},
+		snippets:   map[string]string{},
+		statuses:   statuses,
+		nextVMID:   9100,
+	}
+}
+
+func TestBuildTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "noble.qcow2"), []byte("qcow2 image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mysql := &fakeMysql{}
+	pve := newFakeBuildPVEAPI(
+		model.VMReadiness{Vmid: 9100, Stages: []model.ReadinessStage{{Name: "cloud-init", Message: "cloud-init is running"}}},
+		model.VMReadiness{Vmid: 9100, Ready: true},
+	)
+	s := NewTemplateService(mysql, pve, pve, nil, &model.BuildConfig{ImageDir: dir, ProvisionTimeout: time.Minute}).(*templateService)
+
+	b := model.TemplateBuild{
+		Name:         "ubuntu-24.04",
+		OS:           "ubuntu",
+		Storage:      "vmdisk",
+		ImageStorage: "local",
+		Source:       model.ImageSource{Path: "noble.qcow2"},
+		Cloudinit:    []string{"user"},
+		Provision:    json.RawMessage(`{"packages":["nginx"]}`),
+	}
+	if err := s.validateTemplateBuild(&b); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := mysql.InsertTemplateJob(model.TemplateJob{Name: b.Name, Status: model.JobPending})
+	s.runBuild(id, b)
+
+	job := mysql.jobs[id-1]
+	if job.Status != model.JobSucceeded || job.Progress != 100 || job.VMID != 9100 || job.TemplateID != 1 {
+		t.Fatalf("job = %+v", job)
+	}
+	if pve.uploaded["noble.qcow2"] != "qcow2 image" || pve.createdBy != "local:import/noble.qcow2" {
+		t.Errorf("uploaded=%v created from %q", pve.uploaded, pve.createdBy)
+	}
+	if len(pve.commands) != 1 || !strings.Contains(strings.Join(pve.commands[0], " "), "cloud-init clean") {
+		t.Errorf("commands = %v", pve.commands)
+	}
+	if len(pve.snippets) != 0 || len(pve.converted) != 1 {
+		t.Errorf("snippets=%v converted=%v", pve.snippets, pve.converted)
+	}
+	if tmpl := mysql.templates[0]; tmpl.VMID != 9100 || tmpl.CPUs != defaultBuildCPUs || tmpl.Memory != defaultBuildMemory {
+		t.Errorf("template = %+v", tmpl)
+	}
+
+	// IMAGE_DIR の外のファイルは使えない
+	bad := b
+	bad.Source = model.ImageSource{Path: "../etc/passwd.raw"}
+	if err := s.validateTemplateBuild(&bad); err == nil {
+		t.Error("expected error for image path outside image dir")
+	}
+	bad.Source = model.ImageSource{URL: "https://example.com/noble.img"}
+	if err := s.validateTemplateBuild(&bad); err == nil {
+		t.Error("expected error for image that is not qcow2 or raw")
+	}
+}
+
+func TestBuildTemplateProvisionFailed(t *testing.T) {
+	mysql := &fakeMysql{}
+	pve := newFakeBuildPVEAPI(model.VMReadiness{Vmid: 9100, Stages: []model.ReadinessStage{{Name: "cloud-init", Message: "cloud-init is error"}}})
+	s := NewTemplateService(mysql, pve, pve, nil, &model.BuildConfig{}).(*templateService)
+
+	b := model.TemplateBuild{
+		Name:         "ubuntu-24.04",
+		Storage:      "vmdisk",
+		ImageStorage: "local",
+		Source:       model.ImageSource{URL: "https://cloud-images.ubuntu.com/noble.img", Filename: "noble.qcow2"},
+		Provision:    json.RawMessage(`{"runcmd":["false"]}`),
+	}
+	if err := s.validateTemplateBuild(&b); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := mysql.InsertTemplateJob(model.TemplateJob{Name: b.Name, Status: model.JobPending})
+	s.runBuild(id, b)
+
+	// 作りかけの VM と cloud-init のファイルは残さない
+	job := mysql.jobs[id-1]
+	if job.Status != model.JobFailed || job.Step != model.StepProvision || !strings.Contains(job.Error, "cloud-init is error") {
+		t.Fatalf("job = %+v", job)
+	}
+	if len(pve.deleted) != 1 || pve.deleted[0] != 9100 || len(pve.snippets) != 0 || len(mysql.templates) != 0 {
+		t.Errorf("deleted=%v snippets=%v templates=%v", pve.deleted, pve.snippets, mysql.templates)
+	}
+}
+
+func TestRecoverTemplateJobs(t *testing.T) {
+	mysql := &fakeMysql{
+		// 9200 はテンプレートとして登録まで終わっている
+		templates: []model.Template{{ID: 1, Name: "debian-12", Version: 1, VMID: 9200}},
+		jobs: []model.TemplateJob{
+			{ID: 1, Status: model.JobRunning, Step: model.StepProvision, VMID: 9100},
+			{ID: 2, Status: model.JobRunning, Step: model.StepRegister, VMID: 9200},
+			{ID: 3, Status: model.JobPending},
+			{ID: 4, Status: model.JobFailed, VMID: 9300},
+		},
+	}
+	pve := newFakeBuildPVEAPI()
+	s := NewTemplateService(mysql, pve, pve, nil, &model.BuildConfig{})
+
+	if err := s.RecoverTemplateJobs(); err != nil {
+		t.Fatal(err)
+	}
+	// 中断したジョブの作りかけの VM だけを消す
+	if len(pve.deleted) != 1 || pve.deleted[0] != 9100 {
+		t.Errorf("deleted = %v", pve.deleted)
+	}
+	for _, j := range mysql.jobs {
+		if j.Status != model.JobFailed {
+			t.Errorf("job %d = %s", j.ID, j.Status)
+		}
+	}
+}
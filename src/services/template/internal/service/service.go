@@ -1,7 +1,201 @@
 package service
 
-type teamService struct {
+import (
+	"regexp"
+	"time"
+
+	"github.com/LainInTheWired/ctf_backend/shared/pkg/role"
+	"github.com/LainInTheWired/ctf_backend/template/model"
+	"github.com/LainInTheWired/ctf_backend/template/repository"
+	"github.com/cockroachdb/errors"
+)
+
+type templateService struct {
+	myrepo     repository.MysqlRepository
+	pveapirepo repository.PVEAPIRepository
+	// イメージの取り込みなど時間がかかる呼び出しに使う pveapi
+	buildrepo repository.PVEAPIRepository
+	buildConf *model.BuildConfig
+	roleRepo  role.RoleRepository
+	now       func() time.Time
+}
+
+type TemplateService interface {
+	// RegisterTemplate は Proxmox のテンプレートを登録します
+	// convert の場合はテンプレートでない VM をテンプレートに変換してから登録する
+	RegisterTemplate(t model.Template, convert bool) (*model.Template, error)
+	// GetTemplates は name のテンプレートを新しい version から返します (retired の場合は退役したものも含める)
+	GetTemplates(name string, retired bool) ([]model.Template, error)
+	// GetTemplate はテンプレートとそれを使っている問題を返します
+	GetTemplate(id int) (*model.Template, error)
+	UpdateTemplate(t model.Template) error
+	// RetireTemplate はテンプレートを新しい問題に使えないようにします (作成済みの問題はそのまま使える)
+	RetireTemplate(id int) error
+	// DeleteTemplate は問題に使われていないテンプレートを Proxmox と一緒に削除します
+	DeleteTemplate(id int) error
+
+	// BuildTemplate はクラウドイメージからテンプレートを作るジョブを始めます
+	// 取り込み・VM の作成・プロビジョニング・変換・登録は裏で進み、ジョブで確認できる
+	BuildTemplate(b model.TemplateBuild) (*model.TemplateJob, error)
+	GetTemplateJob(id int) (*model.TemplateJob, error)
+	GetTemplateJobs() ([]model.TemplateJob, error)
+	// RecoverTemplateJobs は再起動で中断したジョブを失敗にします
+	RecoverTemplateJobs() error
+	// IsAdmin はユーザーが管理者か返します
+	IsAdmin(uid int) (bool, error)
+}
+
+func NewTemplateService(r repository.MysqlRepository, p repository.PVEAPIRepository, b repository.PVEAPIRepository, roleRepo role.RoleRepository, conf *model.BuildConfig) TemplateService {
+	return &templateService{
+		myrepo:     r,
+		pveapirepo: p,
+		buildrepo:  b,
+		buildConf:  conf,
+		roleRepo:   roleRepo,
+		now:        time.Now,
+	}
+}
+
+func (s *templateService) IsAdmin(uid int) (bool, error) {
+	return role.IsAdmin(s.roleRepo, uid)
+}
+
+// templateNamePattern はテンプレートの名前です (例: ubuntu-24.04)
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+var cloudinitFeatures = map[string]bool{
+	model.CloudinitUser:    true,
+	model.CloudinitNetwork: true,
+	model.CloudinitMeta:    true,
+	model.CloudinitVendor:  true,
+}
+
+// ValidateTemplate は登録と更新で変えられる項目を確認します
+func ValidateTemplate(t model.Template) error {
+	if t.CPUs < 0 || t.Memory < 0 || t.Disk < 0 {
+		return errors.Newf("resources must not be negative: cpu=%d memory=%d disk=%d", t.CPUs, t.Memory, t.Disk)
+	}
+	seen := map[string]bool{}
+	for _, c := range t.Cloudinit {
+		if !cloudinitFeatures[c] {
+			return errors.Newf("unknown cloudinit feature %q", c)
+		}
+		if seen[c] {
+			return errors.Newf("duplicate cloudinit feature %q", c)
+		}
+		seen[c] = true
+	}
+	if t.Backend == "lxc" && len(t.Cloudinit) > 0 {
+		return errors.New("lxc template can't use cloudinit")
+	}
+	return nil
+}
+
+func (s *templateService) RegisterTemplate(t model.Template, convert bool) (*model.Template, error) {
+	if !templateNamePattern.MatchString(t.Name) {
+		return nil, errors.Newf("invalid template name %q", t.Name)
+	}
+	res, err := s.pveapirepo.GetClusterResources(t.ClusterID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get cluster resources")
+	}
+	var vm *model.ClusterResources
+	for i, r := range res {
+		if (r.Type == "qemu" || r.Type == "lxc") && r.Vmid == t.VMID {
+			vm = &res[i]
+			break
+		}
+	}
+	if vm == nil {
+		return nil, errors.Newf("vm %d is not found in cluster %q", t.VMID, t.ClusterID)
+	}
+	if t.Backend != "" && t.Backend != vm.Type {
+		return nil, errors.Newf("vm %d is %s, not %s", t.VMID, vm.Type, t.Backend)
+	}
+	t.Backend = vm.Type
+	if err := ValidateTemplate(t); err != nil {
+		return nil, errors.Wrap(err, "invalid template")
+	}
+	if vm.Template != 1 {
+		if !convert {
+			return nil, errors.Newf("vm %d is not a template", t.VMID)
+		}
+		if err := s.pveapirepo.ToTemplate(t.ClusterID, t.VMID); err != nil {
+			return nil, errors.Wrap(err, "can't convert to template")
+		}
+	}
+
+	id, version, err := s.myrepo.InsertTemplate(t)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't insert template")
+	}
+	t.ID = id
+	t.Version = version
+	return s.GetTemplate(id)
+}
+
+func (s *templateService) GetTemplates(name string, retired bool) ([]model.Template, error) {
+	ts, err := s.myrepo.SelectTemplates(name, retired)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select templates")
+	}
+	return ts, nil
+}
+
+func (s *templateService) GetTemplate(id int) (*model.Template, error) {
+	t, err := s.myrepo.SelectTemplate(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select template")
+	}
+	qs, err := s.myrepo.SelectTemplateQuestions(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select template questions")
+	}
+	t.Questions = qs
+	return t, nil
+}
+
+func (s *templateService) UpdateTemplate(t model.Template) error {
+	cur, err := s.myrepo.SelectTemplate(t.ID)
+	if err != nil {
+		return errors.Wrap(err, "can't select template")
+	}
+	// 名前と vmid は version の識別に使うので変えられない
+	t.Backend = cur.Backend
+	if err := ValidateTemplate(t); err != nil {
+		return errors.Wrap(err, "invalid template")
+	}
+	if err := s.myrepo.UpdateTemplate(t); err != nil {
+		return errors.Wrap(err, "can't update template")
+	}
+	return nil
+}
+
+func (s *templateService) RetireTemplate(id int) error {
+	if _, err := s.myrepo.SelectTemplate(id); err != nil {
+		return errors.Wrap(err, "can't select template")
+	}
+	if err := s.myrepo.RetireTemplate(id, s.now()); err != nil {
+		return errors.Wrap(err, "can't retire template")
+	}
+	return nil
 }
 
-type TeamService interface {
+func (s *templateService) DeleteTemplate(id int) error {
+	t, err := s.GetTemplate(id)
+	if err != nil {
+		return err
+	}
+	if len(t.Questions) > 0 {
+		return errors.Wrapf(model.ErrTemplateInUse, "template %d is used by %d questions", id, len(t.Questions))
+	}
+	// 問題に使われないように先に登録を消し、コミットしてから VM を削除する
+	t, err = s.myrepo.DeleteTemplate(id)
+	if err != nil {
+		return errors.Wrap(err, "can't delete template")
+	}
+	if err := s.pveapirepo.DeleteVM(t.ClusterID, t.VMID); err != nil {
+		return errors.Wrapf(err, "template %d was deleted but can't delete vm %d", id, t.VMID)
+	}
+	return nil
 }
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/LainInTheWired/ctf_backend/template/model"
+	"github.com/LainInTheWired/ctf_backend/template/repository"
+	"github.com/cockroachdb/errors"
+)
+
+type fakeMysql struct {
+	repository.MysqlRepository
+	templates []model.Template
+	questions map[int][]model.TemplateQuestion
+	jobs      []model.TemplateJob
+}
+
+func (f *fakeMysql) InsertTemplate(t model.Template) (int, int, error) {
+	version := 0
+	for _, r := range f.templates {
+		if r.Name == t.Name && r.Version > version {
+			version = r.Version
+		}
+	}
+	t.ID = len(f.templates) + 1
+	t.Version = version + 1
+	f.templates = append(f.templates, t)
+	return t.ID, t.Version, nil
+}
+func (f *fakeMysql) SelectTemplate(id int) (*model.Template, error) {
+	for _, t := range f.templates {
+		if t.ID == id {
+			r := t
+			return &r, nil
+		}
+	}
+	return nil, errors.Wrapf(model.ErrTemplateNotFound, "template %d", id)
+}
+func (f *fakeMysql) SelectTemplateQuestions(id int) ([]model.TemplateQuestion, error) {
+	return f.questions[id], nil
+}
+func (f *fakeMysql) DeleteTemplate(id int) (*model.Template, error) {
+	if len(f.questions[id]) > 0 {
+		return nil, model.ErrTemplateInUse
+	}
+	for i, t := range f.templates {
+		if t.ID == id {
+			f.templates = append(f.templates[:i], f.templates[i+1:]...)
+			return &t, nil
+		}
+	}
+	return nil, model.ErrTemplateNotFound
+}
+
+type fakePVEAPI struct {
+	repository.PVEAPIRepository
+	resources []model.ClusterResources
+	converted []int
+	deleted   []int
+}
+
+func (f *fakePVEAPI) GetClusterResources(cluster string) ([]model.ClusterResources, error) {
+	return f.resources, nil
+}
+func (f *fakePVEAPI) ToTemplate(cluster string, vmid int) error {
+	f.converted = append(f.converted, vmid)
+	return nil
+}
+func (f *fakePVEAPI) DeleteVM(cluster string, vmid int) error {
+	f.deleted = append(f.deleted, vmid)
+	return nil
+}
+
+func TestRegisterTemplate(t *testing.T) {
+	mysql := &fakeMysql{}
+	pve := &fakePVEAPI{resources: []model.ClusterResources{
+		{Type: "node", Node: "pve-a"},
+		{Type: "qemu", Vmid: 9000, Template: 1},
+		{Type: "qemu", Vmid: 9001},
+		{Type: "lxc", Vmid: 9002, Template: 1},
+	}}
+	s := NewTemplateService(mysql, pve, pve, nil, &model.BuildConfig{})
+
+	t1, err := s.RegisterTemplate(model.Template{Name: "ubuntu-24.04", VMID: 9000, Cloudinit: []string{"user", "network"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t1.Version != 1 || t1.Backend != "qemu" {
+		t.Fatalf("unexpected template: %+v", t1)
+	}
+	// テンプレートでない VM は convert の指定がなければ登録しない
+	if _, err := s.RegisterTemplate(model.Template{Name: "ubuntu-24.04", VMID: 9001}, false); err == nil {
+		t.Fatal("expected error for vm that is not a template")
+	}
+	t2, err := s.RegisterTemplate(model.Template{Name: "ubuntu-24.04", VMID: 9001}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t2.Version != 2 || len(pve.converted) != 1 || pve.converted[0] != 9001 {
+		t.Fatalf("convert: %+v converted=%v", t2, pve.converted)
+	}
+
+	if _, err := s.RegisterTemplate(model.Template{Name: "debian", VMID: 9002, Cloudinit: []string{"user"}}, false); err == nil {
+		t.Fatal("expected error for lxc template with cloudinit")
+	}
+	if _, err := s.RegisterTemplate(model.Template{Name: "Ubuntu 24.04", VMID: 9000}, false); err == nil {
+		t.Fatal("expected error for invalid name")
+	}
+	if _, err := s.RegisterTemplate(model.Template{Name: "missing", VMID: 9999}, false); err == nil {
+		t.Fatal("expected error for missing vm")
+	}
+}
+
+func TestDeleteTemplateInUse(t *testing.T) {
+	mysql := &fakeMysql{
+		templates: []model.Template{{ID: 1, Name: "ubuntu", Version: 1, VMID: 9000}, {ID: 2, Name: "ubuntu", Version: 2, VMID: 9001}},
+		questions: map[int][]model.TemplateQuestion{1: {{ID: 3, Name: "web"}}},
+	}
+	pve := &fakePVEAPI{}
+	s := NewTemplateService(mysql, pve, pve, nil, &model.BuildConfig{})
+
+	if err := s.DeleteTemplate(1); !errors.Is(err, model.ErrTemplateInUse) {
+		t.Fatalf("expected in use error, got %v", err)
+	}
+	if err := s.DeleteTemplate(2); err != nil {
+		t.Fatal(err)
+	}
+	if len(pve.deleted) != 1 || pve.deleted[0] != 9001 || len(mysql.templates) != 1 {
+		t.Fatalf("delete: deleted=%v templates=%+v", pve.deleted, mysql.templates)
+	}
+	if err := s.DeleteTemplate(2); !errors.Is(err, model.ErrTemplateNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package role
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// AdminRoleID は管理者のロールです (gateway と同じ)
+const AdminRoleID = 1
+
+// Role は Redis の role:<id> に保存されたロールです
+type Role struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// RoleRepository は authz が Redis に保存したユーザーのロールを読みます
+type RoleRepository interface {
+	GetRoles(uid int) ([]Role, error)
+}
+
+type redisRoleRepository struct {
+	cli *redis.Client
+}
+
+func NewRoleRepository(cli *redis.Client) RoleRepository {
+	return &redisRoleRepository{
+		cli: cli,
+	}
+}
+
+// GetRoles は gateway と同じく user:<uid> のロールの一覧から role:<id> を読みます
+func (r *redisRoleRepository) GetRoles(uid int) ([]Role, error) {
+	ctx := context.Background()
+	juser, err := r.cli.Get(ctx, fmt.Sprintf("user:%d", uid)).Result()
+	if errors.Is(err, redis.Nil) {
+		return []Role{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get user roles")
+	}
+	var refs []Role
+	if err := json.Unmarshal([]byte(juser), &refs); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal user roles")
+	}
+	roles := []Role{}
+	for _, ref := range refs {
+		jrole, err := r.cli.Get(ctx, fmt.Sprintf("role:%d", ref.ID)).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "can't get role")
+		}
+		var role Role
+		if err := json.Unmarshal([]byte(jrole), &role); err != nil {
+			return nil, errors.Wrap(err, "can't unmarshal role")
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// IsAdmin は uid のユーザーが管理者のロールを持っているか返します
+func IsAdmin(r RoleRepository, uid int) (bool, error) {
+	roles, err := r.GetRoles(uid)
+	if err != nil {
+		return false, errors.Wrap(err, "can't get roles")
+	}
+	for _, ro := range roles {
+		if ro.ID == AdminRoleID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -3,6 +3,8 @@ package validator
 import (
 	"fmt"
 	"net"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/go-playground/validator/v10"
@@ -20,6 +22,7 @@ func NewValidator() echo.Validator {
 
 	v.RegisterValidation("cidr", cidrValidation)
 	v.RegisterValidation("ip", ipValidation)
+	v.RegisterValidation("port", portValidation)
 
 	return &CustomValidator{validator: v}
 }
@@ -44,6 +47,30 @@ func ipValidation(fl validator.FieldLevel) bool {
 
 }
 
+// 問題が公開するポート (例: 22/tcp, 80, 60000:61000/udp, icmp)
+var portPattern = regexp.MustCompile(`^(\d{1,5})(?::(\d{1,5}))?(?:/(tcp|udp))?$`)
+
+// portValidation はポートの指定を検証するカスタムバリデーション関数です
+func portValidation(fl validator.FieldLevel) bool {
+	s, ok := fl.Field().Interface().(string)
+	if !ok {
+		return false
+	}
+	if s == "icmp" {
+		return true
+	}
+	m := portPattern.FindStringSubmatch(s)
+	if m == nil {
+		return false
+	}
+	from, _ := strconv.Atoi(m[1])
+	to := from
+	if m[2] != "" {
+		to, _ = strconv.Atoi(m[2])
+	}
+	return from >= 1 && to <= 65535 && from <= to
+}
+
 // カスタムヴァリデータを編集
 func (cv *CustomValidator) Validate(i interface{}) error {
 	err := cv.validator.Struct(i)
@@ -63,6 +90,8 @@ func (cv *CustomValidator) Validate(i interface{}) error {
 				errorMessages = append(errorMessages, fmt.Sprintf("%s must be a valid CIDR (e.g., 0.0.0.0/24)", fieldName))
 			case "ip":
 				errorMessages = append(errorMessages, fmt.Sprintf("%s must be a valid IP (e.g., 0.0.0.0)", fieldName))
+			case "port":
+				errorMessages = append(errorMessages, fmt.Sprintf("%s must be a valid port (e.g., 22/tcp, 80, icmp)", fieldName))
 			default:
 				errorMessages = append(errorMessages, fmt.Sprintf("%s is fail validation", fieldName))
 			}
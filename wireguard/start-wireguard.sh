@@ -0,0 +1,29 @@
+#!/bin/sh
+# contest が書き出す設定 (VPN_SERVER_CONFIG と VPN_FORWARD_RULES) で wg0 を起動し、更新されたら反映します
+set -eu
+
+CONF=/etc/wireguard/wg0.conf
+RULES=/etc/wireguard/wg0.rules
+
+# 最初のピアが登録されるまで設定ファイルはないので待つ
+while [ ! -f "$CONF" ] || [ ! -f "$RULES" ]; do
+    sleep 5
+done
+
+wg-quick up wg0
+trap 'wg-quick down wg0; exit 0' INT TERM
+
+# contest は一時ファイルからリネームするので moved_to で検知する
+# wg-quick up をやり直すと接続が切れるため、ピアは wg syncconf、ルールは iptables-restore --noflush で反映する
+inotifywait -m -q -e moved_to -e close_write --format '%f' /etc/wireguard | while read -r name; do
+    case "$name" in
+    wg0.conf)
+        wg-quick strip wg0 > /tmp/wg0.peers
+        wg syncconf wg0 /tmp/wg0.peers
+        ;;
+    wg0.rules)
+        iptables-restore --noflush < "$RULES"
+        ;;
+    esac
+done &
+wait $!